@@ -0,0 +1,372 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// An AuthChainProvider loads events by ID, typically from a database.
+// It may return fewer events than were asked for if some of the events are
+// not known. The order of the returned events doesn't matter.
+type AuthChainProvider func(ctx context.Context, eventIDs []string) ([]Event, error)
+
+// An AuthChainIDProvider looks up the IDs of the auth events of each of the
+// given events. It may omit events that are not known from the returned map.
+type AuthChainIDProvider func(ctx context.Context, eventIDs []string) (map[string][]string, error)
+
+// A MissingAuthEventsError is returned when the auth chain of some events
+// references events that the provider didn't return.
+type MissingAuthEventsError struct {
+	// The IDs of the auth events that couldn't be loaded.
+	EventIDs []string
+}
+
+func (e MissingAuthEventsError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: missing auth events with IDs %s",
+		strings.Join(e.EventIDs, ", "),
+	)
+}
+
+// AuthChain returns the full auth chain of the given events: their auth
+// events, the auth events of those events, and so on. Events are loaded
+// from the provider one breadth-first level at a time so that there is a
+// single call to the provider for each level of the chain.
+// The returned events are in an order where every event comes after its auth
+// events, and each event appears only once. The given events are only
+// included if they are in the auth chain of another of the given events.
+// If the provider doesn't return some of the events then the chain of the
+// events that could be loaded is returned along with a MissingAuthEventsError.
+// Returns an error if there is a cycle in the auth events, or if the context
+// is cancelled.
+func AuthChain(ctx context.Context, events []Event, provider AuthChainProvider) ([]Event, error) {
+	eventsByID := make(map[string]*Event, len(events))
+	authEventIDs := make(map[string][]string, len(events))
+	roots := make([]string, len(events))
+	for i := range events {
+		eventID := events[i].EventID()
+		eventsByID[eventID] = &events[i]
+		authEventIDs[eventID] = events[i].AuthEventIDs()
+		roots[i] = eventID
+	}
+
+	fetch := loadAuthEvents(provider, eventsByID)
+	chainIDs, err := walkAuthChain(ctx, roots, authEventIDs, fetch)
+	if chainIDs == nil {
+		return nil, err
+	}
+	chain := make([]Event, len(chainIDs))
+	for i, eventID := range chainIDs {
+		chain[i] = *eventsByID[eventID]
+	}
+	return chain, err
+}
+
+// AuthChainIDs returns the IDs of the events in the full auth chain of the
+// given events. This behaves like AuthChain but only needs the provider to
+// supply the auth event IDs of each event, rather than the full events.
+func AuthChainIDs(ctx context.Context, events []Event, provider AuthChainIDProvider) ([]string, error) {
+	authEventIDs := make(map[string][]string, len(events))
+	roots := make([]string, len(events))
+	for i := range events {
+		roots[i] = events[i].EventID()
+		authEventIDs[roots[i]] = events[i].AuthEventIDs()
+	}
+	return walkAuthChain(ctx, roots, authEventIDs, provider)
+}
+
+// AuthDifference returns the auth difference of the state sets, as used by
+// version 2 of the state resolution algorithm: the events that are in the
+// full auth chain of at least one of the state sets but not in the full auth
+// chain of every state set. The full auth chain of a state set is the union
+// of the auth chains of the events in the set.
+// The auth events of all the state sets are loaded together, and each event
+// is visited once, so the cost is linear in the size of the combined chains
+// rather than proportional to the number of state sets.
+// The returned events are in an order where every event comes after its auth
+// events. Returns a MissingAuthEventsError if the provider doesn't return
+// some of the events, since the difference can't be computed without them.
+// https://matrix.org/docs/spec/rooms/v2#state-resolution
+func AuthDifference(ctx context.Context, stateSets [][]Event, provider AuthChainProvider) ([]Event, error) {
+	eventsByID := map[string]*Event{}
+	authEventIDs := map[string][]string{}
+	stateSetIDs := make([][]string, len(stateSets))
+	for i := range stateSets {
+		stateSetIDs[i] = make([]string, len(stateSets[i]))
+		for j := range stateSets[i] {
+			event := &stateSets[i][j]
+			eventsByID[event.EventID()] = event
+			authEventIDs[event.EventID()] = event.AuthEventIDs()
+			stateSetIDs[i][j] = event.EventID()
+		}
+	}
+
+	differenceIDs, err := authDifference(ctx, stateSetIDs, authEventIDs, loadAuthEvents(provider, eventsByID))
+	if err != nil {
+		return nil, err
+	}
+	difference := make([]Event, len(differenceIDs))
+	for i, eventID := range differenceIDs {
+		difference[i] = *eventsByID[eventID]
+	}
+	return difference, nil
+}
+
+// AuthDifferenceIDs returns the IDs of the events in the auth difference of
+// the state sets. This behaves like AuthDifference but only needs the
+// provider to supply the auth event IDs of each event, rather than the full
+// events.
+func AuthDifferenceIDs(ctx context.Context, stateSets [][]Event, provider AuthChainIDProvider) ([]string, error) {
+	authEventIDs := map[string][]string{}
+	stateSetIDs := make([][]string, len(stateSets))
+	for i := range stateSets {
+		stateSetIDs[i] = make([]string, len(stateSets[i]))
+		for j, event := range stateSets[i] {
+			authEventIDs[event.EventID()] = event.AuthEventIDs()
+			stateSetIDs[i][j] = event.EventID()
+		}
+	}
+	return authDifference(ctx, stateSetIDs, authEventIDs, provider)
+}
+
+// authDifference computes the auth difference of the state sets given as
+// lists of event IDs.
+//
+// Rather than computing the full auth chain of each state set separately,
+// it walks the combined auth chain once and records, for each event, the set
+// of state sets whose auth chain contains it as a bitset. The bitsets are
+// propagated from each event to its auth events in an order where every
+// event is processed before its auth events. An event is in the difference
+// if its bitset doesn't contain every state set.
+func authDifference(
+	ctx context.Context, stateSetIDs [][]string, authEventIDs map[string][]string, fetch AuthChainIDProvider,
+) ([]string, error) {
+	var roots []string
+	seenRoot := map[string]bool{}
+	for _, stateSet := range stateSetIDs {
+		for _, eventID := range stateSet {
+			if !seenRoot[eventID] {
+				seenRoot[eventID] = true
+				roots = append(roots, eventID)
+			}
+		}
+	}
+
+	chain, err := walkAuthChain(ctx, roots, authEventIDs, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	// Give each event an index. The events in the chain come first, in the
+	// order returned by walkAuthChain, followed by the state events that
+	// aren't in the chain.
+	index := make(map[string]int, len(chain)+len(roots))
+	for i, eventID := range chain {
+		index[eventID] = i
+	}
+	nodes := chain
+	for _, eventID := range roots {
+		if _, ok := index[eventID]; !ok {
+			index[eventID] = len(nodes)
+			nodes = append(nodes, eventID)
+		}
+	}
+
+	// member holds the state sets each event is in, and reachable holds the
+	// state sets whose auth chain contains each event.
+	words := (len(stateSetIDs) + 63) / 64
+	member := make([]uint64, len(nodes)*words)
+	reachable := make([]uint64, len(nodes)*words)
+	for i, stateSet := range stateSetIDs {
+		for _, eventID := range stateSet {
+			member[index[eventID]*words+i/64] |= 1 << uint(i%64)
+		}
+	}
+
+	// Every event must be processed before its auth events. The state events
+	// that aren't in the chain are not the auth events of any other event, so
+	// they go first, followed by the chain in reverse.
+	propagate := func(node int) {
+		from := node * words
+		for _, authEventID := range authEventIDs[nodes[node]] {
+			to := index[authEventID] * words
+			for w := 0; w < words; w++ {
+				reachable[to+w] |= reachable[from+w] | member[from+w]
+			}
+		}
+	}
+	for node := len(chain); node < len(nodes); node++ {
+		propagate(node)
+	}
+	for node := len(chain) - 1; node >= 0; node-- {
+		propagate(node)
+	}
+
+	var result []string
+	for i, eventID := range chain {
+		count := 0
+		for w := 0; w < words; w++ {
+			count += bits.OnesCount64(reachable[i*words+w])
+		}
+		if count < len(stateSetIDs) {
+			result = append(result, eventID)
+		}
+	}
+	return result, nil
+}
+
+// loadAuthEvents wraps the provider so that it returns the auth event IDs of
+// the events it loads, storing the loaded events in eventsByID.
+func loadAuthEvents(provider AuthChainProvider, eventsByID map[string]*Event) AuthChainIDProvider {
+	return func(ctx context.Context, eventIDs []string) (map[string][]string, error) {
+		fetched, err := provider(ctx, eventIDs)
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string][]string, len(fetched))
+		for i := range fetched {
+			eventID := fetched[i].EventID()
+			eventsByID[eventID] = &fetched[i]
+			result[eventID] = fetched[i].AuthEventIDs()
+		}
+		return result, nil
+	}
+}
+
+// walkAuthChain walks the auth events of the roots breadth-first, loading
+// the auth event IDs of events not already in authEventIDs using fetch.
+// Returns the IDs in the chain ordered so that every event comes after its
+// auth events.
+func walkAuthChain(
+	ctx context.Context, roots []string, authEventIDs map[string][]string, fetch AuthChainIDProvider,
+) ([]string, error) { // nolint: gocyclo
+	// The IDs of the events in the auth chain in the order they were found.
+	var chain []string
+	inChain := map[string]bool{}
+	var missing []string
+
+	var frontier []string
+	for _, eventID := range roots {
+		for _, authEventID := range authEventIDs[eventID] {
+			if !inChain[authEventID] {
+				inChain[authEventID] = true
+				chain = append(chain, authEventID)
+				frontier = append(frontier, authEventID)
+			}
+		}
+	}
+
+	for len(frontier) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var toFetch []string
+		for _, eventID := range frontier {
+			if _, ok := authEventIDs[eventID]; !ok {
+				toFetch = append(toFetch, eventID)
+			}
+		}
+		if len(toFetch) > 0 {
+			fetched, err := fetch(ctx, toFetch)
+			if err != nil {
+				return nil, err
+			}
+			for _, eventID := range toFetch {
+				ids, ok := fetched[eventID]
+				if !ok {
+					missing = append(missing, eventID)
+					continue
+				}
+				authEventIDs[eventID] = ids
+			}
+		}
+
+		var next []string
+		for _, eventID := range frontier {
+			for _, authEventID := range authEventIDs[eventID] {
+				if !inChain[authEventID] {
+					inChain[authEventID] = true
+					chain = append(chain, authEventID)
+					next = append(next, authEventID)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	result, err := sortAuthChain(chain, authEventIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return result, MissingAuthEventsError{missing}
+	}
+	return result, nil
+}
+
+// sortAuthChain orders the event IDs so that every event comes after its auth
+// events. Events that aren't in authEventIDs are left out of the result.
+// Returns an error if there is a cycle in the auth events.
+func sortAuthChain(eventIDs []string, authEventIDs map[string][]string) ([]string, error) {
+	const (
+		queued    = 1
+		outputted = 2
+	)
+	state := make(map[string]int, len(eventIDs))
+	result := make([]string, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		if _, ok := authEventIDs[eventID]; !ok || state[eventID] == outputted {
+			continue
+		}
+
+		// We use an explicit stack rather than using recursion so
+		// that we can check we aren't creating cycles.
+		stack := []string{eventID}
+		state[eventID] = queued
+
+	LoopProcessTopOfStack:
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			for _, authEventID := range authEventIDs[top] {
+				if _, ok := authEventIDs[authEventID]; !ok {
+					// The event is missing so there is nothing to output.
+					continue
+				}
+				switch state[authEventID] {
+				case outputted:
+					continue
+				case queued:
+					return nil, fmt.Errorf(
+						"gomatrixserverlib: auth event cycle for ID %q",
+						authEventID,
+					)
+				}
+				stack = append(stack, authEventID)
+				state[authEventID] = queued
+				continue LoopProcessTopOfStack
+			}
+			result = append(result, top)
+			state[top] = outputted
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,374 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testAuthChainEvent makes a minimal event with the given ID and auth events.
+func testAuthChainEvent(t testing.TB, eventID string, authEventIDs ...string) Event {
+	if authEventIDs == nil {
+		authEventIDs = []string{}
+	}
+	authEvents, err := json.Marshal(authEventIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testEventf(
+		t, `{"event_id":%q,"type":"m.room.member","state_key":"","auth_events":%s}`, eventID, authEvents,
+	)
+}
+
+// testAuthChainDB is an AuthChainProvider backed by a map that records the
+// batches of event IDs it was asked for.
+type testAuthChainDB struct {
+	events  map[string]Event
+	batches [][]string
+}
+
+func newTestAuthChainDB(events ...Event) *testAuthChainDB {
+	db := &testAuthChainDB{events: map[string]Event{}}
+	for _, event := range events {
+		db.events[event.EventID()] = event
+	}
+	return db
+}
+
+func (db *testAuthChainDB) provide(ctx context.Context, eventIDs []string) ([]Event, error) {
+	db.batches = append(db.batches, eventIDs)
+	var result []Event
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (db *testAuthChainDB) provideIDs(ctx context.Context, eventIDs []string) (map[string][]string, error) {
+	db.batches = append(db.batches, eventIDs)
+	result := map[string][]string{}
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			result[eventID] = event.AuthEventIDs()
+		}
+	}
+	return result, nil
+}
+
+// checkAuthChainOrder checks that every event comes after its auth events.
+func checkAuthChainOrder(t *testing.T, chain []Event) {
+	position := map[string]int{}
+	for i, event := range chain {
+		if _, ok := position[event.EventID()]; ok {
+			t.Fatalf("event %q appears more than once in the chain", event.EventID())
+		}
+		position[event.EventID()] = i
+	}
+	for i, event := range chain {
+		for _, authEventID := range event.AuthEventIDs() {
+			if j, ok := position[authEventID]; ok && j > i {
+				t.Fatalf("event %q comes before its auth event %q", event.EventID(), authEventID)
+			}
+		}
+	}
+}
+
+func chainEventIDs(chain []Event) []string {
+	result := make([]string, len(chain))
+	for i := range chain {
+		result[i] = chain[i].EventID()
+	}
+	return result
+}
+
+func sortedStrings(s []string) []string {
+	result := append([]string(nil), s...)
+	sort.Strings(result)
+	return result
+}
+
+func TestAuthChain(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	join := testAuthChainEvent(t, "$join:a", "$create:a")
+	power := testAuthChainEvent(t, "$power:a", "$create:a", "$join:a")
+	rules := testAuthChainEvent(t, "$rules:a", "$create:a", "$join:a", "$power:a")
+	other := testAuthChainEvent(t, "$other:a", "$create:a", "$power:a")
+	db := newTestAuthChainDB(create, join, power, rules, other)
+
+	input := []Event{
+		testAuthChainEvent(t, "$x:a", "$rules:a", "$power:a"),
+		testAuthChainEvent(t, "$y:a", "$other:a"),
+	}
+	chain, err := AuthChain(context.Background(), input, db.provide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthChainOrder(t, chain)
+
+	want := []string{"$create:a", "$join:a", "$other:a", "$power:a", "$rules:a"}
+	if got := sortedStrings(chainEventIDs(chain)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("AuthChain: want %v got %v", want, got)
+	}
+
+	// There should be one batch per level of the chain and no event should
+	// be requested twice.
+	requested := map[string]bool{}
+	for _, batch := range db.batches {
+		for _, eventID := range batch {
+			if requested[eventID] {
+				t.Fatalf("event %q was requested more than once", eventID)
+			}
+			requested[eventID] = true
+		}
+	}
+	if len(db.batches) != 2 {
+		t.Fatalf("AuthChain: want 2 provider calls got %d: %v", len(db.batches), db.batches)
+	}
+}
+
+func TestAuthChainIncludesInputEventsInChain(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	join := testAuthChainEvent(t, "$join:a", "$create:a")
+	db := newTestAuthChainDB()
+
+	chain, err := AuthChain(context.Background(), []Event{join, create}, db.provide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := chainEventIDs(chain); !reflect.DeepEqual(got, []string{"$create:a"}) {
+		t.Fatalf("AuthChain: want [$create:a] got %v", got)
+	}
+	if len(db.batches) != 0 {
+		t.Fatalf("AuthChain: expected no provider calls got %v", db.batches)
+	}
+}
+
+func TestAuthChainMissingEvents(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	join := testAuthChainEvent(t, "$join:a", "$create:a", "$missing1:a")
+	db := newTestAuthChainDB(create, join)
+
+	input := []Event{testAuthChainEvent(t, "$x:a", "$join:a", "$missing2:a")}
+	chain, err := AuthChain(context.Background(), input, db.provide)
+	missingErr, ok := err.(MissingAuthEventsError)
+	if !ok {
+		t.Fatalf("AuthChain: want MissingAuthEventsError got %T: %v", err, err)
+	}
+	want := []string{"$missing1:a", "$missing2:a"}
+	if got := sortedStrings(missingErr.EventIDs); !reflect.DeepEqual(got, want) {
+		t.Fatalf("AuthChain: want missing %v got %v", want, got)
+	}
+	if got := chainEventIDs(chain); !reflect.DeepEqual(got, []string{"$create:a", "$join:a"}) {
+		t.Fatalf("AuthChain: want partial chain [$create:a $join:a] got %v", got)
+	}
+}
+
+func TestAuthChainCycle(t *testing.T) {
+	a := testAuthChainEvent(t, "$a:a", "$b:a")
+	b := testAuthChainEvent(t, "$b:a", "$c:a")
+	c := testAuthChainEvent(t, "$c:a", "$a:a")
+	db := newTestAuthChainDB(a, b, c)
+
+	input := []Event{testAuthChainEvent(t, "$x:a", "$a:a")}
+	if _, err := AuthChain(context.Background(), input, db.provide); err == nil {
+		t.Fatal("AuthChain: expected an error for a cycle in the auth events")
+	}
+}
+
+func TestAuthChainCancelled(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	db := newTestAuthChainDB(create)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	input := []Event{testAuthChainEvent(t, "$x:a", "$create:a")}
+	if _, err := AuthChain(ctx, input, db.provide); err != context.Canceled {
+		t.Fatalf("AuthChain: want %v got %v", context.Canceled, err)
+	}
+	if len(db.batches) != 0 {
+		t.Fatalf("AuthChain: expected no provider calls got %v", db.batches)
+	}
+}
+
+func TestAuthChainIDs(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	join := testAuthChainEvent(t, "$join:a", "$create:a")
+	power := testAuthChainEvent(t, "$power:a", "$create:a", "$join:a")
+	db := newTestAuthChainDB(create, join, power)
+
+	input := []Event{testAuthChainEvent(t, "$x:a", "$power:a")}
+	got, err := AuthChainIDs(context.Background(), input, db.provideIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"$create:a", "$join:a", "$power:a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("AuthChainIDs: want %v got %v", want, got)
+	}
+}
+
+func TestAuthDifference(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	join := testAuthChainEvent(t, "$join:a", "$create:a")
+	power := testAuthChainEvent(t, "$power:a", "$create:a", "$join:a")
+	a1 := testAuthChainEvent(t, "$a1:a", "$create:a", "$join:a", "$power:a")
+	b1 := testAuthChainEvent(t, "$b1:a", "$create:a", "$join:a", "$power:a")
+	a2 := testAuthChainEvent(t, "$a2:a", "$create:a", "$a1:a")
+	b2 := testAuthChainEvent(t, "$b2:a", "$create:a", "$b1:a")
+	c1 := testAuthChainEvent(t, "$c1:a", "$create:a", "$join:a")
+	db := newTestAuthChainDB(create, join, power, a1, b1, a2, b2, c1)
+
+	testCases := []struct {
+		name      string
+		stateSets [][]Event
+		want      []string
+	}{
+		{
+			// The full auth chains are {create, join, power, a1} and
+			// {create, join, power}.
+			name:      "one sided",
+			stateSets: [][]Event{{a2}, {b1}},
+			want:      []string{"$a1:a"},
+		},
+		{
+			name:      "both sides",
+			stateSets: [][]Event{{a2}, {b2}},
+			want:      []string{"$a1:a", "$b1:a"},
+		},
+		{
+			name:      "same auth chains",
+			stateSets: [][]Event{{a1}, {b1}},
+			want:      nil,
+		},
+		{
+			// The power event is in the auth chain of two of the three sets.
+			name:      "three sets",
+			stateSets: [][]Event{{a1}, {b1}, {c1}},
+			want:      []string{"$power:a"},
+		},
+		{
+			// Being in a state set doesn't put an event in the full auth
+			// chain of that set, even if it's in the chain of another set.
+			name:      "state event in other chain",
+			stateSets: [][]Event{{a1, c1}, {a2}},
+			want:      []string{"$a1:a"},
+		},
+		{
+			// The auth chain of an empty state set is empty so the difference
+			// is the union of the other chains.
+			name:      "empty state set",
+			stateSets: [][]Event{{a1}, {}},
+			want:      []string{"$create:a", "$join:a", "$power:a"},
+		},
+	}
+
+	for _, tc := range testCases {
+		difference, err := AuthDifference(context.Background(), tc.stateSets, db.provide)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		checkAuthChainOrder(t, difference)
+		if got := sortedStrings(chainEventIDs(difference)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: AuthDifference: want %v got %v", tc.name, tc.want, got)
+		}
+
+		ids, err := AuthDifferenceIDs(context.Background(), tc.stateSets, db.provideIDs)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := sortedStrings(ids); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: AuthDifferenceIDs: want %v got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestAuthDifferenceManyStateSets(t *testing.T) {
+	// Use more than 64 state sets to check the bitsets span several words.
+	create := testAuthChainEvent(t, "$create:a")
+	shared := testAuthChainEvent(t, "$shared:a", "$create:a")
+	events := []Event{create, shared}
+	var stateSets [][]Event
+	for i := 0; i < 100; i++ {
+		event := testAuthChainEvent(t, fmt.Sprintf("$e%d:a", i), "$shared:a")
+		events = append(events, event)
+		stateSets = append(stateSets, []Event{event})
+	}
+	// The last state set has an extra event in its auth chain.
+	extra := testAuthChainEvent(t, "$extra:a", "$create:a")
+	events = append(events, extra)
+	stateSets[99] = append(stateSets[99], testAuthChainEvent(t, "$last:a", "$extra:a"))
+
+	db := newTestAuthChainDB(events...)
+	difference, err := AuthDifferenceIDs(context.Background(), stateSets, db.provideIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"$extra:a"}; !reflect.DeepEqual(difference, want) {
+		t.Fatalf("AuthDifferenceIDs: want %v got %v", want, difference)
+	}
+}
+
+func TestAuthDifferenceMissingEvents(t *testing.T) {
+	create := testAuthChainEvent(t, "$create:a")
+	db := newTestAuthChainDB(create)
+
+	stateSets := [][]Event{
+		{testAuthChainEvent(t, "$x:a", "$create:a")},
+		{testAuthChainEvent(t, "$y:a", "$create:a", "$missing:a")},
+	}
+	_, err := AuthDifference(context.Background(), stateSets, db.provide)
+	if _, ok := err.(MissingAuthEventsError); !ok {
+		t.Fatalf("AuthDifference: want MissingAuthEventsError got %T: %v", err, err)
+	}
+}
+
+func BenchmarkAuthDifference(b *testing.B) {
+	// Build a room with a few thousand events where each event is authed by
+	// the create event and the previous three events, and compare the state
+	// at several points in the room.
+	const numEvents = 3000
+	events := []Event{testAuthChainEvent(b, "$0:a")}
+	for i := 1; i < numEvents; i++ {
+		authEventIDs := []string{"$0:a"}
+		for j := i - 3; j < i; j++ {
+			if j > 0 {
+				authEventIDs = append(authEventIDs, fmt.Sprintf("$%d:a", j))
+			}
+		}
+		events = append(events, testAuthChainEvent(b, fmt.Sprintf("$%d:a", i), authEventIDs...))
+	}
+	db := newTestAuthChainDB(events...)
+	stateSets := [][]Event{
+		{events[numEvents-1]},
+		{events[numEvents/2]},
+		{events[numEvents/4], events[numEvents/3]},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.batches = nil
+		if _, err := AuthDifference(context.Background(), stateSets, db.provide); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package authconformance runs the event auth rules against a corpus of JSON
+// fixtures, so that changes to the rules can be checked against known
+// decisions for every room version.
+//
+// Each fixture is a JSON file with a ".json" extension of the form:
+//
+//	{
+//	    "description": "What the fixture checks",
+//	    "room_version": "6",
+//	    "auth_events": [{"type": "m.room.create", ...}, ...],
+//	    "event": {"type": "m.room.message", ...},
+//	    "allowed": false,
+//	    "reason": "Why the event is or isn't allowed",
+//	    "error_contains": "text in the error if it isn't allowed"
+//	}
+//
+// The room version must match the "room_version" of the m.room.create event in
+// the auth events, which is what the auth rules use. An empty room version is
+// treated as version 1. The "error_contains" key is optional.
+//
+// The fixtures used by this package are in its testdata directory. Servers
+// using gomatrixserverlib can run the same harness over their own fixtures by
+// calling RunAuthConformance from a test.
+package authconformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A Fixture is a single auth rule conformance check.
+type Fixture struct {
+	// A description of what the fixture checks.
+	Description string `json:"description"`
+	// The version of the room the event is in.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The state events used to auth the event.
+	AuthEvents []json.RawMessage `json:"auth_events"`
+	// The event to check.
+	Event json.RawMessage `json:"event"`
+	// Whether the event should be allowed by the auth events.
+	Allowed bool `json:"allowed"`
+	// Why the event is or isn't allowed.
+	Reason string `json:"reason"`
+	// If the event isn't allowed, optional text that the error must contain.
+	ErrorContains string `json:"error_contains,omitempty"`
+}
+
+// Check runs the fixture against gomatrixserverlib.Allowed. Returns an error
+// if the fixture is invalid or if the outcome isn't the one expected.
+func (f Fixture) Check() error {
+	authEvents := gomatrixserverlib.NewAuthEventsWithCapacity(len(f.AuthEvents))
+	for _, eventJSON := range f.AuthEvents {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false)
+		if err != nil {
+			return fmt.Errorf("invalid auth event: %s", err)
+		}
+		if err = authEvents.AddEvent(&event); err != nil {
+			return fmt.Errorf("invalid auth event: %s", err)
+		}
+	}
+	if err := f.checkRoomVersion(&authEvents); err != nil {
+		return err
+	}
+
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(f.Event, false)
+	if err != nil {
+		return fmt.Errorf("invalid event: %s", err)
+	}
+
+	err = gomatrixserverlib.Allowed(event, &authEvents)
+	switch {
+	case f.Allowed && err != nil:
+		return fmt.Errorf("expected the event to be allowed (%s) but it wasn't: %s", f.Reason, err)
+	case !f.Allowed && err == nil:
+		return fmt.Errorf("expected the event not to be allowed (%s) but it was", f.Reason)
+	case !f.Allowed && !strings.Contains(err.Error(), f.ErrorContains):
+		return fmt.Errorf("expected the error to contain %q but got: %s", f.ErrorContains, err)
+	}
+	return nil
+}
+
+// checkRoomVersion checks that the room version of the fixture matches the
+// version given by the create event in the auth events, if there is one.
+func (f Fixture) checkRoomVersion(authEvents gomatrixserverlib.AuthEventProvider) error {
+	createEvent, err := authEvents.Create()
+	if err != nil || createEvent == nil {
+		return err
+	}
+	var content struct {
+		RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	}
+	if err = json.Unmarshal(createEvent.Content(), &content); err != nil {
+		return fmt.Errorf("invalid create event content: %s", err)
+	}
+	want, got := f.RoomVersion, content.RoomVersion
+	if want == "" {
+		want = gomatrixserverlib.RoomVersionV1
+	}
+	if got == "" {
+		got = gomatrixserverlib.RoomVersionV1
+	}
+	if want != got {
+		return fmt.Errorf("fixture is for room version %q but the create event is for %q", want, got)
+	}
+	return nil
+}
+
+// LoadFixtures loads the fixtures from the ".json" files in the directory.
+// Returns the fixtures keyed by file name.
+func LoadFixtures(dir string) (map[string]Fixture, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	fixtures := make(map[string]Fixture, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fixture Fixture
+		if err = json.Unmarshal(data, &fixture); err != nil {
+			return nil, fmt.Errorf("authconformance: invalid fixture %q: %s", path, err)
+		}
+		fixtures[filepath.Base(path)] = fixture
+	}
+	return fixtures, nil
+}
+
+// RunAuthConformance checks each of the fixtures in the directory as a
+// subtest named after the fixture file. Fails the test if the directory has
+// no fixtures.
+func RunAuthConformance(t *testing.T, dir string) {
+	fixtures, err := LoadFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatalf("authconformance: no fixtures in %q", dir)
+	}
+	names := make([]string, 0, len(fixtures))
+	for name := range fixtures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fixture := fixtures[name]
+		t.Run(name, func(t *testing.T) {
+			if err := fixture.Check(); err != nil {
+				t.Errorf("%s: %s", fixture.Description, err)
+			}
+		})
+	}
+}
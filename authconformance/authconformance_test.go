@@ -0,0 +1,81 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package authconformance
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAuthConformance(t *testing.T) {
+	RunAuthConformance(t, "testdata")
+}
+
+func TestFixtureCheckMismatch(t *testing.T) {
+	var fixture Fixture
+	if err := json.Unmarshal([]byte(`{
+		"description": "A create event with the wrong expectation",
+		"room_version": "1",
+		"event": {
+			"type": "m.room.create",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e1:a",
+			"content": {"creator": "@u1:a"}
+		},
+		"allowed": false
+	}`), &fixture); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixture.Check(); err == nil {
+		t.Fatal("Check: expected an error when the outcome doesn't match")
+	}
+	fixture.Allowed = true
+	if err := fixture.Check(); err != nil {
+		t.Fatalf("Check: unexpected error: %s", err)
+	}
+}
+
+func TestFixtureCheckRoomVersion(t *testing.T) {
+	var fixture Fixture
+	if err := json.Unmarshal([]byte(`{
+		"room_version": "6",
+		"auth_events": [{
+			"type": "m.room.create",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e1:a",
+			"content": {"creator": "@u1:a"}
+		}],
+		"event": {
+			"type": "m.room.member",
+			"state_key": "@u1:a",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e2:a",
+			"prev_events": [["$e1:a", {}]],
+			"content": {"membership": "join"}
+		},
+		"allowed": true
+	}`), &fixture); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixture.Check(); err == nil {
+		t.Fatal("Check: expected an error when the room versions don't match")
+	}
+}
@@ -31,16 +31,25 @@ func (b64 Base64String) Encode() string {
 	return base64.RawStdEncoding.EncodeToString(b64)
 }
 
-// Decode decodes the given input into this Base64String
+// Decode decodes the given input into this Base64String. The spec says that
+// base64 is unpadded and uses the standard alphabet, but older servers have
+// sent padded values and URL-safe values in signatures, keys and hashes, so
+// both are accepted. Encode always gives the unpadded standard form.
+// Signatures, keys and hashes are all decoded here, so that they are equally
+// tolerant.
 func (b64 *Base64String) Decode(str string) error {
-	// We must check whether the string was encoded in a URL-safe way in order
-	// to use the appropriate encoding.
-	var err error
+	// We must check whether the string was encoded in a URL-safe way or with
+	// padding in order to use the appropriate encoding. The padded encodings
+	// check that the padding is the right length.
+	encoding := base64.RawStdEncoding
 	if strings.ContainsAny(str, "-_") {
-		*b64, err = base64.RawURLEncoding.DecodeString(str)
-	} else {
-		*b64, err = base64.RawStdEncoding.DecodeString(str)
+		encoding = base64.RawURLEncoding
+	}
+	if strings.HasSuffix(str, "=") {
+		encoding = encoding.WithPadding(base64.StdPadding)
 	}
+	var err error
+	*b64, err = encoding.DecodeString(str)
 	return err
 }
 
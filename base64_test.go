@@ -60,6 +60,30 @@ func TestUnmarshalUrlSafeBase64(t *testing.T) {
 	}
 }
 
+func TestUnmarshalPaddedBase64(t *testing.T) {
+	want := "this\xffis\xffa\xfftest"
+	for _, input := range []string{`"dGhpc/9pc/9h/3Rlc3Q="`, `"dGhpc_9pc_9h_3Rlc3Q="`} {
+		var got Base64String
+		if err := json.Unmarshal([]byte(input), &got); err != nil {
+			t.Fatalf("json.Unmarshal(%q): %v", input, err)
+		}
+		if string(got) != want {
+			t.Fatalf("json.Unmarshal(%q): wanted %q got %q", input, want, string(got))
+		}
+		// Encoding the value again gives the unpadded standard form.
+		if got.Encode() != "dGhpc/9pc/9h/3Rlc3Q" {
+			t.Fatalf("Base64String.Encode: wanted %q got %q", "dGhpc/9pc/9h/3Rlc3Q", got.Encode())
+		}
+	}
+
+	for _, input := range []string{`"dGhpc/9pc/9h/3Rlc3Q=="`, `"dGhpc/9pc/9h_3Rlc3Q"`, `"dGhpc/9pc/9h/3Rlc3=Q"`} {
+		var got Base64String
+		if err := json.Unmarshal([]byte(input), &got); err == nil {
+			t.Fatalf("json.Unmarshal(%q): wanted an error", input)
+		}
+	}
+}
+
 func TestMarshalBase64Struct(t *testing.T) {
 	input := struct{ Value Base64String }{Base64String("this\xffis\xffa\xfftest")}
 	want := `{"Value":"dGhpc/9pc/9h/3Rlc3Q"}`
@@ -256,20 +256,30 @@ func (fc *Client) LookupServerKeys(
 
 	// The request format is:
 	// { "server_keys": { "<server_name>": { "<key_id>": { "minimum_valid_until_ts": <ts> }}}
+	// An empty object for a server asks for all of its keys, which is what
+	// a request with an empty key ID asks for.
 	type keyreq struct {
 		MinimumValidUntilTS Timestamp `json:"minimum_valid_until_ts"`
 	}
 	request := struct {
 		ServerKeyMap map[ServerName]map[KeyID]keyreq `json:"server_keys"`
 	}{map[ServerName]map[KeyID]keyreq{}}
+	allKeys := map[ServerName]bool{}
 	for k, ts := range keyRequests {
 		server := request.ServerKeyMap[k.ServerName]
 		if server == nil {
 			server = map[KeyID]keyreq{}
 			request.ServerKeyMap[k.ServerName] = server
 		}
+		if k.KeyID == "" {
+			allKeys[k.ServerName] = true
+			continue
+		}
 		server[k.KeyID] = keyreq{ts}
 	}
+	for serverName := range allKeys {
+		request.ServerKeyMap[serverName] = map[KeyID]keyreq{}
+	}
 
 	requestBytes, err := json.Marshal(request)
 	if err != nil {
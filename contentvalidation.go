@@ -0,0 +1,288 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// An ErrInvalidEventContent is returned by ValidateStateEventContent when
+// the content of an event doesn't have the shape that the spec gives for
+// events of its type.
+type ErrInvalidEventContent struct {
+	// The ID of the event.
+	EventID string
+	// The type of the event.
+	EventType string
+	// The path of the key in the content that is invalid, like
+	// "users.@alice:example.com", or empty if the content as a whole is.
+	Key string
+	// Why the content is invalid.
+	Reason string
+}
+
+func (e ErrInvalidEventContent) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("gomatrixserverlib: invalid content for %s event %q: %s", e.EventType, e.EventID, e.Reason)
+	}
+	return fmt.Sprintf(
+		"gomatrixserverlib: invalid content for %s event %q: %q %s", e.EventType, e.EventID, e.Key, e.Reason,
+	)
+}
+
+// ValidateStateEventContent checks that the content of a m.room.create,
+// m.room.join_rules, m.room.member or m.room.power_levels event has the shape
+// that the spec gives for it, so that malformed content can be rejected with
+// a descriptive error before the auth checks run. Events of other types, and
+// keys of the content that the spec doesn't define, aren't checked. Returns
+// an ErrInvalidEventContent for the first problem found.
+//
+// The checks follow the spec strictly, so they reject some content that the
+// auth checks accept for compatibility with older servers, like power levels
+// given as strings such as "50" rather than as integers.
+func ValidateStateEventContent(e Event) error {
+	var validate func(content map[string]json.RawMessage, fail func(key, reason string) error) error
+	switch e.Type() {
+	case MRoomCreate:
+		validate = validateCreateContent
+	case MRoomJoinRules:
+		validate = validateJoinRulesContent
+	case MRoomMember:
+		validate = validateMemberContent
+	case MRoomPowerLevels:
+		validate = validatePowerLevelsContent
+	default:
+		return nil
+	}
+	fail := func(key, reason string) error {
+		return ErrInvalidEventContent{e.EventID(), e.Type(), key, reason}
+	}
+	var content map[string]json.RawMessage
+	if err := json.Unmarshal(e.Content(), &content); err != nil || content == nil {
+		return fail("", "content is not a JSON object")
+	}
+	return validate(content, fail)
+}
+
+func validateCreateContent(content map[string]json.RawMessage, fail func(key, reason string) error) error {
+	roomVersion := RoomVersionV1
+	if raw, ok := content["room_version"]; ok {
+		var version string
+		if err := json.Unmarshal(raw, &version); err != nil || jsonKind(raw) != "string" {
+			return fail("room_version", "must be a string")
+		}
+		roomVersion = RoomVersion(version)
+	}
+	// Room versions that take the creator from the sender don't need the
+	// "creator" key.
+	desc, err := roomVersion.description()
+	if raw, ok := content["creator"]; ok || err != nil || !desc.implicitCreator {
+		if !ok {
+			return fail("creator", "is missing")
+		}
+		if err := validateContentUserID(raw); err != nil {
+			return fail("creator", err.Error())
+		}
+	}
+	if raw, ok := content["m.federate"]; ok && jsonKind(raw) != "boolean" {
+		return fail("m.federate", "must be a boolean")
+	}
+	if raw, ok := content["predecessor"]; ok {
+		var predecessor map[string]json.RawMessage
+		if jsonKind(raw) != "object" || json.Unmarshal(raw, &predecessor) != nil {
+			return fail("predecessor", "must be an object")
+		}
+		for _, key := range []string{"room_id", "event_id"} {
+			if jsonKind(predecessor[key]) != "string" {
+				return fail("predecessor."+key, "must be a string")
+			}
+		}
+	}
+	return nil
+}
+
+func validateJoinRulesContent(content map[string]json.RawMessage, fail func(key, reason string) error) error {
+	var joinRule string
+	if jsonKind(content["join_rule"]) != "string" || json.Unmarshal(content["join_rule"], &joinRule) != nil {
+		return fail("join_rule", "must be a string")
+	}
+	switch joinRule {
+	case Public, Invite, Knock, Private, Restricted, KnockRestricted:
+	default:
+		return fail("join_rule", fmt.Sprintf("is the unknown join rule %q", joinRule))
+	}
+	if raw, ok := content["allow"]; ok {
+		var allow []map[string]json.RawMessage
+		if jsonKind(raw) != "array" || json.Unmarshal(raw, &allow) != nil {
+			return fail("allow", "must be an array of objects")
+		}
+		for i, condition := range allow {
+			var conditionType string
+			if jsonKind(condition["type"]) != "string" || json.Unmarshal(condition["type"], &conditionType) != nil {
+				return fail(fmt.Sprintf("allow.%d.type", i), "must be a string")
+			}
+			// Conditions of unknown types are ignored, as the spec requires.
+			if conditionType != MRoomMembership {
+				continue
+			}
+			var roomID string
+			if jsonKind(condition["room_id"]) != "string" || json.Unmarshal(condition["room_id"], &roomID) != nil {
+				return fail(fmt.Sprintf("allow.%d.room_id", i), "must be a string")
+			}
+			if _, err := checkID(roomID, "room", '!'); err != nil {
+				return fail(fmt.Sprintf("allow.%d.room_id", i), "is not a valid room ID")
+			}
+		}
+	}
+	return nil
+}
+
+func validateMemberContent(content map[string]json.RawMessage, fail func(key, reason string) error) error {
+	var membership string
+	if jsonKind(content["membership"]) != "string" || json.Unmarshal(content["membership"], &membership) != nil {
+		return fail("membership", "must be a string")
+	}
+	switch membership {
+	case Join, Invite, Leave, Ban, Knock:
+	default:
+		return fail("membership", fmt.Sprintf("is the unknown membership %q", membership))
+	}
+	// The profile keys may be null as well as strings.
+	for _, key := range []string{"displayname", "avatar_url", "reason"} {
+		if raw, ok := content[key]; ok && jsonKind(raw) != "string" && jsonKind(raw) != "null" {
+			return fail(key, "must be a string")
+		}
+	}
+	if raw, ok := content["join_authorised_via_users_server"]; ok {
+		if err := validateContentUserID(raw); err != nil {
+			return fail("join_authorised_via_users_server", err.Error())
+		}
+	}
+	if raw, ok := content["third_party_invite"]; ok {
+		var invite map[string]json.RawMessage
+		if jsonKind(raw) != "object" || json.Unmarshal(raw, &invite) != nil {
+			return fail("third_party_invite", "must be an object")
+		}
+		if jsonKind(invite["display_name"]) != "string" {
+			return fail("third_party_invite.display_name", "must be a string")
+		}
+		var signed map[string]json.RawMessage
+		if jsonKind(invite["signed"]) != "object" || json.Unmarshal(invite["signed"], &signed) != nil {
+			return fail("third_party_invite.signed", "must be an object")
+		}
+		for _, key := range []string{"mxid", "token"} {
+			if jsonKind(signed[key]) != "string" {
+				return fail("third_party_invite.signed."+key, "must be a string")
+			}
+		}
+		if jsonKind(signed["signatures"]) != "object" {
+			return fail("third_party_invite.signed.signatures", "must be an object")
+		}
+	}
+	return nil
+}
+
+func validatePowerLevelsContent(content map[string]json.RawMessage, fail func(key, reason string) error) error {
+	for _, key := range []string{
+		"ban", "events_default", "invite", "kick", "redact", "state_default", "users_default",
+	} {
+		if raw, ok := content[key]; ok {
+			if err := validatePowerLevel(raw); err != nil {
+				return fail(key, err.Error())
+			}
+		}
+	}
+	for _, key := range []string{"events", "notifications", "users"} {
+		raw, ok := content[key]
+		if !ok {
+			continue
+		}
+		var levels map[string]json.RawMessage
+		if jsonKind(raw) != "object" || json.Unmarshal(raw, &levels) != nil {
+			return fail(key, "must be an object")
+		}
+		// Check the levels in order so that the error is deterministic.
+		names := make([]string, 0, len(levels))
+		for name := range levels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if key == "users" {
+				if _, err := ParseUserID(name); err != nil {
+					return fail(key+"."+name, "is not a valid user ID")
+				}
+			}
+			if err := validatePowerLevel(levels[name]); err != nil {
+				return fail(key+"."+name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// validatePowerLevel checks that the value is an integer in the range of
+// power levels.
+func validatePowerLevel(raw json.RawMessage) error {
+	if kind := jsonKind(raw); kind != "number" {
+		return fmt.Errorf("must be an integer, not a %s %s", kind, raw)
+	}
+	level, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return fmt.Errorf("must be an integer, not %s", raw)
+	}
+	if level < MinPowerLevel || level > MaxPowerLevel {
+		return fmt.Errorf("is outside the range of power levels")
+	}
+	return nil
+}
+
+// validateContentUserID checks that the value is a valid user ID.
+func validateContentUserID(raw json.RawMessage) error {
+	var userID string
+	if jsonKind(raw) != "string" || json.Unmarshal(raw, &userID) != nil {
+		return fmt.Errorf("must be a string")
+	}
+	if _, err := ParseUserID(userID); err != nil {
+		return fmt.Errorf("is not a valid user ID")
+	}
+	return nil
+}
+
+// jsonKind returns the kind of the JSON value, as named by JSON schema, or
+// "missing" if there isn't a value.
+func jsonKind(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "missing"
+	}
+	switch raw[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,95 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"testing"
+)
+
+func testContentEvent(t *testing.T, eventType, stateKey, content string) Event {
+	return testEventf(
+		t, `{"event_id":"$e:a","room_id":"!r:a","sender":"@u:a","type":%q,"state_key":%q,"content":%s}`,
+		eventType, stateKey, content,
+	)
+}
+
+func TestValidateStateEventContentStringPowerLevels(t *testing.T) {
+	// The auth checks accept string levels from older servers, but they
+	// aren't integers as the spec requires.
+	event := testContentEvent(t, MRoomPowerLevels, "", `{"ban":"50","users":{"@u:a":100}}`)
+	if _, err := NewPowerLevelContentFromEvent(event); err != nil {
+		t.Fatalf("NewPowerLevelContentFromEvent: unexpected error: %v", err)
+	}
+	err := ValidateStateEventContent(event)
+	invalid, ok := err.(ErrInvalidEventContent)
+	if !ok || invalid.Key != "ban" || invalid.EventType != MRoomPowerLevels {
+		t.Fatalf("ValidateStateEventContent: wanted an ErrInvalidEventContent for \"ban\", got %v", err)
+	}
+	want := `gomatrixserverlib: invalid content for m.room.power_levels event "$e:a": "ban" must be an integer, not a string "50"`
+	if err.Error() != want {
+		t.Errorf("ValidateStateEventContent: got error %q, want %q", err.Error(), want)
+	}
+
+	event = testContentEvent(t, MRoomPowerLevels, "", `{"users":{"@u:a":"100"}}`)
+	if err = ValidateStateEventContent(event); err == nil || err.(ErrInvalidEventContent).Key != "users.@u:a" {
+		t.Errorf("ValidateStateEventContent: wanted an error for \"users.@u:a\", got %v", err)
+	}
+}
+
+func TestValidateStateEventContent(t *testing.T) {
+	tests := []struct {
+		eventType string
+		stateKey  string
+		content   string
+		// The key that is invalid, or "-" if the content is valid.
+		wantKey string
+	}{
+		{MRoomPowerLevels, "", `{"ban":50,"events":{"m.room.name":50},"notifications":{"room":50},"users":{"@u:a":100}}`, "-"},
+		{MRoomPowerLevels, "", `{"kick":1.5}`, "kick"},
+		{MRoomPowerLevels, "", `{"redact":9007199254740992}`, "redact"},
+		{MRoomPowerLevels, "", `{"events":[]}`, "events"},
+		{MRoomPowerLevels, "", `{"users":{"u":100}}`, "users.u"},
+		{MRoomPowerLevels, "", `[]`, ""},
+		{MRoomJoinRules, "", `{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!o:a"},{"type":"other"}]}`, "-"},
+		{MRoomJoinRules, "", `{}`, "join_rule"},
+		{MRoomJoinRules, "", `{"join_rule":"sometimes"}`, "join_rule"},
+		{MRoomJoinRules, "", `{"join_rule":"restricted","allow":{}}`, "allow"},
+		{MRoomJoinRules, "", `{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"o"}]}`, "allow.0.room_id"},
+		{MRoomMember, "@u:a", `{"membership":"join","displayname":null,"avatar_url":"mxc://a/b"}`, "-"},
+		{MRoomMember, "@u:a", `{"membership":"joined"}`, "membership"},
+		{MRoomMember, "@u:a", `{"membership":"join","displayname":5}`, "displayname"},
+		{MRoomMember, "@u:a", `{"membership":"join","join_authorised_via_users_server":"a"}`, "join_authorised_via_users_server"},
+		{MRoomMember, "@u:a", `{"membership":"invite","third_party_invite":{"display_name":"x","signed":{"mxid":"@u:a"}}}`,
+			"third_party_invite.signed.token"},
+		{MRoomCreate, "", `{"creator":"@u:a","m.federate":false,"predecessor":{"room_id":"!o:a","event_id":"$o:a"}}`, "-"},
+		{MRoomCreate, "", `{}`, "creator"},
+		{MRoomCreate, "", `{"creator":"@u:a","m.federate":"no"}`, "m.federate"},
+		{MRoomCreate, "", `{"creator":"@u:a","predecessor":{"room_id":"!o:a"}}`, "predecessor.event_id"},
+		{"m.room.topic", "", `{"topic":5}`, "-"},
+	}
+	for i, test := range tests {
+		err := ValidateStateEventContent(testContentEvent(t, test.eventType, test.stateKey, test.content))
+		if test.wantKey == "-" {
+			if err != nil {
+				t.Errorf("Case %d: ValidateStateEventContent: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if invalid, ok := err.(ErrInvalidEventContent); !ok || invalid.Key != test.wantKey {
+			t.Errorf("Case %d: ValidateStateEventContent: wanted an error for %q, got %v", i, test.wantKey, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import "fmt"
+
+// A DepthNotMonotonicError is returned by VerifyDepthMonotonic when an event
+// doesn't have a greater depth than one of its prev events.
+type DepthNotMonotonicError struct {
+	// The ID of the event with the inconsistent depth.
+	EventID string
+	// The depth of that event.
+	Depth int64
+	// The ID of the prev event whose depth is at least as great.
+	PrevEventID string
+	// The depth of the prev event.
+	PrevDepth int64
+}
+
+func (e DepthNotMonotonicError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: event %q has depth %d but its prev event %q has depth %d",
+		e.EventID, e.Depth, e.PrevEventID, e.PrevDepth,
+	)
+}
+
+// VerifyDepthMonotonic checks that the depth of every event is greater than
+// the depth of each of its prev events, which is useful for sanity checking a
+// chunk of the room DAG received from a remote server, e.g. over backfill.
+// Only prev events that are among the given events are checked; references
+// to events outside of the set are ignored.
+// Returns a DepthNotMonotonicError for the first event in the list that
+// violates the ordering, or nil if the depths are consistent.
+func VerifyDepthMonotonic(events []Event) error {
+	eventsByID := make(map[string]*Event, len(events))
+	for i := range events {
+		eventsByID[events[i].EventID()] = &events[i]
+	}
+	for i := range events {
+		event := &events[i]
+		for _, prevEventID := range event.PrevEventIDs() {
+			prevEvent := eventsByID[prevEventID]
+			if prevEvent == nil {
+				continue
+			}
+			if prevEvent.Depth() >= event.Depth() {
+				return DepthNotMonotonicError{
+					EventID:     event.EventID(),
+					Depth:       event.Depth(),
+					PrevEventID: prevEventID,
+					PrevDepth:   prevEvent.Depth(),
+				}
+			}
+		}
+	}
+	return nil
+}
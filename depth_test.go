@@ -0,0 +1,74 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// testDepthEvent makes a minimal event with the given ID, depth and prev events.
+func testDepthEvent(t *testing.T, eventID string, depth int64, prevEventIDs ...string) Event {
+	if prevEventIDs == nil {
+		prevEventIDs = []string{}
+	}
+	prevEvents, err := json.Marshal(prevEventIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testEventf(
+		t, `{"event_id":%q,"type":"m.room.message","depth":%d,"prev_events":%s}`, eventID, depth, prevEvents,
+	)
+}
+
+func TestVerifyDepthMonotonic(t *testing.T) {
+	// A forked DAG that merges back together, with the branches at different
+	// depths and a prev event that isn't in the set.
+	events := []Event{
+		testDepthEvent(t, "$merge", 5, "$left", "$right"),
+		testDepthEvent(t, "$left", 4, "$root"),
+		testDepthEvent(t, "$right", 2, "$root"),
+		testDepthEvent(t, "$root", 1, "$unknown"),
+	}
+	if err := VerifyDepthMonotonic(events); err != nil {
+		t.Fatalf("VerifyDepthMonotonic: unexpected error: %v", err)
+	}
+	if err := VerifyDepthMonotonic(nil); err != nil {
+		t.Fatalf("VerifyDepthMonotonic(nil): unexpected error: %v", err)
+	}
+}
+
+func TestVerifyDepthMonotonicInconsistent(t *testing.T) {
+	events := []Event{
+		testDepthEvent(t, "$root", 1),
+		testDepthEvent(t, "$left", 3, "$root"),
+		testDepthEvent(t, "$right", 2, "$root"),
+		// Has the same depth as one of its prev events.
+		testDepthEvent(t, "$merge", 3, "$right", "$left"),
+		// Has a lower depth than its prev event.
+		testDepthEvent(t, "$child", 2, "$merge"),
+	}
+	err := VerifyDepthMonotonic(events)
+	want := DepthNotMonotonicError{
+		EventID:     "$merge",
+		Depth:       3,
+		PrevEventID: "$left",
+		PrevDepth:   3,
+	}
+	if err != want {
+		t.Fatalf("VerifyDepthMonotonic: wanted error %v, got %v", want, err)
+	}
+}
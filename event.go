@@ -120,22 +120,58 @@ var emptyEventReferenceList = []EventReference{}
 // This can be called multiple times on the same builder.
 // A different event ID must be supplied each time this is called.
 func (eb *EventBuilder) Build(eventID string, now time.Time, origin ServerName, keyID KeyID, privateKey ed25519.PrivateKey) (result Event, err error) {
+	return eb.build(eventID, now, origin, keyID, privateKey, RoomVersionV1)
+}
+
+// BuildWithDerivedEventID builds a new Event for a room version where the
+// event ID is derived from the reference hash of the event, rather than
+// chosen by the origin server.
+// Returns an error if the room version doesn't derive event IDs from events.
+func (eb *EventBuilder) BuildWithDerivedEventID(
+	now time.Time, origin ServerName, keyID KeyID, privateKey ed25519.PrivateKey, roomVersion RoomVersion,
+) (Event, error) {
+	format, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return Event{}, err
+	}
+	if format == EventIDFormatV1 {
+		return Event{}, fmt.Errorf(
+			"gomatrixserverlib: room version %q does not derive event IDs from the event", roomVersion,
+		)
+	}
+	return eb.build("", now, origin, keyID, privateKey, roomVersion)
+}
+
+// build builds a new Event. If the event ID is empty then the event ID is
+// computed from the event for the room version once it has been signed.
+func (eb *EventBuilder) build(
+	eventID string, now time.Time, origin ServerName, keyID KeyID, privateKey ed25519.PrivateKey, roomVersion RoomVersion,
+) (result Event, err error) {
 	var event struct {
 		EventBuilder
-		EventID        string     `json:"event_id"`
+		EventID        string     `json:"event_id,omitempty"`
 		OriginServerTS Timestamp  `json:"origin_server_ts"`
 		Origin         ServerName `json:"origin"`
 		// This key is either absent or an empty list.
 		// If it is absent then the pointer is nil and omitempty removes it.
 		// Otherwise it points to an empty list and omitempty keeps it.
 		PrevState *[]EventReference `json:"prev_state,omitempty"`
+		// The event references in the format of the room version. These
+		// take the place of the keys of the EventBuilder.
+		PrevEvents RawJSON `json:"prev_events"`
+		AuthEvents RawJSON `json:"auth_events"`
 	}
 	event.EventBuilder = *eb
-	if event.PrevEvents == nil {
-		event.PrevEvents = emptyEventReferenceList
+
+	format, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return
 	}
-	if event.AuthEvents == nil {
-		event.AuthEvents = emptyEventReferenceList
+	if event.PrevEvents, err = marshalEventReferences(eb.PrevEvents, format); err != nil {
+		return
+	}
+	if event.AuthEvents, err = marshalEventReferences(eb.AuthEvents, format); err != nil {
+		return
 	}
 	event.OriginServerTS = AsTimestamp(now)
 	event.Origin = origin
@@ -157,14 +193,35 @@ func (eb *EventBuilder) Build(eventID string, now time.Time, origin ServerName,
 		return
 	}
 
-	if eventJSON, err = addContentHashesToEvent(eventJSON); err != nil {
+	hashAlgorithm, err := roomVersion.HashAlgorithm()
+	if err != nil {
+		return
+	}
+
+	if eventJSON, err = addContentHashesToEvent(eventJSON, hashAlgorithm); err != nil {
+		return
+	}
+
+	redactionAlgorithm, err := roomVersion.RedactionAlgorithm()
+	if err != nil {
 		return
 	}
 
-	if eventJSON, err = signEvent(string(origin), keyID, privateKey, eventJSON); err != nil {
+	if eventJSON, err = signEvent(string(origin), keyID, privateKey, eventJSON, redactionAlgorithm); err != nil {
 		return
 	}
 
+	if eventID == "" {
+		// The event ID is computed from the signed event and isn't covered by
+		// the content hash or the signatures.
+		if eventID, err = ComputeEventID(Event{eventJSON: eventJSON}, roomVersion); err != nil {
+			return
+		}
+		if eventJSON, err = sjson.SetBytes(eventJSON, "event_id", eventID); err != nil {
+			return
+		}
+	}
+
 	if eventJSON, err = CanonicalJSON(eventJSON); err != nil {
 		return
 	}
@@ -203,13 +260,16 @@ func NewEventFromUntrustedJSON(eventJSON []byte) (result Event, err error) {
 	// We know the JSON must be valid here.
 	eventJSON = CanonicalJSONAssumeValid(eventJSON)
 
-	if err = checkEventContentHash(eventJSON); err != nil {
+	// The room version isn't known here, but all the current room versions
+	// use SHA-256 content hashes.
+	if err = checkEventContentHash(eventJSON, HashAlgorithmSHA256); err != nil {
 		result.redacted = true
 
 		// If the content hash doesn't match then we have to discard all non-essential fields
-		// because they've been tampered with.
+		// because they've been tampered with. The room version isn't known
+		// here, so the event is redacted with the rules of room version 1.
 		var redactedJSON []byte
-		if redactedJSON, err = redactEvent(eventJSON); err != nil {
+		if redactedJSON, err = redactEvent(eventJSON, RedactionAlgorithmV1); err != nil {
 			return
 		}
 
@@ -256,29 +316,95 @@ func (e Event) Redacted() bool { return e.redacted }
 // JSON returns the JSON bytes for the event.
 func (e Event) JSON() []byte { return e.eventJSON }
 
-// Redact returns a redacted copy of the event.
+// Redact returns a redacted copy of the event, using the redaction rules of
+// room version 1.
 func (e Event) Redact() Event {
-	if e.redacted {
-		return e
-	}
-	eventJSON, err := redactEvent(e.eventJSON)
+	result, err := e.redact(RedactionAlgorithmV1)
 	if err != nil {
 		// This is unreachable for events created with EventBuilder.Build or NewEventFromUntrustedJSON
 		panic(fmt.Errorf("gomatrixserverlib: invalid event %v", err))
 	}
+	return result
+}
+
+// RedactForRoomVersion returns a redacted copy of the event, using the
+// redaction rules of the room version, which decide which keys of the event
+// and of its content are kept. Returns an error if the room version is
+// unknown or if the event can't be redacted.
+func (e Event) RedactForRoomVersion(roomVersion RoomVersion) (Event, error) {
+	algorithm, err := roomVersion.RedactionAlgorithm()
+	if err != nil {
+		return Event{}, err
+	}
+	return e.redact(algorithm)
+}
+
+// redact returns a redacted copy of the event using the redaction algorithm.
+func (e Event) redact(algorithm RedactionAlgorithm) (Event, error) {
+	if e.redacted {
+		return e, nil
+	}
+	eventJSON, err := redactEvent(e.eventJSON, algorithm)
+	if err != nil {
+		return Event{}, err
+	}
 	if eventJSON, err = CanonicalJSON(eventJSON); err != nil {
-		// This is unreachable for events created with EventBuilder.Build or NewEventFromUntrustedJSON
-		panic(fmt.Errorf("gomatrixserverlib: invalid event %v", err))
+		return Event{}, err
 	}
 	result := Event{
 		redacted:  true,
 		eventJSON: eventJSON,
 	}
 	if err = json.Unmarshal(eventJSON, &result.fields); err != nil {
-		// This is unreachable for events created with EventBuilder.Build or NewEventFromUntrustedJSON
-		panic(fmt.Errorf("gomatrixserverlib: invalid event %v", err))
+		return Event{}, err
 	}
-	return result
+	return result, nil
+}
+
+// EqualCanonical returns whether the events are the same event, which is
+// whether they have the same event ID and the same canonical redacted form,
+// ignoring the "unsigned" key and the signatures. The redacted form includes
+// the content hashes, so events whose content differs will only compare equal
+// if one of them has been redacted. If neither event is redacted then their
+// content must be the same as well, which catches events whose content was
+// changed without updating the hashes. This can be used to tell whether two
+// servers have sent the same event even if they have different signatures on
+// it, or whether one of them has stripped signatures.
+func (e Event) EqualCanonical(other Event) bool {
+	if e.EventID() != other.EventID() {
+		return false
+	}
+	if !e.redacted && !other.redacted {
+		content, err := CanonicalJSON(e.Content())
+		if err != nil {
+			return false
+		}
+		otherContent, err := CanonicalJSON(other.Content())
+		if err != nil || !bytes.Equal(content, otherContent) {
+			return false
+		}
+	}
+	redacted, err := canonicalWithoutSignatures(e.Redact().eventJSON)
+	if err != nil {
+		return false
+	}
+	otherRedacted, err := canonicalWithoutSignatures(other.Redact().eventJSON)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(redacted, otherRedacted)
+}
+
+// canonicalWithoutSignatures returns the canonical event JSON without the
+// "unsigned" and "signatures" keys.
+func canonicalWithoutSignatures(eventJSON []byte) ([]byte, error) {
+	var err error
+	for _, key := range []string{"unsigned", "signatures"} {
+		if eventJSON, err = sjson.DeleteBytes(eventJSON, key); err != nil {
+			return nil, err
+		}
+	}
+	return CanonicalJSON(eventJSON)
 }
 
 // SetUnsigned sets the unsigned key of the event.
@@ -346,9 +472,10 @@ func (e Event) EventReference() EventReference {
 	return reference
 }
 
-// Sign returns a copy of the event with an additional signature.
+// Sign returns a copy of the event with an additional signature, made over
+// the event redacted with the rules of room version 1.
 func (e Event) Sign(signingName string, keyID KeyID, privateKey ed25519.PrivateKey) Event {
-	eventJSON, err := signEvent(signingName, keyID, privateKey, e.eventJSON)
+	eventJSON, err := signEvent(signingName, keyID, privateKey, e.eventJSON, RedactionAlgorithmV1)
 	if err != nil {
 		// This is unreachable for events created with EventBuilder.Build or NewEventFromUntrustedJSON
 		panic(fmt.Errorf("gomatrixserverlib: invalid event %v (%q)", err, string(e.eventJSON)))
@@ -374,9 +501,10 @@ func (e Event) KeyIDs(signingName string) []KeyID {
 	return keyIDs
 }
 
-// Verify checks a ed25519 signature
+// Verify checks a ed25519 signature, made over the event redacted with the
+// rules of room version 1.
 func (e Event) Verify(signingName string, keyID KeyID, publicKey ed25519.PublicKey) error {
-	return verifyEventSignature(signingName, keyID, publicKey, e.eventJSON)
+	return verifyEventSignature(signingName, keyID, publicKey, e.eventJSON, RedactionAlgorithmV1)
 }
 
 // StateKey returns the "state_key" of the event, or the nil if the event is not a state event.
@@ -400,14 +528,29 @@ const (
 	// The entire event JSON, including signatures cannot be bigger than this.
 	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L183-184
 	maxEventLength = 65536
+	// An event cannot reference more than this many prev_events.
+	maxPrevEvents = 20
+	// An event cannot reference more than this many auth_events.
+	maxAuthEvents = 10
 )
 
 // CheckFields checks that the event fields are valid.
 // Returns an error if the IDs have the wrong format or too long.
 // Returns an error if the total length of the event JSON is too long.
 // Returns an error if the event ID doesn't match the origin of the event.
+// The format of the event ID depends on the room version, which isn't known
+// here, so event IDs without a server name are assumed to be derived from
+// the event. RespState.Check checks the event IDs against the format of its
+// room version.
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#size-limits
-func (e Event) CheckFields() error { // nolint: gocyclo
+func (e Event) CheckFields() error {
+	return e.checkFields(0)
+}
+
+// checkFields checks that the event fields are valid like CheckFields, with
+// the event ID in the given format. If the format is zero then the format is
+// decided by whether the event ID has a server name.
+func (e Event) checkFields(format EventIDFormat) error { // nolint: gocyclo
 	if len(e.eventJSON) > maxEventLength {
 		return fmt.Errorf(
 			"gomatrixserverlib: event is too long, length %d > maximum %d",
@@ -441,25 +584,10 @@ func (e Event) CheckFields() error { // nolint: gocyclo
 		return err
 	}
 
-	eventDomain, err := checkID(e.fields.EventID, "event", '$')
-	if err != nil {
+	if err = e.checkEventID(format); err != nil {
 		return err
 	}
 
-	// Synapse requires that the event ID domain has a valid signature.
-	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L66-L68
-	// Synapse requires that the event origin has a valid signature.
-	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/federation/federation_base.py#L133-L136
-	// Since both domains must be valid domains, and there is no good reason for them
-	// to be different we might as well ensure that they are the same since it
-	// makes the signature checks simpler.
-	if origin != ServerName(eventDomain) {
-		return fmt.Errorf(
-			"gomatrixserverlib: event ID domain doesn't match origin: %q != %q",
-			eventDomain, origin,
-		)
-	}
-
 	if origin != ServerName(senderDomain) {
 		// For the most part all events should be sent by a user on the
 		// originating server.
@@ -487,6 +615,63 @@ func (e Event) CheckFields() error { // nolint: gocyclo
 	return nil
 }
 
+// checkEventID checks that the event ID has the given format. Event IDs chosen
+// by the origin server must have the server name of the origin, and event
+// IDs derived from the event must not have a server name. Whether a derived
+// event ID matches the event is checked by ComputeEventID. If the format is
+// zero then the format is decided by whether the event ID has a server name.
+func (e Event) checkEventID(format EventIDFormat) error {
+	if format == 0 {
+		format = EventIDFormatV1
+		if eventIDIsReferenceHash(e.fields.EventID) {
+			format = EventIDFormatV3
+		}
+	}
+	if format != EventIDFormatV1 {
+		if !eventIDIsReferenceHash(e.fields.EventID) {
+			return fmt.Errorf("gomatrixserverlib: invalid event ID %q for a room version with derived event IDs", e.fields.EventID)
+		}
+		return nil
+	}
+
+	eventDomain, err := checkID(e.fields.EventID, "event", '$')
+	if err != nil {
+		return err
+	}
+
+	// Synapse requires that the event ID domain has a valid signature.
+	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L66-L68
+	// Synapse requires that the event origin has a valid signature.
+	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/federation/federation_base.py#L133-L136
+	// Since both domains must be valid domains, and there is no good reason for them
+	// to be different we might as well ensure that they are the same since it
+	// makes the signature checks simpler.
+	if e.fields.Origin != ServerName(eventDomain) {
+		return fmt.Errorf(
+			"gomatrixserverlib: event ID domain doesn't match origin: %q != %q",
+			eventDomain, e.fields.Origin,
+		)
+	}
+	return nil
+}
+
+// eventIDIsReferenceHash returns whether the event ID is derived from the
+// reference hash of the event, as in room versions 3 and later, rather than
+// chosen by the origin server. Such IDs don't have a server name.
+func eventIDIsReferenceHash(eventID string) bool {
+	return len(eventID) > 1 && eventID[0] == '$' && !strings.Contains(eventID, ":")
+}
+
+// withoutDerivedEventID removes the "event_id" key from the event JSON if the
+// event ID is derived from the reference hash of the event.
+func withoutDerivedEventID(eventJSON []byte) ([]byte, error) {
+	eventID := gjson.GetBytes(eventJSON, "event_id")
+	if eventID.Type != gjson.String || !eventIDIsReferenceHash(eventID.Str) {
+		return eventJSON, nil
+	}
+	return sjson.DeleteBytes(eventJSON, "event_id")
+}
+
 func checkID(id, kind string, sigil byte) (domain string, err error) {
 	domain, err = domainFromID(id)
 	if err != nil {
@@ -537,6 +722,33 @@ func (e Event) Unsigned() []byte {
 	return []byte(e.fields.Unsigned)
 }
 
+// PrevContent returns the "prev_content" from the unsigned data of the event,
+// which some servers include on state events to give the content of the
+// state event this event replaced.
+// The unsigned data isn't covered by the event signatures so this is only an
+// advisory hint that must not be trusted for auth or state decisions.
+// Returns false if the event has no "prev_content" object.
+func (e Event) PrevContent() (json.RawMessage, bool) {
+	prevContent := gjson.GetBytes(e.fields.Unsigned, "prev_content")
+	if !prevContent.IsObject() {
+		return nil, false
+	}
+	return json.RawMessage(prevContent.Raw), true
+}
+
+// ReplacesState returns the "replaces_state" from the unsigned data of the
+// event, which some servers include on state events to give the ID of the
+// state event this event replaced.
+// Like PrevContent this is an untrusted, advisory hint.
+// Returns false if the event has no "replaces_state" string.
+func (e Event) ReplacesState() (string, bool) {
+	replacesState := gjson.GetBytes(e.fields.Unsigned, "replaces_state")
+	if replacesState.Type != gjson.String {
+		return "", false
+	}
+	return replacesState.Str, true
+}
+
 // Content returns the content JSON of the event.
 func (e Event) Content() []byte {
 	return []byte(e.fields.Content)
@@ -602,8 +814,10 @@ func (e Event) Depth() int64 {
 
 // UnmarshalJSON implements json.Unmarshaller assuming the Event is from an untrusted source.
 // This will cause more checks than might be necessary but is probably better to be safe than sorry.
+// The data is copied since the event keeps references to it, and a
+// json.Decoder reuses its buffer for the next value.
 func (e *Event) UnmarshalJSON(data []byte) (err error) {
-	*e, err = NewEventFromUntrustedJSON(data)
+	*e, err = NewEventFromUntrustedJSON(append([]byte(nil), data...))
 	return
 }
 
@@ -616,7 +830,14 @@ func (e Event) MarshalJSON() ([]byte, error) {
 }
 
 // UnmarshalJSON implements json.Unmarshaller
+// Room versions 1 and 2 encode event references as a tuple of the event ID
+// and the reference hashes of the event. Later room versions encode them as
+// the bare event ID, in which case EventSHA256 is left empty.
 func (er *EventReference) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*er = EventReference{}
+		return json.Unmarshal(data, &er.EventID)
+	}
 	var tuple []RawJSON
 	if err := json.Unmarshal(data, &tuple); err != nil {
 		return err
@@ -638,6 +859,9 @@ func (er *EventReference) UnmarshalJSON(data []byte) error {
 }
 
 // MarshalJSON implements json.Marshaller
+// The reference is encoded as a tuple of the event ID and the reference hashes
+// of the event, as in room versions 1 and 2. EventBuilder encodes references
+// in the format of the room version the event is built for.
 func (er EventReference) MarshalJSON() ([]byte, error) {
 	hashes := struct {
 		SHA256 Base64String `json:"sha256"`
@@ -648,6 +872,24 @@ func (er EventReference) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&tuple)
 }
 
+// marshalEventReferences encodes the event references in the format of the
+// room version: as tuples where the origin server chooses the event ID, and as
+// bare event IDs where the event ID is derived from the event. A nil list is
+// encoded as an empty list.
+func marshalEventReferences(refs []EventReference, format EventIDFormat) (RawJSON, error) {
+	if format == EventIDFormatV1 {
+		if refs == nil {
+			refs = emptyEventReferenceList
+		}
+		return json.Marshal(refs)
+	}
+	eventIDs := make([]string, len(refs))
+	for i := range refs {
+		eventIDs[i] = refs[i].EventID
+	}
+	return json.Marshal(eventIDs)
+}
+
 // SplitID splits a matrix ID into a local part and a server name.
 func SplitID(sigil byte, id string) (local string, domain ServerName, err error) {
 	// IDs have the format: SIGIL LOCALPART ":" DOMAIN
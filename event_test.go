@@ -17,9 +17,27 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 )
 
+// testEvent loads an event from JSON for a test, failing the test if the
+// JSON isn't a valid event.
+func testEvent(t testing.TB, eventJSON string) Event {
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// testEventf loads an event for a test like testEvent, from JSON made by
+// formatting the arguments like fmt.Sprintf.
+func testEventf(t testing.TB, format string, args ...interface{}) Event {
+	return testEvent(t, fmt.Sprintf(format, args...))
+}
+
 func benchmarkParse(b *testing.B, eventJSON string) {
 	var event Event
 
@@ -79,3 +97,140 @@ func TestAddUnsignedField(t *testing.T) {
 		t.Fatalf("Serialized event does not match expected: %s != %s", string(bytes), initialEventJSON)
 	}
 }
+
+func TestPrevContentAndReplacesState(t *testing.T) {
+	event, err := NewEventFromTrustedJSON([]byte(`{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"leave"},"unsigned":{"prev_content":{"membership":"join"},"replaces_state":"$prev:domain"}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevContent, ok := event.PrevContent()
+	if !ok {
+		t.Fatal("PrevContent: expected prev_content to be present")
+	}
+	if want := `{"membership":"join"}`; string(prevContent) != want {
+		t.Errorf("PrevContent: want %s got %s", want, string(prevContent))
+	}
+	replacesState, ok := event.ReplacesState()
+	if !ok || replacesState != "$prev:domain" {
+		t.Errorf("ReplacesState: want %q got %q, %v", "$prev:domain", replacesState, ok)
+	}
+
+	for _, eventJSON := range []string{
+		`{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"join"},"unsigned":{"age":10}}`,
+		`{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"join"},"unsigned":{"prev_content":"join","replaces_state":1}}`,
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prevContent, ok := event.PrevContent(); ok {
+			t.Errorf("PrevContent(%s): expected no prev_content got %s", eventJSON, string(prevContent))
+		}
+		if replacesState, ok := event.ReplacesState(); ok {
+			t.Errorf("ReplacesState(%s): expected no replaces_state got %q", eventJSON, replacesState)
+		}
+	}
+}
+
+func TestEqualCanonical(t *testing.T) {
+	eventJSON := `{"auth_events":[["$oXL79cT7fFxR7dPH:localhost",{"sha256":"abjkiDSg1RkuZrbj2jZoGMlQaaj1Ue3Jhi7I7NlKfXY"}],["$IVUsaSkm1LBAZYYh:localhost",{"sha256":"X7RUj46hM/8sUHNBIFkStbOauPvbDzjSdH4NibYWnko"}],["$VS2QT0EeArZYi8wf:localhost",{"sha256":"k9eM6utkCH8vhLW9/oRsH74jOBS/6RVK42iGDFbylno"}]],"content":{"name":"test3"},"depth":7,"event_id":"$yvN1b43rlmcOs5fY:localhost","hashes":{"sha256":"Oh1mwI1jEqZ3tgJ+V1Dmu5nOEGpCE4RFUqyJv2gQXKs"},"origin":"localhost","origin_server_ts":1510854416361,"prev_events":[["$FqI6TVvWpcbcnJ97:localhost",{"sha256":"upCsBqUhNUgT2/+zkzg8TbqdQpWWKQnZpGJc6KcbUC4"}]],"prev_state":[],"room_id":"!19Mp0U9hjajeIiw1:localhost","sender":"@test:localhost","signatures":{"localhost":{"ed25519:u9kP":"5IzSuRXkxvbTp0vZhhXYZeOe+619iG3AybJXr7zfNn/4vHz4TH7qSJVQXSaHHvcTcDodAKHnTG1WDulgO5okAQ"}},"state_key":"","type":"m.room.name"}`
+	event, err := NewEventFromUntrustedJSON([]byte(eventJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Redacted() {
+		t.Fatal("NewEventFromUntrustedJSON: expected the event not to be redacted")
+	}
+
+	withUnsigned := event
+	if err = withUnsigned.SetUnsignedField("age", 10); err != nil {
+		t.Fatal(err)
+	}
+	withoutSignatures, err := NewEventFromTrustedJSON([]byte(strings.Replace(
+		eventJSON, `"localhost":{"ed25519:u9kP":"5IzSuRXkxvbTp0vZhhXYZeOe+619iG3AybJXr7zfNn/4vHz4TH7qSJVQXSaHHvcTcDodAKHnTG1WDulgO5okAQ"}`, `"other":{"ed25519:1":"c2lnbmF0dXJl"}`, 1,
+	)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	differentContent, err := NewEventFromTrustedJSON([]byte(strings.Replace(
+		eventJSON, `"name":"test3"`, `"name":"test4"`, 1,
+	)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	differentHashes, err := NewEventFromTrustedJSON([]byte(strings.Replace(
+		eventJSON, `"Oh1mwI1jEqZ3tgJ+V1Dmu5nOEGpCE4RFUqyJv2gQXKs"`, `"aGFzaA"`, 1,
+	)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	differentID, err := NewEventFromTrustedJSON([]byte(strings.Replace(
+		eventJSON, `"$yvN1b43rlmcOs5fY:localhost"`, `"$other:localhost"`, 1,
+	)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		other Event
+		want  bool
+	}{
+		{"same event", event, true},
+		{"different unsigned", withUnsigned, true},
+		{"different signatures", withoutSignatures, true},
+		{"redacted", event.Redact(), true},
+		{"different content", differentContent, false},
+		{"different hashes", differentHashes, false},
+		{"different event ID", differentID, false},
+	}
+	for _, test := range tests {
+		if got := event.EqualCanonical(test.other); got != test.want {
+			t.Errorf("EqualCanonical(%s): got %v, want %v", test.name, got, test.want)
+		}
+		if got := test.other.EqualCanonical(event); got != test.want {
+			t.Errorf("EqualCanonical(%s) reversed: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRedactForRoomVersion(t *testing.T) {
+	event, err := NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.member",
+		"state_key": "@u:a",
+		"event_id": "$join:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"content": {"membership": "join", "join_authorised_via_users_server": "@v:b", "displayname": "U"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 9 keeps the authorising user of a join, but version 1 doesn't,
+	// and neither keeps the display name.
+	for _, test := range []struct {
+		roomVersion RoomVersion
+		want        string
+	}{
+		{RoomVersionV1, `{"membership":"join"}`},
+		{RoomVersionV9, `{"join_authorised_via_users_server":"@v:b","membership":"join"}`},
+	} {
+		redacted, err := event.RedactForRoomVersion(test.roomVersion)
+		if err != nil {
+			t.Fatalf("RedactForRoomVersion(%s): %v", test.roomVersion, err)
+		}
+		if !redacted.Redacted() {
+			t.Errorf("RedactForRoomVersion(%s): wanted a redacted event", test.roomVersion)
+		}
+		if got := string(redacted.Content()); got != test.want {
+			t.Errorf("RedactForRoomVersion(%s): got content %s, want %s", test.roomVersion, got, test.want)
+		}
+	}
+
+	if _, err := event.RedactForRoomVersion("unknown"); err == nil {
+		t.Error("RedactForRoomVersion: wanted an error for an unknown room version")
+	}
+}
@@ -16,9 +16,10 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"sort"
 
 	"golang.org/x/crypto/ed25519"
 
@@ -36,6 +37,17 @@ const (
 	Invite = "invite"
 	// Public is the string constant "public"
 	Public = "public"
+	// Knock is the string constant "knock"
+	Knock = "knock"
+	// Private is the string constant "private"
+	Private = "private"
+	// Restricted is the string constant "restricted"
+	Restricted = "restricted"
+	// KnockRestricted is the string constant "knock_restricted"
+	KnockRestricted = "knock_restricted"
+	// MRoomMembership is the join rule allow condition type for membership
+	// of another room.
+	MRoomMembership = "m.room_membership"
 	// MRoomCreate https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-create
 	MRoomCreate = "m.room.create"
 	// MRoomJoinRules https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-join-rules
@@ -48,10 +60,14 @@ const (
 	MRoomThirdPartyInvite = "m.room.third_party_invite"
 	// MRoomAliases https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-aliases
 	MRoomAliases = "m.room.aliases"
+	// MRoomCanonicalAlias https://matrix.org/docs/spec/client_server/r0.6.0#m-room-canonical-alias
+	MRoomCanonicalAlias = "m.room.canonical_alias"
 	// MRoomHistoryVisibility https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-history-visibility
 	MRoomHistoryVisibility = "m.room.history_visibility"
 	// MRoomRedaction https://matrix.org/docs/spec/client_server/r0.2.0.html#id21
 	MRoomRedaction = "m.room.redaction"
+	// MRoomTombstone https://matrix.org/docs/spec/client_server/r0.5.0#m-room-tombstone
+	MRoomTombstone = "m.room.tombstone"
 	// MTyping https://matrix.org/docs/spec/client_server/r0.3.0.html#m-typing
 	MTyping = "m.typing"
 )
@@ -199,6 +215,9 @@ func accumulateStateNeeded(result *StateNeeded, eventType, sender string, stateK
 		//    https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L370
 		//  * And optionally may require a m.third_party_invite event
 		//    https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L393
+		//  * The membership of the user that authorised a join to a
+		//    restricted room.
+		//    https://matrix.org/docs/spec/rooms/v8#authorization-rules
 		if content == nil {
 			err = errorf("missing memberContent for m.room.member event")
 			return
@@ -210,6 +229,9 @@ func accumulateStateNeeded(result *StateNeeded, eventType, sender string, stateK
 		}
 		if content.Membership == Join {
 			result.JoinRules = true
+			if content.AuthorisedVia != "" {
+				result.Member = append(result.Member, content.AuthorisedVia)
+			}
 		}
 		if content.ThirdPartyInvite != nil {
 			token, tokErr := thirdPartyInviteToken(content.ThirdPartyInvite)
@@ -242,6 +264,10 @@ func thirdPartyInviteToken(thirdPartyInvite *MemberThirdPartyInvite) (string, er
 }
 
 // AuthEventProvider provides auth_events for the authentication checks.
+// If a provider only knows some of the state of the room, for example after
+// a partial state join, then it should return an ErrAuthEventUnknown for
+// state it doesn't know about, rather than nil, since a missing event changes
+// the result of the checks.
 type AuthEventProvider interface {
 	// Create returns the m.room.create event for the room or nil if there isn't a m.room.create event.
 	Create() (*Event, error)
@@ -256,13 +282,32 @@ type AuthEventProvider interface {
 	ThirdPartyInvite(stateKey string) (*Event, error)
 }
 
+// An ErrAuthEventUnknown is returned by an AuthEventProvider when it doesn't
+// know whether there is an event for some state, for example because the
+// state of the room hasn't been fully loaded yet. Allowed returns it when the
+// result of the checks depends on that state, so that the event can be
+// checked again once the state is complete.
+type ErrAuthEventUnknown struct {
+	StateKeyTuple
+}
+
+func (e ErrAuthEventUnknown) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: state (%q, %q) is not known yet", e.EventType, e.StateKey)
+}
+
 // AuthEvents is an implementation of AuthEventProvider backed by a map.
+// It is safe to read from multiple goroutines at once, for example to check
+// several events against the same state with Allowed, as long as no events
+// are added and it isn't cleared while it is being read.
 type AuthEvents struct {
 	events map[StateKeyTuple]*Event
+	// If partial is true then only the state in events or absent is known.
+	partial bool
+	absent  map[StateKeyTuple]bool
 }
 
 // AddEvent adds an event to the provider. If an event already existed for the (type, state_key) then
-// the event is replaced with the new event. Only returns an error if the event is not a state event.
+// the event is replaced with the new event. Returns an error if the event is not a state event.
 func (a *AuthEvents) AddEvent(event *Event) error {
 	if event.StateKey() == nil {
 		return fmt.Errorf("AddEvent: event %q does not have a state key", event.Type())
@@ -271,44 +316,102 @@ func (a *AuthEvents) AddEvent(event *Event) error {
 	return nil
 }
 
+// AddAbsent records that there is no event for the type and state key, for
+// providers created with NewPartialAuthEvents.
+func (a *AuthEvents) AddAbsent(eventType, stateKey string) {
+	if a.absent == nil {
+		a.absent = make(map[StateKeyTuple]bool)
+	}
+	a.absent[StateKeyTuple{eventType, stateKey}] = true
+}
+
+// lookup returns the event for the tuple, nil if there isn't one, or an
+// ErrAuthEventUnknown if the provider is partial and doesn't know.
+func (a *AuthEvents) lookup(tuple StateKeyTuple) (*Event, error) {
+	event := a.events[tuple]
+	if event == nil && a.partial && !a.absent[tuple] {
+		return nil, ErrAuthEventUnknown{tuple}
+	}
+	return event, nil
+}
+
+// Clear removes all the events from the provider so that it can be reused,
+// keeping the memory it has allocated. It must not be called while other
+// goroutines may be reading the events.
+func (a *AuthEvents) Clear() {
+	for tuple := range a.events {
+		delete(a.events, tuple)
+	}
+	for tuple := range a.absent {
+		delete(a.absent, tuple)
+	}
+}
+
 // Create implements AuthEventProvider
 func (a *AuthEvents) Create() (*Event, error) {
-	return a.events[StateKeyTuple{MRoomCreate, ""}], nil
+	return a.lookup(StateKeyTuple{MRoomCreate, ""})
 }
 
 // JoinRules implements AuthEventProvider
 func (a *AuthEvents) JoinRules() (*Event, error) {
-	return a.events[StateKeyTuple{MRoomJoinRules, ""}], nil
+	return a.lookup(StateKeyTuple{MRoomJoinRules, ""})
 }
 
 // PowerLevels implements AuthEventProvider
 func (a *AuthEvents) PowerLevels() (*Event, error) {
-	return a.events[StateKeyTuple{MRoomPowerLevels, ""}], nil
+	return a.lookup(StateKeyTuple{MRoomPowerLevels, ""})
 }
 
 // Member implements AuthEventProvider
 func (a *AuthEvents) Member(stateKey string) (*Event, error) {
-	return a.events[StateKeyTuple{MRoomMember, stateKey}], nil
+	return a.lookup(StateKeyTuple{MRoomMember, stateKey})
 }
 
 // ThirdPartyInvite implements AuthEventProvider
 func (a *AuthEvents) ThirdPartyInvite(stateKey string) (*Event, error) {
-	return a.events[StateKeyTuple{MRoomThirdPartyInvite, stateKey}], nil
+	return a.lookup(StateKeyTuple{MRoomThirdPartyInvite, stateKey})
 }
 
 // NewAuthEvents returns an AuthEventProvider backed by the given events. New events can be added by
 // calling AddEvent().
 func NewAuthEvents(events []*Event) AuthEvents {
-	a := AuthEvents{make(map[StateKeyTuple]*Event)}
+	a := NewAuthEventsWithCapacity(len(events))
 	for _, e := range events {
 		a.AddEvent(e) // nolint: errcheck
 	}
 	return a
 }
 
+// NewPartialAuthEvents returns an AuthEventProvider backed by the given events
+// for when only some of the state of the room is known. Looking up state that
+// hasn't been added with AddEvent or AddAbsent returns an ErrAuthEventUnknown.
+func NewPartialAuthEvents(events []*Event) AuthEvents {
+	a := NewAuthEvents(events)
+	a.partial = true
+	return a
+}
+
+// NewAuthEventsWithCapacity returns an empty AuthEventProvider with space for
+// the given number of events. Events can be added by calling AddEvent().
+func NewAuthEventsWithCapacity(capacity int) AuthEvents {
+	return AuthEvents{events: make(map[StateKeyTuple]*Event, capacity)}
+}
+
 // A NotAllowed error is returned if an event does not pass the auth checks.
 type NotAllowed struct {
 	Message string
+	// The fields below are only set when a membership change was rejected
+	// because the sender's power level was too low. Action is the kind of
+	// change that was attempted: "ban", "unban", "kick" or "invite".
+	Action string
+	// The power level of the sender of the event.
+	SenderLevel int64
+	// The power level of the user whose membership was being changed.
+	// Only set for bans and kicks, which require the sender to have a higher
+	// level than the target.
+	TargetLevel int64
+	// The power level needed to perform the action.
+	RequiredLevel int64
 }
 
 func (a *NotAllowed) Error() string {
@@ -319,10 +422,79 @@ func errorf(message string, args ...interface{}) error {
 	return &NotAllowed{Message: fmt.Sprintf(message, args...)}
 }
 
+// A ContextAuthEventProvider is an AuthEventProvider that can use a context
+// for its lookups, for example to cancel database queries.
+type ContextAuthEventProvider interface {
+	AuthEventProvider
+	// WithContext returns an AuthEventProvider that uses the context for
+	// its lookups.
+	WithContext(ctx context.Context) AuthEventProvider
+}
+
+// contextAuthEvents wraps an AuthEventProvider so that lookups fail once the
+// context is done. The checks load the auth events they need as they go, so
+// this stops the checks between each step.
+type contextAuthEvents struct {
+	ctx        context.Context
+	authEvents AuthEventProvider
+}
+
+func (c contextAuthEvents) Create() (*Event, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.authEvents.Create()
+}
+
+func (c contextAuthEvents) JoinRules() (*Event, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.authEvents.JoinRules()
+}
+
+func (c contextAuthEvents) PowerLevels() (*Event, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.authEvents.PowerLevels()
+}
+
+func (c contextAuthEvents) Member(stateKey string) (*Event, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.authEvents.Member(stateKey)
+}
+
+func (c contextAuthEvents) ThirdPartyInvite(stateKey string) (*Event, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.authEvents.ThirdPartyInvite(stateKey)
+}
+
 // Allowed checks whether an event is allowed by the auth events.
 // It returns a NotAllowed error if the event is not allowed.
 // If there was an error loading the auth events then it returns that error.
 func Allowed(event Event, authEvents AuthEventProvider) error {
+	return AllowedWithContext(context.Background(), event, authEvents)
+}
+
+// AllowedWithContext checks whether an event is allowed by the auth events
+// like Allowed, but stops with the context's error if the context is done
+// before the checks finish. If the provider is a ContextAuthEventProvider then
+// its lookups use the context.
+func AllowedWithContext(ctx context.Context, event Event, authEvents AuthEventProvider) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if provider, ok := authEvents.(ContextAuthEventProvider); ok {
+		authEvents = provider.WithContext(ctx)
+	}
+	if ctx.Done() != nil {
+		authEvents = contextAuthEvents{ctx, authEvents}
+	}
 	switch event.Type() {
 	case MRoomCreate:
 		return createEventAllowed(event)
@@ -334,6 +506,8 @@ func Allowed(event Event, authEvents AuthEventProvider) error {
 		return powerLevelsEventAllowed(event, authEvents)
 	case MRoomRedaction:
 		return redactEventAllowed(event, authEvents)
+	case MRoomThirdPartyInvite:
+		return thirdPartyInviteEventAllowed(event, authEvents)
 	default:
 		return defaultEventAllowed(event, authEvents)
 	}
@@ -424,19 +598,19 @@ func powerLevelsEventAllowed(event Event, authEvents AuthEventProvider) error {
 		return err
 	}
 
-	// Parse the power levels.
-	newPowerLevels, err := NewPowerLevelContentFromEvent(event)
-	if err != nil {
-		return err
+	// Rooms of an unknown version are treated leniently, as version 1 rooms.
+	desc, derr := allower.create.roomVersion().description()
+	if derr != nil {
+		desc, _ = RoomVersionV1.description()
 	}
 
-	// Check that the user levels are all valid user IDs
-	// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L1063
-	for userID := range newPowerLevels.Users {
-		if !isValidUserID(userID) {
-			return errorf("Not a valid user ID: %q", userID)
-		}
+	// Parse the power levels, checking them against the rules of the room
+	// version.
+	newPowerLevels, outOfRange, err := parsePowerLevelContentForVersion(event.Content(), desc)
+	if err != nil {
+		return err
 	}
+	warnClampedPowerLevels(event, outOfRange)
 
 	// Grab the old power level event so that we can check if the event existed.
 	var oldEvent *Event
@@ -493,7 +667,7 @@ func checkEventLevels(senderLevel int64, oldPowerLevels, newPowerLevels PowerLev
 	const (
 		isStateEvent = false
 	)
-	for eventType := range newPowerLevels.Events {
+	for _, eventType := range sortedLevelKeys(newPowerLevels.Events) {
 		levelChecks = append(levelChecks, levelPair{
 			oldPowerLevels.EventLevel(eventType, isStateEvent),
 			newPowerLevels.EventLevel(eventType, isStateEvent),
@@ -503,7 +677,7 @@ func checkEventLevels(senderLevel int64, oldPowerLevels, newPowerLevels PowerLev
 	// Then add checks for each event key in the old levels.
 	// Some of these will be duplicates of the ones added using the keys from
 	// the new levels. But it doesn't hurt to run the checks twice for the same level.
-	for eventType := range oldPowerLevels.Events {
+	for _, eventType := range sortedLevelKeys(oldPowerLevels.Events) {
 		levelChecks = append(levelChecks, levelPair{
 			oldPowerLevels.EventLevel(eventType, isStateEvent),
 			newPowerLevels.EventLevel(eventType, isStateEvent),
@@ -545,6 +719,18 @@ func checkEventLevels(senderLevel int64, oldPowerLevels, newPowerLevels PowerLev
 	return nil
 }
 
+// sortedLevelKeys returns the keys of the levels in order, so that the levels
+// are checked in the same order each time and the same events are always
+// rejected with the same reason.
+func sortedLevelKeys(levels map[string]int64) []string {
+	keys := make([]string, 0, len(levels))
+	for key := range levels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // checkUserLevels checks that the changes in user levels are allowed.
 func checkUserLevels(senderLevel int64, senderID string, oldPowerLevels, newPowerLevels PowerLevelContent) error {
 	type levelPair struct {
@@ -563,7 +749,7 @@ func checkUserLevels(senderLevel int64, senderID string, oldPowerLevels, newPowe
 	}
 
 	// Then add checks for each user key in the new levels.
-	for userID := range newPowerLevels.Users {
+	for _, userID := range sortedLevelKeys(newPowerLevels.Users) {
 		userLevelChecks = append(userLevelChecks, levelPair{
 			oldPowerLevels.UserLevel(userID), newPowerLevels.UserLevel(userID), userID,
 		})
@@ -572,7 +758,7 @@ func checkUserLevels(senderLevel int64, senderID string, oldPowerLevels, newPowe
 	// Then add checks for each user key in the old levels.
 	// Some of these will be duplicates of the ones added using the keys from
 	// the new levels. But it doesn't hurt to run the checks twice for the same level.
-	for userID := range oldPowerLevels.Users {
+	for _, userID := range sortedLevelKeys(oldPowerLevels.Users) {
 		userLevelChecks = append(userLevelChecks, levelPair{
 			oldPowerLevels.UserLevel(userID), newPowerLevels.UserLevel(userID), userID,
 		})
@@ -697,6 +883,45 @@ func defaultEventAllowed(event Event, authEvents AuthEventProvider) error {
 	return allower.commonChecks(event)
 }
 
+// thirdPartyInviteEventAllowed checks whether the m.room.third_party_invite
+// event is allowed. Third party invites can be turned into invites, so the
+// sender needs the level needed to invite users, rather than the level for
+// sending the state event.
+// https://matrix.org/docs/spec/rooms/v1#authorization-rules
+func thirdPartyInviteEventAllowed(event Event, authEvents AuthEventProvider) error {
+	allower, err := newEventAllower(authEvents, event.Sender())
+	if err != nil {
+		return err
+	}
+
+	if event.RoomID() != allower.create.roomID {
+		return errorf("create event has different roomID: %q != %q", event.RoomID(), allower.create.roomID)
+	}
+
+	sender := event.Sender()
+	if err = allower.create.UserIDAllowed(sender); err != nil {
+		return err
+	}
+
+	if allower.member.Membership != Join {
+		return errorf("sender %q not in room", sender)
+	}
+
+	senderLevel := allower.powerLevels.UserLevel(sender)
+	if senderLevel < allower.powerLevels.Invite {
+		return &NotAllowed{
+			Message: fmt.Sprintf(
+				"sender %q has level %d but third party invite requires %d",
+				sender, senderLevel, allower.powerLevels.Invite,
+			),
+			Action:        "invite",
+			SenderLevel:   senderLevel,
+			RequiredLevel: allower.powerLevels.Invite,
+		}
+	}
+	return nil
+}
+
 // An eventAllower has the information needed to authorise all events types
 // other than m.room.create, m.room.member and m.room.aliases which are special.
 type eventAllower struct {
@@ -790,6 +1015,8 @@ type membershipAllower struct {
 	joinRule JoinRuleContent
 	// The m.room.third_party_invite content referenced by this event.
 	thirdPartyInvite ThirdPartyInviteContent
+	// The membership of the user that authorised a join to a restricted room.
+	authoriserMember MemberContent
 }
 
 // newMembershipAllower loads the information needed to authenticate the m.room.member event
@@ -823,6 +1050,11 @@ func newMembershipAllower(authEvents AuthEventProvider, event Event) (m membersh
 		if m.joinRule, err = NewJoinRuleContentFromAuthEvents(authEvents); err != nil {
 			return
 		}
+		if m.newMember.AuthorisedVia != "" {
+			if m.authoriserMember, err = NewMemberContentFromAuthEvents(authEvents, m.newMember.AuthorisedVia); err != nil {
+				return
+			}
+		}
 	}
 	// If this event comes from a third_party_invite, we need to check it against the original event.
 	if m.newMember.ThirdPartyInvite != nil {
@@ -869,13 +1101,30 @@ func (m *membershipAllower) membershipAllowed(event Event) error { // nolint: go
 		return m.membershipAllowedFromThirdPartyInvite()
 	}
 
-	if m.targetID == m.senderID {
-		// If the state_key and the sender are the same then this is an attempt
-		// by a user to update their own membership.
-		return m.membershipAllowedSelf()
+	return CheckMembershipTransition(m.transitionParams())
+}
+
+// transitionParams returns the parameters for checking the membership change
+// with CheckMembershipTransition.
+func (m *membershipAllower) transitionParams() MembershipTransitionParams {
+	return MembershipTransitionParams{
+		RoomVersion:      m.create.roomVersion(),
+		SenderID:         m.senderID,
+		TargetID:         m.targetID,
+		SenderIsTarget:   m.senderID == m.targetID,
+		SenderMembership: m.senderMember.Membership,
+		OldMembership:    m.oldMember.Membership,
+		NewMembership:    m.newMember.Membership,
+		SenderLevel:      m.powerLevels.UserLevel(m.senderID),
+		TargetLevel:      m.powerLevels.UserLevel(m.targetID),
+		BanLevel:         m.powerLevels.Ban,
+		KickLevel:        m.powerLevels.Kick,
+		InviteLevel:      m.powerLevels.Invite,
+		JoinRule:         m.joinRule.JoinRule,
+		RestrictedJoinAuthorised: m.newMember.AuthorisedVia != "" &&
+			m.authoriserMember.Membership == Join &&
+			m.powerLevels.UserLevel(m.newMember.AuthorisedVia) >= m.powerLevels.Invite,
 	}
-	// Otherwise this is an attempt to modify the membership of somebody else.
-	return m.membershipAllowedOther()
 }
 
 // membershipAllowedFronThirdPartyInvite determines if the member events is following
@@ -899,7 +1148,7 @@ func (m *membershipAllower) membershipAllowedFromThirdPartyInvite() error {
 	for _, publicKey := range m.thirdPartyInvite.PublicKeys {
 		for domain, signatures := range m.newMember.ThirdPartyInvite.Signed.Signatures {
 			for keyID := range signatures {
-				if strings.HasPrefix(keyID, "ed25519") {
+				if algorithm, _, perr := ParseKeyID(keyID); perr == nil && algorithm == "ed25519" {
 					if err = VerifyJSON(
 						domain, KeyID(keyID),
 						ed25519.PublicKey(publicKey.PublicKey),
@@ -914,101 +1163,200 @@ func (m *membershipAllower) membershipAllowedFromThirdPartyInvite() error {
 	return errorf("Couldn't verify signature on third-party invite for %s", m.targetID)
 }
 
-// membershipAllowedSelf determines if the change made by the user to their own membership is allowed.
-func (m *membershipAllower) membershipAllowedSelf() error { // nolint: gocyclo
-	if m.newMember.Membership == Join {
+// MembershipTransitionParams describes a change to the membership of a user
+// in a room, along with the parts of the room state that decide whether the
+// change is allowed.
+type MembershipTransitionParams struct {
+	// The version of the room. Only room versions with restricted joins allow
+	// joins authorised by RestrictedJoinAuthorised.
+	RoomVersion RoomVersion
+	// The user ID of the user making the change. Only used in errors.
+	SenderID string
+	// The user ID of the user whose membership is changing. Only used in errors.
+	TargetID string
+	// Whether the user is changing their own membership.
+	SenderIsTarget bool
+	// The current membership of the sender. Ignored if SenderIsTarget is true.
+	SenderMembership string
+	// The current membership of the target. Users who have never been in the
+	// room have a membership of "leave".
+	OldMembership string
+	// The proposed membership of the target.
+	NewMembership string
+	// The power level of the sender.
+	SenderLevel int64
+	// The power level of the target.
+	TargetLevel int64
+	// The power levels needed to ban, kick and invite users.
+	BanLevel    int64
+	KickLevel   int64
+	InviteLevel int64
+	// The join rule of the room.
+	JoinRule string
+	// Whether the user named in the "join_authorised_via_users_server" of a
+	// join is joined to the room and has the power to invite users, so can
+	// authorise joins to a room with a restricted join rule.
+	RestrictedJoinAuthorised bool
+}
+
+// CheckMembershipTransition checks whether the membership change is allowed
+// by the membership rules of the room, without needing a membership event.
+// Returns a *NotAllowed error if the change isn't allowed.
+// Allowed uses this to check m.room.member events, after handling the creator
+// joining the room and third party invites.
+func CheckMembershipTransition(params MembershipTransitionParams) error {
+	if params.SenderIsTarget {
+		// If the state_key and the sender are the same then this is an attempt
+		// by a user to update their own membership.
+		return params.allowedSelf()
+	}
+	// Otherwise this is an attempt to modify the membership of somebody else.
+	return params.allowedOther()
+}
+
+// allowedSelf determines if the change made by the user to their own membership is allowed.
+func (p *MembershipTransitionParams) allowedSelf() error { // nolint: gocyclo
+	if p.NewMembership == Join {
 		// A user that is not in the room is allowed to join if the room
 		// join rules are "public".
-		if m.oldMember.Membership == Leave && m.joinRule.JoinRule == Public {
+		if p.OldMembership == Leave && p.JoinRule == Public {
 			return nil
 		}
 		// An invited user is allowed to join if the join rules are "public"
-		if m.oldMember.Membership == Invite && m.joinRule.JoinRule == Public {
+		if p.OldMembership == Invite && p.JoinRule == Public {
 			return nil
 		}
 		// An invited user is allowed to join if the join rules are "invite"
-		if m.oldMember.Membership == Invite && m.joinRule.JoinRule == Invite {
+		if p.OldMembership == Invite && p.JoinRule == Invite {
 			return nil
 		}
+		// In room versions with restricted joins, a user is allowed to join
+		// a room with a restricted join rule if they were invited or if a
+		// user in the room authorised the join.
+		// https://matrix.org/docs/spec/rooms/v8#authorization-rules
+		if (p.JoinRule == Restricted || p.JoinRule == KnockRestricted) && p.restrictedJoins() {
+			if p.OldMembership == Invite || (p.OldMembership != Ban && p.RestrictedJoinAuthorised) {
+				return nil
+			}
+		}
 		// A joined user is allowed to update their join.
-		if m.oldMember.Membership == Join {
+		if p.OldMembership == Join {
 			return nil
 		}
 	}
-	if m.newMember.Membership == Leave {
+	if p.NewMembership == Leave {
 		// A joined user is allowed to leave the room.
-		if m.oldMember.Membership == Join {
+		if p.OldMembership == Join {
 			return nil
 		}
 		// An invited user is allowed to reject an invite.
-		if m.oldMember.Membership == Invite {
+		if p.OldMembership == Invite {
 			return nil
 		}
 	}
-	return m.membershipFailed()
+	return p.failed()
 }
 
-// membershipAllowedOther determines if the user is allowed to change the membership of another user.
-func (m *membershipAllower) membershipAllowedOther() error { // nolint: gocyclo
-	senderLevel := m.powerLevels.UserLevel(m.senderID)
-	targetLevel := m.powerLevels.UserLevel(m.targetID)
-
+// allowedOther determines if the user is allowed to change the membership of another user.
+func (p *MembershipTransitionParams) allowedOther() error { // nolint: gocyclo
 	// You may only modify the membership of another user if you are in the room.
-	if m.senderMember.Membership != Join {
-		return errorf("sender %q is not in the room", m.senderID)
+	if p.SenderMembership != Join {
+		return errorf("sender %q is not in the room", p.SenderID)
 	}
 
-	if m.newMember.Membership == Ban {
+	switch p.NewMembership {
+	case Ban:
 		// A user may ban another user if their level is high enough
 		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L463
-		if senderLevel >= m.powerLevels.Ban &&
-			senderLevel > targetLevel {
-			return nil
+		if p.SenderLevel < p.BanLevel {
+			return p.insufficientPower("ban", p.BanLevel)
 		}
-	}
-	if m.newMember.Membership == Leave {
+		if p.SenderLevel <= p.TargetLevel {
+			return p.targetPowerTooHigh("ban", p.BanLevel)
+		}
+		return nil
+	case Leave:
 		// A user may unban another user if their level is high enough.
 		// This is doesn't require the same power_level checks as banning.
 		// You can unban someone with higher power_level than you.
 		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L451
-		if m.oldMember.Membership == Ban && senderLevel >= m.powerLevels.Ban {
+		if p.OldMembership == Ban {
+			if p.SenderLevel < p.BanLevel {
+				return p.insufficientPower("unban", p.BanLevel)
+			}
 			return nil
 		}
 		// A user may kick another user if their level is high enough.
 		// TODO: You can kick a user that was already kicked, or has left the room, or was
 		// never in the room in the first place. Do we want to allow these redundant kicks?
-		if m.oldMember.Membership != Ban &&
-			senderLevel >= m.powerLevels.Kick &&
-			senderLevel > targetLevel {
-			return nil
+		if p.SenderLevel < p.KickLevel {
+			return p.insufficientPower("kick", p.KickLevel)
 		}
-	}
-	if m.newMember.Membership == Invite {
+		if p.SenderLevel <= p.TargetLevel {
+			return p.targetPowerTooHigh("kick", p.KickLevel)
+		}
+		return nil
+	case Invite:
 		// A user may invite another user if the user has left the room.
 		// and their level is high enough.
-		if m.oldMember.Membership == Leave && senderLevel >= m.powerLevels.Invite {
-			return nil
-		}
-		// A user may re-invite a user.
-		if m.oldMember.Membership == Invite && senderLevel >= m.powerLevels.Invite {
+		// A user may also re-invite a user.
+		if p.OldMembership == Leave || p.OldMembership == Invite {
+			if p.SenderLevel < p.InviteLevel {
+				return p.insufficientPower("invite", p.InviteLevel)
+			}
 			return nil
 		}
 	}
 
-	return m.membershipFailed()
+	return p.failed()
+}
+
+// insufficientPower returns an error explaining that the sender's power level
+// is below the level required for the action.
+func (p *MembershipTransitionParams) insufficientPower(action string, requiredLevel int64) error {
+	return &NotAllowed{
+		Message: fmt.Sprintf(
+			"sender %q has level %d but %s requires %d",
+			p.SenderID, p.SenderLevel, action, requiredLevel,
+		),
+		Action:        action,
+		SenderLevel:   p.SenderLevel,
+		RequiredLevel: requiredLevel,
+	}
+}
+
+// targetPowerTooHigh returns an error explaining that the sender's power level
+// isn't above the power level of the target of the action.
+func (p *MembershipTransitionParams) targetPowerTooHigh(action string, requiredLevel int64) error {
+	return &NotAllowed{
+		Message: fmt.Sprintf(
+			"sender %q has level %d but %s requires a level above the level %d of %q",
+			p.SenderID, p.SenderLevel, action, p.TargetLevel, p.TargetID,
+		),
+		Action:        action,
+		SenderLevel:   p.SenderLevel,
+		TargetLevel:   p.TargetLevel,
+		RequiredLevel: requiredLevel,
+	}
+}
+
+// restrictedJoins returns whether the room version has restricted joins.
+func (p *MembershipTransitionParams) restrictedJoins() bool {
+	desc, err := p.RoomVersion.description()
+	return err == nil && desc.restrictedJoins
 }
 
-// membershipFailed returns a error explaining why the membership change was disallowed.
-func (m *membershipAllower) membershipFailed() error {
-	if m.senderID == m.targetID {
+// failed returns a error explaining why the membership change was disallowed.
+func (p *MembershipTransitionParams) failed() error {
+	if p.SenderIsTarget {
 		return errorf(
 			"%q is not allowed to change their membership from %q to %q",
-			m.targetID, m.oldMember.Membership, m.newMember.Membership,
+			p.TargetID, p.OldMembership, p.NewMembership,
 		)
 	}
 
 	return errorf(
 		"%q is not allowed to change the membership of %q from %q to %q",
-		m.senderID, m.targetID, m.oldMember.Membership, m.newMember.Membership,
+		p.SenderID, p.TargetID, p.OldMembership, p.NewMembership,
 	)
 }
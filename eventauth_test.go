@@ -16,7 +16,9 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -265,6 +267,95 @@ func (tae *testAuthEvents) ThirdPartyInvite(stateKey string) (*Event, error) {
 	return &event, nil
 }
 
+// contextTestAuthEvents records the contexts passed to WithContext and runs
+// a hook before each lookup.
+type contextTestAuthEvents struct {
+	testAuthEvents
+	contexts []context.Context
+	onLookup func()
+}
+
+func (c *contextTestAuthEvents) WithContext(ctx context.Context) AuthEventProvider {
+	c.contexts = append(c.contexts, ctx)
+	return c
+}
+
+func (c *contextTestAuthEvents) Create() (*Event, error) {
+	c.onLookup()
+	return c.testAuthEvents.Create()
+}
+
+func (c *contextTestAuthEvents) Member(stateKey string) (*Event, error) {
+	c.onLookup()
+	return c.testAuthEvents.Member(stateKey)
+}
+
+func TestAllowedWithContext(t *testing.T) {
+	var authEvents contextTestAuthEvents
+	if err := json.Unmarshal([]byte(`{
+		"create": {
+			"type": "m.room.create",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e1:a",
+			"content": {"creator": "@u1:a"}
+		},
+		"member": {
+			"@u1:a": {
+				"type": "m.room.member",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"state_key": "@u1:a",
+				"event_id": "$e2:a",
+				"content": {"membership": "join"}
+			}
+		}
+	}`), &authEvents.testAuthEvents); err != nil {
+		t.Fatal(err)
+	}
+	authEvents.onLookup = func() {}
+	event, err := NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.message",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"content": {"body": "Test"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = AllowedWithContext(ctx, event, &authEvents); err != nil {
+		t.Fatalf("AllowedWithContext: unexpected error: %s", err)
+	}
+	if len(authEvents.contexts) != 1 || authEvents.contexts[0] != ctx {
+		t.Fatalf("AllowedWithContext: want the provider to get the context, got %v", authEvents.contexts)
+	}
+
+	// Cancelling the context during the checks stops them at the next lookup.
+	lookups := 0
+	authEvents.onLookup = func() {
+		lookups++
+		cancel()
+	}
+	if err = AllowedWithContext(ctx, event, &authEvents); err != context.Canceled {
+		t.Fatalf("AllowedWithContext: want %v, got %v", context.Canceled, err)
+	}
+	if lookups != 1 {
+		t.Fatalf("AllowedWithContext: want 1 lookup before stopping, got %d", lookups)
+	}
+
+	// A context that is already done stops the checks before they start.
+	if err = AllowedWithContext(ctx, event, &authEvents); err != context.Canceled {
+		t.Fatalf("AllowedWithContext: want %v, got %v", context.Canceled, err)
+	}
+	if lookups != 1 {
+		t.Fatalf("AllowedWithContext: want no more lookups, got %d", lookups-1)
+	}
+}
+
 type testCase struct {
 	AuthEvents testAuthEvents    `json:"auth_events"`
 	Allowed    []json.RawMessage `json:"allowed"`
@@ -543,6 +634,392 @@ func TestAllowedWithNoPowerLevels(t *testing.T) {
 	}`)
 }
 
+func TestAllowedSecondEventInNewRoom(t *testing.T) {
+	// In a room without a m.room.power_levels event the creator has level
+	// 100 and state events only need level 0.
+	testEventAllowed(t, `{
+		"auth_events": {
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a"}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e2:a",
+					"content": {"membership": "join"}
+				},
+				"@u2:a": {
+					"type": "m.room.member",
+					"sender": "@u2:a",
+					"room_id": "!r1:a",
+					"state_key": "@u2:a",
+					"event_id": "$e3:a",
+					"content": {"membership": "join"}
+				}
+			}
+		},
+		"allowed": [{
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e4:a",
+			"content": {"users": {"@u1:a": 100}}
+		}, {
+			"type": "m.room.name",
+			"state_key": "",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"event_id": "$e5:a",
+			"content": {"name": "Anyone can do this without power levels"}
+		}],
+		"not_allowed": [{
+			"type": "m.room.member",
+			"state_key": "@u1:a",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"event_id": "$e6:a",
+			"content": {"membership": "leave"},
+			"unsigned": {
+				"not_allowed": "Only the creator has the level needed to kick"
+			}
+		}]
+	}`)
+}
+
+func TestAllowedSecondEventInNewRoomImplicitCreator(t *testing.T) {
+	// In room version 11 the creator is the sender of the create event.
+	testEventAllowed(t, `{
+		"auth_events": {
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"room_version": "11", "creator": "@u2:a"}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e2:a",
+					"content": {"membership": "join"}
+				},
+				"@u2:a": {
+					"type": "m.room.member",
+					"sender": "@u2:a",
+					"room_id": "!r1:a",
+					"state_key": "@u2:a",
+					"event_id": "$e3:a",
+					"content": {"membership": "join"}
+				}
+			}
+		},
+		"allowed": [{
+			"type": "m.room.member",
+			"state_key": "@u2:a",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e4:a",
+			"content": {"membership": "leave"}
+		}],
+		"not_allowed": [{
+			"type": "m.room.member",
+			"state_key": "@u1:a",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"event_id": "$e5:a",
+			"content": {"membership": "leave"},
+			"unsigned": {
+				"not_allowed": "The creator key is ignored in room version 11"
+			}
+		}]
+	}`)
+}
+
+func TestDefaultsForRoomWithoutPLEvent(t *testing.T) {
+	c := DefaultsForRoomWithoutPLEvent("@u1:a")
+	if c.UserLevel("@u1:a") != 100 || c.UserLevel("@u2:a") != 0 {
+		t.Errorf("user levels: want 100 and 0 got %d and %d", c.UserLevel("@u1:a"), c.UserLevel("@u2:a"))
+	}
+	if level := c.EventLevel("m.room.name", true); level != 0 {
+		t.Errorf("state event level: want 0 got %d", level)
+	}
+
+	var withEvent PowerLevelContent
+	withEvent.Defaults()
+	if level := withEvent.EventLevel("m.room.name", true); level != 50 {
+		t.Errorf("state event level with a power levels event: want 50 got %d", level)
+	}
+}
+
+func TestAllowedPowerLevelBounds(t *testing.T) {
+	authEvents := func(roomVersion string) string {
+		return `{
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a", "room_version": "` + roomVersion + `"}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e2:a",
+					"content": {"membership": "join"}
+				}
+			}
+		}`
+	}
+	inRange := `{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"content": {"users": {"@u1:a": 9007199254740991}, "ban": -9007199254740991}
+	}`
+	outOfRange := `{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e4:a",
+		"content": {"users": {"@u1:a": 9223372036854775807}}
+	}, {
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e5:a",
+		"content": {"events": {"m.room.name": -1e30}}
+	}`
+
+	// Room versions that enforce canonical JSON reject levels outside the
+	// canonical JSON integer range.
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents("6")+`,
+		"allowed": [`+inRange+`],
+		"not_allowed": [`+outOfRange+`]
+	}`)
+	// Older room versions clamp them to the range.
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents("1")+`,
+		"allowed": [`+inRange+`, `+outOfRange+`]
+	}`)
+}
+
+func TestAllowedPowerLevelUserIDs(t *testing.T) {
+	authEvents := func(roomVersion string) string {
+		return `{
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a", "room_version": "` + roomVersion + `"}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e2:a",
+					"content": {"membership": "join"}
+				}
+			}
+		}`
+	}
+	valid := `{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"content": {"users": {"@u1:a": 100, "@u2:b": 50}}
+	}`
+	invalid := `{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e4:a",
+		"content": {"users": {"@u1:a": 100, "": 50}}
+	}, {
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e5:a",
+		"content": {"users": {"@u1:a": 100, "+group:a": 50}}
+	}, {
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e6:a",
+		"content": {"users": {"@u1:a": 100, "@junk": 50}}
+	}`
+	// These keys have the sigil and a server name but aren't user IDs.
+	notUserIDs := `{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e8:a",
+		"content": {"users": {"@u1:a": 100, "@:a": 50}}
+	}, {
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e9:a",
+		"content": {"users": {"@u1:a": 100, "@u2:bad server": 50}}
+	}`
+
+	// Version 10 rooms reject levels for keys that aren't user IDs.
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents("10")+`,
+		"allowed": [`+valid+`],
+		"not_allowed": [`+invalid+`, `+notUserIDs+`]
+	}`)
+	// Older room versions only reject keys without the sigil or a server
+	// name, and ignore the others.
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents("9")+`,
+		"allowed": [`+valid+`, `+notUserIDs+`],
+		"not_allowed": [`+invalid+`]
+	}`)
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents("1")+`,
+		"allowed": [`+valid+`, `+notUserIDs+`],
+		"not_allowed": [`+invalid+`]
+	}`)
+
+	event, err := NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e7:a",
+		"content": {"users": {"@u1:a": 100, "@:a": 50, "@u2:bad server": 50}}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewPowerLevelContentFromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"@u1:a": 100}; !reflect.DeepEqual(c.Users, want) {
+		t.Errorf("NewPowerLevelContentFromEvent: want users %v, got %v", want, c.Users)
+	}
+}
+
+func TestAllowedThirdPartyInviteEvent(t *testing.T) {
+	authEvents := func(powerLevels string) string {
+		return `{
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a"}
+			},
+			"power_levels": {
+				"type": "m.room.power_levels",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e2:a",
+				"content": ` + powerLevels + `
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e3:a",
+					"content": {"membership": "join"}
+				},
+				"@u2:a": {
+					"type": "m.room.member",
+					"sender": "@u2:a",
+					"room_id": "!r1:a",
+					"state_key": "@u2:a",
+					"event_id": "$e4:a",
+					"content": {"membership": "join"}
+				},
+				"@u3:a": {
+					"type": "m.room.member",
+					"sender": "@u3:a",
+					"room_id": "!r1:a",
+					"state_key": "@u3:a",
+					"event_id": "$e5:a",
+					"content": {"membership": "join"}
+				}
+			}
+		}`
+	}
+	thirdPartyInvite := func(sender string) string {
+		return `{
+			"type": "m.room.third_party_invite",
+			"state_key": "my_token",
+			"sender": "` + sender + `",
+			"room_id": "!r1:a",
+			"event_id": "$e6:a",
+			"content": {
+				"display_name": "foo...@bar...",
+				"public_key": "pubkey",
+				"key_validity_url": "https://example.tld/isvalid"
+			}
+		}`
+	}
+
+	// In a room where inviting needs a moderator, a user with the default
+	// level can't create third party invites, even if the level for the
+	// event type is lower.
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents(`{
+			"users": {"@u1:a": 100, "@u2:a": 50},
+			"invite": 50,
+			"events": {"m.room.third_party_invite": 0}
+		}`)+`,
+		"allowed": [`+thirdPartyInvite("@u1:a")+`, `+thirdPartyInvite("@u2:a")+`],
+		"not_allowed": [`+thirdPartyInvite("@u3:a")+`]
+	}`)
+
+	// The invite level defaults to 0, so anyone can create third party
+	// invites when it isn't set, regardless of the state level.
+	testEventAllowed(t, `{
+		"auth_events": `+authEvents(`{
+			"users": {"@u1:a": 100, "@u2:a": 50},
+			"state_default": 50
+		}`)+`,
+		"allowed": [`+thirdPartyInvite("@u2:a")+`, `+thirdPartyInvite("@u3:a")+`]
+	}`)
+}
+
 func TestAllowedInviteFrom3PID(t *testing.T) {
 	testEventAllowed(t, `{
 		"auth_events": {
@@ -727,6 +1204,97 @@ func TestAllowedNoFederation(t *testing.T) {
 	}`)
 }
 
+func TestAllowedNoFederationStateEvents(t *testing.T) {
+	testEventAllowed(t, `{
+		"auth_events": {
+			"create": {
+				"type": "m.room.create",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {
+					"creator": "@u1:a",
+					"m.federate": false
+				}
+			},
+			"join_rules": {
+				"type": "m.room.join_rules",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"state_key": "",
+				"event_id": "$e2:a",
+				"content": {"join_rule": "public"}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e3:a",
+					"content": {"membership": "join"}
+				}
+			}
+		},
+		"allowed": [{
+			"type": "m.room.member",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:a",
+			"event_id": "$e4:a",
+			"content": {"membership": "join"}
+		}, {
+			"type": "m.room.aliases",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"state_key": "a",
+			"event_id": "$e5:a",
+			"content": {"aliases": ["#r1:a"]}
+		}],
+		"not_allowed": [{
+			"type": "m.room.member",
+			"sender": "@u2:b",
+			"room_id": "!r1:a",
+			"state_key": "@u2:b",
+			"event_id": "$e6:b",
+			"content": {"membership": "join"},
+			"unsigned": {
+				"not_allowed": "Sender is from a different server."
+			}
+		}, {
+			"type": "m.room.member",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:b",
+			"event_id": "$e7:a",
+			"content": {"membership": "invite"},
+			"unsigned": {
+				"not_allowed": "Target is from a different server."
+			}
+		}, {
+			"type": "m.room.aliases",
+			"sender": "@u2:b",
+			"room_id": "!r1:a",
+			"state_key": "b",
+			"event_id": "$e8:b",
+			"content": {"aliases": ["#r1:b"]},
+			"unsigned": {
+				"not_allowed": "Sender is from a different server."
+			}
+		}, {
+			"type": "m.room.power_levels",
+			"sender": "@u2:b",
+			"room_id": "!r1:a",
+			"state_key": "",
+			"event_id": "$e9:b",
+			"content": {"users": {"@u2:b": 100}},
+			"unsigned": {
+				"not_allowed": "Sender is from a different server."
+			}
+		}]
+	}`)
+}
+
 func TestAllowedWithPowerLevels(t *testing.T) {
 	testEventAllowed(t, `{
 		"auth_events": {
@@ -880,6 +1448,264 @@ func TestAllowedWithPowerLevels(t *testing.T) {
 	}`)
 }
 
+func TestMembershipPowerLevelErrors(t *testing.T) {
+	var authEvents testAuthEvents
+	if err := json.Unmarshal([]byte(`{
+		"create": {
+			"type": "m.room.create",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e1:a",
+			"content": {"creator": "@u1:a"}
+		},
+		"member": {
+			"@u1:a": {
+				"type": "m.room.member",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"state_key": "@u1:a",
+				"event_id": "$e2:a",
+				"content": {"membership": "join"}
+			},
+			"@u2:a": {
+				"type": "m.room.member",
+				"sender": "@u2:a",
+				"room_id": "!r1:a",
+				"state_key": "@u2:a",
+				"event_id": "$e3:a",
+				"content": {"membership": "join"}
+			},
+			"@u3:a": {
+				"type": "m.room.member",
+				"sender": "@u3:a",
+				"room_id": "!r1:a",
+				"state_key": "@u3:a",
+				"event_id": "$e4:a",
+				"content": {"membership": "join"}
+			},
+			"@u4:a": {
+				"type": "m.room.member",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"state_key": "@u4:a",
+				"event_id": "$e5:a",
+				"content": {"membership": "ban"}
+			}
+		},
+		"power_levels": {
+			"type": "m.room.power_levels",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e6:a",
+			"content": {
+				"users": {
+					"@u1:a": 100,
+					"@u2:a": 25,
+					"@u3:a": 60
+				},
+				"kick": 50,
+				"ban": 60,
+				"invite": 30
+			}
+		}
+	}`), &authEvents); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sender, target, membership string
+		want                       NotAllowed
+	}{
+		{"@u2:a", "@u3:a", "leave", NotAllowed{
+			Action: "kick", SenderLevel: 25, RequiredLevel: 50,
+			Message: `sender "@u2:a" has level 25 but kick requires 50`,
+		}},
+		{"@u3:a", "@u1:a", "leave", NotAllowed{
+			Action: "kick", SenderLevel: 60, TargetLevel: 100, RequiredLevel: 50,
+			Message: `sender "@u3:a" has level 60 but kick requires a level above the level 100 of "@u1:a"`,
+		}},
+		{"@u2:a", "@u3:a", "ban", NotAllowed{
+			Action: "ban", SenderLevel: 25, RequiredLevel: 60,
+			Message: `sender "@u2:a" has level 25 but ban requires 60`,
+		}},
+		{"@u3:a", "@u1:a", "ban", NotAllowed{
+			Action: "ban", SenderLevel: 60, TargetLevel: 100, RequiredLevel: 60,
+			Message: `sender "@u3:a" has level 60 but ban requires a level above the level 100 of "@u1:a"`,
+		}},
+		{"@u2:a", "@u4:a", "leave", NotAllowed{
+			Action: "unban", SenderLevel: 25, RequiredLevel: 60,
+			Message: `sender "@u2:a" has level 25 but unban requires 60`,
+		}},
+		{"@u2:a", "@u5:a", "invite", NotAllowed{
+			Action: "invite", SenderLevel: 25, RequiredLevel: 30,
+			Message: `sender "@u2:a" has level 25 but invite requires 30`,
+		}},
+	}
+	for _, tt := range tests {
+		event, err := NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.member",
+			"sender": "`+tt.sender+`",
+			"room_id": "!r1:a",
+			"state_key": "`+tt.target+`",
+			"event_id": "$e7:a",
+			"content": {"membership": "`+tt.membership+`"}
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Allowed(event, &authEvents)
+		notAllowed, ok := err.(*NotAllowed)
+		if !ok {
+			t.Fatalf("%s setting %s to %q: want *NotAllowed, got %v", tt.sender, tt.target, tt.membership, err)
+		}
+		if *notAllowed != tt.want {
+			t.Errorf("%s setting %s to %q: got %+v, want %+v", tt.sender, tt.target, tt.membership, *notAllowed, tt.want)
+		}
+	}
+}
+
+func TestCheckMembershipTransition(t *testing.T) {
+	// The levels needed to ban, kick and invite in every test.
+	const ban, kick, invite = 50, 40, 30
+	tests := []struct {
+		self             bool
+		senderMembership string
+		old, new         string
+		joinRule         string
+		senderLevel      int64
+		targetLevel      int64
+		allowed          bool
+	}{
+		// Users changing their own membership in a public room.
+		{self: true, old: Leave, new: Join, joinRule: Public, allowed: true},
+		{self: true, old: Leave, new: Invite, joinRule: Public, allowed: false},
+		{self: true, old: Leave, new: Leave, joinRule: Public, allowed: false},
+		{self: true, old: Leave, new: Ban, joinRule: Public, allowed: false},
+		{self: true, old: Invite, new: Join, joinRule: Public, allowed: true},
+		{self: true, old: Invite, new: Invite, joinRule: Public, allowed: false},
+		{self: true, old: Invite, new: Leave, joinRule: Public, allowed: true},
+		{self: true, old: Invite, new: Ban, joinRule: Public, allowed: false},
+		{self: true, old: Join, new: Join, joinRule: Public, allowed: true},
+		{self: true, old: Join, new: Invite, joinRule: Public, allowed: false},
+		{self: true, old: Join, new: Leave, joinRule: Public, allowed: true},
+		{self: true, old: Join, new: Ban, joinRule: Public, allowed: false},
+		{self: true, old: Ban, new: Join, joinRule: Public, allowed: false},
+		{self: true, old: Ban, new: Invite, joinRule: Public, allowed: false},
+		{self: true, old: Ban, new: Leave, joinRule: Public, allowed: false},
+		{self: true, old: Ban, new: Ban, joinRule: Public, allowed: false},
+		// Users joining an invite only room.
+		{self: true, old: Leave, new: Join, joinRule: Invite, allowed: false},
+		{self: true, old: Invite, new: Join, joinRule: Invite, allowed: true},
+		{self: true, old: Join, new: Join, joinRule: Invite, allowed: true},
+		{self: true, old: Ban, new: Join, joinRule: Invite, allowed: false},
+		// Users joining rooms with other join rules.
+		{self: true, old: Leave, new: Join, joinRule: Private, allowed: false},
+		{self: true, old: Invite, new: Join, joinRule: Private, allowed: false},
+		{self: true, old: Join, new: Join, joinRule: Private, allowed: true},
+		// Users changing the membership of someone else while not in the room.
+		{senderMembership: Leave, old: Leave, new: Invite, senderLevel: 100, allowed: false},
+		{senderMembership: Invite, old: Join, new: Leave, senderLevel: 100, allowed: false},
+		{senderMembership: Ban, old: Join, new: Ban, senderLevel: 100, allowed: false},
+		// Users inviting someone else.
+		{senderMembership: Join, old: Leave, new: Invite, senderLevel: invite, allowed: true},
+		{senderMembership: Join, old: Leave, new: Invite, senderLevel: invite - 1, allowed: false},
+		{senderMembership: Join, old: Invite, new: Invite, senderLevel: invite, allowed: true},
+		{senderMembership: Join, old: Join, new: Invite, senderLevel: 100, allowed: false},
+		{senderMembership: Join, old: Ban, new: Invite, senderLevel: 100, allowed: false},
+		// Users kicking someone else.
+		{senderMembership: Join, old: Join, new: Leave, senderLevel: kick, allowed: true},
+		{senderMembership: Join, old: Join, new: Leave, senderLevel: kick - 1, allowed: false},
+		{senderMembership: Join, old: Join, new: Leave, senderLevel: kick, targetLevel: kick, allowed: false},
+		{senderMembership: Join, old: Invite, new: Leave, senderLevel: kick, allowed: true},
+		{senderMembership: Join, old: Leave, new: Leave, senderLevel: kick, allowed: true},
+		// Users unbanning someone else, which doesn't depend on the target's level.
+		{senderMembership: Join, old: Ban, new: Leave, senderLevel: ban, targetLevel: 100, allowed: true},
+		{senderMembership: Join, old: Ban, new: Leave, senderLevel: ban - 1, allowed: false},
+		// Users banning someone else.
+		{senderMembership: Join, old: Join, new: Ban, senderLevel: ban, allowed: true},
+		{senderMembership: Join, old: Leave, new: Ban, senderLevel: ban, allowed: true},
+		{senderMembership: Join, old: Ban, new: Ban, senderLevel: ban, allowed: true},
+		{senderMembership: Join, old: Join, new: Ban, senderLevel: ban - 1, allowed: false},
+		{senderMembership: Join, old: Join, new: Ban, senderLevel: ban, targetLevel: ban, allowed: false},
+		// Users can't make someone else join.
+		{senderMembership: Join, old: Leave, new: Join, joinRule: Public, senderLevel: 100, allowed: false},
+		{senderMembership: Join, old: Invite, new: Join, joinRule: Public, senderLevel: 100, allowed: false},
+		{senderMembership: Join, old: Join, new: Join, joinRule: Public, senderLevel: 100, allowed: false},
+	}
+	for _, tt := range tests {
+		params := MembershipTransitionParams{
+			RoomVersion:      RoomVersionV6,
+			SenderID:         "@u1:a",
+			TargetID:         "@u2:a",
+			SenderIsTarget:   tt.self,
+			SenderMembership: tt.senderMembership,
+			OldMembership:    tt.old,
+			NewMembership:    tt.new,
+			SenderLevel:      tt.senderLevel,
+			TargetLevel:      tt.targetLevel,
+			BanLevel:         ban,
+			KickLevel:        kick,
+			InviteLevel:      invite,
+			JoinRule:         tt.joinRule,
+		}
+		if tt.self {
+			params.TargetID = params.SenderID
+			params.SenderMembership = tt.old
+			params.TargetLevel = tt.senderLevel
+		}
+		err := CheckMembershipTransition(params)
+		if tt.allowed && err != nil {
+			t.Errorf("%+v: want allowed, got %v", tt, err)
+		}
+		if !tt.allowed {
+			if _, ok := err.(*NotAllowed); !ok {
+				t.Errorf("%+v: want *NotAllowed, got %v", tt, err)
+			}
+		}
+	}
+}
+
+func TestCheckMembershipTransitionRestricted(t *testing.T) {
+	tests := []struct {
+		roomVersion RoomVersion
+		joinRule    string
+		old         string
+		authorised  bool
+		allowed     bool
+	}{
+		// Users can join a restricted room if they were invited or if the
+		// join was authorised.
+		{RoomVersionV8, Restricted, Leave, true, true},
+		{RoomVersionV8, Restricted, Leave, false, false},
+		{RoomVersionV8, Restricted, Invite, false, true},
+		{RoomVersionV8, KnockRestricted, Knock, true, true},
+		{RoomVersionV8, Restricted, Ban, true, false},
+		// Room versions before restricted joins don't know the join rule.
+		{RoomVersionV7, Restricted, Leave, true, false},
+		{RoomVersionV7, Restricted, Invite, false, false},
+		// Authorising a join doesn't matter for other join rules.
+		{RoomVersionV8, Invite, Leave, true, false},
+	}
+	for _, tt := range tests {
+		err := CheckMembershipTransition(MembershipTransitionParams{
+			RoomVersion:              tt.roomVersion,
+			SenderID:                 "@u1:a",
+			TargetID:                 "@u1:a",
+			SenderIsTarget:           true,
+			OldMembership:            tt.old,
+			NewMembership:            Join,
+			JoinRule:                 tt.joinRule,
+			RestrictedJoinAuthorised: tt.authorised,
+		})
+		if tt.allowed && err != nil {
+			t.Errorf("%+v: want allowed, got %v", tt, err)
+		}
+		if _, ok := err.(*NotAllowed); !tt.allowed && !ok {
+			t.Errorf("%+v: want *NotAllowed, got %v", tt, err)
+		}
+	}
+}
+
 func TestRedactAllowed(t *testing.T) {
 	// Test if redacts are allowed correctly in a room with a power level event.
 	testEventAllowed(t, `{
@@ -1039,6 +1865,156 @@ func TestAuthEvents(t *testing.T) {
 	}
 }
 
+func TestAuthEventsSharedAndClear(t *testing.T) {
+	create, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.create",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e1:a",
+		"content": {"creator": "@u1:a"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.member",
+		"state_key": "@u1:a",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e2:a",
+		"content": {"membership": "join"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.message",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"content": {"body": "Test"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAuthEventsWithCapacity(2)
+	if err = a.AddEvent(&create); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddEvent(&member); err != nil {
+		t.Fatal(err)
+	}
+
+	// Auth events that aren't being changed can be shared between goroutines.
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- Allowed(message, &a)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err = <-errs; err != nil {
+			t.Errorf("Allowed: unexpected error: %s", err)
+		}
+	}
+
+	a.Clear()
+	if e, _ := a.Create(); e != nil {
+		t.Error("Clear: the create event is still there")
+	}
+	if e, _ := a.Member("@u1:a"); e != nil {
+		t.Error("Clear: the member event is still there")
+	}
+	if err = a.AddEvent(&create); err != nil {
+		t.Errorf("AddEvent: unexpected error after Clear: %s", err)
+	}
+}
+
+func TestAllowedPartialAuthEvents(t *testing.T) {
+	create, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.create",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e1:a",
+		"content": {"creator": "@u1:a"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.member",
+		"state_key": "@u1:a",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e2:a",
+		"content": {"membership": "join"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.message",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"content": {"body": "Test"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	join, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.member",
+		"state_key": "@u2:a",
+		"sender": "@u2:a",
+		"room_id": "!r1:a",
+		"event_id": "$e4:a",
+		"content": {"membership": "join"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewPartialAuthEvents([]*Event{&create, &member})
+
+	// Whether the message is allowed depends on the power levels, which
+	// aren't known.
+	want := ErrAuthEventUnknown{StateKeyTuple{MRoomPowerLevels, ""}}
+	if err = Allowed(message, &a); err != want {
+		t.Fatalf("Allowed: want %v, got %v", want, err)
+	}
+	a.AddAbsent(MRoomPowerLevels, "")
+	if err = Allowed(message, &a); err != nil {
+		t.Fatalf("Allowed: unexpected error: %s", err)
+	}
+
+	// The join depends on the existing membership of the joining user.
+	want = ErrAuthEventUnknown{StateKeyTuple{MRoomMember, "@u2:a"}}
+	if err = Allowed(join, &a); err != want {
+		t.Fatalf("Allowed: want %v, got %v", want, err)
+	}
+	a.AddAbsent(MRoomMember, "@u2:a")
+	want = ErrAuthEventUnknown{StateKeyTuple{MRoomJoinRules, ""}}
+	if err = Allowed(join, &a); err != want {
+		t.Fatalf("Allowed: want %v, got %v", want, err)
+	}
+	a.AddAbsent(MRoomJoinRules, "")
+	if _, ok := Allowed(join, &a).(*NotAllowed); !ok {
+		t.Fatal("Allowed: expected the join to an invite only room to not be allowed")
+	}
+
+	// With the full state, missing events are never unknown.
+	full := NewAuthEvents([]*Event{&create, &member})
+	if err = Allowed(message, &full); err != nil {
+		t.Fatalf("Allowed: unexpected error: %s", err)
+	}
+	if _, ok := Allowed(join, &full).(*NotAllowed); !ok {
+		t.Fatal("Allowed: expected the join to an invite only room to not be allowed")
+	}
+}
+
 func newMemberContent(
 	membership string, thirdPartyInvite *MemberThirdPartyInvite,
 ) MemberContent {
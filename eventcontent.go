@@ -17,8 +17,12 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 // CreateContent is the JSON content of a m.room.create event along with
@@ -47,6 +51,83 @@ type PreviousRoom struct {
 	EventID string `json:"event_id"`
 }
 
+// TombstoneContent is the JSON content of a m.room.tombstone event.
+// https://matrix.org/docs/spec/client_server/r0.5.0#m-room-tombstone
+type TombstoneContent struct {
+	// A message explaining why the room was replaced.
+	Body string `json:"body"`
+	// The ID of the room that replaces this one.
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// AliasesContent is the JSON content of a m.room.aliases event, which lists
+// the aliases of the room on the server given by the state key.
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-aliases
+type AliasesContent struct {
+	// The aliases of the room on the server.
+	Aliases []string `json:"aliases"`
+}
+
+// CanonicalAliasContent is the JSON content of a m.room.canonical_alias event.
+// https://matrix.org/docs/spec/client_server/r0.6.0#m-room-canonical-alias
+type CanonicalAliasContent struct {
+	// The canonical alias of the room, if any.
+	Alias string `json:"alias,omitempty"`
+	// Other aliases that the room advertises, if any.
+	AltAliases []string `json:"alt_aliases,omitempty"`
+}
+
+// A contentCache holds the parsed content of auth events, so that the
+// content of an event used for many auth checks is only parsed once. The
+// cached content is shared between the auth checks, so must not be modified.
+// Lookups in a nil cache find nothing and additions are ignored.
+type contentCache map[*Event]interface{}
+
+func (c contentCache) add(event *Event, content interface{}) {
+	if c != nil {
+		c[event] = content
+	}
+}
+
+// A contentCachingProvider is an AuthEventProvider that caches the parsed
+// content of its events. The events it returns must not change while they
+// are cached.
+type contentCachingProvider interface {
+	parsedContent() contentCache
+}
+
+// contentCacheOf returns the content cache of the provider, or nil if it
+// doesn't have one.
+func contentCacheOf(authEvents AuthEventProvider) contentCache {
+	if provider, ok := authEvents.(contentCachingProvider); ok {
+		return provider.parsedContent()
+	}
+	return nil
+}
+
+// parseAuthContent parses the content of an auth event of a type whose
+// parsed content is cached, in the same way as the auth checks do. Returns
+// false if the content of events of that type isn't cached, or if the
+// content couldn't be parsed.
+func parseAuthContent(event *Event) (content interface{}, ok bool) {
+	var err error
+	switch event.Type() {
+	case MRoomCreate:
+		content, err = newCreateContentFromEvent(event)
+	case MRoomPowerLevels:
+		content, err = NewPowerLevelContentFromEvent(*event)
+	case MRoomJoinRules:
+		var c JoinRuleContent
+		err = json.Unmarshal(event.Content(), &c)
+		content = c
+	case MRoomMember:
+		content, err = NewMemberContentFromEvent(*event)
+	default:
+		return nil, false
+	}
+	return content, err == nil
+}
+
 // NewCreateContentFromAuthEvents loads the create event content from the create event in the
 // auth events.
 func NewCreateContentFromAuthEvents(authEvents AuthEventProvider) (c CreateContent, err error) {
@@ -58,18 +139,46 @@ func NewCreateContentFromAuthEvents(authEvents AuthEventProvider) (c CreateConte
 		err = errorf("missing create event")
 		return
 	}
+	cache := contentCacheOf(authEvents)
+	if cached, ok := cache[createEvent]; ok {
+		return cached.(CreateContent), nil
+	}
+	if c, err = newCreateContentFromEvent(createEvent); err == nil {
+		cache.add(createEvent, c)
+	}
+	return
+}
+
+// newCreateContentFromEvent loads the create event content from the create
+// event.
+func newCreateContentFromEvent(createEvent *Event) (c CreateContent, err error) {
 	if err = json.Unmarshal(createEvent.Content(), &c); err != nil {
 		err = errorf("unparsable create event content: %s", err.Error())
 		return
 	}
 	c.roomID = createEvent.RoomID()
 	c.eventID = createEvent.EventID()
+	// Rooms of an unknown version are treated as having an explicit creator.
+	if desc, derr := c.roomVersion().description(); derr == nil && desc.implicitCreator {
+		// The "creator" key was removed from the create event in later
+		// room versions. The creator is the sender of the create event.
+		c.Creator = createEvent.Sender()
+	}
 	if c.senderDomain, err = domainFromID(createEvent.Sender()); err != nil {
 		return
 	}
 	return
 }
 
+// roomVersion returns the version of the room. Rooms created without a
+// "room_version" are version 1 rooms.
+func (c *CreateContent) roomVersion() RoomVersion {
+	if c.RoomVersion == nil {
+		return RoomVersionV1
+	}
+	return RoomVersion(*c.RoomVersion)
+}
+
 // DomainAllowed checks whether the domain is allowed in the room by the
 // "m.federate" flag.
 func (c *CreateContent) DomainAllowed(domain string) error {
@@ -122,6 +231,9 @@ type MemberContent struct {
 	Reason      string `json:"reason,omitempty"`
 	// We use the third_party_invite key to special case thirdparty invites.
 	ThirdPartyInvite *MemberThirdPartyInvite `json:"third_party_invite,omitempty"`
+	// We use the join_authorised_via_users_server key to check the signature
+	// of the server that authorised a join to a restricted room.
+	AuthorisedVia string `json:"join_authorised_via_users_server,omitempty"`
 }
 
 // MemberThirdPartyInvite is the "Invite" structure defined at http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-member
@@ -150,7 +262,14 @@ func NewMemberContentFromAuthEvents(authEvents AuthEventProvider, userID string)
 		c.Membership = Leave
 		return
 	}
-	return NewMemberContentFromEvent(*memberEvent)
+	cache := contentCacheOf(authEvents)
+	if cached, ok := cache[memberEvent]; ok {
+		return cached.(MemberContent), nil
+	}
+	if c, err = NewMemberContentFromEvent(*memberEvent); err == nil {
+		cache.add(memberEvent, c)
+	}
+	return
 }
 
 // NewMemberContentFromEvent parse the member content from an event.
@@ -203,6 +322,66 @@ func NewThirdPartyInviteContentFromAuthEvents(authEvents AuthEventProvider, toke
 type JoinRuleContent struct {
 	// We use the join_rule key to check whether join m.room.member events are allowed.
 	JoinRule string `json:"join_rule"`
+	// The conditions under which a user may join a restricted room.
+	Allow []JoinRuleAllowCondition `json:"allow,omitempty"`
+}
+
+// JoinRuleAllowCondition is a condition under which a user may join a room
+// with a "restricted" or "knock_restricted" join rule.
+// See https://matrix.org/docs/spec/rooms/v8#authorization-rules
+type JoinRuleAllowCondition struct {
+	// The type of condition. Only "m.room_membership" is currently defined.
+	Type string `json:"type"`
+	// The room the user must be joined to for a "m.room_membership" condition.
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// Validate checks that the join rule is one of the known join rules and that
+// the "m.room_membership" allow conditions refer to valid room IDs. Allow
+// conditions of unknown types are ignored, as the spec requires.
+func (c JoinRuleContent) Validate() error {
+	switch c.JoinRule {
+	case Public, Invite, Knock, Private, Restricted, KnockRestricted:
+	default:
+		return fmt.Errorf("gomatrixserverlib: unknown join rule %q", c.JoinRule)
+	}
+	for _, condition := range c.Allow {
+		if condition.Type != MRoomMembership {
+			continue
+		}
+		if _, err := checkID(condition.RoomID, "room", '!'); err != nil {
+			return fmt.Errorf("gomatrixserverlib: invalid join rule allow condition: %s", err)
+		}
+	}
+	return nil
+}
+
+// EvaluateAllowConditions works out which of the allow conditions of a
+// restricted join rule let a user join the room. The user's memberships map
+// the IDs of the rooms the user is in to the user's membership in that room,
+// e.g. "join". Returns the IDs of the rooms named by the "m.room_membership"
+// conditions that the user is joined to, in the order of the conditions and
+// without duplicates, or nothing if no condition is satisfied. Conditions of
+// unknown types are ignored, as the spec requires. Returns an error if a
+// "m.room_membership" condition doesn't refer to a valid room ID.
+func EvaluateAllowConditions(
+	conditions []JoinRuleAllowCondition, userMemberships map[string]string,
+) (allowedVia []string, err error) {
+	seen := map[string]bool{}
+	for _, condition := range conditions {
+		if condition.Type != MRoomMembership {
+			continue
+		}
+		if _, err = checkID(condition.RoomID, "room", '!'); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib: invalid join rule allow condition: %s", err)
+		}
+		if seen[condition.RoomID] || userMemberships[condition.RoomID] != Join {
+			continue
+		}
+		seen[condition.RoomID] = true
+		allowedVia = append(allowedVia, condition.RoomID)
+	}
+	return allowedVia, nil
 }
 
 // NewJoinRuleContentFromAuthEvents loads the join rule content from the join rules event in the auth event.
@@ -218,10 +397,15 @@ func NewJoinRuleContentFromAuthEvents(authEvents AuthEventProvider) (c JoinRuleC
 		c.JoinRule = Invite
 		return
 	}
+	cache := contentCacheOf(authEvents)
+	if cached, ok := cache[joinRulesEvent]; ok {
+		return cached.(JoinRuleContent), nil
+	}
 	if err = json.Unmarshal(joinRulesEvent.Content(), &c); err != nil {
 		err = errorf("unparsable join_rules event content: %s", err.Error())
 		return
 	}
+	cache.add(joinRulesEvent, c)
 	return
 }
 
@@ -279,10 +463,27 @@ func NewPowerLevelContentFromAuthEvents(authEvents AuthEventProvider, creatorUse
 		return
 	}
 	if powerLevelsEvent != nil {
-		return NewPowerLevelContentFromEvent(*powerLevelsEvent)
+		cache := contentCacheOf(authEvents)
+		if cached, ok := cache[powerLevelsEvent]; ok {
+			return cached.(PowerLevelContent), nil
+		}
+		if c, err = NewPowerLevelContentFromEvent(*powerLevelsEvent); err == nil {
+			cache.add(powerLevelsEvent, c)
+		}
+		return
 	}
 
 	// If there are no power levels then fall back to defaults.
+	c = DefaultsForRoomWithoutPLEvent(creatorUserID)
+	return
+}
+
+// DefaultsForRoomWithoutPLEvent returns the power levels that apply in a room
+// without a m.room.power_levels event. These differ from the defaults for keys
+// missing from a m.room.power_levels event: the creator has level 100 and the
+// state_default is 0 rather than 50.
+// https://matrix.org/docs/spec/rooms/v1#authorization-rules
+func DefaultsForRoomWithoutPLEvent(creatorUserID string) (c PowerLevelContent) {
 	c.Defaults()
 	// If there is no power level event then the creator gets level 100
 	// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L569
@@ -316,14 +517,114 @@ func (c *PowerLevelContent) Defaults() {
 
 }
 
+// The range of power levels accepted, which is the range of integers allowed
+// in canonical JSON. Keeping levels in this range means that arithmetic and
+// comparisons on levels can't overflow.
+// https://matrix.org/docs/spec/appendices#canonical-json
+const (
+	MinPowerLevel int64 = -(1 << 53) + 1
+	MaxPowerLevel int64 = (1 << 53) - 1
+)
+
 // NewPowerLevelContentFromEvent loads the power level content from an event.
+// Levels outside the range MinPowerLevel to MaxPowerLevel are clamped to the
+// range, and a warning is logged.
 func NewPowerLevelContentFromEvent(event Event) (c PowerLevelContent, err error) {
+	var outOfRange []string
+	if c, outOfRange, _, err = parsePowerLevelContent(event.Content()); err != nil {
+		return
+	}
+	warnClampedPowerLevels(event, outOfRange)
+	return
+}
+
+// ParsePowerLevelContent parses the content of a m.room.power_levels event
+// following the rules of the room version. Room versions before version 10
+// accept levels given as strings, like "50", or as floats, and convert them
+// to integers, as older clients sent them that way. Later room versions
+// reject levels that aren't integers. Similarly, levels outside the range
+// MinPowerLevel to MaxPowerLevel are clamped to the range in room versions
+// before version 6 and rejected in later ones. Keys of the "users" levels
+// that don't start with "@" or lack a server name are always rejected, and
+// keys that aren't otherwise valid user IDs are ignored before version 10 and
+// rejected after. Returns an UnsupportedRoomVersionError if the room version
+// isn't known.
+func ParsePowerLevelContent(content json.RawMessage, roomVersion RoomVersion) (PowerLevelContent, error) {
+	desc, err := roomVersion.description()
+	if err != nil {
+		return PowerLevelContent{}, err
+	}
+	c, _, err := parsePowerLevelContentForVersion(content, desc)
+	if err != nil {
+		return PowerLevelContent{}, err
+	}
+	return c, nil
+}
+
+// parsePowerLevelContentForVersion loads the power level content, rejecting
+// it if the levels break the rules of the room version. Returns the keys of
+// the levels that were clamped, in room versions that allow that.
+func parsePowerLevelContentForVersion(
+	content []byte, desc roomVersionDescription,
+) (c PowerLevelContent, outOfRange []string, err error) {
+	var notIntegers []string
+	if c, outOfRange, notIntegers, err = parsePowerLevelContent(content); err != nil {
+		return
+	}
+
+	// Room versions with strict power levels reject levels that had to be
+	// converted to integers. Older room versions convert them.
+	if desc.strictPowerLevelIntegers && len(notIntegers) > 0 {
+		err = errorf("Power levels %s are not integers", strings.Join(notIntegers, ", "))
+		return
+	}
+
+	// Room versions that enforce canonical JSON reject levels outside the
+	// canonical JSON integer range. Older room versions clamp them.
+	if desc.enforceCanonicalJSON && len(outOfRange) > 0 {
+		err = errorf(
+			"Power levels %s are outside the allowed range %d to %d",
+			strings.Join(outOfRange, ", "), MinPowerLevel, MaxPowerLevel,
+		)
+		return
+	}
+
+	// Check that the user levels are all valid user IDs.
+	// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L1063
+	// Room versions with strict power levels check the whole grammar of the
+	// user IDs. Older room versions only check the sigil and the server name
+	// separator, and ignore the levels of keys that pass that check but aren't
+	// user IDs, which parsePowerLevelContent leaves out.
+	if invalid := invalidPowerLevelUsers(content, desc.strictPowerLevelUsers); len(invalid) > 0 {
+		err = errorf("Not valid user IDs: %q", invalid)
+		return
+	}
+	return
+}
+
+// warnClampedPowerLevels logs a warning if any of the power levels in the
+// event were clamped to the allowed range.
+func warnClampedPowerLevels(event Event, outOfRange []string) {
+	if len(outOfRange) == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"event_id": event.EventID(),
+		"keys":     outOfRange,
+	}).Warn("gomatrixserverlib: clamped power levels outside the allowed range")
+}
+
+// parsePowerLevelContent loads the power level content from the content of
+// an event, and returns the keys of the levels that were outside the allowed
+// range and were clamped, and of the levels that weren't integers and were
+// converted.
+func parsePowerLevelContent(content []byte) (c PowerLevelContent, outOfRange, notIntegers []string, err error) { // nolint: gocyclo
 	// Set the levels to their default values.
 	c.Defaults()
 
 	// We can't extract the JSON directly to the powerLevelContent because we
 	// need to convert string values to int values.
-	var content struct {
+	var levels struct {
 		InviteLevel       levelJSONValue            `json:"invite"`
 		BanLevel          levelJSONValue            `json:"ban"`
 		KickLevel         levelJSONValue            `json:"kick"`
@@ -332,36 +633,71 @@ func NewPowerLevelContentFromEvent(event Event) (c PowerLevelContent, err error)
 		UsersDefaultLevel levelJSONValue            `json:"users_default"`
 		EventLevels       map[string]levelJSONValue `json:"events"`
 		StateDefaultLevel levelJSONValue            `json:"state_default"`
-		EventDefaultLevel levelJSONValue            `json:"event_default"`
+		EventDefaultLevel levelJSONValue            `json:"events_default"`
 	}
-	if err = json.Unmarshal(event.Content(), &content); err != nil {
+	if err = json.Unmarshal(content, &levels); err != nil {
 		err = errorf("unparsable power_levels event content: %s", err.Error())
 		return
 	}
 
 	// Update the levels with the values that are present in the event content.
-	content.InviteLevel.assignIfExists(&c.Invite)
-	content.BanLevel.assignIfExists(&c.Ban)
-	content.KickLevel.assignIfExists(&c.Kick)
-	content.RedactLevel.assignIfExists(&c.Redact)
-	content.UsersDefaultLevel.assignIfExists(&c.UsersDefault)
-	content.StateDefaultLevel.assignIfExists(&c.StateDefault)
-	content.EventDefaultLevel.assignIfExists(&c.EventsDefault)
-
-	for k, v := range content.UserLevels {
+	levels.InviteLevel.assignIfExists(&c.Invite)
+	levels.BanLevel.assignIfExists(&c.Ban)
+	levels.KickLevel.assignIfExists(&c.Kick)
+	levels.RedactLevel.assignIfExists(&c.Redact)
+	levels.UsersDefaultLevel.assignIfExists(&c.UsersDefault)
+	levels.StateDefaultLevel.assignIfExists(&c.StateDefault)
+	levels.EventDefaultLevel.assignIfExists(&c.EventsDefault)
+
+	for key, v := range map[string]levelJSONValue{
+		"invite":         levels.InviteLevel,
+		"ban":            levels.BanLevel,
+		"kick":           levels.KickLevel,
+		"redact":         levels.RedactLevel,
+		"users_default":  levels.UsersDefaultLevel,
+		"state_default":  levels.StateDefaultLevel,
+		"events_default": levels.EventDefaultLevel,
+	} {
+		if v.clamped {
+			outOfRange = append(outOfRange, key)
+		}
+		if v.converted {
+			notIntegers = append(notIntegers, key)
+		}
+	}
+
+	for k, v := range levels.UserLevels {
+		if _, uerr := ParseUserID(k); uerr != nil {
+			// Levels for keys that aren't user IDs can't apply to anyone.
+			continue
+		}
 		if c.Users == nil {
 			c.Users = make(map[string]int64)
 		}
 		c.Users[k] = v.value
+		if v.clamped {
+			outOfRange = append(outOfRange, "users."+k)
+		}
+		if v.converted {
+			notIntegers = append(notIntegers, "users."+k)
+		}
 	}
 
-	for k, v := range content.EventLevels {
+	for k, v := range levels.EventLevels {
 		if c.Events == nil {
 			c.Events = make(map[string]int64)
 		}
 		c.Events[k] = v.value
+		if v.clamped {
+			outOfRange = append(outOfRange, "events."+k)
+		}
+		if v.converted {
+			notIntegers = append(notIntegers, "events."+k)
+		}
 	}
 
+	sort.Strings(outOfRange)
+	sort.Strings(notIntegers)
 	return
 }
 
@@ -372,6 +708,10 @@ type levelJSONValue struct {
 	exists bool
 	// The integer value of the power level.
 	value int64
+	// Was the value outside the allowed range and clamped to it?
+	clamped bool
+	// Was the value a string or a float that was converted to an integer?
+	converted bool
 }
 
 func (v *levelJSONValue) UnmarshalJSON(data []byte) error {
@@ -388,20 +728,48 @@ func (v *levelJSONValue) UnmarshalJSON(data []byte) error {
 			if err = json.Unmarshal(data, &floatValue); err != nil {
 				return err
 			}
-			int64Value = int64(floatValue)
+			// Converting a float outside the int64 range is undefined so
+			// saturate before converting.
+			switch {
+			case floatValue > float64(MaxPowerLevel):
+				int64Value = MaxPowerLevel + 1
+			case floatValue < float64(MinPowerLevel):
+				int64Value = MinPowerLevel - 1
+			default:
+				int64Value = int64(floatValue)
+			}
+			v.converted = true
 		} else {
 			// If we managed to get a string, try parsing the string as an int.
 			int64Value, err = strconv.ParseInt(stringValue, 10, 64)
+			if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+				// ParseInt saturates values outside the int64 range, which
+				// will be clamped below.
+				err = nil
+			}
 			if err != nil {
 				return err
 			}
+			v.converted = true
 		}
 	}
 	v.exists = true
-	v.value = int64Value
+	v.value = clampPowerLevel(int64Value)
+	v.clamped = v.value != int64Value
 	return nil
 }
 
+// clampPowerLevel clamps the level to the range MinPowerLevel to MaxPowerLevel.
+func clampPowerLevel(level int64) int64 {
+	if level > MaxPowerLevel {
+		return MaxPowerLevel
+	}
+	if level < MinPowerLevel {
+		return MinPowerLevel
+	}
+	return level
+}
+
 // assign the power level if a value was present in the JSON.
 func (v *levelJSONValue) assignIfExists(to *int64) {
 	if v.exists {
@@ -409,8 +777,33 @@ func (v *levelJSONValue) assignIfExists(to *int64) {
 	}
 }
 
+// invalidPowerLevelUsers returns the keys of the "users" levels of the
+// m.room.power_levels event content that aren't valid user IDs, in sorted
+// order. If strict is true the keys must be user IDs according to
+// ParseUserID, otherwise they only need to pass isValidUserID.
+func invalidPowerLevelUsers(content []byte, strict bool) []string {
+	var levels struct {
+		UserLevels map[string]json.RawMessage `json:"users"`
+	}
+	if err := json.Unmarshal(content, &levels); err != nil {
+		return nil
+	}
+	var invalid []string
+	for userID := range levels.UserLevels {
+		if strict {
+			if _, err := ParseUserID(userID); err != nil {
+				invalid = append(invalid, userID)
+			}
+		} else if !isValidUserID(userID) {
+			invalid = append(invalid, userID)
+		}
+	}
+	sort.Strings(invalid)
+	return invalid
+}
+
 // Check if the user ID is a valid user ID.
 func isValidUserID(userID string) bool {
 	// TODO: Do we want to add anymore checks beyond checking the sigil and that it has a domain part?
-	return userID[0] == '@' && strings.IndexByte(userID, ':') != -1
+	return len(userID) > 0 && userID[0] == '@' && strings.IndexByte(userID, ':') != -1
 }
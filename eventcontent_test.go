@@ -17,6 +17,7 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -34,6 +35,10 @@ func TestLevelJSONValueValid(t *testing.T) {
 		if int64(want) != got.value {
 			t.Fatalf("Wanted %d got %q", want, got.value)
 		}
+		// Only the first entry is an integer in the JSON.
+		if got.converted != (i > 0) {
+			t.Fatalf("Wanted entry %d to have converted %v", want, i > 0)
+		}
 	}
 }
 
@@ -49,3 +54,136 @@ func TestLevelJSONValueInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestNewPowerLevelContentFromEventEventsDefault(t *testing.T) {
+	// Only the "events_default" key from the spec sets the default level for
+	// non-state events. The "event_default" key isn't in the spec, so it is
+	// ignored and the default of 0 applies.
+	legacy, err := NewEventFromTrustedJSON([]byte(`{"type":"m.room.power_levels","state_key":"","content":{"event_default":25}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyContent, err := NewPowerLevelContentFromEvent(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := legacyContent.EventLevel("m.room.message", false); level != 0 {
+		t.Fatalf("Wanted m.room.message level 0 for event_default got %d", level)
+	}
+
+	event, err := NewEventFromTrustedJSON([]byte(`{"type":"m.room.power_levels","state_key":"","content":{"events_default":25}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewPowerLevelContentFromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := c.EventLevel("m.room.message", false); level != 25 {
+		t.Fatalf("Wanted m.room.message level 25 got %d", level)
+	}
+	if c.EventsDefault != 25 {
+		t.Fatalf("Wanted events_default 25 got %d", c.EventsDefault)
+	}
+}
+
+func TestParsePowerLevelContent(t *testing.T) {
+	content := json.RawMessage(`{"ban":"60","events":{"m.room.name":75.0},"users":{"@u:a":"100"}}`)
+
+	// Room versions before version 10 convert the levels to integers.
+	for _, roomVersion := range []RoomVersion{RoomVersionV1, RoomVersionV6, RoomVersionV9} {
+		c, err := ParsePowerLevelContent(content, roomVersion)
+		if err != nil {
+			t.Fatalf("ParsePowerLevelContent(%s): unexpected error: %v", roomVersion, err)
+		}
+		if c.Ban != 60 || c.Events["m.room.name"] != 75 || c.Users["@u:a"] != 100 || c.Kick != 50 {
+			t.Errorf("ParsePowerLevelContent(%s): got %+v", roomVersion, c)
+		}
+	}
+
+	// Later room versions reject them.
+	for _, roomVersion := range []RoomVersion{RoomVersionV10, RoomVersionV11} {
+		_, err := ParsePowerLevelContent(content, roomVersion)
+		want := "Power levels ban, events.m.room.name, users.@u:a are not integers"
+		if err == nil || err.(*NotAllowed).Message != want {
+			t.Errorf("ParsePowerLevelContent(%s): got error %v, want %q", roomVersion, err, want)
+		}
+		if _, err = ParsePowerLevelContent(json.RawMessage(`{"ban":60,"users":{"@u:a":100}}`), roomVersion); err != nil {
+			t.Errorf("ParsePowerLevelContent(%s): unexpected error for integer levels: %v", roomVersion, err)
+		}
+	}
+
+	// Levels outside the allowed range are clamped until version 6.
+	outOfRange := json.RawMessage(`{"ban":9007199254740992}`)
+	if c, err := ParsePowerLevelContent(outOfRange, RoomVersionV5); err != nil || c.Ban != MaxPowerLevel {
+		t.Errorf("ParsePowerLevelContent(%s): got %d, %v, want the level clamped", RoomVersionV5, c.Ban, err)
+	}
+	if _, err := ParsePowerLevelContent(outOfRange, RoomVersionV6); err == nil {
+		t.Errorf("ParsePowerLevelContent(%s): wanted an error for a level outside the range", RoomVersionV6)
+	}
+
+	if _, err := ParsePowerLevelContent(content, "unknown"); err == nil {
+		t.Errorf("ParsePowerLevelContent: wanted an error for an unknown room version")
+	}
+}
+
+func TestLevelJSONValueClamped(t *testing.T) {
+	inputs := map[string]int64{
+		`9007199254740991`:        MaxPowerLevel,
+		`9007199254740992`:        MaxPowerLevel,
+		`9223372036854775807`:     MaxPowerLevel,
+		`1e30`:                    MaxPowerLevel,
+		`"99999999999999999999"`:  MaxPowerLevel,
+		`-9007199254740992`:       MinPowerLevel,
+		`-1e30`:                   MinPowerLevel,
+		`"-99999999999999999999"`: MinPowerLevel,
+	}
+	for input, want := range inputs {
+		var got levelJSONValue
+		if err := json.Unmarshal([]byte(input), &got); err != nil {
+			t.Fatalf("Unexpected error unmarshalling %s: %s", input, err)
+		}
+		if got.value != want {
+			t.Errorf("Unmarshalling %s: wanted %d got %d", input, want, got.value)
+		}
+		if got.clamped != (input != `9007199254740991`) {
+			t.Errorf("Unmarshalling %s: wanted clamped to be %v", input, !got.clamped)
+		}
+	}
+}
+
+func TestEvaluateAllowConditions(t *testing.T) {
+	conditions := []JoinRuleAllowCondition{
+		{Type: MRoomMembership, RoomID: "!a:example.com"},
+		{Type: "org.example.unknown", RoomID: "!b:example.com"},
+		{Type: MRoomMembership, RoomID: "!c:example.com"},
+		{Type: MRoomMembership, RoomID: "!a:example.com"},
+		{Type: MRoomMembership, RoomID: "!d:example.com"},
+	}
+	tests := []struct {
+		memberships    map[string]string
+		wantAllowedVia []string
+	}{
+		// Only rooms the user is joined to grant access, and only once.
+		{map[string]string{"!a:example.com": Join, "!c:example.com": Join}, []string{"!a:example.com", "!c:example.com"}},
+		{map[string]string{"!c:example.com": Join, "!d:example.com": Leave}, []string{"!c:example.com"}},
+		// Rooms named by conditions of unknown types don't count.
+		{map[string]string{"!b:example.com": Join}, nil},
+		{map[string]string{"!a:example.com": Invite, "!d:example.com": Ban}, nil},
+		{nil, nil},
+	}
+	for i, test := range tests {
+		allowedVia, err := EvaluateAllowConditions(conditions, test.memberships)
+		if err != nil {
+			t.Fatalf("Case %d: EvaluateAllowConditions: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(allowedVia, test.wantAllowedVia) {
+			t.Errorf("Case %d: EvaluateAllowConditions: got %v, want %v", i, allowedVia, test.wantAllowedVia)
+		}
+	}
+
+	_, err := EvaluateAllowConditions([]JoinRuleAllowCondition{{Type: MRoomMembership, RoomID: "not a room"}}, nil)
+	if err == nil {
+		t.Errorf("EvaluateAllowConditions: wanted an error for an invalid room ID")
+	}
+}
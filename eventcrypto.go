@@ -18,7 +18,7 @@ package gomatrixserverlib
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 
@@ -27,10 +27,10 @@ import (
 	"golang.org/x/crypto/ed25519"
 )
 
-// addContentHashesToEvent sets the "hashes" key of the event with a SHA-256 hash of the unredacted event content.
+// addContentHashesToEvent sets the "hashes" key of the event with a hash of the unredacted event content.
 // This hash is used to detect whether the unredacted content of the event is valid.
 // Returns the event JSON with a "hashes" key added to it.
-func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
+func addContentHashesToEvent(eventJSON []byte, hashAlgorithm HashAlgorithm) ([]byte, error) {
 	var event map[string]RawJSON
 
 	if err := json.Unmarshal(eventJSON, &event); err != nil {
@@ -38,11 +38,18 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 	}
 
 	unsignedJSON := event["unsigned"]
+	eventIDJSON := event["event_id"]
 
 	delete(event, "signatures")
 	delete(event, "unsigned")
 	delete(event, "hashes")
 
+	// Event IDs derived from the event aren't part of the content hash.
+	var eventID string
+	if json.Unmarshal(eventIDJSON, &eventID) == nil && eventIDIsReferenceHash(eventID) {
+		delete(event, "event_id")
+	}
+
 	hashableEventJSON, err := json.Marshal(event)
 	if err != nil {
 		return nil, err
@@ -53,11 +60,10 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	sha256Hash := sha256.Sum256(hashableEventJSON)
-	hashes := struct {
-		Sha256 Base64String `json:"sha256"`
-	}{Base64String(sha256Hash[:])}
-	hashesJSON, err := json.Marshal(&hashes)
+	hashes := map[string]Base64String{
+		hashAlgorithm.Name(): Base64String(hashAlgorithm.Sum(hashableEventJSON)),
+	}
+	hashesJSON, err := json.Marshal(hashes)
 	if err != nil {
 		return nil, err
 	}
@@ -65,23 +71,28 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 	if len(unsignedJSON) > 0 {
 		event["unsigned"] = unsignedJSON
 	}
+	if len(eventIDJSON) > 0 {
+		event["event_id"] = eventIDJSON
+	}
 	event["hashes"] = RawJSON(hashesJSON)
 
 	return json.Marshal(event)
 }
 
-// checkEventContentHash checks if the unredacted content of the event matches the SHA-256 hash under the "hashes" key.
+// checkEventContentHash checks if the unredacted content of the event matches the hash under the "hashes" key.
 // Assumes that eventJSON has been canonicalised already.
-func checkEventContentHash(eventJSON []byte) error {
-	var err error
-
-	result := gjson.GetBytes(eventJSON, "hashes.sha256")
+func checkEventContentHash(eventJSON []byte, hashAlgorithm HashAlgorithm) error {
+	result := gjson.GetBytes(eventJSON, "hashes."+hashAlgorithm.Name())
 	var hash Base64String
-	if err = hash.Decode(result.Str); err != nil {
+	if err := hash.Decode(result.Str); err != nil {
 		return err
 	}
 
-	hashableEventJSON := eventJSON
+	// Event IDs derived from the event aren't part of the content hash.
+	hashableEventJSON, err := withoutDerivedEventID(eventJSON)
+	if err != nil {
+		return err
+	}
 
 	for _, key := range []string{"signatures", "unsigned", "hashes"} {
 		if hashableEventJSON, err = sjson.DeleteBytes(hashableEventJSON, key); err != nil {
@@ -89,26 +100,57 @@ func checkEventContentHash(eventJSON []byte) error {
 		}
 	}
 
-	sha256Hash := sha256.Sum256(hashableEventJSON)
+	contentHash := hashAlgorithm.Sum(hashableEventJSON)
 
-	if !bytes.Equal(sha256Hash[:], []byte(hash)) {
-		return fmt.Errorf("Invalid Sha256 content hash: %v != %v", sha256Hash[:], []byte(hash))
+	if !bytes.Equal(contentHash, []byte(hash)) {
+		return fmt.Errorf("Invalid %s content hash: %v != %v", hashAlgorithm.Name(), contentHash, []byte(hash))
 	}
 
 	return nil
 }
 
-// ReferenceSha256HashOfEvent returns the SHA-256 hash of the redacted event content.
+// redactEventForSignatures redacts the event with the redaction algorithm of
+// its room version so that it can be signed or the signatures checked. Event
+// IDs derived from the event aren't covered by the signatures since they are
+// computed from the signed event.
+func redactEventForSignatures(eventJSON []byte, redactionAlgorithm RedactionAlgorithm) ([]byte, error) {
+	eventJSON, err := withoutDerivedEventID(eventJSON)
+	if err != nil {
+		return nil, err
+	}
+	return redactEvent(eventJSON, redactionAlgorithm)
+}
+
+// referenceOfEvent returns a reference to the event, containing the event ID
+// and the SHA-256 reference hash of the event.
 // This is used when referring to this event from other events.
 func referenceOfEvent(eventJSON []byte) (EventReference, error) {
-	redactedJSON, err := redactEvent(eventJSON)
+	sha256Hash, err := referenceHashOfEvent(eventJSON, HashAlgorithmSHA256, RedactionAlgorithmV1)
 	if err != nil {
 		return EventReference{}, err
 	}
 
+	eventID := gjson.GetBytes(eventJSON, "event_id")
+	if eventID.Type != gjson.String {
+		return EventReference{}, fmt.Errorf("gomatrixserverlib: event has no event ID")
+	}
+
+	return EventReference{eventID.Str, sha256Hash}, nil
+}
+
+// referenceHashOfEvent returns the hash of the redacted event with the
+// "signatures" and "unsigned" keys removed.
+func referenceHashOfEvent(
+	eventJSON []byte, hashAlgorithm HashAlgorithm, redactionAlgorithm RedactionAlgorithm,
+) ([]byte, error) {
+	redactedJSON, err := redactEventForSignatures(eventJSON, redactionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
 	var event map[string]RawJSON
 	if err = json.Unmarshal(redactedJSON, &event); err != nil {
-		return EventReference{}, err
+		return nil, err
 	}
 
 	delete(event, "signatures")
@@ -116,29 +158,73 @@ func referenceOfEvent(eventJSON []byte) (EventReference, error) {
 
 	hashableEventJSON, err := json.Marshal(event)
 	if err != nil {
-		return EventReference{}, err
+		return nil, err
 	}
 
 	hashableEventJSON, err = CanonicalJSON(hashableEventJSON)
 	if err != nil {
-		return EventReference{}, err
+		return nil, err
 	}
 
-	sha256Hash := sha256.Sum256(hashableEventJSON)
+	return hashAlgorithm.Sum(hashableEventJSON), nil
+}
 
-	var eventID string
-	if err = json.Unmarshal(event["event_id"], &eventID); err != nil {
-		return EventReference{}, err
+// ComputeEventID computes the event ID of the event for room versions that
+// derive the event ID from the reference hash of the event content.
+// The "event_id" key is not part of the reference hash since in those room
+// versions the ID isn't included in the event sent over federation; any
+// "event_id" present on the event is treated as the ID advertised by the peer.
+// Returns an error if the room version doesn't derive event IDs from the event,
+// or if the room version is unknown.
+// https://matrix.org/docs/spec/rooms/v4#event-ids
+func ComputeEventID(e Event, version RoomVersion) (string, error) {
+	format, err := version.EventIDFormat()
+	if err != nil {
+		return "", err
+	}
+
+	var encoding *base64.Encoding
+	switch format {
+	case EventIDFormatV2:
+		encoding = base64.RawStdEncoding
+	case EventIDFormatV3:
+		encoding = base64.RawURLEncoding
+	default:
+		return "", fmt.Errorf(
+			"gomatrixserverlib: room version %q does not derive event IDs from the event", version,
+		)
+	}
+
+	hashAlgorithm, err := version.HashAlgorithm()
+	if err != nil {
+		return "", err
+	}
+
+	redactionAlgorithm, err := version.RedactionAlgorithm()
+	if err != nil {
+		return "", err
 	}
 
-	return EventReference{eventID, sha256Hash[:]}, nil
+	eventJSON, err := sjson.DeleteBytes(e.eventJSON, "event_id")
+	if err != nil {
+		return "", err
+	}
+
+	referenceHash, err := referenceHashOfEvent(eventJSON, hashAlgorithm, redactionAlgorithm)
+	if err != nil {
+		return "", err
+	}
+
+	return "$" + encoding.EncodeToString(referenceHash), nil
 }
 
 // SignEvent adds a ED25519 signature to the event for the given key.
-func signEvent(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, eventJSON []byte) ([]byte, error) {
+func signEvent(
+	signingName string, keyID KeyID, privateKey ed25519.PrivateKey, eventJSON []byte, redactionAlgorithm RedactionAlgorithm,
+) ([]byte, error) {
 
 	// Redact the event before signing so signature that will remain valid even if the event is redacted.
-	redactedJSON, err := redactEvent(eventJSON)
+	redactedJSON, err := redactEventForSignatures(eventJSON, redactionAlgorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -169,8 +255,10 @@ func signEvent(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, e
 }
 
 // VerifyEventSignature checks if the event has been signed by the given ED25519 key.
-func verifyEventSignature(signingName string, keyID KeyID, publicKey ed25519.PublicKey, eventJSON []byte) error {
-	redactedJSON, err := redactEvent(eventJSON)
+func verifyEventSignature(
+	signingName string, keyID KeyID, publicKey ed25519.PublicKey, eventJSON []byte, redactionAlgorithm RedactionAlgorithm,
+) error {
+	redactedJSON, err := redactEventForSignatures(eventJSON, redactionAlgorithm)
 	if err != nil {
 		return err
 	}
@@ -178,11 +266,22 @@ func verifyEventSignature(signingName string, keyID KeyID, publicKey ed25519.Pub
 	return VerifyJSON(signingName, keyID, publicKey, redactedJSON)
 }
 
+// VerifyEventSignature checks that the event has a valid signature from the
+// origin server made with the given key, without needing a JSONVerifier. Only
+// that one signature is checked: the event may need signatures from other
+// servers, which VerifyEventSignatures checks, and the key isn't checked to
+// have been valid at the time of the event. The event is redacted with the
+// rules of room version 1 before checking the signature. Returns an error if
+// the event isn't signed with the key or the signature doesn't match.
+func VerifyEventSignature(e Event, origin ServerName, keyID KeyID, publicKey ed25519.PublicKey) error {
+	return verifyEventSignature(string(origin), keyID, publicKey, e.eventJSON, RedactionAlgorithmV1)
+}
+
 // VerifyEventSignatures checks that each event in a list of events has valid
-// signatures from the server that sent it.
+// signatures from the server that sent it, using the rules of room version 1.
 //
 // returns an array with either an error or nil for each event.
-func VerifyEventSignatures(ctx context.Context, events []Event, keyRing JSONVerifier) ([]error, error) { // nolint: gocyclo
+func VerifyEventSignatures(ctx context.Context, events []Event, keyRing JSONVerifier) ([]error, error) {
 	// we will end up doing at least as many verifications as we have events.
 	// some events require multiple verifications, as they are signed by multiple
 	// servers.
@@ -192,55 +291,11 @@ func VerifyEventSignatures(ctx context.Context, events []Event, keyRing JSONVeri
 	verificationMap := make([][]int, len(events))
 
 	for evtIdx, event := range events {
-		redactedJSON, err := redactEvent(event.eventJSON)
-		if err != nil {
-			return nil, err
-		}
-
-		domains := make(map[ServerName]bool)
-		domains[event.Origin()] = true
-
-		// in general, we expect the domain of the sender id to be the
-		// same as the origin; however there was a bug in an old version
-		// of synapse which meant that some joins/leaves used the origin
-		// and event id supplied by the helping server instead of the
-		// joining/leaving server.
-		//
-		// That's ok, provided it's signed by the sender's server too.
-		//
-		// XXX we may have to exclude 3pid invites here, as per
-		// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L58-L64.
-		//
-		senderDomain, err := domainFromID(event.Sender())
+		requests, err := eventVerifyJSONRequests(event, RoomVersionV1)
 		if err != nil {
 			return nil, err
 		}
-		domains[ServerName(senderDomain)] = true
-
-		// MRoomMember invite events are signed by both the server sending
-		// the invite and the server the invite is for.
-		if event.Type() == MRoomMember && event.StateKey() != nil {
-			targetDomain, err := domainFromID(*event.StateKey())
-			if err != nil {
-				return nil, err
-			}
-			if ServerName(targetDomain) != event.Origin() {
-				c, err := NewMemberContentFromEvent(event)
-				if err != nil {
-					return nil, err
-				}
-				if c.Membership == Invite {
-					domains[ServerName(targetDomain)] = true
-				}
-			}
-		}
-
-		for domain := range domains {
-			v := VerifyJSONRequest{
-				Message:    redactedJSON,
-				AtTS:       event.OriginServerTS(),
-				ServerName: domain,
-			}
+		for _, v := range requests {
 			verificationMap[evtIdx] = append(verificationMap[evtIdx], len(toVerify))
 			toVerify = append(toVerify, v)
 		}
@@ -266,20 +321,300 @@ func VerifyEventSignatures(ctx context.Context, events []Event, keyRing JSONVeri
 	return verificationErrors, nil
 }
 
+// eventVerifyJSONRequests returns the requests to check the signatures that
+// the event needs in the room version, one for each server that must have
+// signed it.
+func eventVerifyJSONRequests(event Event, roomVersion RoomVersion) ([]VerifyJSONRequest, error) { // nolint: gocyclo
+	desc, err := roomVersion.description()
+	if err != nil {
+		return nil, err
+	}
+	redactionAlgorithm, err := roomVersion.RedactionAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	redactedJSON, err := redactEventForSignatures(event.eventJSON, redactionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make(map[ServerName]bool)
+	domains[event.Origin()] = true
+
+	// in general, we expect the domain of the sender id to be the
+	// same as the origin; however there was a bug in an old version
+	// of synapse which meant that some joins/leaves used the origin
+	// and event id supplied by the helping server instead of the
+	// joining/leaving server.
+	//
+	// That's ok, provided it's signed by the sender's server too.
+	//
+	// XXX we may have to exclude 3pid invites here, as per
+	// https://github.com/matrix-org/synapse/blob/v0.21.0/synapse/event_auth.py#L58-L64.
+	//
+	senderDomain, err := domainFromID(event.Sender())
+	if err != nil {
+		return nil, err
+	}
+	domains[ServerName(senderDomain)] = true
+
+	// MRoomMember invite events are signed by both the server sending
+	// the invite and the server the invite is for.
+	if event.Type() == MRoomMember && event.StateKey() != nil {
+		targetDomain, err := domainFromID(*event.StateKey())
+		if err != nil {
+			return nil, err
+		}
+		if ServerName(targetDomain) != event.Origin() {
+			c, err := NewMemberContentFromEvent(event)
+			if err != nil {
+				return nil, err
+			}
+			if c.Membership == Invite {
+				domains[ServerName(targetDomain)] = true
+			}
+		}
+	}
+
+	// MRoomMember join events to restricted rooms are also signed by the
+	// server of the user that authorised the join. Room versions without
+	// restricted joins ignore the "join_authorised_via_users_server" key.
+	if event.Type() == MRoomMember && desc.restrictedJoins {
+		c, err := NewMemberContentFromEvent(event)
+		if err == nil && c.Membership == Join && c.AuthorisedVia != "" {
+			authoriserDomain, err := domainFromID(c.AuthorisedVia)
+			if err != nil {
+				return nil, err
+			}
+			domains[ServerName(authoriserDomain)] = true
+		}
+	}
+
+	requests := make([]VerifyJSONRequest, 0, len(domains))
+	for domain := range domains {
+		requests = append(requests, VerifyJSONRequest{
+			Message:    redactedJSON,
+			AtTS:       event.OriginServerTS(),
+			ServerName: domain,
+		})
+	}
+	return requests, nil
+}
+
+// A VerifyResult is the result of checking the signatures of an event.
+type VerifyResult struct {
+	// The ID of the event.
+	EventID string
+	// Whether the event has valid signatures from every server that must
+	// have signed it.
+	Passed bool
+	// Why the event didn't pass if it didn't. This is a KeyNotFoundError,
+	// KeyFetchFailedError, KeyExpiredError or SignatureInvalidError if the
+	// KeyRing couldn't find a key, found a key that wasn't valid at the time
+	// of the event, or found a key that the signature didn't match. Other
+	// JSONVerifiers may return other errors.
+	Error error
+	// The outcome for each of the signatures from the server whose check
+	// failed, if the JSONVerifier reported them.
+	Signatures []SignatureResult
+	// Whether only the redacted form of the event is valid, if it passed.
+	// The signatures only cover the redacted form, so an event whose
+	// content was changed or removed on the way, such as by a server that
+	// redacted it, still passes but no longer matches its content hash.
+	// Such an event must be treated as redacted, so callers should store
+	// Event.RedactForRoomVersion with the room version that the event was
+	// checked with rather than the event as it was received.
+	Redacted bool
+}
+
+// VerifyEventSignaturesBatch checks the signatures of each event, like
+// VerifyEventSignatures, and returns a result for each event in the same
+// order, so that the events that pass can be kept and the others dropped.
+// As the spec requires, the signatures are checked over the redacted form
+// of the event, and then the content of each event that passed is checked
+// against its content hash, setting Redacted if only the redacted form is
+// valid.
+// Unlike VerifyEventSignatures it doesn't fail the whole batch if an event
+// is malformed: that event fails instead. If the JSONVerifier returns an
+// error then every event that was checked fails with that error.
+// The room version decides how the events are redacted and which servers
+// must sign them. If it is unknown then every event fails.
+func VerifyEventSignaturesBatch(
+	ctx context.Context, events []Event, keyRing JSONVerifier, roomVersion RoomVersion,
+) []VerifyResult {
+	results := make([]VerifyResult, len(events))
+	toVerify := make([]VerifyJSONRequest, 0, len(events))
+	verificationMap := make([][]int, len(events))
+	for evtIdx, event := range events {
+		results[evtIdx].EventID = event.EventID()
+		requests, err := eventVerifyJSONRequests(event, roomVersion)
+		if err != nil {
+			results[evtIdx].Error = err
+			continue
+		}
+		for _, v := range requests {
+			verificationMap[evtIdx] = append(verificationMap[evtIdx], len(toVerify))
+			toVerify = append(toVerify, v)
+		}
+	}
+
+	verifyResults, err := keyRing.VerifyJSONs(ctx, toVerify)
+	if err == nil && len(verifyResults) < len(toVerify) {
+		err = fmt.Errorf("gomatrixserverlib: expected %d verification results got %d", len(toVerify), len(verifyResults))
+	}
+	for evtIdx := range events {
+		if results[evtIdx].Error != nil {
+			continue
+		}
+		if err != nil {
+			results[evtIdx].Error = err
+			continue
+		}
+		for _, verificationIdx := range verificationMap[evtIdx] {
+			if verifyResults[verificationIdx].Error != nil {
+				results[evtIdx].Error = verifyResults[verificationIdx].Error
+				results[evtIdx].Signatures = verifyResults[verificationIdx].Signatures
+				break
+			}
+		}
+		results[evtIdx].Passed = results[evtIdx].Error == nil
+		if results[evtIdx].Passed {
+			results[evtIdx].Redacted = !hasValidContentHash(events[evtIdx])
+		}
+	}
+	return results
+}
+
+// hasValidContentHash returns whether the full content of the event matches
+// its content hash. Events that were redacted when they were loaded don't.
+func hasValidContentHash(event Event) bool {
+	if event.redacted {
+		return false
+	}
+	return checkEventContentHash(CanonicalJSONAssumeValid(event.eventJSON), HashAlgorithmSHA256) == nil
+}
+
 // VerifyAllEventSignatures checks that each event in a list of events has valid
-// signatures from the server that sent it.
+// signatures from the server that sent it, using the rules of room version 1.
 //
 // returns an error if any event fails verifications
 func VerifyAllEventSignatures(ctx context.Context, events []Event, keyRing JSONVerifier) error {
-	verificationErrors, err := VerifyEventSignatures(ctx, events, keyRing)
+	for _, result := range VerifyEventSignaturesBatch(ctx, events, keyRing, RoomVersionV1) {
+		if !result.Passed {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// VerifyAllEventSignaturesCollect checks the signatures of each event, like
+// VerifyAllEventSignatures, but carries on past events that fail so that it
+// can report all of them. Returns the error for each event that failed keyed
+// by event ID, which is empty if every event passed. If several events have
+// the same ID then the first failure is kept. The events are checked with the
+// rules of the room version, like VerifyEventSignaturesBatch.
+func VerifyAllEventSignaturesCollect(
+	ctx context.Context, events []Event, keyRing JSONVerifier, roomVersion RoomVersion,
+) map[string]error {
+	failures := map[string]error{}
+	for _, result := range VerifyEventSignaturesBatch(ctx, events, keyRing, roomVersion) {
+		if result.Passed {
+			continue
+		}
+		if _, ok := failures[result.EventID]; !ok {
+			failures[result.EventID] = result.Error
+		}
+	}
+	return failures
+}
+
+// A RestrictedJoinNoAuthoriserError is returned by CheckRestrictedJoinSignature
+// when the join event doesn't name a user that authorised the join.
+type RestrictedJoinNoAuthoriserError struct{}
+
+func (e RestrictedJoinNoAuthoriserError) Error() string {
+	return "gomatrixserverlib: join event doesn't claim an authorising user"
+}
+
+// A RestrictedJoinSignatureMissingError is returned by
+// CheckRestrictedJoinSignature when the server of the authorising user
+// hasn't signed the join event.
+type RestrictedJoinSignatureMissingError struct {
+	ServerName ServerName
+}
+
+func (e RestrictedJoinSignatureMissingError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: join event isn't signed by the authorising server %q", e.ServerName,
+	)
+}
+
+// A RestrictedJoinSignatureInvalidError is returned by
+// CheckRestrictedJoinSignature when the signature of the authorising server
+// on the join event couldn't be verified.
+type RestrictedJoinSignatureInvalidError struct {
+	ServerName ServerName
+	Err        error
+}
+
+func (e RestrictedJoinSignatureInvalidError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: invalid signature from the authorising server %q on join event: %s",
+		e.ServerName, e.Err,
+	)
+}
+
+// CheckRestrictedJoinSignature checks that a join event to a restricted room
+// is signed by the server of the user named in the
+// "join_authorised_via_users_server" key of the event content.
+// Returns a RestrictedJoinNoAuthoriserError if the event doesn't name an
+// authorising user, a RestrictedJoinSignatureMissingError if the authorising
+// server hasn't signed the event, or a RestrictedJoinSignatureInvalidError if
+// the signature isn't valid. The event is redacted with the rules of the room
+// version before checking the signature.
+// https://matrix.org/docs/spec/rooms/v8#authorization-rules
+func CheckRestrictedJoinSignature(ctx context.Context, keyRing JSONVerifier, joinEvent Event, roomVersion RoomVersion) error {
+	if joinEvent.Type() != MRoomMember {
+		return fmt.Errorf("gomatrixserverlib: event %q is not a m.room.member event", joinEvent.EventID())
+	}
+	content, err := NewMemberContentFromEvent(joinEvent)
 	if err != nil {
 		return err
 	}
-	for idx := range events {
-		ve := verificationErrors[idx]
-		if ve != nil {
-			return ve
-		}
+	if content.Membership != Join || content.AuthorisedVia == "" {
+		return RestrictedJoinNoAuthoriserError{}
+	}
+	authoriserDomain, err := domainFromID(content.AuthorisedVia)
+	if err != nil {
+		return err
+	}
+	serverName := ServerName(authoriserDomain)
+
+	if len(joinEvent.KeyIDs(authoriserDomain)) == 0 {
+		return RestrictedJoinSignatureMissingError{serverName}
+	}
+
+	redactionAlgorithm, err := roomVersion.RedactionAlgorithm()
+	if err != nil {
+		return err
+	}
+	redactedJSON, err := redactEventForSignatures(joinEvent.eventJSON, redactionAlgorithm)
+	if err != nil {
+		return err
+	}
+	results, err := keyRing.VerifyJSONs(ctx, []VerifyJSONRequest{{
+		ServerName: serverName,
+		Message:    redactedJSON,
+		AtTS:       joinEvent.OriginServerTS(),
+	}})
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("gomatrixserverlib: expected 1 verification result got %d", len(results))
+	}
+	if results[0].Error != nil {
+		return RestrictedJoinSignatureInvalidError{serverName, results[0].Error}
 	}
 	return nil
 }
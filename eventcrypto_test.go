@@ -20,8 +20,11 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
 )
@@ -42,14 +45,14 @@ func TestVerifyEventSignatureTestVectors(t *testing.T) {
 	}
 
 	testVerifyOK := func(input string) {
-		err := verifyEventSignature(entityName, keyID, publicKey, []byte(input))
+		err := verifyEventSignature(entityName, keyID, publicKey, []byte(input), RedactionAlgorithmV1)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 
 	testVerifyNotOK := func(reason, input string) {
-		err := verifyEventSignature(entityName, keyID, publicKey, []byte(input))
+		err := verifyEventSignature(entityName, keyID, publicKey, []byte(input), RedactionAlgorithmV1)
 		if err == nil {
 			t.Fatalf("Expected VerifyJSON to fail for input %v because %v", input, reason)
 		}
@@ -185,11 +188,11 @@ func TestSignEventTestVectors(t *testing.T) {
 	}
 
 	testSign := func(input string, want string) {
-		hashed, err := addContentHashesToEvent([]byte(input))
+		hashed, err := addContentHashesToEvent([]byte(input), HashAlgorithmSHA256)
 		if err != nil {
 			t.Fatal(err)
 		}
-		signed, err := signEvent(entityName, keyID, privateKey, hashed)
+		signed, err := signEvent(entityName, keyID, privateKey, hashed, RedactionAlgorithmV1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -381,7 +384,7 @@ func TestVerifyAllEventSignatures(t *testing.T) {
 	if len(verifier.requests) != 2 {
 		t.Fatalf("Number of requests: got %d, want 2", len(verifier.requests))
 	}
-	wantContent, err := redactEvent(eventJSON)
+	wantContent, err := redactEvent(eventJSON, RedactionAlgorithmV1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -440,7 +443,7 @@ func TestVerifyAllEventSignaturesForInvite(t *testing.T) {
 	if len(verifier.requests) != 2 {
 		t.Fatalf("Number of requests: got %d, want 2", len(verifier.requests))
 	}
-	wantContent, err := redactEvent(eventJSON)
+	wantContent, err := redactEvent(eventJSON, RedactionAlgorithmV1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -465,3 +468,673 @@ func TestVerifyAllEventSignaturesForInvite(t *testing.T) {
 		t.Errorf("Verify server 1: got %s, want %s", servers[1], "bobserver")
 	}
 }
+
+// testRestrictedJoinEvent returns a join event authorised by a user on
+// "resident" with the given signatures JSON.
+func testRestrictedJoinEvent(t *testing.T, authorisedVia, signatures string) Event {
+	eventJSON := []byte(`{
+		"type": "m.room.member",
+		"state_key": "@bob:joiner",
+		"event_id": "$join:joiner",
+		"room_id": "!test:room",
+		"sender": "@bob:joiner",
+		"origin": "joiner",
+		"content": {
+			"membership": "join",
+			"join_authorised_via_users_server": "` + authorisedVia + `"
+		},
+		"origin_server_ts": 123456,
+		"signatures": ` + signatures + `
+	}`)
+	event, err := NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestCheckRestrictedJoinSignature(t *testing.T) {
+	signedByBoth := `{"joiner": {"ed25519:1": "sig"}, "resident": {"ed25519:1": "sig"}}`
+	signedByJoiner := `{"joiner": {"ed25519:1": "sig"}}`
+
+	err := CheckRestrictedJoinSignature(
+		context.Background(), &StubVerifier{}, testRestrictedJoinEvent(t, "", signedByBoth), RoomVersionV9,
+	)
+	if _, ok := err.(RestrictedJoinNoAuthoriserError); !ok {
+		t.Errorf("no authoriser: want RestrictedJoinNoAuthoriserError got %T: %v", err, err)
+	}
+
+	err = CheckRestrictedJoinSignature(
+		context.Background(), &StubVerifier{}, testRestrictedJoinEvent(t, "@alice:resident", signedByJoiner), RoomVersionV9,
+	)
+	if e, ok := err.(RestrictedJoinSignatureMissingError); !ok || e.ServerName != "resident" {
+		t.Errorf("missing signature: want RestrictedJoinSignatureMissingError got %T: %v", err, err)
+	}
+
+	verifier := StubVerifier{
+		results: []VerifyJSONResult{{Error: fmt.Errorf("bad signature")}},
+	}
+	err = CheckRestrictedJoinSignature(
+		context.Background(), &verifier, testRestrictedJoinEvent(t, "@alice:resident", signedByBoth), RoomVersionV9,
+	)
+	if e, ok := err.(RestrictedJoinSignatureInvalidError); !ok || e.ServerName != "resident" {
+		t.Errorf("invalid signature: want RestrictedJoinSignatureInvalidError got %T: %v", err, err)
+	}
+
+	verifier = StubVerifier{
+		results: make([]VerifyJSONResult, 1),
+	}
+	err = CheckRestrictedJoinSignature(
+		context.Background(), &verifier, testRestrictedJoinEvent(t, "@alice:resident", signedByBoth), RoomVersionV9,
+	)
+	if err != nil {
+		t.Errorf("valid signature: unexpected error: %v", err)
+	}
+	if len(verifier.requests) != 1 || verifier.requests[0].ServerName != "resident" {
+		t.Fatalf("valid signature: want a single request for %q got %v", "resident", verifier.requests)
+	}
+	// Version 9 rooms keep the authorising user when redacting join events,
+	// so that the signature covers who authorised the join.
+	if !bytes.Contains(verifier.requests[0].Message, []byte(`"join_authorised_via_users_server":"@alice:resident"`)) {
+		t.Errorf("valid signature: want the authorising user in the signed JSON, got %s", verifier.requests[0].Message)
+	}
+}
+
+func TestVerifyAllEventSignaturesForRestrictedJoin(t *testing.T) {
+	// Only room versions with restricted joins require the signature of the
+	// server of the user that authorised the join.
+	event := testRestrictedJoinEvent(t, "@alice:resident", `{}`)
+	for _, test := range []struct {
+		roomVersion RoomVersion
+		want        []string
+	}{
+		{RoomVersionV1, []string{"joiner"}},
+		{RoomVersionV7, []string{"joiner"}},
+		{RoomVersionV8, []string{"joiner", "resident"}},
+		{RoomVersionV11, []string{"joiner", "resident"}},
+	} {
+		verifier := StubVerifier{
+			results: make([]VerifyJSONResult, 2),
+		}
+		results := VerifyEventSignaturesBatch(context.Background(), []Event{event}, &verifier, test.roomVersion)
+		if !results[0].Passed {
+			t.Fatalf("room version %s: %v", test.roomVersion, results[0].Error)
+		}
+
+		servers := []string{}
+		for _, rq := range verifier.requests {
+			servers = append(servers, string(rq.ServerName))
+		}
+		sort.Strings(servers)
+		if !reflect.DeepEqual(servers, test.want) {
+			t.Errorf("room version %s: Verify servers: got %v, want %v", test.roomVersion, servers, test.want)
+		}
+	}
+}
+
+func TestVerifyAllEventSignaturesCollect(t *testing.T) {
+	const keyID = KeyID("ed25519:1")
+	now := time.Unix(1500000000, 0)
+	db := NewInMemoryKeyDatabase(nil)
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each server has its key in the database, and the bad servers sign
+	// their events with a different key.
+	build := func(serverName ServerName, good bool) Event {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			{serverName, keyID}: {
+				VerifyKey:    VerifyKey{Key: Base64String(publicKey)},
+				ValidUntilTS: AsTimestamp(now.Add(time.Hour)),
+				ExpiredTS:    PublicKeyNotExpired,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !good {
+			privateKey = otherKey
+		}
+		stateKey := ""
+		builder := EventBuilder{
+			Sender:   "@u:" + string(serverName),
+			RoomID:   "!r:" + string(serverName),
+			Type:     "m.room.topic",
+			StateKey: &stateKey,
+			Content:  RawJSON(`{"topic":"hello"}`),
+		}
+		event, err := builder.Build("$"+string(serverName)+":"+string(serverName), now, serverName, keyID, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	events := []Event{
+		build("a.com", true),
+		build("b.com", false),
+		build("c.com", true),
+		build("d.com", false),
+		build("e.com", true),
+	}
+
+	keyRing := KeyRing{KeyDatabase: db}
+	failures := VerifyAllEventSignaturesCollect(context.Background(), events, keyRing, RoomVersionV1)
+	if len(failures) != 2 {
+		t.Fatalf("VerifyAllEventSignaturesCollect: got %d failures, want 2: %v", len(failures), failures)
+	}
+	for _, eventID := range []string{"$b.com:b.com", "$d.com:d.com"} {
+		if _, ok := failures[eventID].(SignatureInvalidError); !ok {
+			t.Errorf("VerifyAllEventSignaturesCollect: wanted a SignatureInvalidError for %q, got %v", eventID, failures[eventID])
+		}
+	}
+
+	// Every event passing gives an empty map.
+	failures = VerifyAllEventSignaturesCollect(context.Background(), []Event{events[0], events[2], events[4]}, keyRing, RoomVersionV1)
+	if len(failures) != 0 {
+		t.Errorf("VerifyAllEventSignaturesCollect: wanted no failures, got %v", failures)
+	}
+}
+
+func TestVerifyEventSignaturesBatchRedacted(t *testing.T) {
+	const keyID = KeyID("ed25519:1")
+	now := time.Unix(1500000000, 0)
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewInMemoryKeyDatabase(nil)
+	if err = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{"a.com", keyID}: {
+			VerifyKey:    VerifyKey{Key: Base64String(publicKey)},
+			ValidUntilTS: AsTimestamp(now.Add(time.Hour)),
+			ExpiredTS:    PublicKeyNotExpired,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	builder := EventBuilder{
+		Sender:  "@u:a.com",
+		RoomID:  "!r:a.com",
+		Type:    "m.room.message",
+		Content: RawJSON(`{"body":"secret"}`),
+	}
+	original, err := builder.Build("$e:a.com", now, "a.com", keyID, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A third server relays the event with its content changed, such as by
+	// redacting it, keeping the original hashes and signatures.
+	relay := func(from, to string, redact bool) Event {
+		eventJSON := bytes.Replace(original.JSON(), []byte(from), []byte(to), 1)
+		if bytes.Equal(eventJSON, original.JSON()) {
+			t.Fatalf("Event JSON %s doesn't contain %s", original.JSON(), from)
+		}
+		var event Event
+		if redact {
+			event, err = NewEventFromUntrustedJSON(eventJSON)
+		} else {
+			event, err = NewEventFromTrustedJSON(eventJSON, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	events := []Event{
+		original,
+		relay(`"content":{"body":"secret"}`, `"content":{}`, false),
+		relay(`"content":{"body":"secret"}`, `"content":{}`, true),
+		relay(`"body":"secret"`, `"body":"changed"`, false),
+		relay(`"type":"m.room.message"`, `"type":"m.room.other"`, false),
+	}
+
+	results := VerifyEventSignaturesBatch(context.Background(), events, KeyRing{KeyDatabase: db}, RoomVersionV1)
+	if !results[0].Passed || results[0].Redacted {
+		t.Errorf("VerifyEventSignaturesBatch: wanted the original event to pass unredacted, got %+v", results[0])
+	}
+	for i := 1; i <= 3; i++ {
+		if !results[i].Passed || !results[i].Redacted {
+			t.Errorf("Event %d: VerifyEventSignaturesBatch: wanted the event to pass only redacted, got %+v", i, results[i])
+		}
+	}
+	// The type is covered by the signature, so changing it isn't allowed.
+	if results[4].Passed || results[4].Redacted {
+		t.Errorf("VerifyEventSignaturesBatch: wanted the event with a changed type to fail, got %+v", results[4])
+	}
+}
+
+func TestVerifyEventSignaturesBatch(t *testing.T) {
+	const keyID = KeyID("ed25519:1")
+	now := time.Unix(1500000000, 0)
+	db := NewInMemoryKeyDatabase(nil)
+	build := func(serverName ServerName, privateKey ed25519.PrivateKey) Event {
+		stateKey := ""
+		builder := EventBuilder{
+			Sender:   "@u:" + string(serverName),
+			RoomID:   "!r:" + string(serverName),
+			Type:     "m.room.topic",
+			StateKey: &stateKey,
+			Content:  RawJSON(`{"topic":"hello"}`),
+		}
+		event, err := builder.Build("$"+string(serverName)+":"+string(serverName), now, serverName, keyID, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	signed := func(serverName ServerName, result PublicKeyLookupResult) Event {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Key == nil {
+			result.Key = Base64String(publicKey)
+		}
+		if err = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			{serverName, keyID}: result,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return build(serverName, privateKey)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validUntil := AsTimestamp(now.Add(time.Hour))
+
+	events := []Event{
+		signed("good.com", PublicKeyLookupResult{ValidUntilTS: validUntil}),
+		build("unknown.com", otherKey),
+		signed("expired.com", PublicKeyLookupResult{ExpiredTS: AsTimestamp(now.Add(-time.Hour))}),
+		signed("bad.com", PublicKeyLookupResult{
+			VerifyKey: VerifyKey{Key: Base64String(otherKey.Public().(ed25519.PublicKey))}, ValidUntilTS: validUntil,
+		}),
+		signed("good2.com", PublicKeyLookupResult{ValidUntilTS: validUntil}),
+	}
+	results := VerifyEventSignaturesBatch(context.Background(), events, KeyRing{KeyDatabase: db}, RoomVersionV1)
+	if len(results) != len(events) {
+		t.Fatalf("VerifyEventSignaturesBatch: got %d results, want %d", len(results), len(events))
+	}
+	for i, result := range results {
+		if result.EventID != events[i].EventID() {
+			t.Errorf("Result %d: got event ID %q, want %q", i, result.EventID, events[i].EventID())
+		}
+	}
+	if !results[0].Passed || results[0].Error != nil || !results[4].Passed || results[4].Error != nil {
+		t.Errorf("VerifyEventSignaturesBatch: wanted the good events to pass, got %+v and %+v", results[0], results[4])
+	}
+	if _, ok := results[1].Error.(KeyNotFoundError); results[1].Passed || !ok {
+		t.Errorf("VerifyEventSignaturesBatch: wanted a KeyNotFoundError, got %+v", results[1])
+	}
+	if _, ok := results[2].Error.(KeyExpiredError); results[2].Passed || !ok {
+		t.Errorf("VerifyEventSignaturesBatch: wanted a KeyExpiredError, got %+v", results[2])
+	}
+	if _, ok := results[3].Error.(SignatureInvalidError); results[3].Passed || !ok {
+		t.Errorf("VerifyEventSignaturesBatch: wanted a SignatureInvalidError, got %+v", results[3])
+	}
+
+	// VerifyAllEventSignatures fails with the first failure.
+	if err := VerifyAllEventSignatures(context.Background(), events, KeyRing{KeyDatabase: db}); err != results[1].Error {
+		t.Errorf("VerifyAllEventSignatures: got %v, want %v", err, results[1].Error)
+	}
+	if err := VerifyAllEventSignatures(context.Background(), []Event{events[0], events[4]}, KeyRing{KeyDatabase: db}); err != nil {
+		t.Errorf("VerifyAllEventSignatures: unexpected error: %v", err)
+	}
+
+	// An error from the verifier fails every event.
+	keyRing := KeyRing{KeyDatabase: &erroringKeyDatabase{}}
+	for _, result := range VerifyEventSignaturesBatch(context.Background(), events, keyRing, RoomVersionV1) {
+		if result.Passed || result.Error != error(&testErrorFetch) {
+			t.Errorf("VerifyEventSignaturesBatch: wanted the database error, got %+v", result)
+		}
+	}
+}
+
+func TestVerifyEventSignature(t *testing.T) {
+	const keyID = KeyID("ed25519:1")
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateKey := ""
+	builder := EventBuilder{
+		Sender:   "@u:origin",
+		RoomID:   "!r:origin",
+		Type:     "m.room.topic",
+		StateKey: &stateKey,
+		Content:  RawJSON(`{"topic":"hello"}`),
+	}
+	event, err := builder.Build("$e:origin", time.Unix(1500000000, 0), "origin", keyID, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = VerifyEventSignature(event, "origin", keyID, publicKey); err != nil {
+		t.Errorf("VerifyEventSignature: unexpected error for the signing key: %v", err)
+	}
+	tests := []struct {
+		origin    ServerName
+		keyID     KeyID
+		publicKey ed25519.PublicKey
+	}{
+		{"origin", keyID, otherKey},
+		{"origin", "ed25519:2", publicKey},
+		{"other", keyID, publicKey},
+	}
+	for _, test := range tests {
+		if err = VerifyEventSignature(event, test.origin, test.keyID, test.publicKey); err == nil {
+			t.Errorf("VerifyEventSignature: wanted an error for %q with key ID %q", test.origin, test.keyID)
+		}
+	}
+}
+
+func TestComputeEventID(t *testing.T) {
+	// The signed minimal event from the test vectors in
+	// https://matrix.org/docs/spec/appendices.html, as it would be advertised
+	// with an event ID in a room version 3 or later room.
+	eventJSON := []byte(`{
+		"auth_events": [],
+		"content": {},
+		"depth": 3,
+		"event_id": "$8yif6p8EqgoSten2BLje9ntKm720NyFLWQv9tn8memc",
+		"hashes": {
+			"sha256": "5jM4wQpv6lnBo7CLIghJuHdW+s2CMBJPUOGOC89ncos"
+		},
+		"origin": "domain",
+		"origin_server_ts": 1000000,
+		"prev_events": [],
+		"room_id": "!x:domain",
+		"sender": "@a:domain",
+		"signatures": {
+			"domain": {
+				"ed25519:1": "KxwGjPSDEtvnFgU00fwFz+l6d2pJM6XBIaMEn81SXPTRl16AqLAYqfIReFGZlHi5KLjAWbOoMszkwsQma+lYAg"
+			}
+		},
+		"type": "X",
+		"unsigned": {
+			"age_ts": 1000000
+		}
+	}`)
+	event, err := NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "$8yif6p8EqgoSten2BLje9ntKm720NyFLWQv9tn8memc"
+	for _, version := range []RoomVersion{
+		RoomVersionV3, RoomVersionV4, RoomVersionV5, RoomVersionV6, RoomVersionV7,
+		RoomVersionV8, RoomVersionV9, RoomVersionV10,
+	} {
+		got, err := ComputeEventID(event, version)
+		if err != nil {
+			t.Fatalf("ComputeEventID(%q): %s", version, err)
+		}
+		if got != want {
+			t.Errorf("ComputeEventID(%q): want %q got %q", version, want, got)
+		}
+	}
+	// Room version 11 no longer keeps the "origin" key when redacting, so it
+	// isn't part of the reference hash.
+	if got, err := ComputeEventID(event, RoomVersionV11); err != nil || got != "$70O_oKlXzFbkfu0KE88USi98DjSWrOELrPj-8tisl8I" {
+		t.Errorf("ComputeEventID(%q): want %q got %q, %v", RoomVersionV11, "$70O_oKlXzFbkfu0KE88USi98DjSWrOELrPj-8tisl8I", got, err)
+	}
+
+	// The unsigned data and the advertised event ID are not part of the
+	// reference hash.
+	event, err = event.SetUnsigned(map[string]int{"age": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ComputeEventID(event, RoomVersionV4); err != nil || got != want {
+		t.Errorf("ComputeEventID after SetUnsigned: want %q got %q, %v", want, got, err)
+	}
+
+	// Room versions 1 and 2 don't derive the event ID from the event.
+	for _, version := range []RoomVersion{RoomVersionV1, RoomVersionV2, ""} {
+		if _, err := ComputeEventID(event, version); err == nil {
+			t.Errorf("ComputeEventID(%q): expected an error", version)
+		}
+	}
+
+	if _, err := ComputeEventID(event, "unknown"); err == nil {
+		t.Error("ComputeEventID with unknown room version: expected an error")
+	} else if _, ok := err.(UnsupportedRoomVersionError); !ok {
+		t.Errorf("ComputeEventID with unknown room version: want UnsupportedRoomVersionError got %T", err)
+	}
+}
+
+func TestComputeEventIDEncodings(t *testing.T) {
+	// Room version 3 uses the standard base64 alphabet and room version 4
+	// onwards use the URL-safe alphabet.
+	event, err := NewEventFromTrustedJSON([]byte(`{
+		"auth_events": [],
+		"content": {"body": "x"},
+		"depth": 7,
+		"origin": "domain",
+		"origin_server_ts": 1000000,
+		"prev_events": [],
+		"room_id": "!x:domain",
+		"sender": "@a:domain",
+		"type": "X"
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3, err := ComputeEventID(event, RoomVersionV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, err := ComputeEventID(event, RoomVersionV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := base64.RawURLEncoding.DecodeString(v4[1:])
+	if err != nil {
+		t.Fatalf("room version 4 event ID %q is not URL-safe base64: %s", v4, err)
+	}
+	if want := "$" + base64.RawStdEncoding.EncodeToString(hash); v3 != want {
+		t.Errorf("room version 3 event ID: want %q got %q", want, v3)
+	}
+}
+
+func TestComputeEventIDRedactionRules(t *testing.T) {
+	// The reference hash is computed over the event redacted with the rules
+	// of the room version, so the event ID changes in the room versions
+	// that change which keys are kept.
+	for _, tc := range []struct {
+		eventJSON string
+		want      map[RoomVersion]string
+	}{
+		{
+			// Room version 6 no longer keeps the aliases of m.room.aliases events.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.aliases","state_key":"domain","content":{"aliases":["#a:domain"]}}`,
+			map[RoomVersion]string{
+				RoomVersionV5:  "$aRBFVYRLqz2-gCtsvs5Gbw0cM08uqj8J8cMnqxJ1MJ0",
+				RoomVersionV6:  "$X01ufY0NUZfJROS4iEPAPv9Z493LpptOdqiWcIV_y-0",
+				RoomVersionV11: "$Ff2g2eDrmY0Uv7CUH1upBq6ZDu2VIMmseSIsE753Jxw",
+			},
+		},
+		{
+			// Room version 8 keeps the allow conditions of m.room.join_rules events.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.join_rules","state_key":"","content":{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!y:domain"}]}}`,
+			map[RoomVersion]string{
+				RoomVersionV7:  "$ZjCY4vi484JoCaqqAFmsUhU2MdvNzW7VowWg9NYPRXo",
+				RoomVersionV8:  "$_AX28AItRUJqgCoIRC9TmTVD4E4GIgJPCFliszT2YME",
+				RoomVersionV11: "$2BIwqsdHLRlnvCQqvoGgBt016rn3_bo6bCKMLWoRuAY",
+			},
+		},
+		{
+			// Room version 9 keeps the user who authorised a restricted join, and
+			// room version 11 no longer keeps the top level membership and origin.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.member","state_key":"@a:domain","membership":"join","content":{"membership":"join","join_authorised_via_users_server":"@b:domain","displayname":"A"}}`,
+			map[RoomVersion]string{
+				RoomVersionV8:  "$1hXNRMgxS2CeO3_MjbE3NoSJptuR3dE9ju4XhTbVy8Q",
+				RoomVersionV9:  "$lomypl8ubszcTJe17KOOmfVOGmi7aj-_7W-_CTuL59Q",
+				RoomVersionV11: "$CxvTRqw7TtG19Eb8GlA55x_qdCOdSLxdPPXKcAx4m04",
+			},
+		},
+		{
+			// Room version 11 keeps all the content of m.room.create events, and no
+			// longer keeps the top level prev_state.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.create","state_key":"","prev_state":[],"content":{"creator":"@a:domain","room_version":"11","m.federate":false}}`,
+			map[RoomVersion]string{
+				RoomVersionV10: "$cN3aAifZCUbEZv54ykvZykOC7rKSc8sAi8tv_4J3uE0",
+				RoomVersionV11: "$bfUFAAEM-TgBTfYio-rlAQwTEGoIhzU8bKuLRa3pXq0",
+			},
+		},
+		{
+			// Room version 11 keeps the invite level of m.room.power_levels events.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.power_levels","state_key":"","content":{"invite":0,"users":{"@a:domain":100}}}`,
+			map[RoomVersion]string{
+				RoomVersionV10: "$GiYaLcSE2wfX-8GvDmOKGd4JIZ8f2eolZDy9-T7qq0A",
+				RoomVersionV11: "$iyVbrJViOY9PUA8PXfJ-sW0FWfCzzqkyFuuKlO5OKno",
+			},
+		},
+		{
+			// Room version 11 keeps the redacts key of the content of m.room.redaction
+			// events.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.redaction","redacts":"$e","content":{"redacts":"$e","reason":"r"}}`,
+			map[RoomVersion]string{
+				RoomVersionV10: "$v1Qi2qpAG0SFLaUtachZPIqAGHIhVGcMqtP0GBaQipE",
+				RoomVersionV11: "$4NzAVKfx3OIriWMOToSh6APb43w9_OvJRjJdXd7hgFY",
+			},
+		},
+		{
+			// Room version 11 keeps the signed part of third party invites.
+			`{"auth_events":[],"depth":3,"origin":"domain","origin_server_ts":1000000,"prev_events":[],"room_id":"!x:domain","sender":"@a:domain","type":"m.room.member","state_key":"@c:domain","content":{"membership":"invite","third_party_invite":{"display_name":"c","signed":{"mxid":"@c:domain","token":"t","signatures":{}}}}}`,
+			map[RoomVersion]string{
+				RoomVersionV10: "$-r8XPA_fcptW1n0hiwM-J4sxyisyOMGhqGMSgM-zEFM",
+				RoomVersionV11: "$cp1zBcvYfBE-noKq3LB5ASt3Q1cOnffz1INAjpUjrGM",
+			},
+		},
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(tc.eventJSON), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for version, want := range tc.want {
+			got, err := ComputeEventID(event, version)
+			if err != nil {
+				t.Fatalf("ComputeEventID(%q): %s", version, err)
+			}
+			if got != want {
+				t.Errorf("ComputeEventID(%q) of %s: want %q got %q", version, event.Type(), want, got)
+			}
+		}
+	}
+}
+
+func TestVerifyEventSignaturesBatchRoomVersion(t *testing.T) {
+	// Events are signed over their redacted form, which depends on the room
+	// version, so an event built for a version 11 room only verifies with the
+	// rules of that room version.
+	const keyID = KeyID("ed25519:1")
+	now := time.Unix(1500000000, 0)
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewInMemoryKeyDatabase(nil)
+	if err = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{"a.com", keyID}: {
+			VerifyKey:    VerifyKey{Key: Base64String(publicKey)},
+			ValidUntilTS: AsTimestamp(now.Add(time.Hour)),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stateKey := "@u:a.com"
+	builder := EventBuilder{
+		Sender:   "@u:a.com",
+		RoomID:   "!r:a.com",
+		Type:     MRoomMember,
+		StateKey: &stateKey,
+		Content:  RawJSON(`{"membership":"join"}`),
+	}
+	event, err := builder.BuildWithDerivedEventID(now, "a.com", keyID, privateKey, RoomVersionV11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ComputeEventID(event, RoomVersionV11); err != nil || got != event.EventID() {
+		t.Errorf("ComputeEventID: want %q got %q, %v", event.EventID(), got, err)
+	}
+
+	keyRing := KeyRing{KeyDatabase: db}
+	if results := VerifyEventSignaturesBatch(context.Background(), []Event{event}, keyRing, RoomVersionV11); !results[0].Passed {
+		t.Errorf("VerifyEventSignaturesBatch: wanted the event to pass in room version 11, got %+v", results[0])
+	}
+	if results := VerifyEventSignaturesBatch(context.Background(), []Event{event}, keyRing, RoomVersionV10); results[0].Passed {
+		t.Error("VerifyEventSignaturesBatch: wanted the event to fail in room version 10")
+	}
+	if results := VerifyEventSignaturesBatch(context.Background(), []Event{event}, keyRing, "unknown"); results[0].Passed {
+		t.Error("VerifyEventSignaturesBatch: wanted the event to fail in an unknown room version")
+	}
+}
+
+func TestBuildEventReferenceFormat(t *testing.T) {
+	// Room versions with server chosen event IDs reference events with
+	// [event_id, hashes] tuples, later room versions with bare event IDs.
+	const keyID = KeyID("ed25519:1")
+	now := time.Unix(1500000000, 0)
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := EventReference{EventID: "$prev:a.com", EventSHA256: Base64String("hash")}
+	builder := EventBuilder{
+		Sender:     "@u:a.com",
+		RoomID:     "!r:a.com",
+		Type:       "m.room.message",
+		Content:    RawJSON(`{"body":"hello"}`),
+		PrevEvents: []EventReference{ref},
+	}
+
+	v1, err := builder.Build("$e:a.com", now, "a.com", keyID, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v1Refs struct {
+		PrevEvents []RawJSON `json:"prev_events"`
+		AuthEvents []RawJSON `json:"auth_events"`
+	}
+	if err = json.Unmarshal(v1.JSON(), &v1Refs); err != nil {
+		t.Fatal(err)
+	}
+	want := `["$prev:a.com",{"sha256":"aGFzaA"}]`
+	if len(v1Refs.PrevEvents) != 1 || string(v1Refs.PrevEvents[0]) != want {
+		t.Errorf("room version 1 prev_events: want [%s] got %q", want, v1Refs.PrevEvents)
+	}
+	if v1Refs.AuthEvents == nil || len(v1Refs.AuthEvents) != 0 {
+		t.Errorf("room version 1 auth_events: want [] got %q", v1Refs.AuthEvents)
+	}
+
+	v4, err := builder.BuildWithDerivedEventID(now, "a.com", keyID, privateKey, RoomVersionV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v4Refs struct {
+		PrevEvents []string `json:"prev_events"`
+		AuthEvents []string `json:"auth_events"`
+	}
+	if err = json.Unmarshal(v4.JSON(), &v4Refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(v4Refs.PrevEvents) != 1 || v4Refs.PrevEvents[0] != ref.EventID {
+		t.Errorf("room version 4 prev_events: want [%q] got %q", ref.EventID, v4Refs.PrevEvents)
+	}
+	if v4Refs.AuthEvents == nil || len(v4Refs.AuthEvents) != 0 {
+		t.Errorf("room version 4 auth_events: want [] got %q", v4Refs.AuthEvents)
+	}
+	if got := v4.PrevEventIDs(); len(got) != 1 || got[0] != ref.EventID {
+		t.Errorf("Event.PrevEventIDs: want [%q] got %q", ref.EventID, got)
+	}
+}
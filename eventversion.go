@@ -0,0 +1,243 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// A RoomVersion refers to the version of the room, as given by the
+// "room_version" key of the m.room.create event. The version determines
+// the event format and the algorithms used by the room.
+// See https://matrix.org/docs/spec/#room-versions
+type RoomVersion string
+
+// EventIDFormat refers to the way event IDs are generated in a room version.
+type EventIDFormat int
+
+// StateResAlgorithm refers to the version of the state resolution algorithm
+// used by a room version.
+type StateResAlgorithm int
+
+// RedactionAlgorithm refers to the rules used to redact the events of a room
+// version, which decide the keys that are kept by the signatures and
+// reference hashes of the events.
+type RedactionAlgorithm int
+
+// Room version constants. These are strings because the version grammar
+// allows for future expansion.
+const (
+	RoomVersionV1  RoomVersion = "1"
+	RoomVersionV2  RoomVersion = "2"
+	RoomVersionV3  RoomVersion = "3"
+	RoomVersionV4  RoomVersion = "4"
+	RoomVersionV5  RoomVersion = "5"
+	RoomVersionV6  RoomVersion = "6"
+	RoomVersionV7  RoomVersion = "7"
+	RoomVersionV8  RoomVersion = "8"
+	RoomVersionV9  RoomVersion = "9"
+	RoomVersionV10 RoomVersion = "10"
+	RoomVersionV11 RoomVersion = "11"
+)
+
+// Event ID format constants.
+const (
+	// EventIDFormatV1 event IDs are chosen by the origin server and have
+	// the form "$localpart:server_name".
+	EventIDFormatV1 EventIDFormat = iota + 1
+	// EventIDFormatV2 event IDs are the standard base64 encoding of the
+	// reference hash of the event.
+	EventIDFormatV2
+	// EventIDFormatV3 event IDs are the URL-safe base64 encoding of the
+	// reference hash of the event.
+	EventIDFormatV3
+)
+
+// State resolution algorithm constants.
+const (
+	// StateResV1 is the original state resolution algorithm, which is
+	// implemented by ResolveStateConflicts.
+	StateResV1 StateResAlgorithm = iota + 1
+	// StateResV2 is version 2 of the state resolution algorithm, which is
+	// implemented by ResolveStateConflictsV2.
+	StateResV2
+)
+
+// Redaction algorithm constants. Each version keeps the keys of the one
+// before it, except where noted.
+const (
+	// RedactionAlgorithmV1 is the original redaction algorithm.
+	RedactionAlgorithmV1 RedactionAlgorithm = iota + 1
+	// RedactionAlgorithmV2 no longer keeps the "aliases" key of the content
+	// of m.room.aliases events.
+	RedactionAlgorithmV2
+	// RedactionAlgorithmV3 keeps the "allow" key of the content of
+	// m.room.join_rules events.
+	RedactionAlgorithmV3
+	// RedactionAlgorithmV4 keeps the "join_authorised_via_users_server" key
+	// of the content of m.room.member events.
+	RedactionAlgorithmV4
+	// RedactionAlgorithmV5 no longer keeps the top level "origin",
+	// "membership" and "prev_state" keys. It keeps all the content of
+	// m.room.create events, the "invite" key of m.room.power_levels events,
+	// the "signed" key of the "third_party_invite" of m.room.member events
+	// and the "redacts" key of m.room.redaction events.
+	RedactionAlgorithmV5
+)
+
+// A HashAlgorithm is used to compute the content hashes and reference hashes
+// of the events in a room.
+type HashAlgorithm interface {
+	// Name returns the key of the hash in the "hashes" object of an event.
+	// This is used as a JSON path so must only contain letters and digits.
+	Name() string
+	// Sum returns the hash of the data.
+	Sum(data []byte) []byte
+}
+
+// HashAlgorithmSHA256 is the SHA-256 hash algorithm, which is used by all the
+// current room versions.
+var HashAlgorithmSHA256 HashAlgorithm = sha256HashAlgorithm{}
+
+type sha256HashAlgorithm struct{}
+
+func (sha256HashAlgorithm) Name() string { return "sha256" }
+
+func (sha256HashAlgorithm) Sum(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// roomVersionDescription describes the behaviour of a room version.
+type roomVersionDescription struct {
+	eventIDFormat EventIDFormat
+	// The hash algorithm used for the content and reference hashes of the
+	// events. Room versions that don't set one use SHA-256.
+	hashAlgorithm HashAlgorithm
+	// Whether the room requires that integers in events are in the canonical
+	// JSON range, rather than clamping them to it.
+	enforceCanonicalJSON bool
+	// Whether the creator of the room is the sender of the m.room.create
+	// event rather than the "creator" key of its content.
+	implicitCreator bool
+	// Whether m.room.power_levels events are rejected if the keys of their
+	// "users" levels aren't valid user IDs, rather than ignoring those keys.
+	strictPowerLevelUsers bool
+	// Whether m.room.power_levels events are rejected if their levels aren't
+	// integers, rather than converting strings and floats to integers.
+	strictPowerLevelIntegers bool
+	// Whether users can join the room without an invite if its join rule is
+	// "restricted" or "knock_restricted" and a user in the room authorised
+	// the join.
+	restrictedJoins bool
+	// The state resolution algorithm used by the room. Room versions that
+	// don't set one use version 2 of the algorithm.
+	stateResAlgorithm StateResAlgorithm
+	// The rules used to redact the events of the room. Room versions that
+	// don't set one use version 1 of the algorithm.
+	redactionAlgorithm RedactionAlgorithm
+}
+
+var roomVersionMeta = map[RoomVersion]roomVersionDescription{
+	RoomVersionV1:  {eventIDFormat: EventIDFormatV1, stateResAlgorithm: StateResV1},
+	RoomVersionV2:  {eventIDFormat: EventIDFormatV1},
+	RoomVersionV3:  {eventIDFormat: EventIDFormatV2},
+	RoomVersionV4:  {eventIDFormat: EventIDFormatV3},
+	RoomVersionV5:  {eventIDFormat: EventIDFormatV3},
+	RoomVersionV6:  {eventIDFormat: EventIDFormatV3, enforceCanonicalJSON: true, redactionAlgorithm: RedactionAlgorithmV2},
+	RoomVersionV7:  {eventIDFormat: EventIDFormatV3, enforceCanonicalJSON: true, redactionAlgorithm: RedactionAlgorithmV2},
+	RoomVersionV8:  {eventIDFormat: EventIDFormatV3, enforceCanonicalJSON: true, restrictedJoins: true, redactionAlgorithm: RedactionAlgorithmV3},
+	RoomVersionV9:  {eventIDFormat: EventIDFormatV3, enforceCanonicalJSON: true, restrictedJoins: true, redactionAlgorithm: RedactionAlgorithmV4},
+	RoomVersionV10: {eventIDFormat: EventIDFormatV3, enforceCanonicalJSON: true, restrictedJoins: true, strictPowerLevelUsers: true, strictPowerLevelIntegers: true, redactionAlgorithm: RedactionAlgorithmV4},
+	RoomVersionV11: {eventIDFormat: EventIDFormatV3, enforceCanonicalJSON: true, restrictedJoins: true, strictPowerLevelUsers: true, strictPowerLevelIntegers: true, implicitCreator: true, redactionAlgorithm: RedactionAlgorithmV5},
+}
+
+// An UnsupportedRoomVersionError is returned when a room version is not
+// known to this library.
+type UnsupportedRoomVersionError struct {
+	Version RoomVersion
+}
+
+func (e UnsupportedRoomVersionError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: unsupported room version %q", string(e.Version))
+}
+
+// description returns the description of the room version. The empty room
+// version is treated as version 1, since a m.room.create event without a
+// "room_version" key creates a version 1 room.
+func (v RoomVersion) description() (roomVersionDescription, error) {
+	if v == "" {
+		v = RoomVersionV1
+	}
+	desc, ok := roomVersionMeta[v]
+	if !ok {
+		return roomVersionDescription{}, UnsupportedRoomVersionError{v}
+	}
+	return desc, nil
+}
+
+// EventIDFormat returns the event ID format used by the room version.
+// Returns an UnsupportedRoomVersionError if the room version is not known.
+func (v RoomVersion) EventIDFormat() (EventIDFormat, error) {
+	desc, err := v.description()
+	if err != nil {
+		return 0, err
+	}
+	return desc.eventIDFormat, nil
+}
+
+// HashAlgorithm returns the hash algorithm used for the content hashes and
+// reference hashes of events in the room version.
+// Returns an UnsupportedRoomVersionError if the room version is not known.
+func (v RoomVersion) HashAlgorithm() (HashAlgorithm, error) {
+	desc, err := v.description()
+	if err != nil {
+		return nil, err
+	}
+	if desc.hashAlgorithm == nil {
+		return HashAlgorithmSHA256, nil
+	}
+	return desc.hashAlgorithm, nil
+}
+
+// StateResAlgorithm returns the state resolution algorithm used by the room
+// version.
+// Returns an UnsupportedRoomVersionError if the room version is not known.
+func (v RoomVersion) StateResAlgorithm() (StateResAlgorithm, error) {
+	desc, err := v.description()
+	if err != nil {
+		return 0, err
+	}
+	if desc.stateResAlgorithm == 0 {
+		return StateResV2, nil
+	}
+	return desc.stateResAlgorithm, nil
+}
+
+// RedactionAlgorithm returns the rules used to redact the events of the room
+// version.
+// Returns an UnsupportedRoomVersionError if the room version is not known.
+func (v RoomVersion) RedactionAlgorithm() (RedactionAlgorithm, error) {
+	desc, err := v.description()
+	if err != nil {
+		return 0, err
+	}
+	if desc.redactionAlgorithm == 0 {
+		return RedactionAlgorithmV1, nil
+	}
+	return desc.redactionAlgorithm, nil
+}
@@ -0,0 +1,99 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestRoomVersionHashAlgorithm(t *testing.T) {
+	for _, version := range []RoomVersion{
+		"", RoomVersionV1, RoomVersionV2, RoomVersionV3, RoomVersionV4, RoomVersionV5,
+		RoomVersionV6, RoomVersionV7, RoomVersionV8, RoomVersionV9, RoomVersionV10,
+	} {
+		hashAlgorithm, err := version.HashAlgorithm()
+		if err != nil {
+			t.Fatalf("room version %q: unexpected error: %s", version, err)
+		}
+		if hashAlgorithm != HashAlgorithmSHA256 {
+			t.Errorf("room version %q: want SHA-256, got %q", version, hashAlgorithm.Name())
+		}
+	}
+
+	if _, err := RoomVersion("unknown").HashAlgorithm(); err == nil {
+		t.Error("unknown room version: expected an error")
+	}
+}
+
+func TestRoomVersionStateResAlgorithm(t *testing.T) {
+	for version, want := range map[RoomVersion]StateResAlgorithm{
+		"":             StateResV1,
+		RoomVersionV1:  StateResV1,
+		RoomVersionV2:  StateResV2,
+		RoomVersionV6:  StateResV2,
+		RoomVersionV11: StateResV2,
+	} {
+		got, err := version.StateResAlgorithm()
+		if err != nil {
+			t.Fatalf("room version %q: unexpected error: %s", version, err)
+		}
+		if got != want {
+			t.Errorf("room version %q: want state resolution algorithm %d, got %d", version, want, got)
+		}
+	}
+
+	if _, err := RoomVersion("unknown").StateResAlgorithm(); err == nil {
+		t.Error("unknown room version: expected an error")
+	}
+}
+
+func TestRoomVersionRedactionAlgorithm(t *testing.T) {
+	for version, want := range map[RoomVersion]RedactionAlgorithm{
+		"":             RedactionAlgorithmV1,
+		RoomVersionV5:  RedactionAlgorithmV1,
+		RoomVersionV6:  RedactionAlgorithmV2,
+		RoomVersionV7:  RedactionAlgorithmV2,
+		RoomVersionV8:  RedactionAlgorithmV3,
+		RoomVersionV9:  RedactionAlgorithmV4,
+		RoomVersionV10: RedactionAlgorithmV4,
+		RoomVersionV11: RedactionAlgorithmV5,
+	} {
+		got, err := version.RedactionAlgorithm()
+		if err != nil {
+			t.Fatalf("room version %q: unexpected error: %s", version, err)
+		}
+		if got != want {
+			t.Errorf("room version %q: want redaction algorithm %d, got %d", version, want, got)
+		}
+	}
+
+	if _, err := RoomVersion("unknown").RedactionAlgorithm(); err == nil {
+		t.Error("unknown room version: expected an error")
+	}
+}
+
+func TestHashAlgorithmSHA256(t *testing.T) {
+	data := []byte("hello")
+	want := sha256.Sum256(data)
+	if got := HashAlgorithmSHA256.Sum(data); hex.EncodeToString(got) != hex.EncodeToString(want[:]) {
+		t.Errorf("HashAlgorithmSHA256.Sum: want %x, got %x", want, got)
+	}
+	if HashAlgorithmSHA256.Name() != "sha256" {
+		t.Errorf("HashAlgorithmSHA256.Name: want %q, got %q", "sha256", HashAlgorithmSHA256.Name())
+	}
+}
@@ -269,6 +269,23 @@ func (ac *FederationClient) LookupProfile(
 	return
 }
 
+// Query makes a query of the given type to the remote server, with the given
+// query parameters. The response fields are returned as they are, so this
+// can be used for query types other than the ones that have their own
+// methods, like LookupRoomAlias and LookupProfile.
+// Spec: https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-query-querytype
+func (ac *FederationClient) Query(
+	ctx context.Context, s ServerName, queryType string, args url.Values,
+) (res RespQuery, err error) {
+	path := federationPathPrefixV1 + "/query/" + url.PathEscape(queryType)
+	if query := args.Encode(); query != "" {
+		path += "?" + query
+	}
+	req := NewFederationRequest("GET", s, path)
+	err = ac.doRequest(ctx, req, &res)
+	return
+}
+
 // GetEvent gets an event by ID from a remote server.
 // See https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-event-eventid
 func (ac *FederationClient) GetEvent(
@@ -2,13 +2,16 @@ package gomatrixserverlib
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
 
 	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
 )
 
 // A ServerName is the name a matrix homeserver is identified by.
@@ -29,6 +32,11 @@ func ParseAndValidateServerName(serverName ServerName) (host string, port int, v
 
 	host, port = splitServerName(serverName)
 
+	// Don't go any further if there is only a port, such as ":8448".
+	if len(host) == 0 {
+		return
+	}
+
 	// the host part must be one of:
 	//  - a valid (ascii) dns name
 	//  - an IPv4 address
@@ -47,6 +55,12 @@ func ParseAndValidateServerName(serverName ServerName) (host string, port int, v
 		return
 	}
 
+	// IPv6 addresses must be in square brackets, so any other host containing
+	// a colon is invalid rather than a DNS name.
+	if strings.Contains(host, ":") {
+		return
+	}
+
 	// try parsing as an IPv4 address
 	ip := net.ParseIP(host)
 	if ip != nil && ip.To4() != nil {
@@ -94,6 +108,12 @@ func splitServerName(serverName ServerName) (string, int) {
 		return nameStr, -1
 	}
 
+	if strings.Contains(nameStr[:lastColon], ":") && !strings.HasSuffix(nameStr[:lastColon], "]") {
+		// The colon is part of an IPv6 address that isn't in square brackets,
+		// such as "::1" or "::1:8448", so we can't tell where a port would be.
+		return nameStr, -1
+	}
+
 	portStr := nameStr[lastColon+1:]
 	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
@@ -145,6 +165,47 @@ type RespPublicRooms struct {
 	TotalRoomCountEstimate int `json:"total_room_count_estimate,omitempty"`
 }
 
+// Filter returns a copy of the response with only the rooms for which the
+// predicate returns true. The pagination tokens and the room count estimate
+// are left as they are.
+func (r RespPublicRooms) Filter(predicate func(PublicRoom) bool) RespPublicRooms {
+	result := r
+	result.Chunk = make([]PublicRoom, 0, len(r.Chunk))
+	for _, room := range r.Chunk {
+		if predicate(room) {
+			result.Chunk = append(result.Chunk, room)
+		}
+	}
+	return result
+}
+
+// FilterByServer returns a copy of the response without the rooms whose room
+// IDs are on servers matched by blocked. Rooms with invalid room IDs are also
+// removed since their server can't be checked.
+func (r RespPublicRooms) FilterByServer(blocked ServerNameMatcher) RespPublicRooms {
+	return r.Filter(func(room PublicRoom) bool {
+		_, serverName, err := SplitID('!', room.RoomID)
+		if err != nil {
+			return false
+		}
+		return !blocked.MatchServerName(serverName)
+	})
+}
+
+// A ServerNameMatcher decides whether a server name belongs to a set of
+// servers, for example the servers on a denylist.
+type ServerNameMatcher interface {
+	MatchServerName(serverName ServerName) bool
+}
+
+// ServerNameMatcherFunc is a function that can be used as a ServerNameMatcher.
+type ServerNameMatcherFunc func(serverName ServerName) bool
+
+// MatchServerName implements ServerNameMatcher.
+func (f ServerNameMatcherFunc) MatchServerName(serverName ServerName) bool {
+	return f(serverName)
+}
+
 // PublicRoom stores the info of a room returned by
 // GET /_matrix/federation/v1/publicRooms
 type PublicRoom struct {
@@ -168,12 +229,138 @@ type PublicRoom struct {
 	AvatarURL string `json:"avatar_url,omitempty"`
 }
 
+// Validate checks that the canonical alias and the aliases of the room are
+// valid room aliases.
+func (r PublicRoom) Validate() error {
+	if r.CanonicalAlias != "" {
+		if _, err := ParseRoomAlias(r.CanonicalAlias); err != nil {
+			return err
+		}
+	}
+	for _, alias := range r.Aliases {
+		if _, err := ParseRoomAlias(alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // A RespEventAuth is the content of a response to GET /_matrix/federation/v1/event_auth/{roomID}/{eventID}
 type RespEventAuth struct {
 	// A list of events needed to authenticate the state events.
 	AuthEvents []Event `json:"auth_chain"`
 }
 
+// ToStateIDs returns the event IDs of the state events and the auth events,
+// in the same order, as a response to /state_ids. The lists are empty rather
+// than nil if there are no events, so that they are marshalled as arrays.
+func (r RespState) ToStateIDs() RespStateIDs {
+	ids := RespStateIDs{
+		StateEventIDs: make([]string, len(r.StateEvents)),
+		AuthEventIDs:  make([]string, len(r.AuthEvents)),
+	}
+	for i := range r.StateEvents {
+		ids.StateEventIDs[i] = r.StateEvents[i].EventID()
+	}
+	for i := range r.AuthEvents {
+		ids.AuthEventIDs[i] = r.AuthEvents[i].EventID()
+	}
+	return ids
+}
+
+// A RawRespState is a response to /state whose events are only decoded when
+// they are asked for, which saves decoding all of the events of a large
+// response when only a few of them are looked at. The decoded events are
+// cached, so the JSON of an event shouldn't be changed once it has been
+// decoded. It isn't safe for concurrent use.
+type RawRespState struct {
+	// The JSON of the events giving the state of the room before the
+	// request event.
+	StateEvents []json.RawMessage `json:"pdus"`
+	// The JSON of the events needed to authenticate the state events.
+	AuthEvents []json.RawMessage `json:"auth_chain"`
+
+	decodedState []*Event
+	decodedAuth  []*Event
+}
+
+// NewRawRespState returns a RawRespState holding the events of the
+// response, which are already decoded.
+func NewRawRespState(r RespState) RawRespState {
+	raw := RawRespState{
+		StateEvents:  make([]json.RawMessage, len(r.StateEvents)),
+		AuthEvents:   make([]json.RawMessage, len(r.AuthEvents)),
+		decodedState: make([]*Event, len(r.StateEvents)),
+		decodedAuth:  make([]*Event, len(r.AuthEvents)),
+	}
+	for i := range r.StateEvents {
+		raw.StateEvents[i] = r.StateEvents[i].JSON()
+		raw.decodedState[i] = &r.StateEvents[i]
+	}
+	for i := range r.AuthEvents {
+		raw.AuthEvents[i] = r.AuthEvents[i].JSON()
+		raw.decodedAuth[i] = &r.AuthEvents[i]
+	}
+	return raw
+}
+
+// Get returns the state event at the index, decoding it if it hasn't been
+// decoded already. Returns an error if the index is out of range or the
+// event can't be decoded.
+func (r *RawRespState) Get(i int) (Event, error) {
+	return getRawEvent(r.StateEvents, &r.decodedState, i)
+}
+
+// GetAuth returns the auth event at the index, decoding it if it hasn't been
+// decoded already. Returns an error if the index is out of range or the
+// event can't be decoded.
+func (r *RawRespState) GetAuth(i int) (Event, error) {
+	return getRawEvent(r.AuthEvents, &r.decodedAuth, i)
+}
+
+// ToRespState decodes all of the events that haven't been decoded already
+// and returns them as a RespState. Returns an error if any of the events
+// can't be decoded.
+func (r *RawRespState) ToRespState() (RespState, error) {
+	resp := RespState{
+		StateEvents: make([]Event, len(r.StateEvents)),
+		AuthEvents:  make([]Event, len(r.AuthEvents)),
+	}
+	var err error
+	for i := range r.StateEvents {
+		if resp.StateEvents[i], err = r.Get(i); err != nil {
+			return RespState{}, err
+		}
+	}
+	for i := range r.AuthEvents {
+		if resp.AuthEvents[i], err = r.GetAuth(i); err != nil {
+			return RespState{}, err
+		}
+	}
+	return resp, nil
+}
+
+// getRawEvent decodes the event at the index of raw, caching it in decoded.
+func getRawEvent(raw []json.RawMessage, decoded *[]*Event, i int) (Event, error) {
+	if i < 0 || i >= len(raw) {
+		return Event{}, fmt.Errorf("gomatrixserverlib: event index %d out of range for %d events", i, len(raw))
+	}
+	if len(*decoded) != len(raw) {
+		// The events were set directly or unmarshalled, so nothing has
+		// been decoded yet.
+		*decoded = make([]*Event, len(raw))
+	}
+	if event := (*decoded)[i]; event != nil {
+		return *event, nil
+	}
+	event, err := NewEventFromUntrustedJSON(raw[i])
+	if err != nil {
+		return Event{}, err
+	}
+	(*decoded)[i] = &event
+	return event, nil
+}
+
 // Events combines the auth events and the state events and returns
 // them in an order where every event comes after its auth events.
 // Each event will only appear once in the output list.
@@ -246,200 +433,1805 @@ func (r RespState) Events() ([]Event, error) {
 	return result, nil
 }
 
-// Check that a response to /state is valid.
-func (r RespState) Check(ctx context.Context, keyRing JSONVerifier) error {
-	logger := util.GetLogger(ctx)
-	var allEvents []Event
-	for _, event := range r.AuthEvents {
-		if event.StateKey() == nil {
-			return fmt.Errorf("gomatrixserverlib: event %q does not have a state key", event.EventID())
+// Normalize removes the duplicate events from the response, keeping the first
+// occurrence of each event. Events in AuthEvents that are also in StateEvents
+// are removed from AuthEvents, since the auth chain of the state can include
+// state events, such as the m.room.create event, and the state events can be
+// used as auth events just as well. The specification doesn't say whether
+// servers should repeat them in the "auth_chain", so some do, and merging
+// responses from several servers can repeat them as well. Normalizing the
+// response before calling Check means that each event is only checked once.
+// The lists are copied rather than modified in place.
+func (r *RespState) Normalize() {
+	seen := make(map[string]bool, len(r.StateEvents)+len(r.AuthEvents))
+	dedupe := func(events []Event) []Event {
+		result := make([]Event, 0, len(events))
+		for _, event := range events {
+			if seen[event.EventID()] {
+				continue
+			}
+			seen[event.EventID()] = true
+			result = append(result, event)
 		}
-		allEvents = append(allEvents, event)
+		return result
 	}
+	r.StateEvents = dedupe(r.StateEvents)
+	r.AuthEvents = dedupe(r.AuthEvents)
+}
 
-	stateTuples := map[StateKeyTuple]bool{}
-	for _, event := range r.StateEvents {
-		if event.StateKey() == nil {
-			return fmt.Errorf("gomatrixserverlib: event %q does not have a state key", event.EventID())
+// Clone returns a copy of the response that can be modified without
+// affecting the original. The StateEvents and AuthEvents lists are copied, so
+// that the events in the copy can be filtered, reordered or replaced in
+// place. The events themselves share their JSON with the original, which is
+// safe since Event methods that change an event, like SetUnsignedField,
+// replace its JSON rather than modifying it. Nil lists stay nil.
+func (r RespState) Clone() RespState {
+	clone := func(events []Event) []Event {
+		if events == nil {
+			return nil
 		}
-		stateTuple := StateKeyTuple{event.Type(), *event.StateKey()}
-		if stateTuples[stateTuple] {
-			return fmt.Errorf(
-				"gomatrixserverlib: duplicate state key tuple (%q, %q)",
-				event.Type(), *event.StateKey(),
+		return append(make([]Event, 0, len(events)), events...)
+	}
+	return RespState{
+		StateEvents: clone(r.StateEvents),
+		AuthEvents:  clone(r.AuthEvents),
+	}
+}
+
+// BuildRespState builds the response to a /state request from the current
+// state of the room, keyed by the event type and state key of each event,
+// loading the auth chain of the state with AuthChain. The provider loads an
+// event by ID using the context, returning nil if the event isn't known. The
+// state events are sorted by event type and then state key, and the auth
+// events are in an order where every event comes after its auth events,
+// including the state events that are auth events of other events. Returns
+// an error if an event is under the key of another event type or state key,
+// if the provider fails or if the context is cancelled, or a
+// MissingAuthEventsError if the provider doesn't know some of the auth
+// events.
+func BuildRespState(
+	ctx context.Context, state map[StateKeyTuple]Event, provider func(context.Context, string) (*Event, error),
+) (RespState, error) {
+	stateEvents := make(map[StateKeyTuple]*Event, len(state))
+	for tuple, event := range state {
+		event := event
+		if event.StateKey() == nil || stateKeyTupleOf(&event) != tuple {
+			return RespState{}, fmt.Errorf(
+				"gomatrixserverlib: event %q is in the state under (%q, %q)",
+				event.EventID(), tuple.EventType, tuple.StateKey,
 			)
 		}
-		stateTuples[stateTuple] = true
-		allEvents = append(allEvents, event)
+		stateEvents[tuple] = &event
 	}
+	events := stateEventsOf(stateEvents)
 
-	// Check if the events pass signature checks.
-	logger.Infof("Checking event signatures for %d events of room state", len(allEvents))
-	if err := VerifyAllEventSignatures(ctx, allEvents, keyRing); err != nil {
-		return err
+	authEvents, err := AuthChain(ctx, events, func(ctx context.Context, eventIDs []string) ([]Event, error) {
+		var result []Event
+		for _, eventID := range eventIDs {
+			event, err := provider(ctx, eventID)
+			if err != nil {
+				return nil, err
+			}
+			if event != nil {
+				result = append(result, *event)
+			}
+		}
+		return result, nil
+	})
+	if err != nil {
+		return RespState{}, err
 	}
+	return RespState{StateEvents: events, AuthEvents: authEvents}, nil
+}
 
-	eventsByID := map[string]*Event{}
-	// Collect a map of event reference to event
-	for i := range allEvents {
-		eventsByID[allEvents[i].EventID()] = &allEvents[i]
+// Shard splits the response into at most n responses, so that they can be
+// processed in parallel. The state events are split into contiguous runs of
+// nearly equal length, and each shard has the auth events that its state
+// events need, including auth events that are state events in other shards,
+// so that each shard is closed under auth events and can be checked on its
+// own. Auth events are repeated across the shards that need them. There are
+// fewer than n shards if there are fewer than n state events. Returns an
+// error if n isn't positive, or a MissingAuthEventError if an auth event
+// needed by a state event isn't in the response.
+func (r RespState) Shard(n int) ([]RespState, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("gomatrixserverlib: number of shards must be positive, got %d", n)
 	}
-
-	// Check whether the events are allowed by the auth rules.
-	for _, event := range allEvents {
-		if err := checkAllowedByAuthEvents(event, eventsByID); err != nil {
-			return err
+	if n > len(r.StateEvents) {
+		n = len(r.StateEvents)
+	}
+	eventsByID := make(map[string]*Event, len(r.AuthEvents)+len(r.StateEvents))
+	for _, events := range [][]Event{r.AuthEvents, r.StateEvents} {
+		for i := range events {
+			if _, ok := eventsByID[events[i].EventID()]; !ok {
+				eventsByID[events[i].EventID()] = &events[i]
+			}
 		}
 	}
 
-	return nil
-}
-
-// A RespMakeJoin is the content of a response to GET /_matrix/federation/v2/make_join/{roomID}/{userID}
-type RespMakeJoin struct {
-	// An incomplete m.room.member event for a user on the requesting server
-	// generated by the responding server.
-	// See https://matrix.org/docs/spec/server_server/unstable.html#joining-rooms
-	JoinEvent EventBuilder `json:"event"`
+	shards := make([]RespState, 0, n)
+	for i := 0; i < n; i++ {
+		stateEvents := r.StateEvents[i*len(r.StateEvents)/n : (i+1)*len(r.StateEvents)/n]
+		inShard := make(map[string]bool, len(stateEvents))
+		for _, event := range stateEvents {
+			inShard[event.EventID()] = true
+		}
+		// Walk the auth chain of the state events, collecting the events
+		// that aren't already in the shard.
+		var authEvents []Event
+		stack := append([]Event(nil), stateEvents...)
+		for len(stack) > 0 {
+			event := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, authEventID := range event.AuthEventIDs() {
+				if inShard[authEventID] {
+					continue
+				}
+				authEvent := eventsByID[authEventID]
+				if authEvent == nil {
+					return nil, MissingAuthEventError{event.EventID(), authEventID}
+				}
+				inShard[authEventID] = true
+				authEvents = append(authEvents, *authEvent)
+				stack = append(stack, *authEvent)
+			}
+		}
+		shards = append(shards, RespState{
+			StateEvents: append([]Event(nil), stateEvents...),
+			AuthEvents:  authEvents,
+		})
+	}
+	return shards, nil
 }
 
-// A RespSendJoin is the content of a response to PUT /_matrix/federation/v2/send_join/{roomID}/{eventID}
-type RespSendJoin struct {
-	RespState
-	Origin ServerName
-}
+// respStateBinaryVersion is the first byte of the binary encoding of a
+// RespState, so that the encoding can be changed later.
+const respStateBinaryVersion = 1
 
-// MarshalJSON implements json.Marshaller
-func (r RespSendJoin) MarshalJSON() ([]byte, error) {
-	return json.Marshal(respSendJoinFields{
-		StateEvents: r.StateEvents,
-		AuthEvents:  r.AuthEvents,
-		Origin:      r.Origin,
-	})
+// MarshalBinary implements encoding.BinaryMarshaler, for storing a RespState
+// more cheaply than as JSON. The encoding is a version byte, followed by the
+// auth events and then the state events. Each list is a count followed by the
+// events, and each event is its length followed by its JSON. Whether the
+// event is redacted is stored in the lowest bit of its length.
+func (r RespState) MarshalBinary() ([]byte, error) {
+	size := 1 + 2*binary.MaxVarintLen64
+	for _, events := range [][]Event{r.AuthEvents, r.StateEvents} {
+		for _, event := range events {
+			size += binary.MaxVarintLen64 + len(event.JSON())
+		}
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, respStateBinaryVersion)
+	buf = appendBinaryEvents(buf, r.AuthEvents)
+	buf = appendBinaryEvents(buf, r.StateEvents)
+	return buf, nil
 }
 
-// UnmarshalJSON implements json.Unmarshaller
-func (r *RespSendJoin) UnmarshalJSON(data []byte) error {
-	var fields respSendJoinFields
-	if err := json.Unmarshal(data, &fields); err != nil {
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, for loading a
+// RespState stored using MarshalBinary. The events are trusted, as they are
+// when loaded using NewEventFromTrustedJSON.
+func (r *RespState) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != respStateBinaryVersion {
+		return fmt.Errorf("gomatrixserverlib: unknown binary encoding of RespState")
+	}
+	// The events keep references to their JSON, so take a copy of the data
+	// rather than holding on to the caller's buffer.
+	rest := append([]byte(nil), data[1:]...)
+	authEvents, rest, err := readBinaryEvents(rest)
+	if err != nil {
 		return err
 	}
-	*r = RespSendJoin{
-		Origin: fields.Origin,
-		RespState: RespState{
-			StateEvents: fields.StateEvents,
-			AuthEvents:  fields.AuthEvents,
-		},
+	stateEvents, rest, err := readBinaryEvents(rest)
+	if err != nil {
+		return err
 	}
+	if len(rest) != 0 {
+		return fmt.Errorf("gomatrixserverlib: %d unexpected bytes after binary RespState", len(rest))
+	}
+	r.AuthEvents = authEvents
+	r.StateEvents = stateEvents
 	return nil
 }
 
-type respSendJoinFields struct {
-	StateEvents []Event    `json:"state"`
-	AuthEvents  []Event    `json:"auth_chain"`
-	Origin      ServerName `json:"origin"`
+// appendBinaryEvents appends the binary encoding of the events to buf.
+func appendBinaryEvents(buf []byte, events []Event) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(events)))]...)
+	for _, event := range events {
+		header := uint64(len(event.JSON())) << 1
+		if event.Redacted() {
+			header |= 1
+		}
+		buf = append(buf, varint[:binary.PutUvarint(varint[:], header)]...)
+		buf = append(buf, event.JSON()...)
+	}
+	return buf
 }
 
-// ToRespState returns a new RespState with the same data from the given RespSendJoin
-func (r RespSendJoin) ToRespState() RespState {
-	return RespState{
-		StateEvents: r.StateEvents,
-		AuthEvents:  r.AuthEvents,
+// readBinaryEvents reads a list of events encoded by appendBinaryEvents from
+// the start of data. Returns the events and the rest of the data.
+func readBinaryEvents(data []byte) ([]Event, []byte, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("gomatrixserverlib: truncated binary RespState")
+	}
+	data = data[n:]
+	// Each event takes at least a byte, which bounds the count before we use
+	// it to allocate.
+	if count > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("gomatrixserverlib: truncated binary RespState")
+	}
+	events := make([]Event, count)
+	for i := range events {
+		header, n := binary.Uvarint(data)
+		if n <= 0 || header>>1 > uint64(len(data)-n) {
+			return nil, nil, fmt.Errorf("gomatrixserverlib: truncated binary RespState")
+		}
+		data = data[n:]
+		length := int(header >> 1)
+		event, err := NewEventFromTrustedJSON(data[:length:length], header&1 == 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		events[i] = event
+		data = data[length:]
 	}
+	return events, data, nil
 }
 
-// Check that a response to /send_join is valid.
-// This checks that it would be valid as a response to /state
-// This also checks that the join event is allowed by the state.
-func (r RespSendJoin) Check(ctx context.Context, keyRing JSONVerifier, joinEvent Event) error {
-	// First check that the state is valid and that the events in the response
-	// are correctly signed.
-	//
-	// The response to /send_join has the same data as a response to /state
-	// and the checks for a response to /state also apply.
-	if err := r.ToRespState().Check(ctx, keyRing); err != nil {
-		return err
+// CheckOptions control how strictly a response to /state is checked.
+// The zero value is the strictest.
+type CheckOptions struct {
+	// If true then events with auth events that aren't in the response are
+	// not rejected. The auth rules can't be checked for those events, so a
+	// MissingAuthEventError is returned for each missing auth event as a
+	// warning instead. Events whose auth events are all present are still
+	// checked against them.
+	AllowMissingAuthEvents bool
+	// The maximum length of the JSON of each event in bytes. Events that are
+	// longer are rejected with an ErrEventTooLarge error. If zero then the
+	// limit from the specification, 65536 bytes, is used.
+	MaxEventSize int
+	// The maximum number of prev_events of each event. Events with more are
+	// rejected with an ErrTooManyEventReferences error. If zero then the limit
+	// from the specification, 20, is used.
+	MaxPrevEvents int
+	// The maximum number of auth_events of each event. Events with more are
+	// rejected with an ErrTooManyEventReferences error. If zero then the limit
+	// from the specification, 10, is used.
+	MaxAuthEvents int
+}
+
+// maxEventSize returns the maximum length of the JSON of each event.
+func (o CheckOptions) maxEventSize() int {
+	if o.MaxEventSize == 0 {
+		return maxEventLength
 	}
+	return o.MaxEventSize
+}
 
-	stateEventsByID := map[string]*Event{}
-	authEvents := NewAuthEvents(nil)
-	for i, event := range r.StateEvents {
-		stateEventsByID[event.EventID()] = &r.StateEvents[i]
-		if err := authEvents.AddEvent(&r.StateEvents[i]); err != nil {
-			return err
-		}
+// maxPrevEvents returns the maximum number of prev_events of each event.
+func (o CheckOptions) maxPrevEvents() int {
+	if o.MaxPrevEvents == 0 {
+		return maxPrevEvents
 	}
+	return o.MaxPrevEvents
+}
 
-	// Now check that the join event is valid against its auth events.
-	if err := checkAllowedByAuthEvents(joinEvent, stateEventsByID); err != nil {
-		return err
+// maxAuthEvents returns the maximum number of auth_events of each event.
+func (o CheckOptions) maxAuthEvents() int {
+	if o.MaxAuthEvents == 0 {
+		return maxAuthEvents
 	}
+	return o.MaxAuthEvents
+}
 
-	// Now check that the join event is valid against the supplied state.
-	if err := Allowed(joinEvent, &authEvents); err != nil {
-		return fmt.Errorf(
-			"gomatrixserverlib: event with ID %q is not allowed by the supplied state: %s",
-			joinEvent.EventID(), err.Error(),
-		)
+// An ErrTooManyEventReferences is returned when checking a response to /state
+// if an event has more prev_events or auth_events than allowed.
+type ErrTooManyEventReferences struct {
+	// The ID of the event with too many references.
+	EventID string
+	// The key of the references, either "prev_events" or "auth_events".
+	Key string
+	// The number of references the event has.
+	Count int
+	// The maximum number of references allowed.
+	Max int
+}
 
-	}
+func (e ErrTooManyEventReferences) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: event %q has too many %s, %d > maximum %d",
+		e.EventID, e.Key, e.Count, e.Max,
+	)
+}
 
-	return nil
+// An ErrEventUnsigned is returned when checking a response to /state if an
+// event has no signatures at all, as opposed to signatures that can't be
+// verified.
+type ErrEventUnsigned struct {
+	// The ID of the event without signatures.
+	EventID string
 }
 
-// A RespMakeLeave is the content of a response to GET /_matrix/federation/v2/make_leave/{roomID}/{userID}
-type RespMakeLeave struct {
-	// An incomplete m.room.member event for a user on the requesting server
-	// generated by the responding server.
-	// See https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-make-leave-roomid-userid
-	LeaveEvent EventBuilder `json:"event"`
+func (e ErrEventUnsigned) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: event %q has no signatures", e.EventID)
 }
 
-// A RespDirectory is the content of a response to GET  /_matrix/federation/v1/query/directory
-// This is returned when looking up a room alias from a remote server.
-// See https://matrix.org/docs/spec/server_server/unstable.html#directory
-type RespDirectory struct {
-	// The matrix room ID the room alias corresponds to.
-	RoomID string `json:"room_id"`
-	// A list of matrix servers that the directory server thinks could be used
-	// to join the room. The joining server may need to try multiple servers
-	// before it finds one that it can use to join the room.
-	Servers []ServerName `json:"servers"`
+// maxReportedSignatureFailures is the number of events that an
+// ErrEventSignaturesInvalid gives the details of.
+const maxReportedSignatureFailures = 3
+
+// An ErrEventSignaturesInvalid is returned when checking a response to /state
+// if the signatures of some of the events couldn't be verified. It gives the
+// outcome for each signature of the first few events that failed, so that
+// the failures can be diagnosed.
+type ErrEventSignaturesInvalid struct {
+	// The first few events that failed, in the order they were checked.
+	Failures []VerifyResult
+	// The number of events that failed, which may be more than the number
+	// of failures given.
+	Count int
 }
 
-// RespProfile is the content of a response to GET /_matrix/federation/v1/query/profile
-type RespProfile struct {
-	DisplayName string `json:"displayname,omitempty"`
-	AvatarURL   string `json:"avatar_url,omitempty"`
+func (e ErrEventSignaturesInvalid) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gomatrixserverlib: %d event(s) failed signature checks", e.Count)
+	for _, failure := range e.Failures {
+		fmt.Fprintf(&b, "; event %q: %s", failure.EventID, failure.Error)
+		if len(failure.Signatures) > 0 {
+			signatures := make([]string, len(failure.Signatures))
+			for i := range failure.Signatures {
+				signatures[i] = failure.Signatures[i].String()
+			}
+			fmt.Fprintf(&b, " [%s]", strings.Join(signatures, ", "))
+		}
+	}
+	if more := e.Count - len(e.Failures); more > 0 {
+		fmt.Fprintf(&b, "; and %d more", more)
+	}
+	return b.String()
 }
 
-func checkAllowedByAuthEvents(event Event, eventsByID map[string]*Event) error {
-	authEvents := NewAuthEvents(nil)
-	for _, authRef := range event.AuthEvents() {
-		authEvent := eventsByID[authRef.EventID]
-		if authEvent == nil {
-			return fmt.Errorf(
-				"gomatrixserverlib: missing auth event with ID %q for event %q",
-				authRef.EventID, event.EventID(),
-			)
+// checkEventSignatures checks the signatures of the events with the rules of
+// the room version, returning an ErrEventSignaturesInvalid if any of them fail.
+func checkEventSignatures(ctx context.Context, events []Event, keyRing JSONVerifier, roomVersion RoomVersion) error {
+	var e ErrEventSignaturesInvalid
+	for _, result := range VerifyEventSignaturesBatch(ctx, events, keyRing, roomVersion) {
+		if result.Passed {
+			continue
 		}
-		if err := authEvents.AddEvent(authEvent); err != nil {
-			return err
+		if e.Count < maxReportedSignatureFailures {
+			e.Failures = append(e.Failures, result)
 		}
+		e.Count++
 	}
-	if err := Allowed(event, &authEvents); err != nil {
-		return fmt.Errorf(
-			"gomatrixserverlib: event with ID %q is not allowed by its auth_events: %s",
-			event.EventID(), err.Error(),
-		)
+	if e.Count > 0 {
+		return e
 	}
 	return nil
 }
 
-// RespInvite is the content of a response to PUT /_matrix/federation/v1/invite/{roomID}/{eventID}
-type RespInvite struct {
-	// The invite event signed by recipient server.
-	Event Event
+// An ErrSenderNotSigned is returned when checking a response to /state if an
+// event isn't signed by the server of its sender. Other servers may sign the
+// event as well, such as the server of the invited user for an invite or the
+// authorising server for a join to a restricted room, but their signatures
+// don't stand in for the signature of the sender's server.
+type ErrSenderNotSigned struct {
+	// The ID of the event.
+	EventID string
+	// The server of the sender of the event.
+	ServerName ServerName
+}
+
+func (e ErrSenderNotSigned) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: event %q is not signed by the server of its sender %q", e.EventID, e.ServerName,
+	)
+}
+
+// An ErrRestrictedJoinUnauthorised is returned when checking a response to
+// /send_join if the join event names a user in its
+// "join_authorised_via_users_server" who couldn't authorise it: because they
+// aren't joined to the room or don't have the power to invite users according
+// to the state in the response, or because their server didn't sign the
+// join event.
+type ErrRestrictedJoinUnauthorised struct {
+	// The ID of the join event.
+	EventID string
+	// The user named as authorising the join.
+	AuthorisedVia string
+	// Why the user couldn't authorise the join.
+	Err error
+}
+
+func (e ErrRestrictedJoinUnauthorised) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: join event %q is not authorised by %q: %s", e.EventID, e.AuthorisedVia, e.Err,
+	)
+}
+
+// An ErrRejectedAuthEvent is returned when checking a response to /state if
+// an event has an auth event that was rejected, because the auth event isn't
+// allowed by its own auth events. A rejected event stays in the room graph,
+// but must not be used to auth other events.
+type ErrRejectedAuthEvent struct {
+	// The ID of the event that references the rejected auth event.
+	EventID string
+	// The ID of the rejected auth event.
+	AuthEventID string
+	// Why the auth event was rejected.
+	Err error
+}
+
+func (e ErrRejectedAuthEvent) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: event %q has auth event %q which was rejected: %s",
+		e.EventID, e.AuthEventID, e.Err.Error(),
+	)
+}
+
+// isUnsigned returns whether the event has no signatures from any server.
+func isUnsigned(event Event) bool {
+	var signatures struct {
+		Signatures map[string]map[string]json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(event.JSON(), &signatures); err != nil {
+		return true
+	}
+	for _, serverSignatures := range signatures.Signatures {
+		if len(serverSignatures) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSenderSigned checks that the event has a signature from the server of
+// its sender. The signature itself is verified with the others later.
+func checkSenderSigned(event Event) error {
+	senderDomain, err := domainFromID(event.Sender())
+	if err != nil {
+		return err
+	}
+	if len(event.KeyIDs(senderDomain)) == 0 {
+		return ErrSenderNotSigned{event.EventID(), ServerName(senderDomain)}
+	}
+	return nil
+}
+
+// An ErrEventTooLarge is returned when checking a response to /state if the
+// JSON of an event is longer than the maximum allowed.
+type ErrEventTooLarge struct {
+	// The ID of the event that is too large.
+	EventID string
+	// The length of the JSON of the event in bytes.
+	Size int
+	// The maximum length allowed in bytes.
+	MaxSize int
+}
+
+func (e ErrEventTooLarge) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: event %q is too large, length %d > maximum %d",
+		e.EventID, e.Size, e.MaxSize,
+	)
+}
+
+// A MissingAuthEventError is returned when checking a response to /state if
+// an event references an auth event that isn't in the response. It is also
+// returned by version 2 state resolution for auth events that weren't given,
+// depending on the MissingAuthEventPolicy.
+type MissingAuthEventError struct {
+	// The ID of the event that references the auth event.
+	EventID string
+	// The ID of the auth event that is missing.
+	AuthEventID string
+}
+
+func (e MissingAuthEventError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: missing auth event with ID %q for event %q",
+		e.AuthEventID, e.EventID,
+	)
+}
+
+// Check that a response to /state is valid.
+// The room version determines whether the event IDs are checked against the
+// reference hashes of the events, so should be the version of the room the
+// state was requested for rather than the version in the response.
+// Returns an ErrEventSignaturesInvalid if the signatures of any of the events
+// can't be verified.
+func (r RespState) Check(ctx context.Context, keyRing JSONVerifier, roomVersion RoomVersion) error {
+	_, err := r.CheckWithOptions(ctx, keyRing, roomVersion, CheckOptions{})
+	return err
+}
+
+// CheckWithOptions checks that a response to /state is valid like Check, but
+// can be made more lenient using the options. Returns a list of warnings
+// about problems that the options allowed, or an error if the response isn't
+// valid. The response is checked in the same way as by CheckAllWithOptions,
+// and the error is the first problem that it finds, except that the
+// signatures that couldn't be verified are reported together as an
+// ErrEventSignaturesInvalid.
+func (r RespState) CheckWithOptions(
+	ctx context.Context, keyRing JSONVerifier, roomVersion RoomVersion, opts CheckOptions,
+) ([]error, error) {
+	result := r.checkAll(ctx, keyRing, roomVersion, opts, true)
+	if result.firstErr != nil {
+		return nil, result.firstErr
+	}
+	return result.warnings, nil
+}
+
+// CheckAll checks that a response to /state is valid like Check, but rather
+// than stopping at the first problem it carries on past events that fail
+// and returns every problem that it finds, so that a badly broken response
+// can be diagnosed in one pass. Each event is reported at most once for the
+// checks on the event itself, such as its size, event ID and signatures, and
+// isn't checked further once it fails one. Every missing auth event is
+// reported, and events that pass those checks are checked against the auth
+// rules. Events whose auth events failed are reported with an
+// ErrRejectedAuthEvent, and so are the events authed using those, all the way
+// down the auth chain. Returns nil if the response is valid.
+func (r RespState) CheckAll(ctx context.Context, keyRing JSONVerifier, roomVersion RoomVersion) []error {
+	_, errs := r.CheckAllWithOptions(ctx, keyRing, roomVersion, CheckOptions{})
+	return errs
+}
+
+// CheckAllWithOptions checks that a response to /state is valid and returns
+// every problem that it finds like CheckAll, but can be made more lenient
+// using the options like CheckWithOptions. Returns a list of warnings about
+// problems that the options allowed, and a list of the problems that make
+// the response invalid, which is nil if the response is valid.
+func (r RespState) CheckAllWithOptions(
+	ctx context.Context, keyRing JSONVerifier, roomVersion RoomVersion, opts CheckOptions,
+) (warnings, errs []error) {
+	result := r.checkAll(ctx, keyRing, roomVersion, opts, false)
+	return result.warnings, result.errs
+}
+
+// respStateCheckResult is the outcome of checking a response to /state.
+type respStateCheckResult struct {
+	// The problems that the options allowed.
+	warnings []error
+	// Every problem that makes the response invalid, in the order they
+	// were found.
+	errs []error
+	// The problem that CheckWithOptions reports, which is the first of the
+	// errors unless that is a signature failure, in which case it is the
+	// ErrEventSignaturesInvalid for all of the signature failures.
+	firstErr error
+}
+
+// checkAll checks a response to /state, carrying on past the events that
+// fail. The checks are done in stages, cheapest first, and each stage only
+// checks the events that passed the earlier stages. If firstOnly is true
+// then only the first problem is needed, so the signatures, which may need
+// keys to be fetched, aren't checked once a problem has been found.
+func (r RespState) checkAll( // nolint: gocyclo
+	ctx context.Context, keyRing JSONVerifier, roomVersion RoomVersion, opts CheckOptions, firstOnly bool,
+) (result respStateCheckResult) {
+	logger := util.GetLogger(ctx)
+	if _, err := roomVersion.EventIDFormat(); err != nil {
+		result.errs, result.firstErr = []error{err}, err
+		return
+	}
+	addErr := func(err error) {
+		result.errs = append(result.errs, err)
+		if result.firstErr == nil {
+			result.firstErr = err
+		}
+	}
+	// The first problem with each event by event ID.
+	failed := map[string]error{}
+	fail := func(eventID string, err error) {
+		addErr(err)
+		if _, ok := failed[eventID]; !ok {
+			failed[eventID] = err
+		}
+	}
+
+	allEvents := make([]Event, 0, len(r.AuthEvents)+len(r.StateEvents))
+	allEvents = append(append(allEvents, r.AuthEvents...), r.StateEvents...)
+	// check runs the check on each event that hasn't failed yet.
+	check := func(f func(event Event) error) {
+		for _, event := range allEvents {
+			if _, ok := failed[event.EventID()]; ok {
+				continue
+			}
+			if err := f(event); err != nil {
+				fail(event.EventID(), err)
+			}
+		}
+	}
+
+	stateTuples := map[StateKeyTuple]bool{}
+	for i, event := range allEvents {
+		if event.StateKey() == nil {
+			fail(event.EventID(), fmt.Errorf("gomatrixserverlib: event %q does not have a state key", event.EventID()))
+			continue
+		}
+		if i < len(r.AuthEvents) {
+			continue
+		}
+		stateTuple := StateKeyTuple{event.Type(), *event.StateKey()}
+		if stateTuples[stateTuple] {
+			addErr(fmt.Errorf(
+				"gomatrixserverlib: duplicate state key tuple (%q, %q)",
+				event.Type(), *event.StateKey(),
+			))
+		}
+		stateTuples[stateTuple] = true
+	}
+
+	// Check that none of the events are too large to store, or reference so
+	// many other events that following them would be expensive.
+	maxSize, maxPrev, maxAuth := opts.maxEventSize(), opts.maxPrevEvents(), opts.maxAuthEvents()
+	check(func(event Event) error {
+		if size := len(event.JSON()); size > maxSize {
+			return ErrEventTooLarge{event.EventID(), size, maxSize}
+		}
+		if count := len(event.PrevEvents()); count > maxPrev {
+			return ErrTooManyEventReferences{event.EventID(), "prev_events", count, maxPrev}
+		}
+		if count := len(event.AuthEvents()); count > maxAuth {
+			return ErrTooManyEventReferences{event.EventID(), "auth_events", count, maxAuth}
+		}
+		return nil
+	})
+
+	// Check that the membership events are about valid users.
+	check(checkMemberStateKey)
+
+	// Check that the event IDs match the event content, in room versions
+	// where the event ID is derived from the event.
+	check(func(event Event) error {
+		return checkEventIDs([]Event{event}, roomVersion)
+	})
+
+	// Check that the senders of the events are allowed in the room, in case
+	// the room isn't federated.
+	createEvent := findCreateEvent(r.StateEvents, r.AuthEvents)
+	if federated, err := federationCheck(createEvent); err != nil {
+		fail(createEvent.EventID(), err)
+	} else {
+		check(federated)
+	}
+
+	eventsByID := make(map[string]*Event, len(allEvents))
+	for i := range allEvents {
+		eventsByID[allEvents[i].EventID()] = &allEvents[i]
+	}
+
+	// Check that the auth chain is closed, so that the auth events of every
+	// event are in the response. Events with missing auth events can't be
+	// checked against the auth rules, so they either fail or, if the options
+	// allow it, are left unchecked with a warning.
+	unchecked := map[string]bool{}
+	for _, event := range allEvents {
+		if _, ok := failed[event.EventID()]; ok {
+			continue
+		}
+		missing := missingAuthEvents(event, eventsByID)
+		if len(missing) > 0 && opts.AllowMissingAuthEvents {
+			logger.Warnf("Not checking event %q since some of its auth events are missing", event.EventID())
+			result.warnings = append(result.warnings, missing...)
+			unchecked[event.EventID()] = true
+			continue
+		}
+		for _, err := range missing {
+			fail(event.EventID(), err)
+		}
+	}
+
+	// Check that every event is signed, and signed by the server of its
+	// sender, before checking the signatures, so that an event without the
+	// signatures it needs is reported as such rather than as a signature
+	// that couldn't be verified, and so that no keys are fetched for it.
+	check(func(event Event) error {
+		if isUnsigned(event) {
+			return ErrEventUnsigned{event.EventID()}
+		}
+		return checkSenderSigned(event)
+	})
+
+	// Check the signatures of the events that are still in the running.
+	if firstOnly && result.firstErr != nil {
+		return
+	}
+	var toVerify []Event
+	for _, event := range allEvents {
+		if _, ok := failed[event.EventID()]; !ok {
+			toVerify = append(toVerify, event)
+		}
+	}
+	logger.Infof("Checking event signatures for %d events of room state", len(toVerify))
+	firstErr := result.firstErr
+	var signatureErr ErrEventSignaturesInvalid
+	for _, verified := range VerifyEventSignaturesBatch(ctx, toVerify, keyRing, roomVersion) {
+		if _, ok := failed[verified.EventID]; verified.Passed || ok {
+			continue
+		}
+		if signatureErr.Count < maxReportedSignatureFailures {
+			signatureErr.Failures = append(signatureErr.Failures, verified)
+		}
+		signatureErr.Count++
+		fail(verified.EventID, verified.Error)
+	}
+	if signatureErr.Count > 0 && firstErr == nil {
+		result.firstErr = signatureErr
+	}
+
+	// Check the events that are still in the running against the auth
+	// rules. The same provider is reused for each event. An event needs at
+	// most six auth events: the create, power levels and join rules events,
+	// the sender's and target's membership events, and a third party invite
+	// event.
+	var authErrs []error
+	authEvents := NewAuthEventsWithCapacity(6)
+	for _, event := range allEvents {
+		if _, ok := failed[event.EventID()]; ok || unchecked[event.EventID()] {
+			continue
+		}
+		if err := checkAllowedByAuthEvents(event, eventsByID, &authEvents); err != nil {
+			authErrs = append(authErrs, err)
+			failed[event.EventID()] = err
+		}
+	}
+
+	// Reject the events that were authed using an event that failed, and
+	// then the events that were authed using those, all the way down the
+	// auth chain. These are reported before the events that the auth rules
+	// rejected, since an event that was authed using a rejected event can't
+	// be trusted even if it passes its own checks.
+	for rejected := true; rejected; {
+		rejected = false
+		for _, event := range allEvents {
+			if _, ok := failed[event.EventID()]; ok {
+				continue
+			}
+			for _, authEventID := range event.AuthEventIDs() {
+				if err, ok := failed[authEventID]; ok {
+					fail(event.EventID(), ErrRejectedAuthEvent{event.EventID(), authEventID, err})
+					rejected = true
+					break
+				}
+			}
+		}
+	}
+	for _, err := range authErrs {
+		addErr(err)
+	}
+	return
+}
+
+// Orphans returns the IDs of the state events that can't be authed using the
+// events in the response. An event can't be authed if any of its auth events
+// are missing from the response or can't be authed themselves, or if it isn't
+// allowed by its auth events. This is meant for diagnosing a response before
+// deciding whether to accept it, so it doesn't check signatures.
+func (r RespState) Orphans() []string {
+	eventsByID := make(map[string]*Event, len(r.AuthEvents)+len(r.StateEvents))
+	for _, events := range [][]Event{r.AuthEvents, r.StateEvents} {
+		for i := range events {
+			eventsByID[events[i].EventID()] = &events[i]
+		}
+	}
+
+	// authed records whether each event that has been visited can be authed.
+	// Events are marked as not authed while their auth events are visited
+	// so that cycles in the auth events can't be authed.
+	authed := make(map[string]bool, len(eventsByID))
+	authEvents := NewAuthEventsWithCapacity(6)
+	var canAuth func(event *Event) bool
+	canAuth = func(event *Event) bool {
+		if result, ok := authed[event.EventID()]; ok {
+			return result
+		}
+		authed[event.EventID()] = false
+		for _, authEventID := range event.AuthEventIDs() {
+			authEvent := eventsByID[authEventID]
+			if authEvent == nil || !canAuth(authEvent) {
+				return false
+			}
+		}
+		result := checkAllowedByAuthEvents(*event, eventsByID, &authEvents) == nil
+		authed[event.EventID()] = result
+		return result
+	}
+
+	var orphans []string
+	for i := range r.StateEvents {
+		if !canAuth(&r.StateEvents[i]) {
+			orphans = append(orphans, r.StateEvents[i].EventID())
+		}
+	}
+	return orphans
+}
+
+// BySigningServer groups the state events by the servers that signed them,
+// returning the IDs of the events that each server signed in the order of
+// the state events. An event signed by more than one server, such as an
+// invite signed by the servers of both the sender and the invited user, is
+// listed under each of them. The server names are lowercased, since they
+// are case insensitive, and signatures from names that aren't valid server
+// names are ignored. The signatures aren't checked.
+func (r RespState) BySigningServer() map[ServerName][]string {
+	byServer := map[ServerName][]string{}
+	for _, event := range r.StateEvents {
+		var signatures struct {
+			Signatures map[ServerName]map[string]json.RawMessage `json:"signatures"`
+		}
+		if err := json.Unmarshal(event.JSON(), &signatures); err != nil {
+			continue
+		}
+		signedBy := map[ServerName]bool{}
+		for serverName, serverSignatures := range signatures.Signatures {
+			if len(serverSignatures) == 0 {
+				continue
+			}
+			if _, _, valid := ParseAndValidateServerName(serverName); !valid {
+				continue
+			}
+			signedBy[ServerName(strings.ToLower(string(serverName)))] = true
+		}
+		for serverName := range signedBy {
+			byServer[serverName] = append(byServer[serverName], event.EventID())
+		}
+	}
+	return byServer
+}
+
+// TopPowerUser returns the user with the highest power level in the room
+// given by the state, and their level. The levels are the ones given to
+// users in the m.room.power_levels event, or if there isn't one then the
+// creator of the room has level 100, where the creator is worked out as the
+// room version says. If more than one user has the highest level then the
+// lowest user ID is returned. Returns an error if there isn't a create
+// event, if the power levels content is invalid, or if no user has a level.
+func (r RespState) TopPowerUser() (userID string, level int, err error) {
+	authEvents := NewAuthEventsWithCapacity(len(r.StateEvents))
+	for i := range r.StateEvents {
+		if r.StateEvents[i].StateKey() != nil {
+			authEvents.AddEvent(&r.StateEvents[i]) // nolint: errcheck
+		}
+	}
+	create, err := NewCreateContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return "", 0, err
+	}
+	powerLevels, err := NewPowerLevelContentFromAuthEvents(&authEvents, create.Creator)
+	if err != nil {
+		return "", 0, err
+	}
+	var top int64
+	for user, userLevel := range powerLevels.Users {
+		if userID == "" || userLevel > top || (userLevel == top && user < userID) {
+			userID, top = user, userLevel
+		}
+	}
+	if userID == "" {
+		return "", 0, fmt.Errorf("gomatrixserverlib: no users have a power level in the room")
+	}
+	return userID, int(top), nil
+}
+
+// IsFederatable returns whether servers other than the server that created
+// the room can take part in it, according to the "m.federate" flag of the
+// m.room.create event in the response, which defaults to true. Rooms that
+// aren't federatable shouldn't be joined over federation. Returns an error
+// if there isn't a create event or its content is invalid.
+func (r RespState) IsFederatable() (bool, error) {
+	createEvent := findCreateEvent(r.StateEvents, r.AuthEvents)
+	if createEvent == nil {
+		return false, fmt.Errorf("gomatrixserverlib: no m.room.create event in response")
+	}
+	var content CreateContent
+	if err := json.Unmarshal(createEvent.Content(), &content); err != nil {
+		return false, fmt.Errorf(
+			"gomatrixserverlib: unparsable create event content: %s", err,
+		)
+	}
+	return content.Federate == nil || *content.Federate, nil
+}
+
+// JoinRule returns the join rules of the room given by the m.room.join_rules
+// event in the state. Rooms without a join rules event are invite only.
+// Returns an error if the join rules event content is invalid, or if the join
+// rule isn't known.
+func (r RespState) JoinRule() (JoinRuleContent, error) {
+	for _, event := range r.StateEvents {
+		if event.Type() != MRoomJoinRules || !event.StateKeyEquals("") {
+			continue
+		}
+		var content JoinRuleContent
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			return JoinRuleContent{}, fmt.Errorf(
+				"gomatrixserverlib: unparsable join_rules event content: %s", err,
+			)
+		}
+		if err := content.Validate(); err != nil {
+			return JoinRuleContent{}, err
+		}
+		return content, nil
+	}
+	return JoinRuleContent{JoinRule: Invite}, nil
+}
+
+// Aliases returns the aliases of the room given by the state, for example to
+// fill in a room directory entry. The canonical alias comes from the
+// m.room.canonical_alias event, and the other aliases are its "alt_aliases"
+// followed by the aliases in the legacy m.room.aliases events, without
+// duplicates or the canonical alias. Aliases that aren't valid room aliases
+// are skipped. Returns an error if the content of one of the events is
+// invalid.
+func (r RespState) Aliases() (canonical string, alt []string, err error) {
+	var aliases, legacy []string
+	for _, event := range r.StateEvents {
+		switch event.Type() {
+		case MRoomCanonicalAlias:
+			if !event.StateKeyEquals("") {
+				continue
+			}
+			var content CanonicalAliasContent
+			if err = json.Unmarshal(event.Content(), &content); err != nil {
+				return "", nil, fmt.Errorf(
+					"gomatrixserverlib: unparsable canonical_alias event content: %s", err,
+				)
+			}
+			if _, err := ParseRoomAlias(content.Alias); err == nil {
+				canonical = content.Alias
+			}
+			aliases = append(aliases, content.AltAliases...)
+		case MRoomAliases:
+			if event.StateKey() == nil {
+				continue
+			}
+			var content AliasesContent
+			if err = json.Unmarshal(event.Content(), &content); err != nil {
+				return "", nil, fmt.Errorf(
+					"gomatrixserverlib: unparsable aliases event content: %s", err,
+				)
+			}
+			legacy = append(legacy, content.Aliases...)
+		}
+	}
+
+	seen := map[string]bool{canonical: true}
+	for _, alias := range append(aliases, legacy...) {
+		if seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		if _, err := ParseRoomAlias(alias); err == nil {
+			alt = append(alt, alias)
+		}
+	}
+	return canonical, alt, nil
+}
+
+// CollectMemberships returns the membership of the user in each of the rooms,
+// given the state of each room by room ID, from the user's m.room.member
+// event in the state. Rooms where the user doesn't have a member event, or
+// where its content is invalid, are left out.
+func CollectMemberships(userID string, states map[string]RespState) map[string]string {
+	memberships := make(map[string]string, len(states))
+	for roomID, state := range states {
+		for _, event := range state.StateEvents {
+			if event.Type() != MRoomMember || !event.StateKeyEquals(userID) {
+				continue
+			}
+			if membership, err := event.Membership(); err == nil {
+				memberships[roomID] = membership
+			}
+			break
+		}
+	}
+	return memberships
+}
+
+// checkMemberStateKey checks that the state key of an m.room.member event is
+// a valid user ID, since it names the user whose membership the event sets.
+// Events of other types are ignored.
+func checkMemberStateKey(event Event) error {
+	if event.Type() != MRoomMember || event.StateKey() == nil {
+		return nil
+	}
+	if _, err := ParseUserID(*event.StateKey()); err != nil {
+		return fmt.Errorf(
+			"gomatrixserverlib: membership event %q has a state key that isn't a valid user ID: %s",
+			event.EventID(), err,
+		)
+	}
+	return nil
+}
+
+// checkFederation checks that the senders of the state and auth events are
+// allowed in the room by the "m.federate" flag of the room's create event.
+// The create event is looked for in the state events first, and then in the
+// auth events. If there isn't a create event then the auth checks will fail
+// anyway, so nothing is checked here.
+func checkFederation(stateEvents, authEvents []Event) error {
+	federated, err := federationCheck(findCreateEvent(stateEvents, authEvents))
+	if err != nil {
+		return err
+	}
+	for _, events := range [][]Event{stateEvents, authEvents} {
+		for _, event := range events {
+			if err := federated(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// federationCheck returns a function that checks that the sender of an event
+// is allowed in the room by the "m.federate" flag of the create event. If the
+// create event is nil then every sender is allowed. Returns an error if the
+// content of the create event isn't valid.
+func federationCheck(createEvent *Event) (func(event Event) error, error) {
+	if createEvent == nil {
+		return func(Event) error { return nil }, nil
+	}
+	createAuthEvents := NewAuthEvents([]*Event{createEvent})
+	create, err := NewCreateContentFromAuthEvents(&createAuthEvents)
+	if err != nil {
+		return nil, err
+	}
+	return func(event Event) error {
+		if err := create.UserIDAllowed(event.Sender()); err != nil {
+			return fmt.Errorf(
+				"gomatrixserverlib: event %q is not allowed in the room: %s",
+				event.EventID(), err,
+			)
+		}
+		return nil
+	}, nil
+}
+
+// findCreateEvent returns the first m.room.create event in the state events,
+// or else in the auth events, or nil if there isn't one.
+func findCreateEvent(stateEvents, authEvents []Event) *Event {
+	for _, events := range [][]Event{stateEvents, authEvents} {
+		for i := range events {
+			if events[i].Type() == MRoomCreate && events[i].StateKeyEquals("") {
+				return &events[i]
+			}
+		}
+	}
+	return nil
+}
+
+// checkEventIDs checks that the event ID of each event has the format of the
+// room version. For room versions where the event ID is derived from the
+// event, the ID must match the ID computed from the event content. For other
+// room versions the ID must have the server name of the origin. Returns an
+// error if the room version is unknown.
+func checkEventIDs(events []Event, roomVersion RoomVersion) error {
+	format, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if format == EventIDFormatV1 {
+			if err = event.checkEventID(format); err != nil {
+				return err
+			}
+			continue
+		}
+		eventID, err := ComputeEventID(event, roomVersion)
+		if err != nil {
+			return err
+		}
+		if eventID != event.EventID() {
+			return fmt.Errorf(
+				"gomatrixserverlib: event ID %q doesn't match the event content, expected %q",
+				event.EventID(), eventID,
+			)
+		}
+	}
+	return nil
+}
+
+// A RespMakeJoin is the content of a response to GET /_matrix/federation/v2/make_join/{roomID}/{userID}
+type RespMakeJoin struct {
+	// An incomplete m.room.member event for a user on the requesting server
+	// generated by the responding server.
+	// See https://matrix.org/docs/spec/server_server/unstable.html#joining-rooms
+	JoinEvent EventBuilder `json:"event"`
+	// The version of the room. Servers that don't send a room version are
+	// assumed to be in a version 1 room.
+	RoomVersion RoomVersion `json:"room_version,omitempty"`
+}
+
+// BuildJoinEvent builds and signs the join event from the template returned
+// by the remote server, ready to send to /send_join.
+// The event ID is chosen randomly for room versions where the origin server
+// chooses the event ID, and computed from the event for later room versions.
+// The "origin_server_ts" of the event is the time told by the clock, or the
+// current time if the clock is nil.
+func (r RespMakeJoin) BuildJoinEvent(
+	origin ServerName, keyID KeyID, privateKey ed25519.PrivateKey, clock Clock,
+) (Event, error) {
+	if r.JoinEvent.Type != MRoomMember {
+		return Event{}, fmt.Errorf(
+			"gomatrixserverlib: join event template has type %q, expected %q",
+			r.JoinEvent.Type, MRoomMember,
+		)
+	}
+	format, err := r.RoomVersion.EventIDFormat()
+	if err != nil {
+		return Event{}, err
+	}
+	if clock == nil {
+		clock = WallClock
+	}
+	now := clock.Now()
+	if format == EventIDFormatV1 {
+		eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), origin)
+		return r.JoinEvent.Build(eventID, now, origin, keyID, privateKey)
+	}
+	return r.JoinEvent.BuildWithDerivedEventID(now, origin, keyID, privateKey, r.RoomVersion)
+}
+
+// PrecheckJoinAllowed checks whether the auth rules would allow the join
+// event from the template for the user, against the current state of the
+// room, which must have been fetched already. This catches joins that are
+// bound to be rejected, such as joins by banned users or to invite only
+// rooms, before the join event is signed and sent to /send_join. The sender
+// and state key of the template are replaced with the user ID.
+// Returns an error if the template isn't a join event, or a *NotAllowed
+// error if the join isn't allowed.
+func (r RespMakeJoin) PrecheckJoinAllowed(state RespState, userID string) error {
+	builder := r.JoinEvent
+	if builder.Type != MRoomMember {
+		return fmt.Errorf(
+			"gomatrixserverlib: join event template has type %q, expected %q", builder.Type, MRoomMember,
+		)
+	}
+	builder.Sender = userID
+	builder.StateKey = &userID
+
+	// The event is only checked against the auth rules, which don't look at
+	// its signatures or event ID, so it isn't signed.
+	eventJSON, err := json.Marshal(struct {
+		EventBuilder
+		EventID        string    `json:"event_id"`
+		OriginServerTS Timestamp `json:"origin_server_ts"`
+	}{builder, "$precheck", AsTimestamp(WallClock.Now())})
+	if err != nil {
+		return err
+	}
+	event, err := NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		return err
+	}
+	if membership, err := event.Membership(); err != nil || membership != Join {
+		return fmt.Errorf("gomatrixserverlib: join event template is not a join")
+	}
+
+	authEvents := NewAuthEventsWithCapacity(len(state.StateEvents))
+	for i := range state.StateEvents {
+		if state.StateEvents[i].StateKey() != nil {
+			authEvents.AddEvent(&state.StateEvents[i]) // nolint: errcheck
+		}
+	}
+	return Allowed(event, &authEvents)
+}
+
+// A RespSendJoin is the content of a response to PUT /_matrix/federation/v2/send_join/{roomID}/{eventID}
+type RespSendJoin struct {
+	RespState
+	Origin ServerName
+}
+
+// MarshalJSON implements json.Marshaller
+func (r RespSendJoin) MarshalJSON() ([]byte, error) {
+	return json.Marshal(respSendJoinFields{
+		StateEvents: r.StateEvents,
+		AuthEvents:  r.AuthEvents,
+		Origin:      r.Origin,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *RespSendJoin) UnmarshalJSON(data []byte) error {
+	var fields respSendJoinFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*r = RespSendJoin{
+		Origin: fields.Origin,
+		RespState: RespState{
+			StateEvents: fields.StateEvents,
+			AuthEvents:  fields.AuthEvents,
+		},
+	}
+	return nil
+}
+
+type respSendJoinFields struct {
+	StateEvents []Event    `json:"state"`
+	AuthEvents  []Event    `json:"auth_chain"`
+	Origin      ServerName `json:"origin"`
+}
+
+// ToRespState returns a new RespState with the same data from the given RespSendJoin
+func (r RespSendJoin) ToRespState() RespState {
+	return RespState{
+		StateEvents: r.StateEvents,
+		AuthEvents:  r.AuthEvents,
+	}
+}
+
+// Check that a response to /send_join is valid.
+// This checks that it would be valid as a response to /state
+// This also checks that the join event is allowed by the state.
+func (r RespSendJoin) Check(ctx context.Context, keyRing JSONVerifier, joinEvent Event, roomVersion RoomVersion) error {
+	// First check that the state is valid and that the events in the response
+	// are correctly signed.
+	//
+	// The response to /send_join has the same data as a response to /state
+	// and the checks for a response to /state also apply.
+	if err := r.ToRespState().Check(ctx, keyRing, roomVersion); err != nil {
+		return err
+	}
+
+	stateEventsByID := make(map[string]*Event, len(r.StateEvents))
+	authEvents := NewAuthEventsWithCapacity(len(r.StateEvents))
+	for i, event := range r.StateEvents {
+		stateEventsByID[event.EventID()] = &r.StateEvents[i]
+		if err := authEvents.AddEvent(&r.StateEvents[i]); err != nil {
+			return err
+		}
+	}
+	return checkSendJoinEvent(ctx, keyRing, joinEvent, roomVersion, stateEventsByID, &authEvents)
+}
+
+// checkSendJoinEvent checks that the join event is allowed by its auth
+// events and by the state in a response to /send_join, and that it is
+// signed by the server that authorised it if the room is restricted.
+func checkSendJoinEvent(
+	ctx context.Context, keyRing JSONVerifier, joinEvent Event, roomVersion RoomVersion,
+	stateEventsByID map[string]*Event, authEvents *AuthEvents,
+) error {
+	if joinEvent.Type() != MRoomMember {
+		return fmt.Errorf("gomatrixserverlib: event %q is not a m.room.member event", joinEvent.EventID())
+	}
+
+	// If the join was authorised by a server resident in a restricted room
+	// then check that the authorising user could authorise it, and that
+	// their server signed the join event.
+	if err := checkRestrictedJoinAuthorised(ctx, keyRing, joinEvent, roomVersion, authEvents); err != nil {
+		return err
+	}
+
+	// Now check that the join event is valid against its auth events.
+	joinAuthEvents := NewAuthEventsWithCapacity(len(joinEvent.AuthEvents()))
+	if err := checkAllowedByAuthEvents(joinEvent, stateEventsByID, &joinAuthEvents); err != nil {
+		return err
+	}
+
+	// Now check that the join event is valid against the supplied state.
+	if err := Allowed(joinEvent, authEvents); err != nil {
+		return fmt.Errorf(
+			"gomatrixserverlib: event with ID %q is not allowed by the supplied state: %s",
+			joinEvent.EventID(), err.Error(),
+		)
+
+	}
+
+	return nil
+}
+
+// checkRestrictedJoinAuthorised checks that the user named in the
+// "join_authorised_via_users_server" of the join event is joined to the room
+// with the power to invite users according to the state, and that their
+// server signed the join event. This only applies to room versions with
+// restricted joins where the join rule is "restricted" or "knock_restricted",
+// since otherwise the key is ignored by the auth rules. Returns an
+// ErrRestrictedJoinUnauthorised if the join isn't authorised, or nil if the
+// event doesn't name a user or the join doesn't need authorising.
+func checkRestrictedJoinAuthorised(
+	ctx context.Context, keyRing JSONVerifier, joinEvent Event, roomVersion RoomVersion, authEvents *AuthEvents,
+) error {
+	desc, err := roomVersion.description()
+	if err != nil {
+		return err
+	}
+	if !desc.restrictedJoins {
+		return nil
+	}
+	content, err := NewMemberContentFromEvent(joinEvent)
+	if err != nil {
+		return err
+	}
+	if content.Membership != Join || content.AuthorisedVia == "" {
+		return nil
+	}
+	joinRule, err := NewJoinRuleContentFromAuthEvents(authEvents)
+	if err != nil {
+		return err
+	}
+	if joinRule.JoinRule != Restricted && joinRule.JoinRule != KnockRestricted {
+		return nil
+	}
+	unauthorised := func(err error) error {
+		return ErrRestrictedJoinUnauthorised{joinEvent.EventID(), content.AuthorisedVia, err}
+	}
+
+	authoriser, err := NewMemberContentFromAuthEvents(authEvents, content.AuthorisedVia)
+	if err != nil {
+		return err
+	}
+	if authoriser.Membership != Join {
+		return unauthorised(fmt.Errorf("the user is not joined to the room"))
+	}
+	create, err := NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return err
+	}
+	powerLevels, err := NewPowerLevelContentFromAuthEvents(authEvents, create.Creator)
+	if err != nil {
+		return err
+	}
+	if level := powerLevels.UserLevel(content.AuthorisedVia); level < powerLevels.Invite {
+		return unauthorised(fmt.Errorf(
+			"the user has power level %d but inviting users needs %d", level, powerLevels.Invite,
+		))
+	}
+
+	if err := CheckRestrictedJoinSignature(ctx, keyRing, joinEvent, roomVersion); err != nil {
+		return unauthorised(err)
+	}
+	return nil
+}
+
+// respSendJoinStreamBatchSize is the number of events whose signatures are
+// checked at once by RespSendJoin.CheckStream.
+const respSendJoinStreamBatchSize = 256
+
+// CheckStream decodes a response to /send_join from the reader into the
+// RespSendJoin and checks that it is valid, like Check. Rather than decoding
+// the whole response first, the events are checked as they are decoded and
+// their signatures are checked in batches, so the body of the response
+// doesn't need to be held in memory and an invalid response is rejected
+// without reading the rest of it. The state is collected for checking the
+// join event as it is decoded. Checks that need every event, like whether
+// the events are allowed by their auth events, are done at the end.
+// A valid response passes both Check and CheckStream, but the errors for an
+// invalid response may be different since the checks are done in a
+// different order.
+func (r *RespSendJoin) CheckStream(
+	ctx context.Context, keyRing JSONVerifier, joinEvent Event, roomVersion RoomVersion, reader io.Reader,
+) error {
+	*r = RespSendJoin{}
+	if _, err := roomVersion.EventIDFormat(); err != nil {
+		return err
+	}
+	s := respSendJoinStream{
+		ctx:         ctx,
+		keyRing:     keyRing,
+		roomVersion: roomVersion,
+		stateTuples: map[StateKeyTuple]bool{},
+		stateEvents: NewAuthEventsWithCapacity(0),
+	}
+
+	decoder := json.NewDecoder(reader)
+	if err := expectJSONDelim(decoder, '{'); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+		if seen[key] {
+			return fmt.Errorf("gomatrixserverlib: duplicate key %q in send_join response", key)
+		}
+		seen[key] = true
+		switch key {
+		case "state":
+			err = s.decodeEvents(decoder, &r.StateEvents, true)
+		case "auth_chain":
+			err = s.decodeEvents(decoder, &r.AuthEvents, false)
+		case "origin":
+			err = decoder.Decode(&r.Origin)
+		default:
+			var ignored json.RawMessage
+			err = decoder.Decode(&ignored)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := expectJSONDelim(decoder, '}'); err != nil {
+		return err
+	}
+	if err := s.verifySignatures(); err != nil {
+		return err
+	}
+
+	// Check that the senders of the events are allowed in the room, in case
+	// the room isn't federated.
+	if err := checkFederation(r.StateEvents, r.AuthEvents); err != nil {
+		return err
+	}
+
+	// Check that the auth chain is closed, and that the events are allowed
+	// by their auth events.
+	eventsByID := make(map[string]*Event, len(r.AuthEvents)+len(r.StateEvents))
+	stateEventsByID := make(map[string]*Event, len(r.StateEvents))
+	for i := range r.AuthEvents {
+		eventsByID[r.AuthEvents[i].EventID()] = &r.AuthEvents[i]
+	}
+	for i := range r.StateEvents {
+		eventsByID[r.StateEvents[i].EventID()] = &r.StateEvents[i]
+		stateEventsByID[r.StateEvents[i].EventID()] = &r.StateEvents[i]
+	}
+	for _, events := range [][]Event{r.AuthEvents, r.StateEvents} {
+		for _, event := range events {
+			if missing := missingAuthEvents(event, eventsByID); len(missing) > 0 {
+				return missing[0]
+			}
+		}
+	}
+	if err := checkEventsAllowed(eventsByID, r.AuthEvents, r.StateEvents); err != nil {
+		return err
+	}
+
+	return checkSendJoinEvent(ctx, keyRing, joinEvent, roomVersion, stateEventsByID, &s.stateEvents)
+}
+
+// respSendJoinStream holds the state of RespSendJoin.CheckStream.
+type respSendJoinStream struct {
+	ctx         context.Context
+	keyRing     JSONVerifier
+	roomVersion RoomVersion
+	opts        CheckOptions
+	// The state key tuples of the state events decoded so far.
+	stateTuples map[StateKeyTuple]bool
+	// The state events decoded so far.
+	stateEvents AuthEvents
+	// The events whose signatures haven't been checked yet.
+	unverified []Event
+}
+
+// decodeEvents decodes a JSON array of events, checking each event as it is
+// decoded and appending it to the events. A null array has no events.
+func (s *respSendJoinStream) decodeEvents(decoder *json.Decoder, events *[]Event, isState bool) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("gomatrixserverlib: expected '[' in JSON, got %v", token)
+	}
+	for decoder.More() {
+		var event Event
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if err := s.checkEvent(event, isState); err != nil {
+			return err
+		}
+		*events = append(*events, event)
+	}
+	return expectJSONDelim(decoder, ']')
+}
+
+// checkEvent does the checks on an event that don't need the other events
+// in the response, in the same way as RespState.CheckWithOptions. The
+// signatures are checked once there is a full batch of events.
+func (s *respSendJoinStream) checkEvent(event Event, isState bool) error {
+	if event.StateKey() == nil {
+		return fmt.Errorf("gomatrixserverlib: event %q does not have a state key", event.EventID())
+	}
+	if isState {
+		stateTuple := StateKeyTuple{event.Type(), *event.StateKey()}
+		if s.stateTuples[stateTuple] {
+			return fmt.Errorf(
+				"gomatrixserverlib: duplicate state key tuple (%q, %q)",
+				event.Type(), *event.StateKey(),
+			)
+		}
+		s.stateTuples[stateTuple] = true
+		// The event is copied since the slice it is appended to may move.
+		stateEvent := event
+		if err := s.stateEvents.AddEvent(&stateEvent); err != nil {
+			return err
+		}
+	}
+	if size, maxSize := len(event.JSON()), s.opts.maxEventSize(); size > maxSize {
+		return ErrEventTooLarge{event.EventID(), size, maxSize}
+	}
+	if count, maxPrev := len(event.PrevEvents()), s.opts.maxPrevEvents(); count > maxPrev {
+		return ErrTooManyEventReferences{event.EventID(), "prev_events", count, maxPrev}
+	}
+	if count, maxAuth := len(event.AuthEvents()), s.opts.maxAuthEvents(); count > maxAuth {
+		return ErrTooManyEventReferences{event.EventID(), "auth_events", count, maxAuth}
+	}
+	if err := checkMemberStateKey(event); err != nil {
+		return err
+	}
+	if err := checkEventIDs([]Event{event}, s.roomVersion); err != nil {
+		return err
+	}
+	if isUnsigned(event) {
+		return ErrEventUnsigned{event.EventID()}
+	}
+	if err := checkSenderSigned(event); err != nil {
+		return err
+	}
+	s.unverified = append(s.unverified, event)
+	if len(s.unverified) >= respSendJoinStreamBatchSize {
+		return s.verifySignatures()
+	}
+	return nil
+}
+
+// verifySignatures checks the signatures of the events that haven't been
+// checked yet.
+func (s *respSendJoinStream) verifySignatures() error {
+	if len(s.unverified) == 0 {
+		return nil
+	}
+	if err := checkEventSignatures(s.ctx, s.unverified, s.keyRing, s.roomVersion); err != nil {
+		return err
+	}
+	s.unverified = s.unverified[:0]
+	return nil
+}
+
+// expectJSONDelim reads the next token from the decoder and checks that it
+// is the delimiter.
+func expectJSONDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("gomatrixserverlib: expected %q in JSON, got %v", delim, token)
+	}
+	return nil
+}
+
+// A RespMakeLeave is the content of a response to GET /_matrix/federation/v2/make_leave/{roomID}/{userID}
+type RespMakeLeave struct {
+	// An incomplete m.room.member event for a user on the requesting server
+	// generated by the responding server.
+	// See https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-make-leave-roomid-userid
+	LeaveEvent EventBuilder `json:"event"`
+}
+
+// A RespDirectory is the content of a response to GET  /_matrix/federation/v1/query/directory
+// This is returned when looking up a room alias from a remote server.
+// See https://matrix.org/docs/spec/server_server/unstable.html#directory
+type RespDirectory struct {
+	// The matrix room ID the room alias corresponds to.
+	RoomID string `json:"room_id"`
+	// A list of matrix servers that the directory server thinks could be used
+	// to join the room. The joining server may need to try multiple servers
+	// before it finds one that it can use to join the room.
+	Servers []ServerName `json:"servers"`
+}
+
+// RespProfile is the content of a response to GET /_matrix/federation/v1/query/profile
+type RespProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// A RespQuery is the content of a response to
+// GET /_matrix/federation/v1/query/{queryType}, for any type of query. The
+// fields of the response are kept as they are, so that responses to query
+// types that this library doesn't know about can be handled by the caller.
+// See https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-query-querytype
+type RespQuery struct {
+	// The fields of the response object.
+	Fields map[string]json.RawMessage
+}
+
+// MarshalJSON implements json.Marshaller
+func (r RespQuery) MarshalJSON() ([]byte, error) {
+	if r.Fields == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(r.Fields)
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *RespQuery) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return fmt.Errorf("gomatrixserverlib: query response is not a JSON object")
+	}
+	r.Fields = fields
+	return nil
+}
+
+// AsDirectory returns the response to a "directory" query. Returns an error
+// if the fields aren't valid for a directory response.
+func (r RespQuery) AsDirectory() (RespDirectory, error) {
+	var res RespDirectory
+	err := r.decode("directory", &res)
+	return res, err
+}
+
+// AsProfile returns the response to a "profile" query. Returns an error if
+// the fields aren't valid for a profile response.
+func (r RespQuery) AsProfile() (RespProfile, error) {
+	var res RespProfile
+	err := r.decode("profile", &res)
+	return res, err
+}
+
+// decode decodes the fields of the response into the response type of the
+// query type.
+func (r RespQuery) decode(queryType string, res interface{}) error {
+	data, err := r.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, res); err != nil {
+		return fmt.Errorf("gomatrixserverlib: invalid %s query response: %s", queryType, err)
+	}
+	return nil
+}
+
+// RespOpenIDUserInfo is the content of a response to
+// GET /_matrix/federation/v1/openid/userinfo, which gives the user that an
+// OpenID access token was issued for. It is the same as the UserInfo that
+// Client.LookupUserInfo returns.
+type RespOpenIDUserInfo = UserInfo
+
+// Check that the response has a valid user ID in its sub. The server that
+// the token was issued by should also check that the user ID is on that
+// server, as Client.LookupUserInfo does.
+func (u UserInfo) Check() error {
+	if _, err := ParseUserID(u.Sub); err != nil {
+		return fmt.Errorf("gomatrixserverlib: invalid sub in openid userinfo: %s", err.Error())
+	}
+	return nil
+}
+
+// missingAuthEvents returns a MissingAuthEventError for each of the auth events
+// of the event that isn't in eventsByID.
+func missingAuthEvents(event Event, eventsByID map[string]*Event) []error {
+	var missing []error
+	for _, authEventID := range event.AuthEventIDs() {
+		if eventsByID[authEventID] == nil {
+			missing = append(missing, MissingAuthEventError{event.EventID(), authEventID})
+		}
+	}
+	return missing
+}
+
+// checkEventsAllowed checks that each of the events is allowed by its auth
+// events, which are looked up in eventsByID. If any of the rejected events are auth
+// events of the other events then returns an ErrRejectedAuthEvent for the
+// first such reference, since an event that was authed using a rejected
+// event can't be trusted even if it passes its own checks. Otherwise returns
+// the error for the first rejected event.
+func checkEventsAllowed(eventsByID map[string]*Event, eventLists ...[]Event) error {
+	var firstErr error
+	rejected := map[string]error{}
+	authEvents := NewAuthEventsWithCapacity(6)
+	for _, events := range eventLists {
+		for _, event := range events {
+			if err := checkAllowedByAuthEvents(event, eventsByID, &authEvents); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				rejected[event.EventID()] = err
+			}
+		}
+	}
+	if firstErr == nil {
+		return nil
+	}
+	for _, events := range eventLists {
+		for _, event := range events {
+			for _, authEventID := range event.AuthEventIDs() {
+				if err, ok := rejected[authEventID]; ok {
+					return ErrRejectedAuthEvent{event.EventID(), authEventID, err}
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// checkAllowedByAuthEvents checks that the event is allowed by its auth events,
+// which are looked up in eventsByID. The events are added to authEvents, which
+// is cleared first so that it can be reused for each event being checked.
+func checkAllowedByAuthEvents(event Event, eventsByID map[string]*Event, authEvents *AuthEvents) error {
+	authEvents.Clear()
+	for _, authRef := range event.AuthEvents() {
+		authEvent := eventsByID[authRef.EventID]
+		if authEvent == nil {
+			return MissingAuthEventError{event.EventID(), authRef.EventID}
+		}
+		if err := authEvents.AddEvent(authEvent); err != nil {
+			return err
+		}
+	}
+	if err := Allowed(event, authEvents); err != nil {
+		return fmt.Errorf(
+			"gomatrixserverlib: event with ID %q is not allowed by its auth_events: %s",
+			event.EventID(), err.Error(),
+		)
+	}
+	return nil
+}
+
+// RespInvite is the content of a response to PUT /_matrix/federation/v1/invite/{roomID}/{eventID}
+type RespInvite struct {
+	// The invite event signed by recipient server.
+	Event Event
+}
+
+// BuildRespInvite builds the response to an invite for a user on our server by
+// adding our signature to the invite event, which is redacted with the rules
+// of the room version before signing. The signatures already on the event,
+// such as the signature of the inviting server, are kept.
+// Returns an error if the event isn't an invite for a user on our server, or
+// if the room version is unknown.
+func BuildRespInvite(
+	inviteEvent Event, roomVersion RoomVersion, origin ServerName, keyID KeyID, key ed25519.PrivateKey,
+) (RespInvite, error) {
+	redactionAlgorithm, err := roomVersion.RedactionAlgorithm()
+	if err != nil {
+		return RespInvite{}, err
+	}
+	if inviteEvent.Type() != MRoomMember || inviteEvent.StateKey() == nil {
+		return RespInvite{}, fmt.Errorf(
+			"gomatrixserverlib: event %q is not a membership event", inviteEvent.EventID(),
+		)
+	}
+	content, err := NewMemberContentFromEvent(inviteEvent)
+	if err != nil {
+		return RespInvite{}, err
+	}
+	if content.Membership != Invite {
+		return RespInvite{}, fmt.Errorf(
+			"gomatrixserverlib: event %q has membership %q, not %q",
+			inviteEvent.EventID(), content.Membership, Invite,
+		)
+	}
+	userID, err := ParseUserID(*inviteEvent.StateKey())
+	if err != nil {
+		return RespInvite{}, err
+	}
+	if userID.ServerName() != origin {
+		return RespInvite{}, fmt.Errorf(
+			"gomatrixserverlib: invite event %q is for %q, who isn't on %q",
+			inviteEvent.EventID(), userID, origin,
+		)
+	}
+
+	eventJSON, err := signEvent(string(origin), keyID, key, inviteEvent.JSON(), redactionAlgorithm)
+	if err != nil {
+		return RespInvite{}, err
+	}
+	if eventJSON, err = CanonicalJSON(eventJSON); err != nil {
+		return RespInvite{}, err
+	}
+	event, err := NewEventFromTrustedJSON(eventJSON, inviteEvent.Redacted())
+	if err != nil {
+		return RespInvite{}, err
+	}
+	return RespInvite{Event: event}, nil
 }
 
 // MarshalJSON implements json.Marshaller
@@ -0,0 +1,59 @@
+//go:build go1.18
+// +build go1.18
+
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzParseAndValidateServerName checks that ParseAndValidateServerName
+// doesn't panic on any input, and that the results are consistent.
+//
+// The seed corpus below runs as part of "go test". To fuzz with generated
+// inputs, which needs Go 1.18 or later, run:
+//
+//	go test -run '^$' -fuzz FuzzParseAndValidateServerName
+//
+// Any failing inputs found are written to testdata/fuzz, and should be
+// committed so that they are checked by "go test" from then on.
+func FuzzParseAndValidateServerName(f *testing.F) {
+	for _, seed := range []string{
+		"", ":", ":8448", "[", "]", "[]", "[]:8448", "[::1]", "[::1]:8448",
+		"[::1", "::1", "::1:8448", "a", "a:", "a:8448", "a:99999",
+		"1.2.3.4", "1.2.3.4:8448", "example.com", "exa_mple.com",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		host, port, valid := ParseAndValidateServerName(ServerName(input))
+		if !valid {
+			return
+		}
+		if host == "" {
+			t.Errorf("%q: valid with an empty host", input)
+		}
+		if strings.Contains(host, ":") && host[0] != '[' {
+			t.Errorf("%q: valid with an unbracketed IPv6 host %q", input, host)
+		}
+		if port < -1 || port > 65535 {
+			t.Errorf("%q: valid with port %d", input, port)
+		}
+	})
+}
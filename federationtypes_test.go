@@ -1,8 +1,18 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/ed25519"
 )
 
 const emptyRespStateResponse = `{"state":[],"auth_chain":[],"origin":""}`
@@ -16,6 +26,8 @@ func TestParseServerName(t *testing.T) {
 		"1.1.1.1":                      {"1.1.1.1", -1},
 		"[1fff:0:a88:85a3::ac1f]:1234": {"[1fff:0:a88:85a3::ac1f]", 1234},
 		"[2001:0db8::ff00:0042]":       {"[2001:0db8::ff00:0042]", -1},
+		"[::1]:8448":                   {"[::1]", 8448},
+		"[::1]":                        {"[::1]", -1},
 	}
 
 	for input, output := range validTests {
@@ -35,12 +47,23 @@ func TestParseServerName(t *testing.T) {
 	invalidTests := []string{
 		// ipv6 not in square brackets
 		"2001:0db8::ff00:0042",
+		"::1",
+		"::1:8448",
+		"2001:0db8::ff00:0042:8448",
 
 		// host with invalid characters
 		"test_test.com",
 
 		// ipv6 with insufficient parts
 		"[2001:0db8:0000:0000:0000:ff00:0042]",
+
+		// ipv6 with an unclosed square bracket
+		"[::1:8448",
+
+		// empty host
+		"",
+		":8448",
+		"[]:8448",
 	}
 
 	for _, input := range invalidTests {
@@ -88,3 +111,1961 @@ func TestRespSendJoinUnmarshalJSON(t *testing.T) {
 	}
 
 }
+
+// testV6TopicEvent returns a content-hashed event in a version 6 room with
+// the given topic, advertised under the given event ID.
+func testV6TopicEvent(t *testing.T, eventID, topic string) Event {
+	eventJSON, err := addContentHashesToEvent([]byte(`{
+		"auth_events": [],
+		"content": {"topic": "`+topic+`"},
+		"depth": 5,
+		"event_id": "`+eventID+`",
+		"origin": "domain",
+		"origin_server_ts": 1000000,
+		"prev_events": [],
+		"room_id": "!x:domain",
+		"sender": "@a:domain",
+		"state_key": "",
+		"type": "m.room.topic"
+	}`), HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestRespStateCheckEventIDs(t *testing.T) {
+	// Work out the genuine ID of the event, then splice different content
+	// under that ID.
+	genuineID, err := ComputeEventID(testV6TopicEvent(t, "", "genuine"), RoomVersionV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := testV6TopicEvent(t, genuineID, "tampered")
+
+	r := RespState{StateEvents: []Event{tampered}}
+	err = r.Check(context.Background(), &StubVerifier{}, RoomVersionV6)
+	if err == nil {
+		t.Fatal("RespState.Check: expected an error for a tampered event")
+	}
+	if !strings.Contains(err.Error(), "doesn't match the event content") {
+		t.Fatalf("RespState.Check: unexpected error: %s", err)
+	}
+
+	if err = r.Check(context.Background(), &StubVerifier{}, "unknown"); err == nil {
+		t.Fatal("RespState.Check: expected an error for an unknown room version")
+	}
+
+	// An event ID without a server name passes the version-less field
+	// checks, but not the checks of a room version with server chosen IDs.
+	noServerName := testV6TopicEvent(t, "$noservername", "genuine")
+	if err = noServerName.CheckFields(); err != nil {
+		t.Fatalf("Event.CheckFields: unexpected error: %s", err)
+	}
+	r = RespState{StateEvents: []Event{noServerName}}
+	if err = r.Check(context.Background(), &StubVerifier{}, RoomVersionV1); err == nil {
+		t.Fatal("RespState.Check: expected an error for an event ID without a server name in a version 1 room")
+	}
+}
+
+func TestRespStateCheckMemberStateKeys(t *testing.T) {
+	for _, stateKey := range []string{"", "not-a-user", "@:domain", "@alice", "@alice:bad domain"} {
+		event, err := NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.member",
+			"state_key": "`+stateKey+`",
+			"event_id": "$member:domain",
+			"room_id": "!x:domain",
+			"sender": "@a:domain",
+			"content": {"membership": "join"}
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := RespState{StateEvents: []Event{event}}
+		err = r.Check(context.Background(), &StubVerifier{}, RoomVersionV1)
+		if err == nil {
+			t.Fatalf("RespState.Check: expected an error for state key %q", stateKey)
+		}
+		if !strings.Contains(err.Error(), "isn't a valid user ID") {
+			t.Fatalf("RespState.Check: unexpected error for state key %q: %s", stateKey, err)
+		}
+	}
+}
+
+// testRespStateMissingAuthEvents returns a response to /state where the
+// m.room.name event has an auth event that isn't in the response. The events
+// have placeholder signatures that only a StubVerifier accepts.
+func testRespStateMissingAuthEvents(t *testing.T) RespState {
+	var events []Event
+	for _, eventJSON := range []string{`{
+		"type": "m.room.create",
+		"state_key": "",
+		"event_id": "$create:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"content": {"creator": "@u:a"}
+	}`, `{
+		"type": "m.room.member",
+		"state_key": "@u:a",
+		"event_id": "$member:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"prev_events": [["$create:a", {}]],
+		"auth_events": [["$create:a", {}]],
+		"content": {"membership": "join"}
+	}`, `{
+		"type": "m.room.name",
+		"state_key": "",
+		"event_id": "$name:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"auth_events": [["$create:a", {}], ["$member:a", {}], ["$power_levels:a", {}]],
+		"content": {"name": "A room"}
+	}`} {
+		events = append(events, testEvent(t, eventJSON))
+	}
+	return RespState{StateEvents: events[1:], AuthEvents: events[:1]}
+}
+
+// testTopicEvent returns a m.room.topic event from the sender of the events
+// in testRespStateMissingAuthEvents, with the given JSON lists of prev_events
+// and auth_events.
+func testTopicEvent(t *testing.T, prevEvents, authEvents, topic string) Event {
+	return testEventf(t, `{"type":"m.room.topic","state_key":"","event_id":"$topic:a","room_id":"!r:a",`+
+		`"sender":"@u:a","origin":"a","signatures":{"a":{"ed25519:1":"c2lnbmF0dXJl"}},`+
+		`"prev_events":%s,"auth_events":%s,"content":{"topic":%q}}`, prevEvents, authEvents, topic)
+}
+
+func TestRespStateToStateIDs(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	got := r.ToStateIDs()
+	want := RespStateIDs{
+		StateEventIDs: []string{"$member:a", "$name:a"},
+		AuthEventIDs:  []string{"$create:a"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RespState.ToStateIDs: got %v, want %v", got, want)
+	}
+
+	gotJSON, err := json.Marshal(RespState{}.ToStateIDs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"pdu_ids":[],"auth_chain_ids":[]}`; string(gotJSON) != want {
+		t.Errorf("RespState.ToStateIDs: got %s for an empty response, want %s", gotJSON, want)
+	}
+}
+
+func TestRespStateCheckRejectedAuthEvent(t *testing.T) {
+	// The power levels event is sent by a user who isn't in the room, so is
+	// rejected, but the name event uses it as an auth event. The name event
+	// would be allowed by its auth events on its own.
+	r := testRespStateMissingAuthEvents(t)
+	powerLevels, err := NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"event_id": "$power_levels:a",
+		"room_id": "!r:a",
+		"sender": "@v:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"auth_events": [["$create:a", {}]],
+		"content": {"users": {"@u:a": 100, "@v:a": 100}}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AuthEvents = append(append([]Event(nil), r.AuthEvents...), powerLevels)
+
+	err = r.Check(context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 4)}, RoomVersionV1)
+	rejectedErr, ok := err.(ErrRejectedAuthEvent)
+	if !ok {
+		t.Fatalf("RespState.Check: want ErrRejectedAuthEvent, got %v", err)
+	}
+	if rejectedErr.EventID != "$name:a" || rejectedErr.AuthEventID != "$power_levels:a" {
+		t.Errorf("RespState.Check: got rejected auth event %q for %q, want %q for %q",
+			rejectedErr.AuthEventID, rejectedErr.EventID, "$power_levels:a", "$name:a")
+	}
+
+	// If nothing uses the rejected event as an auth event then the error is
+	// just that the event isn't allowed.
+	r.StateEvents = r.StateEvents[:1]
+	err = r.Check(context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 3)}, RoomVersionV1)
+	if _, ok = err.(ErrRejectedAuthEvent); ok || err == nil {
+		t.Errorf("RespState.Check: want an error that isn't ErrRejectedAuthEvent, got %v", err)
+	}
+}
+
+func TestRespStateCheckAllRejectedAuthChain(t *testing.T) {
+	// The first power levels event is sent by a user who isn't in the room,
+	// so is rejected. The second power levels event is authed using the
+	// first, and the topic event is authed using the second, so both are
+	// rejected as well even though they pass their own checks.
+	r := testRespStateMissingAuthEvents(t)
+	r.StateEvents = r.StateEvents[:1]
+	r.AuthEvents = append([]Event(nil), r.AuthEvents...)
+	for _, eventJSON := range []string{`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"event_id": "$power_levels:a",
+		"room_id": "!r:a",
+		"sender": "@v:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"auth_events": [["$create:a", {}]],
+		"content": {"users": {"@u:a": 100, "@v:a": 100}}
+	}`, `{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"event_id": "$power_levels_2:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"auth_events": [["$create:a", {}], ["$member:a", {}], ["$power_levels:a", {}]],
+		"content": {"users": {"@u:a": 100, "@v:a": 100}}
+	}`} {
+		r.AuthEvents = append(r.AuthEvents, testEvent(t, eventJSON))
+	}
+	r.AuthEvents = append(r.AuthEvents, testTopicEvent(
+		t, "[]", `[["$create:a",{}],["$member:a",{}],["$power_levels_2:a",{}]]`, "A topic",
+	))
+
+	errs := r.CheckAll(context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 5)}, RoomVersionV1)
+	if len(errs) != 3 {
+		t.Fatalf("RespState.CheckAll: got %d errors, want 3: %v", len(errs), errs)
+	}
+	rejected := map[string]ErrRejectedAuthEvent{}
+	for _, err := range errs {
+		if e, ok := err.(ErrRejectedAuthEvent); ok {
+			rejected[e.EventID] = e
+		}
+	}
+	if e := rejected["$power_levels_2:a"]; e.AuthEventID != "$power_levels:a" {
+		t.Errorf("RespState.CheckAll: got rejected auth event %q for %q, want %q", e.AuthEventID, "$power_levels_2:a", "$power_levels:a")
+	}
+	e := rejected["$topic:a"]
+	if e.AuthEventID != "$power_levels_2:a" {
+		t.Fatalf("RespState.CheckAll: got rejected auth event %q for %q, want %q", e.AuthEventID, "$topic:a", "$power_levels_2:a")
+	}
+	if cause, ok := e.Err.(ErrRejectedAuthEvent); !ok || cause.AuthEventID != "$power_levels:a" {
+		t.Errorf("RespState.CheckAll: want %q rejected because of %q, got %v", "$topic:a", "$power_levels:a", e.Err)
+	}
+
+	// Check reports the first event that was authed using a rejected event.
+	err := r.Check(context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 5)}, RoomVersionV1)
+	if e, ok := err.(ErrRejectedAuthEvent); !ok || e.EventID != "$power_levels_2:a" {
+		t.Errorf("RespState.Check: want ErrRejectedAuthEvent for %q, got %v", "$power_levels_2:a", err)
+	}
+}
+
+func TestRespStateCheckMissingAuthEvents(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+
+	// By default a missing auth event is an error.
+	err := r.Check(context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 3)}, RoomVersionV1)
+	if _, ok := err.(MissingAuthEventError); !ok {
+		t.Fatalf("RespState.Check: want MissingAuthEventError, got %v", err)
+	}
+
+	// When allowed it is returned as a warning instead.
+	warnings, err := r.CheckWithOptions(
+		context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 3)}, RoomVersionV1,
+		CheckOptions{AllowMissingAuthEvents: true},
+	)
+	if err != nil {
+		t.Fatalf("RespState.CheckWithOptions: unexpected error: %s", err)
+	}
+	want := []error{MissingAuthEventError{EventID: "$name:a", AuthEventID: "$power_levels:a"}}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Fatalf("RespState.CheckWithOptions: want warnings %v, got %v", want, warnings)
+	}
+
+	// The events that can be checked still are.
+	r.StateEvents[0], err = NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.member",
+		"state_key": "@u:a",
+		"event_id": "$member:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"signatures": {"a": {"ed25519:1": "c2lnbmF0dXJl"}},
+		"prev_events": [["$other:a", {}]],
+		"auth_events": [["$create:a", {}]],
+		"content": {"membership": "join"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.CheckWithOptions(
+		context.Background(), &StubVerifier{results: make([]VerifyJSONResult, 3)}, RoomVersionV1,
+		CheckOptions{AllowMissingAuthEvents: true},
+	)
+	if err == nil {
+		t.Fatal("RespState.CheckWithOptions: expected an error for an event that isn't allowed")
+	}
+}
+
+// testRespStateWithEventOfSize returns a valid response to /state with a
+// m.room.topic event whose JSON is the given number of bytes long.
+func testRespStateWithEventOfSize(t *testing.T, size int) RespState {
+	r := testRespStateMissingAuthEvents(t)
+	authEvents := `[["$create:a",{}],["$member:a",{}]]`
+	padding := size - len(testTopicEvent(t, "[]", authEvents, "").JSON())
+	topic := testTopicEvent(t, "[]", authEvents, strings.Repeat("x", padding))
+	if len(topic.JSON()) != size {
+		t.Fatalf("Wanted an event of length %d, got %d", size, len(topic.JSON()))
+	}
+	return RespState{
+		StateEvents: []Event{r.AuthEvents[0], r.StateEvents[0], topic},
+	}
+}
+
+func TestRespStateCheckEventSize(t *testing.T) {
+	verifier := &StubVerifier{results: make([]VerifyJSONResult, 3)}
+	if err := testRespStateWithEventOfSize(t, 65536).Check(context.Background(), verifier, RoomVersionV1); err != nil {
+		t.Errorf("RespState.Check: unexpected error for an event of 65536 bytes: %s", err)
+	}
+
+	r := testRespStateWithEventOfSize(t, 65537)
+	err := r.Check(context.Background(), verifier, RoomVersionV1)
+	want := ErrEventTooLarge{EventID: "$topic:a", Size: 65537, MaxSize: 65536}
+	if err != want {
+		t.Errorf("RespState.Check: want %v, got %v", want, err)
+	}
+
+	// The limit can be changed using the options.
+	if _, err = r.CheckWithOptions(
+		context.Background(), verifier, RoomVersionV1, CheckOptions{MaxEventSize: 65537},
+	); err != nil {
+		t.Errorf("RespState.CheckWithOptions: unexpected error with a larger limit: %s", err)
+	}
+	_, err = r.CheckWithOptions(context.Background(), verifier, RoomVersionV1, CheckOptions{MaxEventSize: 1024})
+	if tooLarge, ok := err.(ErrEventTooLarge); !ok || tooLarge.MaxSize != 1024 {
+		t.Errorf("RespState.CheckWithOptions: want ErrEventTooLarge with a maximum of 1024, got %v", err)
+	}
+}
+
+// testRespStateWithReferences returns a response to /state with a
+// m.room.topic event with the given numbers of prev_events and auth_events.
+// The auth events alternate between the create and member events.
+func testRespStateWithReferences(t *testing.T, prevCount, authCount int) RespState {
+	r := testRespStateMissingAuthEvents(t)
+	prevEvents := make([]string, prevCount)
+	for i := range prevEvents {
+		prevEvents[i] = fmt.Sprintf(`["$prev%d:a",{}]`, i)
+	}
+	authEvents := make([]string, authCount)
+	for i := range authEvents {
+		authEvents[i] = []string{`["$create:a",{}]`, `["$member:a",{}]`}[i%2]
+	}
+	topic := testTopicEvent(
+		t, "["+strings.Join(prevEvents, ",")+"]", "["+strings.Join(authEvents, ",")+"]", "A topic",
+	)
+	return RespState{
+		StateEvents: []Event{r.AuthEvents[0], r.StateEvents[0], topic},
+	}
+}
+
+func TestRespStateCheckEventReferences(t *testing.T) {
+	verifier := &StubVerifier{results: make([]VerifyJSONResult, 3)}
+	if err := testRespStateWithReferences(t, 20, 10).Check(context.Background(), verifier, RoomVersionV1); err != nil {
+		t.Errorf("RespState.Check: unexpected error for 20 prev_events and 10 auth_events: %s", err)
+	}
+
+	err := testRespStateWithReferences(t, 21, 10).Check(context.Background(), verifier, RoomVersionV1)
+	want := ErrTooManyEventReferences{EventID: "$topic:a", Key: "prev_events", Count: 21, Max: 20}
+	if err != want {
+		t.Errorf("RespState.Check: want %v, got %v", want, err)
+	}
+	err = testRespStateWithReferences(t, 20, 11).Check(context.Background(), verifier, RoomVersionV1)
+	want = ErrTooManyEventReferences{EventID: "$topic:a", Key: "auth_events", Count: 11, Max: 10}
+	if err != want {
+		t.Errorf("RespState.Check: want %v, got %v", want, err)
+	}
+
+	// The limits can be changed using the options.
+	r := testRespStateWithReferences(t, 21, 11)
+	if _, err = r.CheckWithOptions(
+		context.Background(), verifier, RoomVersionV1, CheckOptions{MaxPrevEvents: 21, MaxAuthEvents: 11},
+	); err != nil {
+		t.Errorf("RespState.CheckWithOptions: unexpected error with larger limits: %s", err)
+	}
+	_, err = r.CheckWithOptions(context.Background(), verifier, RoomVersionV1, CheckOptions{MaxPrevEvents: 25, MaxAuthEvents: 2})
+	want = ErrTooManyEventReferences{EventID: "$topic:a", Key: "auth_events", Count: 11, Max: 2}
+	if err != want {
+		t.Errorf("RespState.CheckWithOptions: want %v, got %v", want, err)
+	}
+}
+
+func TestRespStateCheckNoFederation(t *testing.T) {
+	create, err := NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.create",
+		"state_key": "",
+		"event_id": "$create:a",
+		"room_id": "!r:a",
+		"sender": "@u:a",
+		"origin": "a",
+		"content": {"creator": "@u:a", "m.federate": false}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.member",
+		"state_key": "@v:b",
+		"event_id": "$member:b",
+		"room_id": "!r:a",
+		"sender": "@v:b",
+		"origin": "b",
+		"auth_events": [["$create:a", {}]],
+		"content": {"membership": "join"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote event is rejected whether it is in the state or in the auth
+	// chain, and regardless of its auth events.
+	for _, r := range []RespState{
+		{StateEvents: []Event{create, remote}},
+		{StateEvents: []Event{create}, AuthEvents: []Event{remote}},
+		{AuthEvents: []Event{create, remote}},
+	} {
+		err = r.Check(context.Background(), &StubVerifier{}, RoomVersionV1)
+		if err == nil {
+			t.Fatal("RespState.Check: expected an error for a remote event in an unfederated room")
+		}
+		if !strings.Contains(err.Error(), "room is unfederatable") {
+			t.Fatalf("RespState.Check: unexpected error: %s", err)
+		}
+	}
+}
+
+func TestRespStateCheckAuthChainClosed(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	// Move the event with the dangling auth event reference into the auth
+	// chain, where it is only needed to auth the other events.
+	r = RespState{
+		StateEvents: []Event{r.StateEvents[0]},
+		AuthEvents:  []Event{r.AuthEvents[0], r.StateEvents[1]},
+	}
+
+	// The dangling reference is found before any signatures are checked.
+	var verifier StubVerifier
+	err := r.Check(context.Background(), &verifier, RoomVersionV1)
+	want := MissingAuthEventError{EventID: "$name:a", AuthEventID: "$power_levels:a"}
+	if err != want {
+		t.Fatalf("RespState.Check: want %v, got %v", want, err)
+	}
+	if len(verifier.requests) != 0 {
+		t.Fatalf("RespState.Check: want no signature checks, got %d", len(verifier.requests))
+	}
+}
+
+func TestRespStateCheckUnsigned(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	for _, signatures := range []string{``, `"signatures": {},`, `"signatures": {"a": {}},`} {
+		topic, err := NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.topic",
+			"state_key": "",
+			"event_id": "$topic:a",
+			"room_id": "!r:a",
+			"sender": "@u:a",
+			"origin": "a",
+			`+signatures+`
+			"auth_events": [["$create:a", {}], ["$member:a", {}]],
+			"content": {"topic": "A topic"}
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unsigned := RespState{
+			StateEvents: []Event{r.StateEvents[0], topic},
+			AuthEvents:  r.AuthEvents,
+		}
+
+		// The unsigned event is found before any signatures are checked.
+		var verifier StubVerifier
+		err = unsigned.Check(context.Background(), &verifier, RoomVersionV1)
+		want := ErrEventUnsigned{EventID: "$topic:a"}
+		if err != want {
+			t.Errorf("RespState.Check with %q: want %v, got %v", signatures, want, err)
+		}
+		if len(verifier.requests) != 0 {
+			t.Errorf("RespState.Check with %q: want no signature checks, got %d", signatures, len(verifier.requests))
+		}
+	}
+}
+
+func TestRespStateCheckSenderSigned(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	for _, test := range []struct {
+		name       string
+		event      string
+		signatures string
+		wantErr    bool
+	}{
+		{"topic from the sender's server", `"type": "m.room.topic", "state_key": "", "sender": "@u:a", "content": {"topic": "A topic"}`,
+			`{"a": {"ed25519:1": "c2lnbmF0dXJl"}}`, false},
+		{"spoofed topic", `"type": "m.room.topic", "state_key": "", "sender": "@u:a", "content": {"topic": "A topic"}`,
+			`{"b": {"ed25519:1": "c2lnbmF0dXJl"}}`, true},
+		{"co-signed invite", `"type": "m.room.member", "state_key": "@v:b", "sender": "@u:a", "content": {"membership": "invite"}`,
+			`{"a": {"ed25519:1": "c2lnbmF0dXJl"}, "b": {"ed25519:1": "c2lnbmF0dXJl"}}`, false},
+		{"invite only signed by the invited server", `"type": "m.room.member", "state_key": "@v:b", "sender": "@u:a", "content": {"membership": "invite"}`,
+			`{"b": {"ed25519:1": "c2lnbmF0dXJl"}}`, true},
+		{"restricted join", `"type": "m.room.member", "state_key": "@v:b", "sender": "@v:b", "content": {"membership": "join", "join_authorised_via_users_server": "@u:a"}`,
+			`{"a": {"ed25519:1": "c2lnbmF0dXJl"}, "b": {"ed25519:1": "c2lnbmF0dXJl"}}`, false},
+		{"restricted join only signed by the authorising server", `"type": "m.room.member", "state_key": "@v:b", "sender": "@v:b", "content": {"membership": "join", "join_authorised_via_users_server": "@u:a"}`,
+			`{"a": {"ed25519:1": "c2lnbmF0dXJl"}}`, true},
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(`{
+			"event_id": "$event:a",
+			"room_id": "!r:a",
+			"origin": "a",
+			"auth_events": [["$create:a", {}], ["$member:a", {}]],
+			"signatures": `+test.signatures+`,
+			`+test.event+`
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := RespState{
+			StateEvents: []Event{r.StateEvents[0], event},
+			AuthEvents:  r.AuthEvents,
+		}
+
+		verifier := StubVerifier{results: make([]VerifyJSONResult, 10)}
+		err = resp.Check(context.Background(), &verifier, RoomVersionV1)
+		senderErr, isSenderErr := err.(ErrSenderNotSigned)
+		if !test.wantErr {
+			if isSenderErr {
+				t.Errorf("%s: RespState.Check: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		// An event that isn't signed by its sender's server is rejected
+		// before any signatures are checked.
+		sender, _ := domainFromID(event.Sender())
+		if want := (ErrSenderNotSigned{"$event:a", ServerName(sender)}); senderErr != want {
+			t.Errorf("%s: RespState.Check: want %v, got %v", test.name, want, err)
+		}
+		if len(verifier.requests) != 0 {
+			t.Errorf("%s: RespState.Check: want no signature checks, got %d", test.name, len(verifier.requests))
+		}
+	}
+}
+
+func TestRespStateOrphans(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	orphans := r.Orphans()
+	if want := []string{"$name:a"}; !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("RespState.Orphans: want %v, got %v", want, orphans)
+	}
+
+	// Without the create event nothing can be authed.
+	r.AuthEvents = nil
+	orphans = r.Orphans()
+	if want := []string{"$member:a", "$name:a"}; !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("RespState.Orphans: want %v, got %v", want, orphans)
+	}
+}
+
+func TestRespStateNormalize(t *testing.T) {
+	events := testRespStateMissingAuthEvents(t)
+	create, member := events.AuthEvents[0], events.StateEvents[0]
+	// The member event is in both lists, and the create event is repeated in
+	// the auth chain.
+	r := RespState{
+		StateEvents: []Event{member, member},
+		AuthEvents:  []Event{create, member, create},
+	}
+	r.Normalize()
+	if got, want := stateResEventIDs(r.StateEvents), []string{"$member:a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RespState.Normalize: want state events %v, got %v", want, got)
+	}
+	if got, want := stateResEventIDs(r.AuthEvents), []string{"$create:a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RespState.Normalize: want auth events %v, got %v", want, got)
+	}
+
+	// Each event is then only verified once.
+	verifier := StubVerifier{results: make([]VerifyJSONResult, 2)}
+	if err := r.Check(context.Background(), &verifier, RoomVersionV1); err != nil {
+		t.Fatalf("RespState.Check: unexpected error: %s", err)
+	}
+	if len(verifier.requests) != 2 {
+		t.Errorf("RespState.Check: want 2 signature checks, got %d", len(verifier.requests))
+	}
+}
+
+func TestRespStateClone(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	wantState, wantAuth := stateResEventIDs(r.StateEvents), stateResEventIDs(r.AuthEvents)
+
+	clone := r.Clone()
+	clone.StateEvents[0] = clone.AuthEvents[0]
+	clone.AuthEvents = clone.AuthEvents[:0]
+	if err := clone.StateEvents[0].SetUnsignedField("age", 1); err != nil {
+		t.Fatalf("Event.SetUnsignedField: unexpected error: %s", err)
+	}
+	if got := stateResEventIDs(r.StateEvents); !reflect.DeepEqual(got, wantState) {
+		t.Errorf("RespState.Clone: original state events changed to %v, want %v", got, wantState)
+	}
+	if got := stateResEventIDs(r.AuthEvents); !reflect.DeepEqual(got, wantAuth) {
+		t.Errorf("RespState.Clone: original auth events changed to %v, want %v", got, wantAuth)
+	}
+	if len(r.AuthEvents[0].Unsigned()) != 0 {
+		t.Errorf("RespState.Clone: original event got unsigned %s", r.AuthEvents[0].Unsigned())
+	}
+
+	if clone := (RespState{}).Clone(); clone.StateEvents != nil || clone.AuthEvents != nil {
+		t.Errorf("RespState.Clone: want nil lists to stay nil, got %v", clone)
+	}
+}
+
+func TestBuildRespState(t *testing.T) {
+	r := testRespStateMissingAuthEvents(t)
+	create, member := r.AuthEvents[0], r.StateEvents[0]
+	topic := testTopicEvent(t, `[["$member:a",{}]]`, `[["$create:a",{}],["$member:a",{}]]`, "A topic")
+	member2 := testEvent(t, `{"type":"m.room.member","state_key":"@u:a","event_id":"$member2:a","room_id":"!r:a",`+
+		`"sender":"@u:a","origin":"a","signatures":{"a":{"ed25519:1":"c2lnbmF0dXJl"}},"prev_events":[["$topic:a",{}]],`+
+		`"auth_events":[["$create:a",{}],["$member:a",{}]],"content":{"membership":"join","displayname":"U"}}`)
+
+	known := map[string]*Event{}
+	for _, event := range []Event{create, member, topic, member2} {
+		event := event
+		known[event.EventID()] = &event
+	}
+	provider := func(ctx context.Context, eventID string) (*Event, error) {
+		return known[eventID], nil
+	}
+	// The join has been replaced in the state by a change of display name, so
+	// the auth chain has to include the join from the provider.
+	state := map[StateKeyTuple]Event{
+		{"m.room.create", ""}:     create,
+		{"m.room.member", "@u:a"}: member2,
+		{"m.room.topic", ""}:      topic,
+	}
+
+	got, err := BuildRespState(context.Background(), state, provider)
+	if err != nil {
+		t.Fatalf("BuildRespState: unexpected error: %s", err)
+	}
+	if want := []string{"$create:a", "$member2:a", "$topic:a"}; !reflect.DeepEqual(stateResEventIDs(got.StateEvents), want) {
+		t.Errorf("BuildRespState: want state events %v, got %v", want, stateResEventIDs(got.StateEvents))
+	}
+	if want := []string{"$create:a", "$member:a"}; !reflect.DeepEqual(stateResEventIDs(got.AuthEvents), want) {
+		t.Errorf("BuildRespState: want auth events %v, got %v", want, stateResEventIDs(got.AuthEvents))
+	}
+	verifier := &StubVerifier{results: make([]VerifyJSONResult, 10)}
+	if err = got.Check(context.Background(), verifier, RoomVersionV1); err != nil {
+		t.Errorf("RespState.Check: unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = BuildRespState(ctx, state, provider); err != context.Canceled {
+		t.Errorf("BuildRespState: want %v for a cancelled context, got %v", context.Canceled, err)
+	}
+
+	delete(known, "$member:a")
+	_, err = BuildRespState(context.Background(), state, provider)
+	if _, ok := err.(MissingAuthEventsError); !ok {
+		t.Errorf("BuildRespState: want a MissingAuthEventsError, got %v", err)
+	}
+
+	state[StateKeyTuple{"m.room.name", ""}] = topic
+	if _, err = BuildRespState(context.Background(), state, provider); err == nil {
+		t.Error("BuildRespState: want an error for an event under the wrong key, got nil")
+	}
+}
+
+func TestRespStateBinaryRoundTrip(t *testing.T) {
+	// Events are stored as compact JSON, so compact the test events to get
+	// a fair comparison of the sizes of the encodings.
+	r := testRespStateMissingAuthEvents(t)
+	for _, events := range [][]Event{r.AuthEvents, r.StateEvents} {
+		for i := range events {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, events[i].JSON()); err != nil {
+				t.Fatal(err)
+			}
+			event, err := NewEventFromTrustedJSON(compact.Bytes(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events[i] = event
+		}
+	}
+	r.StateEvents[1] = r.StateEvents[1].Redact()
+
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got RespState
+	if err = got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Fatalf("RespState binary round trip: want %+v, got %+v", r, got)
+	}
+	if !got.StateEvents[1].Redacted() {
+		t.Fatal("RespState binary round trip: the redacted event is no longer redacted")
+	}
+
+	// The events are stored as they are, so the encoding is about the same
+	// size as compact JSON: each event costs a length prefix of one or two
+	// bytes in place of a comma, and there are no surrounding keys. The saving
+	// is in decoding, which doesn't need to scan the JSON for the ends of the
+	// events. Unlike JSON, it also keeps whether each event was redacted.
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventCount := len(r.AuthEvents) + len(r.StateEvents)
+	if len(data) > len(jsonData)+eventCount {
+		t.Fatalf("RespState binary encoding is %d bytes, JSON is %d bytes", len(data), len(jsonData))
+	}
+
+	for i := 0; i < len(data); i++ {
+		if err = got.UnmarshalBinary(data[:i]); err == nil {
+			t.Fatalf("RespState.UnmarshalBinary: expected an error for %d of %d bytes", i, len(data))
+		}
+	}
+	if err = got.UnmarshalBinary(append(data, 0)); err == nil {
+		t.Fatal("RespState.UnmarshalBinary: expected an error for trailing data")
+	}
+}
+
+func testJoinRulesRespState(t *testing.T, content string) RespState {
+	return RespState{StateEvents: []Event{testEventf(t, `{
+		"type": "m.room.join_rules",
+		"state_key": "",
+		"event_id": "$join_rules:domain",
+		"room_id": "!x:domain",
+		"sender": "@a:domain",
+		"content": %s
+	}`, content)}}
+}
+
+func TestRespStateJoinRule(t *testing.T) {
+	joinRule, err := testJoinRulesRespState(t, `{"join_rule": "public"}`).JoinRule()
+	if err != nil || joinRule.JoinRule != Public {
+		t.Errorf("public: want %q got %q, %v", Public, joinRule.JoinRule, err)
+	}
+
+	joinRule, err = testJoinRulesRespState(t, `{"join_rule": "invite"}`).JoinRule()
+	if err != nil || joinRule.JoinRule != Invite {
+		t.Errorf("invite: want %q got %q, %v", Invite, joinRule.JoinRule, err)
+	}
+
+	joinRule, err = RespState{}.JoinRule()
+	if err != nil || joinRule.JoinRule != Invite {
+		t.Errorf("no join rules event: want %q got %q, %v", Invite, joinRule.JoinRule, err)
+	}
+
+	joinRule, err = testJoinRulesRespState(t, `{
+		"join_rule": "restricted",
+		"allow": [
+			{"type": "m.room_membership", "room_id": "!space:domain"},
+			{"type": "org.example.unknown"}
+		]
+	}`).JoinRule()
+	if err != nil {
+		t.Fatalf("restricted: %s", err)
+	}
+	want := []JoinRuleAllowCondition{
+		{Type: MRoomMembership, RoomID: "!space:domain"},
+		{Type: "org.example.unknown"},
+	}
+	if joinRule.JoinRule != Restricted || !reflect.DeepEqual(joinRule.Allow, want) {
+		t.Errorf("restricted: want %q %v got %q %v", Restricted, want, joinRule.JoinRule, joinRule.Allow)
+	}
+
+	for _, content := range []string{
+		`{"join_rule": "everyone"}`,
+		`{"join_rule": 1}`,
+		`{"join_rule": "restricted", "allow": [{"type": "m.room_membership", "room_id": "#alias:domain"}]}`,
+		`{"join_rule": "restricted", "allow": [{"type": "m.room_membership"}]}`,
+	} {
+		if _, err := testJoinRulesRespState(t, content).JoinRule(); err == nil {
+			t.Errorf("JoinRule(%s): expected an error", content)
+		}
+	}
+}
+
+func TestRespStateIsFederatable(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		want    bool
+		wantErr bool
+	}{
+		{`{"creator": "@a:domain"}`, true, false},
+		{`{"creator": "@a:domain", "m.federate": true}`, true, false},
+		{`{"creator": "@a:domain", "m.federate": false}`, false, false},
+		{`{"creator": "@a:domain", "m.federate": "no"}`, false, true},
+	} {
+		create, err := NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.create",
+			"state_key": "",
+			"event_id": "$create:domain",
+			"room_id": "!x:domain",
+			"sender": "@a:domain",
+			"content": `+test.content+`
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The create event is found in the auth events as well.
+		for _, r := range []RespState{{StateEvents: []Event{create}}, {AuthEvents: []Event{create}}} {
+			got, err := r.IsFederatable()
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("%s: RespState.IsFederatable: got %v, %v, want %v", test.content, got, err, test.want)
+			}
+		}
+	}
+
+	if _, err := testJoinRulesRespState(t, `{"join_rule": "public"}`).IsFederatable(); err == nil {
+		t.Errorf("RespState.IsFederatable: wanted an error without a create event")
+	}
+}
+
+func TestPublicRoomValidate(t *testing.T) {
+	room := PublicRoom{
+		RoomID:         "!room:example.com",
+		CanonicalAlias: "#room:example.com",
+		Aliases:        []string{"#room:example.com", "#other:example.org:8448"},
+	}
+	if err := room.Validate(); err != nil {
+		t.Errorf("Validate: unexpected error: %s", err)
+	}
+	if err := (PublicRoom{RoomID: "!room:example.com"}).Validate(); err != nil {
+		t.Errorf("Validate without aliases: unexpected error: %s", err)
+	}
+
+	room.CanonicalAlias = "room:example.com"
+	if err := room.Validate(); err == nil {
+		t.Error("Validate: expected an error for an invalid canonical alias")
+	}
+	room.CanonicalAlias = ""
+	room.Aliases = append(room.Aliases, "#room")
+	if err := room.Validate(); err == nil {
+		t.Error("Validate: expected an error for an invalid alias")
+	}
+}
+
+func TestRespPublicRoomsFilterByServer(t *testing.T) {
+	input := RespPublicRooms{
+		Chunk: []PublicRoom{
+			{RoomID: "!a:good.example.com"},
+			{RoomID: "!b:bad.example.com"},
+			{RoomID: "!c:good.example.com"},
+			{RoomID: "!d:bad.example.com:8448"},
+			{RoomID: "not_a_room_id"},
+		},
+		NextBatch:              "next",
+		PrevBatch:              "prev",
+		TotalRoomCountEstimate: 5,
+	}
+	blocked := ServerNameMatcherFunc(func(serverName ServerName) bool {
+		host, _, _ := ParseAndValidateServerName(serverName)
+		return host == "bad.example.com"
+	})
+
+	got := input.FilterByServer(blocked)
+	want := RespPublicRooms{
+		Chunk: []PublicRoom{
+			{RoomID: "!a:good.example.com"},
+			{RoomID: "!c:good.example.com"},
+		},
+		NextBatch:              "next",
+		PrevBatch:              "prev",
+		TotalRoomCountEstimate: 5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterByServer: got %+v, want %+v", got, want)
+	}
+	if len(input.Chunk) != 5 || input.Chunk[1].RoomID != "!b:bad.example.com" {
+		t.Errorf("FilterByServer modified the input: %+v", input.Chunk)
+	}
+
+	none := input.Filter(func(PublicRoom) bool { return false })
+	if none.Chunk == nil || len(none.Chunk) != 0 {
+		t.Errorf("Filter: want an empty chunk, got %#v", none.Chunk)
+	}
+}
+
+func TestRespMakeJoinBuildJoinEvent(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := KeyID("ed25519:test")
+	now := time.Unix(1500000000, 0)
+
+	for _, tc := range []struct {
+		roomVersion RoomVersion
+		prevEvents  string
+	}{
+		{"", `[["$prev:remote", {"sha256": "aGVsbG8"}]]`},
+		{RoomVersionV3, `["$abc+def/ghi"]`},
+		{RoomVersionV6, `["$abc-def_ghi"]`},
+	} {
+		var r RespMakeJoin
+		if err = json.Unmarshal([]byte(`{
+			"room_version": "`+string(tc.roomVersion)+`",
+			"event": {
+				"type": "m.room.member",
+				"state_key": "@bob:local",
+				"sender": "@bob:local",
+				"room_id": "!room:remote",
+				"content": {"membership": "join"},
+				"depth": 10,
+				"prev_events": `+tc.prevEvents+`,
+				"auth_events": `+tc.prevEvents+`
+			}
+		}`), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		event, err := r.BuildJoinEvent("local", keyID, privateKey, FixedClock(now))
+		if err != nil {
+			t.Fatalf("room version %q: BuildJoinEvent: %s", tc.roomVersion, err)
+		}
+
+		// Check that the event passes the checks a receiving server would
+		// make on it.
+		received, err := NewEventFromUntrustedJSON(event.JSON())
+		if err != nil {
+			t.Fatalf("room version %q: NewEventFromUntrustedJSON: %s", tc.roomVersion, err)
+		}
+		if received.Redacted() {
+			t.Errorf("room version %q: event failed the content hash check", tc.roomVersion)
+		}
+		if err = received.Verify("local", keyID, publicKey); err != nil {
+			t.Errorf("room version %q: Verify: %s", tc.roomVersion, err)
+		}
+		if received.Origin() != "local" || received.OriginServerTS() != AsTimestamp(now) {
+			t.Errorf("room version %q: wrong origin or timestamp: %q %d", tc.roomVersion, received.Origin(), received.OriginServerTS())
+		}
+
+		var prevEvents []RawJSON
+		if err = json.Unmarshal([]byte(gjson.GetBytes(event.JSON(), "prev_events").Raw), &prevEvents); err != nil {
+			t.Fatal(err)
+		}
+		if tc.roomVersion == "" {
+			if !strings.HasSuffix(event.EventID(), ":local") {
+				t.Errorf("room version 1: want an event ID on the origin server got %q", event.EventID())
+			}
+			if prevEvents[0][0] != '[' {
+				t.Errorf("room version 1: want prev_events as tuples got %s", string(prevEvents[0]))
+			}
+			continue
+		}
+		wantID, err := ComputeEventID(event, tc.roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.EventID() != wantID {
+			t.Errorf("room version %q: want event ID %q got %q", tc.roomVersion, wantID, event.EventID())
+		}
+		if prevEvents[0][0] != '"' {
+			t.Errorf("room version %q: want prev_events as event IDs got %s", tc.roomVersion, string(prevEvents[0]))
+		}
+	}
+}
+
+func TestRespMakeJoinBuildJoinEventClock(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := RespMakeJoin{
+		RoomVersion: RoomVersionV6,
+		JoinEvent: EventBuilder{
+			Type:     MRoomMember,
+			StateKey: new(string),
+			Sender:   "@bob:local",
+			RoomID:   "!room:remote",
+			Content:  RawJSON(`{"membership":"join"}`),
+			Depth:    10,
+		},
+	}
+	*r.JoinEvent.StateKey = "@bob:local"
+
+	// With a fixed clock the event is the same each time it is built.
+	clock := FixedClock(time.Unix(1500000000, 123000000))
+	first, err := r.BuildJoinEvent("local", "ed25519:test", privateKey, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.BuildJoinEvent("local", "ed25519:test", privateKey, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.OriginServerTS() != 1500000000123 {
+		t.Errorf("wanted origin_server_ts 1500000000123, got %d", first.OriginServerTS())
+	}
+	if first.EventID() != second.EventID() || !bytes.Equal(first.JSON(), second.JSON()) {
+		t.Errorf("wanted the same event each time, got %s and %s", first.JSON(), second.JSON())
+	}
+
+	// Without a clock the event has the current time.
+	before := AsTimestamp(time.Now())
+	event, err := r.BuildJoinEvent("local", "ed25519:test", privateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := AsTimestamp(time.Now())
+	if event.OriginServerTS() < before || event.OriginServerTS() > after {
+		t.Errorf("wanted origin_server_ts between %d and %d, got %d", before, after, event.OriginServerTS())
+	}
+}
+
+func TestBuildRespInvite(t *testing.T) {
+	senderPublicKey, senderPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ourPublicKey, ourPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := KeyID("ed25519:test")
+	now := time.Unix(1500000000, 0)
+
+	buildEvent := func(stateKey, membership string) Event {
+		builder := EventBuilder{
+			Sender:   "@alice:remote",
+			RoomID:   "!room:remote",
+			Type:     MRoomMember,
+			StateKey: &stateKey,
+			Depth:    10,
+		}
+		if err = builder.SetContent(map[string]string{"membership": membership}); err != nil {
+			t.Fatal(err)
+		}
+		event, berr := builder.Build("$invite:remote", now, "remote", keyID, senderPrivateKey)
+		if berr != nil {
+			t.Fatal(berr)
+		}
+		return event
+	}
+
+	resp, err := BuildRespInvite(buildEvent("@bob:local", Invite), RoomVersionV1, "local", keyID, ourPrivateKey)
+	if err != nil {
+		t.Fatalf("BuildRespInvite: unexpected error: %s", err)
+	}
+	for serverName, publicKey := range map[string]ed25519.PublicKey{
+		"remote": senderPublicKey,
+		"local":  ourPublicKey,
+	} {
+		if err = verifyEventSignature(serverName, keyID, publicKey, resp.Event.JSON(), RedactionAlgorithmV1); err != nil {
+			t.Errorf("BuildRespInvite: signature of %q doesn't verify: %s", serverName, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		stateKey, membership string
+	}{
+		{"@bob:local", Join},
+		{"@bob:elsewhere", Invite},
+	} {
+		if _, err = BuildRespInvite(buildEvent(tc.stateKey, tc.membership), RoomVersionV1, "local", keyID, ourPrivateKey); err == nil {
+			t.Errorf("BuildRespInvite: expected an error for %s of %q", tc.membership, tc.stateKey)
+		}
+	}
+}
+
+func TestRespOpenIDUserInfo(t *testing.T) {
+	var res RespOpenIDUserInfo
+	if err := json.Unmarshal([]byte(`{"sub":"@alice:example.com"}`), &res); err != nil {
+		t.Fatalf("json.Unmarshal: unexpected error: %v", err)
+	}
+	if res.Sub != "@alice:example.com" {
+		t.Fatalf("json.Unmarshal: got sub %q, want %q", res.Sub, "@alice:example.com")
+	}
+	if err := res.Check(); err != nil {
+		t.Errorf("Check: unexpected error: %v", err)
+	}
+
+	for _, sub := range []string{"", "alice:example.com", "@:example.com", "@alice", "@alice:bad host"} {
+		if err := (RespOpenIDUserInfo{Sub: sub}).Check(); err == nil {
+			t.Errorf("Check: wanted an error for sub %q", sub)
+		}
+	}
+}
+
+func TestRespQuery(t *testing.T) {
+	var directory RespQuery
+	if err := json.Unmarshal([]byte(`{"room_id":"!room:a","servers":["a","b"]}`), &directory); err != nil {
+		t.Fatalf("json.Unmarshal: unexpected error: %v", err)
+	}
+	gotDirectory, err := directory.AsDirectory()
+	if err != nil {
+		t.Fatalf("AsDirectory: unexpected error: %v", err)
+	}
+	wantDirectory := RespDirectory{RoomID: "!room:a", Servers: []ServerName{"a", "b"}}
+	if !reflect.DeepEqual(gotDirectory, wantDirectory) {
+		t.Errorf("AsDirectory: got %+v, want %+v", gotDirectory, wantDirectory)
+	}
+
+	var profile RespQuery
+	if err = json.Unmarshal([]byte(`{"displayname":"Alice","avatar_url":"mxc://a/b"}`), &profile); err != nil {
+		t.Fatalf("json.Unmarshal: unexpected error: %v", err)
+	}
+	gotProfile, err := profile.AsProfile()
+	if err != nil {
+		t.Fatalf("AsProfile: unexpected error: %v", err)
+	}
+	if want := (RespProfile{DisplayName: "Alice", AvatarURL: "mxc://a/b"}); gotProfile != want {
+		t.Errorf("AsProfile: got %+v, want %+v", gotProfile, want)
+	}
+	if _, err = profile.AsDirectory(); err != nil {
+		t.Errorf("AsDirectory: unexpected error for a response without directory fields: %v", err)
+	}
+	if _, err = directory.AsProfile(); err != nil {
+		t.Errorf("AsProfile: unexpected error for a response without profile fields: %v", err)
+	}
+
+	// A response to an unknown query type keeps its fields as they are.
+	unknownJSON := `{"answer":42,"nested":{"a":[1,2]}}`
+	var unknown RespQuery
+	if err = json.Unmarshal([]byte(unknownJSON), &unknown); err != nil {
+		t.Fatalf("json.Unmarshal: unexpected error: %v", err)
+	}
+	if got := string(unknown.Fields["nested"]); got != `{"a":[1,2]}` {
+		t.Errorf("json.Unmarshal: got nested field %s, want %s", got, `{"a":[1,2]}`)
+	}
+	if _, err = unknown.AsProfile(); err != nil {
+		t.Errorf("AsProfile: unexpected error: %v", err)
+	}
+	if _, err = (RespQuery{Fields: map[string]json.RawMessage{"room_id": json.RawMessage(`1`)}}).AsDirectory(); err == nil {
+		t.Errorf("AsDirectory: wanted an error for an invalid room ID")
+	}
+	remarshalled, err := json.Marshal(unknown)
+	if err != nil {
+		t.Fatalf("json.Marshal: unexpected error: %v", err)
+	}
+	if string(remarshalled) != unknownJSON {
+		t.Errorf("json.Marshal: got %s, want %s", remarshalled, unknownJSON)
+	}
+
+	for _, invalid := range []string{`null`, `[]`, `"query"`} {
+		if err = json.Unmarshal([]byte(invalid), &RespQuery{}); err == nil {
+			t.Errorf("json.Unmarshal: wanted an error for %s", invalid)
+		}
+	}
+}
+
+// testSignedSendJoin returns the JSON of a response to /send_join for a
+// public room with the given number of joined members, a join event for a
+// new member, and a KeyRing with the key that the events are signed with.
+func testSignedSendJoin(tb testing.TB, members int) ([]byte, Event, KeyRing) {
+	const serverName, keyID = ServerName("example.com"), KeyID("ed25519:1")
+	privateKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	keyRing := KeyRing{KeyDatabase: NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{serverName, keyID}: {
+			VerifyKey:    VerifyKey{Key: Base64String(privateKey.Public().(ed25519.PublicKey))},
+			ValidUntilTS: AsTimestamp(time.Unix(2000000000, 0)),
+			ExpiredTS:    PublicKeyNotExpired,
+		},
+	})}
+
+	var depth int64
+	var prevEvents []EventReference
+	build := func(sender, eventType, stateKey, content string, authEvents ...Event) Event {
+		depth++
+		builder := EventBuilder{
+			Sender:     sender,
+			RoomID:     "!room:example.com",
+			Type:       eventType,
+			StateKey:   &stateKey,
+			PrevEvents: prevEvents,
+			Depth:      depth,
+			Content:    RawJSON(content),
+		}
+		for _, authEvent := range authEvents {
+			builder.AuthEvents = append(builder.AuthEvents, authEvent.EventReference())
+		}
+		event, err := builder.Build(
+			fmt.Sprintf("$%d:example.com", depth), time.Unix(1500000000, 0), serverName, keyID, privateKey,
+		)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		prevEvents = []EventReference{event.EventReference()}
+		return event
+	}
+
+	alice := "@alice:example.com"
+	create := build(alice, MRoomCreate, "", `{"creator":"`+alice+`"}`)
+	aliceJoin := build(alice, MRoomMember, alice, `{"membership":"join"}`, create)
+	powerLevels := build(alice, MRoomPowerLevels, "", `{"users":{"`+alice+`":100}}`, create, aliceJoin)
+	joinRules := build(alice, MRoomJoinRules, "", `{"join_rule":"public"}`, create, aliceJoin, powerLevels)
+	authChain := []Event{create, aliceJoin, powerLevels, joinRules}
+	state := append([]Event(nil), authChain...)
+	for i := 0; i < members; i++ {
+		member := fmt.Sprintf("@member%d:example.com", i)
+		state = append(state, build(member, MRoomMember, member, `{"membership":"join"}`, create, powerLevels, joinRules))
+	}
+	joiner := "@joiner:example.com"
+	joinEvent := build(joiner, MRoomMember, joiner, `{"membership":"join"}`, create, powerLevels, joinRules)
+
+	body, err := json.Marshal(RespSendJoin{
+		RespState: RespState{StateEvents: state, AuthEvents: authChain},
+		Origin:    serverName,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return body, joinEvent, keyRing
+}
+
+func TestRespSendJoinCheckStream(t *testing.T) {
+	body, joinEvent, keyRing := testSignedSendJoin(t, 600)
+	ctx := context.Background()
+
+	var want RespSendJoin
+	if err := json.Unmarshal(body, &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := want.Check(ctx, keyRing, joinEvent, RoomVersionV1); err != nil {
+		t.Fatalf("RespSendJoin.Check: unexpected error: %v", err)
+	}
+	var got RespSendJoin
+	if err := got.CheckStream(ctx, keyRing, joinEvent, RoomVersionV1, bytes.NewReader(body)); err != nil {
+		t.Fatalf("RespSendJoin.CheckStream: unexpected error: %v", err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Fatalf("RespSendJoin.CheckStream: decoded response differs from json.Unmarshal")
+	}
+}
+
+func TestRespStateShard(t *testing.T) {
+	body, _, keyRing := testSignedSendJoin(t, 10)
+	ctx := context.Background()
+	var resp RespSendJoin
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{1, 3, 4, 100} {
+		shards, err := resp.Shard(n)
+		if err != nil {
+			t.Fatalf("RespState.Shard(%d): unexpected error: %v", n, err)
+		}
+		wantShards := n
+		if wantShards > len(resp.StateEvents) {
+			wantShards = len(resp.StateEvents)
+		}
+		if len(shards) != wantShards {
+			t.Fatalf("RespState.Shard(%d): got %d shards, want %d", n, len(shards), wantShards)
+		}
+		var stateEventIDs []string
+		for i, shard := range shards {
+			if err := shard.Check(ctx, keyRing, RoomVersionV1); err != nil {
+				t.Errorf("RespState.Shard(%d): shard %d: RespState.Check: unexpected error: %v", n, i, err)
+			}
+			stateEventIDs = append(stateEventIDs, shard.ToStateIDs().StateEventIDs...)
+		}
+		if want := resp.ToStateIDs().StateEventIDs; !reflect.DeepEqual(stateEventIDs, want) {
+			t.Errorf("RespState.Shard(%d): got state events %v, want %v", n, stateEventIDs, want)
+		}
+	}
+
+	if _, err := resp.Shard(0); err == nil {
+		t.Errorf("RespState.Shard(0): wanted an error")
+	}
+	_, err := testRespStateMissingAuthEvents(t).Shard(2)
+	want := MissingAuthEventError{EventID: "$name:a", AuthEventID: "$power_levels:a"}
+	if err != want {
+		t.Errorf("RespState.Shard: want %v, got %v", want, err)
+	}
+}
+
+func TestRespStateCheckAll(t *testing.T) {
+	body, _, keyRing := testSignedSendJoin(t, 5)
+	ctx := context.Background()
+	var resp RespSendJoin
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if errs := resp.RespState.CheckAll(ctx, keyRing, RoomVersionV1); errs != nil {
+		t.Fatalf("RespState.CheckAll: unexpected errors: %v", errs)
+	}
+
+	// Break three of the member events in different ways.
+	modify := func(i int, f func(fields map[string]interface{})) string {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(resp.StateEvents[i].JSON(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		f(fields)
+		eventJSON, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, err := NewEventFromTrustedJSON(eventJSON, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.StateEvents[i] = event
+		return event.EventID()
+	}
+	badSignature := modify(4, func(fields map[string]interface{}) {
+		fields["content"] = map[string]interface{}{"membership": "leave"}
+	})
+	unsigned := modify(5, func(fields map[string]interface{}) {
+		delete(fields, "signatures")
+	})
+	missingAuth := modify(6, func(fields map[string]interface{}) {
+		fields["auth_events"] = append(fields["auth_events"].([]interface{}), []interface{}{"$missing:example.com", map[string]interface{}{}})
+	})
+
+	errs := resp.CheckAll(ctx, keyRing, RoomVersionV1)
+	if len(errs) != 3 {
+		t.Fatalf("RespState.CheckAll: got %d errors, want 3: %v", len(errs), errs)
+	}
+	found := map[string]bool{}
+	for _, err := range errs {
+		switch e := err.(type) {
+		case SignatureInvalidError:
+			found[badSignature] = true
+		case ErrEventUnsigned:
+			found[e.EventID] = e.EventID == unsigned
+		case MissingAuthEventError:
+			found[e.EventID] = e.EventID == missingAuth && e.AuthEventID == "$missing:example.com"
+		default:
+			t.Errorf("RespState.CheckAll: unexpected error: %v", err)
+		}
+	}
+	for _, eventID := range []string{badSignature, unsigned, missingAuth} {
+		if !found[eventID] {
+			t.Errorf("RespState.CheckAll: wanted an error for %q, got %v", eventID, errs)
+		}
+	}
+
+	// Check only reports the first.
+	if err := resp.RespState.Check(ctx, keyRing, RoomVersionV1); err == nil {
+		t.Errorf("RespState.Check: wanted an error")
+	}
+
+	// The options can turn the missing auth event into a warning.
+	warnings, errs := resp.CheckAllWithOptions(ctx, keyRing, RoomVersionV1, CheckOptions{AllowMissingAuthEvents: true})
+	if len(warnings) != 1 {
+		t.Fatalf("RespState.CheckAllWithOptions: got %d warnings, want 1: %v", len(warnings), warnings)
+	}
+	if e, ok := warnings[0].(MissingAuthEventError); !ok || e.EventID != missingAuth {
+		t.Errorf("RespState.CheckAllWithOptions: wanted a missing auth event warning for %q, got %v", missingAuth, warnings[0])
+	}
+	for _, err := range errs {
+		if _, ok := err.(MissingAuthEventError); ok {
+			t.Errorf("RespState.CheckAllWithOptions: unexpected error: %v", err)
+		}
+	}
+}
+
+func TestRespStateCheckSignatureBreakdown(t *testing.T) {
+	body, _, keyRing := testSignedSendJoin(t, 10)
+	var resp RespSendJoin
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the content of five of the member events without re-signing
+	// them, so that their signatures don't match.
+	var broken []string
+	for i := 4; i < 9; i++ {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(resp.StateEvents[i].JSON(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		fields["content"] = map[string]interface{}{"membership": "leave"}
+		eventJSON, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StateEvents[i], err = NewEventFromTrustedJSON(eventJSON, false); err != nil {
+			t.Fatal(err)
+		}
+		broken = append(broken, resp.StateEvents[i].EventID())
+	}
+
+	err := resp.RespState.Check(context.Background(), keyRing, RoomVersionV1)
+	e, ok := err.(ErrEventSignaturesInvalid)
+	if !ok {
+		t.Fatalf("RespState.Check: wanted an ErrEventSignaturesInvalid, got %v", err)
+	}
+	if e.Count != len(broken) || len(e.Failures) != maxReportedSignatureFailures {
+		t.Fatalf("RespState.Check: got %d failures of %d, want %d of %d",
+			len(e.Failures), e.Count, maxReportedSignatureFailures, len(broken))
+	}
+	for i, failure := range e.Failures {
+		if failure.EventID != broken[i] {
+			t.Errorf("RespState.Check: got failure for %q, want %q", failure.EventID, broken[i])
+		}
+		if len(failure.Signatures) != 1 {
+			t.Fatalf("RespState.Check: wanted one signature for %q, got %v", failure.EventID, failure.Signatures)
+		}
+		signature := failure.Signatures[0]
+		if _, ok := signature.Error.(SignatureInvalidError); !ok || signature.ServerName != "example.com" || signature.KeyID != "ed25519:1" {
+			t.Errorf("RespState.Check: wanted an invalid signature from example.com, got %v", signature)
+		}
+		if !strings.Contains(err.Error(), signature.String()) {
+			t.Errorf("RespState.Check: wanted the error to include %q, got %q", signature, err)
+		}
+	}
+	if !strings.Contains(err.Error(), "and 2 more") {
+		t.Errorf("RespState.Check: wanted the error to count the unreported failures, got %q", err)
+	}
+}
+
+func TestRespSendJoinCheckStreamMatchesCheck(t *testing.T) {
+	body, joinEvent, keyRing := testSignedSendJoin(t, 10)
+	ctx := context.Background()
+	var resp RespSendJoin
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	marshal := func(r RespSendJoin) []byte {
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	wrongKeyRing := KeyRing{KeyDatabase: NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{"example.com", "ed25519:1"}: {
+			VerifyKey:    VerifyKey{Key: Base64String(otherKey.Public().(ed25519.PublicKey))},
+			ValidUntilTS: AsTimestamp(time.Unix(2000000000, 0)),
+		},
+	})}
+
+	tests := []struct {
+		name      string
+		body      []byte
+		keyRing   JSONVerifier
+		joinEvent Event
+		wantErr   bool
+	}{
+		{"valid", body, keyRing, joinEvent, false},
+		{"null arrays", []byte(`{"state":null,"auth_chain":null,"origin":"example.com"}`), keyRing, joinEvent, true},
+		{"missing auth event", marshal(RespSendJoin{
+			RespState: RespState{StateEvents: resp.StateEvents[1:], AuthEvents: resp.AuthEvents[1:]},
+		}), keyRing, joinEvent, true},
+		{"duplicate state", marshal(RespSendJoin{
+			RespState: RespState{StateEvents: append(resp.StateEvents, resp.StateEvents[0]), AuthEvents: resp.AuthEvents},
+		}), keyRing, joinEvent, true},
+		{"wrong key", body, wrongKeyRing, joinEvent, true},
+		{"join event not allowed", body, keyRing, resp.StateEvents[0], true},
+	}
+	for _, test := range tests {
+		var r RespSendJoin
+		err := json.Unmarshal(test.body, &r)
+		if err == nil {
+			err = r.Check(ctx, test.keyRing, test.joinEvent, RoomVersionV1)
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: RespSendJoin.Check: got error %v, wanted error %v", test.name, err, test.wantErr)
+		}
+		err = r.CheckStream(ctx, test.keyRing, test.joinEvent, RoomVersionV1, bytes.NewReader(test.body))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: RespSendJoin.CheckStream: got error %v, wanted error %v", test.name, err, test.wantErr)
+		}
+	}
+
+	// A truncated response is rejected.
+	var r RespSendJoin
+	if err := r.CheckStream(ctx, keyRing, joinEvent, RoomVersionV1, bytes.NewReader(body[:len(body)/2])); err == nil {
+		t.Errorf("RespSendJoin.CheckStream: wanted an error for a truncated response")
+	}
+}
+
+// testSignedRespState returns the JSON of a response to /state with the
+// same events as testSignedSendJoin.
+func testSignedRespState(tb testing.TB, members int) []byte {
+	body, _, _ := testSignedSendJoin(tb, members)
+	var resp RespSendJoin
+	if err := json.Unmarshal(body, &resp); err != nil {
+		tb.Fatal(err)
+	}
+	body, err := json.Marshal(resp.RespState)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return body
+}
+
+func TestRawRespState(t *testing.T) {
+	body := testSignedRespState(t, 5)
+	var want RespState
+	if err := json.Unmarshal(body, &want); err != nil {
+		t.Fatal(err)
+	}
+	var raw RawRespState
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.StateEvents) != len(want.StateEvents) || len(raw.AuthEvents) != len(want.AuthEvents) {
+		t.Fatalf("RawRespState: got %d and %d events, want %d and %d",
+			len(raw.StateEvents), len(raw.AuthEvents), len(want.StateEvents), len(want.AuthEvents))
+	}
+	event, err := raw.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.EventID() != want.StateEvents[3].EventID() {
+		t.Errorf("RawRespState.Get: got %q, want %q", event.EventID(), want.StateEvents[3].EventID())
+	}
+	event, err = raw.GetAuth(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.EventID() != want.AuthEvents[1].EventID() {
+		t.Errorf("RawRespState.GetAuth: got %q, want %q", event.EventID(), want.AuthEvents[1].EventID())
+	}
+	if _, err = raw.Get(len(raw.StateEvents)); err == nil {
+		t.Errorf("RawRespState.Get: wanted an error for an index out of range")
+	}
+
+	got, err := raw.ToRespState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.ToStateIDs(), want.ToStateIDs()) {
+		t.Errorf("RawRespState.ToRespState: got %v, want %v", got.ToStateIDs(), want.ToStateIDs())
+	}
+
+	// Converting a RespState keeps the decoded events, so whether an event
+	// is redacted isn't lost.
+	want.StateEvents[0] = want.StateEvents[0].Redact()
+	raw = NewRawRespState(want)
+	if event, err = raw.Get(0); err != nil || !event.Redacted() {
+		t.Errorf("NewRawRespState: wanted the redacted event, got %v", err)
+	}
+	rawJSON, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rawJSON, wantJSON) {
+		t.Errorf("NewRawRespState: got JSON %s, want %s", rawJSON, wantJSON)
+	}
+}
+
+// BenchmarkRespStateDecode decodes every event of a large response, for
+// comparison with BenchmarkRawRespStateDecodeSubset.
+func BenchmarkRespStateDecode(b *testing.B) {
+	body := testSignedRespState(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var resp RespState
+		if err := json.Unmarshal(body, &resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRawRespStateDecodeSubset decodes ten events of a large response.
+func BenchmarkRawRespStateDecodeSubset(b *testing.B) {
+	body := testSignedRespState(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var resp RawRespState
+		if err := json.Unmarshal(body, &resp); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			if _, err := resp.Get(j * 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRespSendJoinCheck(b *testing.B) {
+	body, joinEvent, keyRing := testSignedSendJoin(b, 2000)
+	ctx := context.Background()
+
+	// The body is read from a reader in both cases, as it would be from an
+	// HTTP response.
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := ioutil.ReadAll(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var r RespSendJoin
+			if err = json.Unmarshal(data, &r); err != nil {
+				b.Fatal(err)
+			}
+			if err = r.Check(ctx, keyRing, joinEvent, RoomVersionV1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("CheckStream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var r RespSendJoin
+			if err := r.CheckStream(ctx, keyRing, joinEvent, RoomVersionV1, bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRespSendJoinCheckRestrictedJoin(t *testing.T) {
+	// The events of each room version are redacted differently for their
+	// signatures and event IDs, so check the versions that change the keys of
+	// restricted joins.
+	// The join doesn't need authorising in public rooms, or in room versions
+	// without restricted joins.
+	for _, test := range []struct {
+		roomVersion RoomVersion
+		joinRule    string
+		enforced    bool
+	}{
+		{RoomVersionV8, Restricted, true},
+		{RoomVersionV9, Restricted, true},
+		{RoomVersionV11, Restricted, true},
+		{RoomVersionV9, Public, false},
+		{RoomVersionV7, Public, false},
+	} {
+		test := test
+		t.Run(string(test.roomVersion)+"/"+test.joinRule, func(t *testing.T) {
+			testRespSendJoinCheckRestrictedJoin(t, test.roomVersion, test.joinRule, test.enforced)
+		})
+	}
+}
+
+func testRespSendJoinCheckRestrictedJoin(t *testing.T, roomVersion RoomVersion, joinRule string, enforced bool) {
+	const keyID = KeyID("ed25519:1")
+	residentKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	joinerKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	keyRing := KeyRing{KeyDatabase: NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{"example.com", keyID}: {
+			VerifyKey:    VerifyKey{Key: Base64String(residentKey.Public().(ed25519.PublicKey))},
+			ValidUntilTS: AsTimestamp(time.Unix(2000000000, 0)),
+		},
+		{"other.com", keyID}: {
+			VerifyKey:    VerifyKey{Key: Base64String(joinerKey.Public().(ed25519.PublicKey))},
+			ValidUntilTS: AsTimestamp(time.Unix(2000000000, 0)),
+		},
+	})}
+
+	var depth int64
+	var prevEvents []EventReference
+	build := func(
+		origin ServerName, privateKey ed25519.PrivateKey, sender, eventType, stateKey, content string, authEvents ...Event,
+	) Event {
+		depth++
+		builder := EventBuilder{
+			Sender:     sender,
+			RoomID:     "!room:example.com",
+			Type:       eventType,
+			StateKey:   &stateKey,
+			PrevEvents: prevEvents,
+			Depth:      depth,
+			Content:    RawJSON(content),
+		}
+		for _, authEvent := range authEvents {
+			builder.AuthEvents = append(builder.AuthEvents, authEvent.EventReference())
+		}
+		event, err := builder.BuildWithDerivedEventID(time.Unix(1500000000, 0), origin, keyID, privateKey, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eventType != MRoomMember || stateKey != "@joiner:other.com" {
+			prevEvents = []EventReference{event.EventReference()}
+		}
+		return event
+	}
+	resident := func(sender, eventType, stateKey, content string, authEvents ...Event) Event {
+		return build("example.com", residentKey, sender, eventType, stateKey, content, authEvents...)
+	}
+
+	alice, mod := "@alice:example.com", "@mod:example.com"
+	create := resident(alice, MRoomCreate, "", `{"creator":"`+alice+`","room_version":"`+string(roomVersion)+`"}`)
+	aliceJoin := resident(alice, MRoomMember, alice, `{"membership":"join"}`, create)
+	powerLevels := resident(alice, MRoomPowerLevels, "", `{"invite":50,"users":{"`+alice+`":100}}`, create, aliceJoin)
+	joinRules := resident(alice, MRoomJoinRules, "", `{
+		"join_rule":"`+joinRule+`",
+		"allow":[{"type":"m.room_membership","room_id":"!space:example.com"}]
+	}`, create, aliceJoin, powerLevels)
+	modJoin := resident(mod, MRoomMember, mod, `{"membership":"join","join_authorised_via_users_server":"`+alice+`"}`,
+		create, powerLevels, joinRules, aliceJoin)
+	state := []Event{create, aliceJoin, powerLevels, joinRules, modJoin}
+	resp := RespSendJoin{RespState: RespState{StateEvents: state, AuthEvents: state[:4]}, Origin: "example.com"}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// join returns a join for @joiner:other.com authorised by the user,
+	// signed by the resident server if signed is true.
+	join := func(authorisedVia string, signed bool, authEvents ...Event) Event {
+		content := `{"membership":"join"}`
+		if authorisedVia != "" {
+			content = `{"membership":"join","join_authorised_via_users_server":"` + authorisedVia + `"}`
+		}
+		event := build("other.com", joinerKey, "@joiner:other.com", MRoomMember, "@joiner:other.com", content,
+			append([]Event{create, powerLevels, joinRules}, authEvents...)...)
+		if !signed {
+			return event
+		}
+		// Event.Sign uses the redaction rules of room version 1, so sign
+		// with the rules of the room version instead.
+		redactionAlgorithm, err := roomVersion.RedactionAlgorithm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventJSON, err := signEvent("example.com", keyID, residentKey, event.JSON(), redactionAlgorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eventJSON, err = CanonicalJSON(eventJSON); err != nil {
+			t.Fatal(err)
+		}
+		if event, err = NewEventFromTrustedJSON(eventJSON, false); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	tests := []struct {
+		name             string
+		joinEvent        Event
+		wantErr          bool
+		wantUnauthorised bool
+	}{
+		{"authorised", join(alice, true, aliceJoin), false, false},
+		{"authoriser can't invite", join(mod, true, modJoin), true, true},
+		{"authoriser not joined", join("@nobody:example.com", true), true, true},
+		{"not signed by the authorising server", join(alice, false, aliceJoin), true, true},
+		{"no authoriser", join("", false), true, false},
+	}
+	for _, test := range tests {
+		if !enforced {
+			test.wantErr, test.wantUnauthorised = false, false
+		}
+		var checkErr, streamErr error
+		checkErr = resp.Check(context.Background(), keyRing, test.joinEvent, roomVersion)
+		var got RespSendJoin
+		streamErr = got.CheckStream(context.Background(), keyRing, test.joinEvent, roomVersion, bytes.NewReader(body))
+		for _, err := range []error{checkErr, streamErr} {
+			if (err != nil) != test.wantErr {
+				t.Errorf("%s: got error %v, wanted error %v", test.name, err, test.wantErr)
+				continue
+			}
+			if _, ok := err.(ErrRestrictedJoinUnauthorised); ok != test.wantUnauthorised {
+				t.Errorf("%s: got error %v, wanted ErrRestrictedJoinUnauthorised %v", test.name, err, test.wantUnauthorised)
+			}
+		}
+	}
+}
+
+func TestCollectMemberships(t *testing.T) {
+	member := func(userID, membership string) [3]string {
+		return [3]string{MRoomMember, userID, `{"membership": "` + membership + `"}`}
+	}
+	states := map[string]RespState{
+		"!joined:a": testRoomState(t, "!joined:a", member("@alice:a", Join), member("@bob:a", Join)),
+		"!invited:a": testRoomState(t, "!invited:a",
+			[3]string{MRoomCreate, "", `{"creator": "@bob:a"}`}, member("@bob:a", Join), member("@alice:a", Invite)),
+		"!absent:a": testRoomState(t, "!absent:a", member("@bob:a", Leave)),
+	}
+	got := CollectMemberships("@alice:a", states)
+	want := map[string]string{"!joined:a": Join, "!invited:a": Invite}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CollectMemberships: got %v, want %v", got, want)
+	}
+}
+
+func TestRespStateAliases(t *testing.T) {
+	canonical := [3]string{MRoomCanonicalAlias, "", `{
+		"alias": "#main:a",
+		"alt_aliases": ["#other:a", "not an alias", "#main:a"]
+	}`}
+	legacyA := [3]string{MRoomAliases, "a", `{"aliases": ["#legacy:a", "#other:a"]}`}
+	legacyB := [3]string{MRoomAliases, "b", `{"aliases": ["#legacy:b", "#:b"]}`}
+
+	tests := []struct {
+		state         RespState
+		wantCanonical string
+		wantAlt       []string
+	}{
+		{testRoomState(t, "!room:a"), "", nil},
+		{testRoomState(t, "!room:a", [3]string{MRoomCanonicalAlias, "", `{"alias": "#main:a"}`}), "#main:a", nil},
+		{testRoomState(t, "!room:a", [3]string{MRoomCanonicalAlias, "", `{"alias": "invalid"}`}), "", nil},
+		{testRoomState(t, "!room:a", legacyA, legacyB), "", []string{"#legacy:a", "#other:a", "#legacy:b"}},
+		{testRoomState(t, "!room:a", legacyA, canonical, legacyB), "#main:a", []string{"#other:a", "#legacy:a", "#legacy:b"}},
+	}
+	for i, test := range tests {
+		gotCanonical, gotAlt, err := test.state.Aliases()
+		if err != nil {
+			t.Fatalf("Case %d: Aliases: unexpected error: %v", i, err)
+		}
+		if gotCanonical != test.wantCanonical {
+			t.Errorf("Case %d: Aliases: got canonical alias %q, want %q", i, gotCanonical, test.wantCanonical)
+		}
+		if !reflect.DeepEqual(gotAlt, test.wantAlt) {
+			t.Errorf("Case %d: Aliases: got alt aliases %v, want %v", i, gotAlt, test.wantAlt)
+		}
+	}
+
+	invalid := testRoomState(t, "!room:a", [3]string{MRoomAliases, "a", `{"aliases": "#legacy:a"}`})
+	if _, _, err := invalid.Aliases(); err == nil {
+		t.Errorf("Aliases: wanted an error for invalid aliases event content")
+	}
+}
+
+func TestRespStateBySigningServer(t *testing.T) {
+	signedEvent := func(eventID, stateKey, content, signatures string) Event {
+		event, err := NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.member",
+			"state_key": "`+stateKey+`",
+			"event_id": "`+eventID+`",
+			"room_id": "!room:a",
+			"sender": "@alice:a",
+			"content": `+content+`,
+			"signatures": `+signatures+`
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	r := RespState{StateEvents: []Event{
+		signedEvent("$join:a", "@alice:a", `{"membership": "join"}`,
+			`{"a": {"ed25519:1": "sig"}}`),
+		// Invites are signed by the servers of both users.
+		signedEvent("$invite:a", "@bob:b", `{"membership": "invite"}`,
+			`{"a": {"ed25519:1": "sig"}, "B": {"ed25519:1": "sig"}}`),
+		signedEvent("$invite2:a", "@carol:c", `{"membership": "invite"}`,
+			`{"a": {"ed25519:1": "sig", "ed25519:2": "sig"}, "c": {"ed25519:1": "sig"}}`),
+		// Servers without signatures and invalid server names are ignored.
+		signedEvent("$leave:a", "@dave:a", `{"membership": "leave"}`,
+			`{"a": {"ed25519:1": "sig"}, "d": {}, "bad server": {"ed25519:1": "sig"}}`),
+	}}
+	want := map[ServerName][]string{
+		"a": {"$join:a", "$invite:a", "$invite2:a", "$leave:a"},
+		"b": {"$invite:a"},
+		"c": {"$invite2:a"},
+	}
+	if got := r.BySigningServer(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BySigningServer: got %v, want %v", got, want)
+	}
+}
+
+func TestRespStateTopPowerUser(t *testing.T) {
+	createV1 := [3]string{MRoomCreate, "", `{"creator": "@alice:a"}`}
+	// The creator key is ignored in version 11, where the sender of the
+	// create event is the creator.
+	createV11 := [3]string{MRoomCreate, "", `{"creator": "@alice:a", "room_version": "11"}`}
+	powerLevels := func(users string) [3]string {
+		return [3]string{MRoomPowerLevels, "", `{"users": ` + users + `}`}
+	}
+
+	tests := []struct {
+		state     RespState
+		wantUser  string
+		wantLevel int
+	}{
+		{testRoomState(t, "!room:a", createV1), "@alice:a", 100},
+		{testRoomState(t, "!room:a", createV11), "@creator:a", 100},
+		// The power levels event replaces the creator's implicit level,
+		// and ties go to the lowest user ID.
+		{testRoomState(t, "!room:a", createV1, powerLevels(`{"@alice:a": 50, "@dave:a": 75, "@carol:a": 75}`)), "@carol:a", 75},
+		{testRoomState(t, "!room:a", createV11, powerLevels(`{"@bob:a": 100}`)), "@bob:a", 100},
+	}
+	for i, test := range tests {
+		userID, level, err := test.state.TopPowerUser()
+		if err != nil {
+			t.Fatalf("Case %d: TopPowerUser: unexpected error: %v", i, err)
+		}
+		if userID != test.wantUser || level != test.wantLevel {
+			t.Errorf("Case %d: TopPowerUser: got %q at %d, want %q at %d", i, userID, level, test.wantUser, test.wantLevel)
+		}
+	}
+
+	for _, state := range []RespState{
+		testRoomState(t, "!room:a"),
+		testRoomState(t, "!room:a", createV1, powerLevels(`{}`)),
+		testRoomState(t, "!room:a", createV1, powerLevels(`"invalid"`)),
+	} {
+		if _, _, err := state.TopPowerUser(); err == nil {
+			t.Errorf("TopPowerUser: wanted an error")
+		}
+	}
+}
+
+func TestRespMakeJoinPrecheckJoinAllowed(t *testing.T) {
+	r := RespMakeJoin{JoinEvent: EventBuilder{
+		Sender:  "@template:b",
+		RoomID:  "!room:a",
+		Type:    MRoomMember,
+		Content: RawJSON(`{"membership":"join"}`),
+	}}
+	create := [3]string{MRoomCreate, "", `{"creator": "@creator:a"}`}
+	creatorJoin := [3]string{MRoomMember, "@creator:a", `{"membership": "join"}`}
+	banned := [3]string{MRoomMember, "@banned:b", `{"membership": "ban"}`}
+	invited := [3]string{MRoomMember, "@invited:b", `{"membership": "invite"}`}
+	joinRule := func(rule string) [3]string {
+		return [3]string{MRoomJoinRules, "", `{"join_rule": "` + rule + `"}`}
+	}
+	public := testRoomState(t, "!room:a", create, creatorJoin, joinRule(Public), banned)
+	inviteOnly := testRoomState(t, "!room:a", create, creatorJoin, joinRule(Invite), invited)
+
+	tests := []struct {
+		state   RespState
+		userID  string
+		allowed bool
+	}{
+		{public, "@alice:b", true},
+		{public, "@banned:b", false},
+		{inviteOnly, "@alice:b", false},
+		{inviteOnly, "@invited:b", true},
+	}
+	for _, test := range tests {
+		err := r.PrecheckJoinAllowed(test.state, test.userID)
+		if test.allowed && err != nil {
+			t.Errorf("PrecheckJoinAllowed(%q): unexpected error: %v", test.userID, err)
+		}
+		if _, ok := err.(*NotAllowed); !test.allowed && !ok {
+			t.Errorf("PrecheckJoinAllowed(%q): wanted *NotAllowed, got %v", test.userID, err)
+		}
+	}
+
+	r.JoinEvent.Content = RawJSON(`{"membership":"leave"}`)
+	if err := r.PrecheckJoinAllowed(public, "@alice:b"); err == nil {
+		t.Errorf("PrecheckJoinAllowed: wanted an error for a template that isn't a join")
+	}
+}
@@ -0,0 +1,92 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"fmt"
+)
+
+// A RoomAlias is a matrix room alias of the form "#localpart:server_name".
+// Use ParseRoomAlias to get a RoomAlias from a string.
+//
+// https://matrix.org/docs/spec/appendices.html#room-aliases
+type RoomAlias string
+
+// ParseRoomAlias checks that the string is a valid room alias.
+// Returns an error if the alias doesn't start with '#', has an empty
+// localpart, is too long, or if the server name isn't valid.
+func ParseRoomAlias(alias string) (RoomAlias, error) {
+	if len(alias) > maxIDLength {
+		return "", fmt.Errorf(
+			"gomatrixserverlib: room alias is too long, length %d > maximum %d",
+			len(alias), maxIDLength,
+		)
+	}
+	localpart, serverName, err := SplitID('#', alias)
+	if err != nil {
+		return "", err
+	}
+	if localpart == "" {
+		return "", fmt.Errorf("gomatrixserverlib: room alias %q has an empty localpart", alias)
+	}
+	if _, _, valid := ParseAndValidateServerName(serverName); !valid {
+		return "", fmt.Errorf("gomatrixserverlib: room alias %q has an invalid server name", alias)
+	}
+	return RoomAlias(alias), nil
+}
+
+// ServerName returns the server name of the room alias.
+// The alias must have been validated using ParseRoomAlias.
+func (a RoomAlias) ServerName() ServerName {
+	_, serverName, _ := SplitID('#', string(a))
+	return serverName
+}
+
+// A UserID is a matrix user ID of the form "@localpart:server_name".
+// Use ParseUserID to get a UserID from a string.
+//
+// https://matrix.org/docs/spec/appendices.html#user-identifiers
+type UserID string
+
+// ParseUserID checks that the string is a valid user ID.
+// Returns an error if the user ID doesn't start with '@', has an empty
+// localpart, is too long, or if the server name isn't valid.
+func ParseUserID(userID string) (UserID, error) {
+	if len(userID) > maxIDLength {
+		return "", fmt.Errorf(
+			"gomatrixserverlib: user ID is too long, length %d > maximum %d",
+			len(userID), maxIDLength,
+		)
+	}
+	localpart, serverName, err := SplitID('@', userID)
+	if err != nil {
+		return "", err
+	}
+	if localpart == "" {
+		return "", fmt.Errorf("gomatrixserverlib: user ID %q has an empty localpart", userID)
+	}
+	if _, _, valid := ParseAndValidateServerName(serverName); !valid {
+		return "", fmt.Errorf("gomatrixserverlib: user ID %q has an invalid server name", userID)
+	}
+	return UserID(userID), nil
+}
+
+// ServerName returns the server name of the user ID.
+// The user ID must have been validated using ParseUserID.
+func (u UserID) ServerName() ServerName {
+	_, serverName, _ := SplitID('@', string(u))
+	return serverName
+}
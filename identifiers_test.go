@@ -0,0 +1,99 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoomAlias(t *testing.T) {
+	validTests := map[string]ServerName{
+		"#room:example.com":        "example.com",
+		"#room:example.com:8448":   "example.com:8448",
+		"#room:1.2.3.4":            "1.2.3.4",
+		"#room:1.2.3.4:8448":       "1.2.3.4:8448",
+		"#room:[1234:5678::abcd]":  "[1234:5678::abcd]",
+		"#room:[::1]:8448":         "[::1]:8448",
+		"#a.b-c_d=e/f:example.com": "example.com",
+	}
+	for input, want := range validTests {
+		alias, err := ParseRoomAlias(input)
+		if err != nil {
+			t.Errorf("ParseRoomAlias(%q): unexpected error: %s", input, err)
+			continue
+		}
+		if got := alias.ServerName(); got != want {
+			t.Errorf("ParseRoomAlias(%q).ServerName(): want %q got %q", input, want, got)
+		}
+	}
+
+	invalidTests := []string{
+		"",
+		"#",
+		"room:example.com",
+		"!room:example.com",
+		"#room",
+		"#:example.com",
+		"#room:",
+		"#room:example.com:",
+		"#room:exa_mple.com",
+		"#room:[1234:5678::abcd",
+		"#room:" + strings.Repeat("a", 255),
+	}
+	for _, input := range invalidTests {
+		if alias, err := ParseRoomAlias(input); err == nil {
+			t.Errorf("ParseRoomAlias(%q): expected an error got %q", input, alias)
+		}
+	}
+}
+
+func TestParseUserID(t *testing.T) {
+	validTests := map[string]ServerName{
+		"@alice:example.com":      "example.com",
+		"@alice:example.com:8448": "example.com:8448",
+		"@alice:[::1]:8448":       "[::1]:8448",
+		"@a.b-c_d=e/f:1.2.3.4":    "1.2.3.4",
+	}
+	for input, want := range validTests {
+		userID, err := ParseUserID(input)
+		if err != nil {
+			t.Errorf("ParseUserID(%q): unexpected error: %s", input, err)
+			continue
+		}
+		if got := userID.ServerName(); got != want {
+			t.Errorf("ParseUserID(%q).ServerName(): want %q got %q", input, want, got)
+		}
+	}
+
+	invalidTests := []string{
+		"",
+		"@",
+		"alice:example.com",
+		"#alice:example.com",
+		"+group:example.com",
+		"@alice",
+		"@:example.com",
+		"@alice:",
+		"@alice:exa_mple.com",
+		"@alice:" + strings.Repeat("a", 255),
+	}
+	for _, input := range invalidTests {
+		if userID, err := ParseUserID(input); err == nil {
+			t.Errorf("ParseUserID(%q): expected an error got %q", input, userID)
+		}
+	}
+}
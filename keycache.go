@@ -0,0 +1,158 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+const defaultLRUKeyDatabaseMaxEntries = 10000
+
+// An LRUKeyDatabase is a KeyDatabase that keeps a bounded number of keys in
+// memory, forgetting the least recently used keys when it is full. It can be
+// used as the KeyDatabase of a KeyRing when there is no persistent storage,
+// so that keys aren't fetched from the network for every verification. It is
+// safe for concurrent use, and the zero value is ready to use.
+//
+// Keys expire from the cache at their valid_until_ts, after which the
+// KeyRing has to fetch them again to find out whether they have been
+// renewed. Keys that a server has marked as old have a fixed validity, so
+// they only leave the cache when they are the least recently used.
+type LRUKeyDatabase struct {
+	// The most keys to keep. Defaults to 10000.
+	MaxEntries int
+	// Whether expired keys are returned. In KeyValidityStrict mode, the
+	// default, keys are never returned after they have expired from the
+	// cache. In KeyValidityLenient mode they are returned until they are
+	// replaced or forgotten, since a lenient KeyRing accepts them anyway.
+	// This should match the KeyValidity of the KeyRing.
+	KeyValidity KeyValidityMode
+	// The clock to tell the time with. Defaults to WallClock.
+	Clock Clock
+
+	mutex   sync.Mutex
+	entries map[PublicKeyLookupRequest]*list.Element
+	// The keys in order of use, most recently used first. The values are
+	// lruKeyDatabaseEntry.
+	order list.List
+}
+
+type lruKeyDatabaseEntry struct {
+	req PublicKeyLookupRequest
+	key PublicKeyLookupResult
+}
+
+func (db *LRUKeyDatabase) maxEntries() int {
+	if db.MaxEntries <= 0 {
+		return defaultLRUKeyDatabaseMaxEntries
+	}
+	return db.MaxEntries
+}
+
+func (db *LRUKeyDatabase) now() Timestamp {
+	if db.Clock == nil {
+		return AsTimestamp(WallClock.Now())
+	}
+	return AsTimestamp(db.Clock.Now())
+}
+
+// hasExpired returns whether the key has expired from the cache.
+func (db *LRUKeyDatabase) hasExpired(key PublicKeyLookupResult, now Timestamp) bool {
+	if key.ExpiredTS != PublicKeyNotExpired {
+		return false
+	}
+	return key.ValidUntilTS == PublicKeyNotValid || now > key.ValidUntilTS
+}
+
+// Len returns the number of keys in the cache, including any that have
+// expired but haven't been removed yet.
+func (db *LRUKeyDatabase) Len() int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return len(db.entries)
+}
+
+// Purge removes all of the keys for the server from the cache, so that they
+// are fetched again the next time they are needed. This is useful when a
+// server is known to have changed its keys.
+func (db *LRUKeyDatabase) Purge(serverName ServerName) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for req, element := range db.entries {
+		if req.ServerName == serverName {
+			db.order.Remove(element)
+			delete(db.entries, req)
+		}
+	}
+}
+
+// FetcherName implements KeyFetcher
+func (db *LRUKeyDatabase) FetcherName() string {
+	return "LRUKeyDatabase"
+}
+
+// FetchKeys implements KeyFetcher
+func (db *LRUKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	now := db.now()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		element, ok := db.entries[req]
+		if !ok {
+			continue
+		}
+		entry := element.Value.(lruKeyDatabaseEntry)
+		if db.KeyValidity != KeyValidityLenient && db.hasExpired(entry.key, now) {
+			db.order.Remove(element)
+			delete(db.entries, req)
+			continue
+		}
+		db.order.MoveToFront(element)
+		results[req] = entry.key
+	}
+	return results, nil
+}
+
+// StoreKeys implements KeyDatabase
+func (db *LRUKeyDatabase) StoreKeys(
+	ctx context.Context, results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.entries == nil {
+		db.entries = map[PublicKeyLookupRequest]*list.Element{}
+	}
+	for req, key := range results {
+		entry := lruKeyDatabaseEntry{req, key}
+		if element, ok := db.entries[req]; ok {
+			element.Value = entry
+			db.order.MoveToFront(element)
+			continue
+		}
+		for len(db.entries) >= db.maxEntries() {
+			oldest := db.order.Back()
+			db.order.Remove(oldest)
+			delete(db.entries, oldest.Value.(lruKeyDatabaseEntry).req)
+		}
+		db.entries[req] = db.order.PushFront(entry)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFetchAll fetches the keys from the database, failing the test on error.
+func testFetchAll(t *testing.T, db KeyDatabase, reqs ...PublicKeyLookupRequest) map[PublicKeyLookupRequest]PublicKeyLookupResult {
+	requests := map[PublicKeyLookupRequest]Timestamp{}
+	for _, req := range reqs {
+		requests[req] = 1000
+	}
+	results, err := db.FetchKeys(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestLRUKeyDatabaseEvictsLeastRecentlyUsed(t *testing.T) {
+	key := PublicKeyLookupResult{ValidUntilTS: PublicKeyNotValid, ExpiredTS: 500}
+	a := PublicKeyLookupRequest{"a.example.com", "ed25519:1"}
+	b := PublicKeyLookupRequest{"b.example.com", "ed25519:1"}
+	c := PublicKeyLookupRequest{"c.example.com", "ed25519:1"}
+	db := &LRUKeyDatabase{MaxEntries: 2}
+	store := func(req PublicKeyLookupRequest) {
+		if err := db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{req: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Using a makes b the least recently used, so storing c forgets b.
+	store(a)
+	store(b)
+	testFetchAll(t, db, a)
+	store(c)
+	if db.Len() != 2 {
+		t.Fatalf("LRUKeyDatabase: wanted 2 keys, got %d", db.Len())
+	}
+	results := testFetchAll(t, db, a, b, c)
+	if _, ok := results[b]; ok || len(results) != 2 {
+		t.Errorf("LRUKeyDatabase: wanted the keys for a and c, got %v", results)
+	}
+
+	// Storing a key again replaces it without using up room.
+	store(c)
+	if db.Len() != 2 {
+		t.Errorf("LRUKeyDatabase: wanted 2 keys, got %d", db.Len())
+	}
+}
+
+func TestLRUKeyDatabaseExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	current := PublicKeyLookupRequest{"example.com", "ed25519:current"}
+	old := PublicKeyLookupRequest{"example.com", "ed25519:old"}
+	keys := map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		current: {ValidUntilTS: AsTimestamp(now.Add(time.Hour)), ExpiredTS: PublicKeyNotExpired},
+		old:     {ValidUntilTS: PublicKeyNotValid, ExpiredTS: 500},
+	}
+	for _, mode := range []KeyValidityMode{KeyValidityStrict, KeyValidityLenient} {
+		db := &LRUKeyDatabase{KeyValidity: mode, Clock: ClockFunc(func() time.Time { return now })}
+		if err := db.StoreKeys(context.Background(), keys); err != nil {
+			t.Fatal(err)
+		}
+		if results := testFetchAll(t, db, current, old); len(results) != 2 {
+			t.Errorf("LRUKeyDatabase (%s): wanted both keys before they expire, got %v", mode, results)
+		}
+
+		// The current key expires at its valid until timestamp, but the old
+		// key stays since its validity won't change. A strict cache doesn't
+		// return expired keys.
+		now = now.Add(2 * time.Hour)
+		results := testFetchAll(t, db, current, old)
+		_, hasCurrent := results[current]
+		if _, hasOld := results[old]; !hasOld {
+			t.Errorf("LRUKeyDatabase (%s): wanted the old key to be kept", mode)
+		}
+		if hasCurrent != (mode == KeyValidityLenient) {
+			t.Errorf("LRUKeyDatabase (%s): got expired key returned %v", mode, hasCurrent)
+		}
+		now = now.Add(-2 * time.Hour)
+	}
+}
+
+func TestLRUKeyDatabasePurge(t *testing.T) {
+	key := PublicKeyLookupResult{ValidUntilTS: PublicKeyNotValid, ExpiredTS: 500}
+	purged1 := PublicKeyLookupRequest{"purged.example.com", "ed25519:1"}
+	purged2 := PublicKeyLookupRequest{"purged.example.com", "ed25519:2"}
+	kept := PublicKeyLookupRequest{"kept.example.com", "ed25519:1"}
+	db := &LRUKeyDatabase{}
+	if err := db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		purged1: key, purged2: key, kept: key,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Purge("purged.example.com")
+	if db.Len() != 1 {
+		t.Errorf("LRUKeyDatabase: wanted 1 key after purging, got %d", db.Len())
+	}
+	if results := testFetchAll(t, db, purged1, purged2, kept); len(results) != 1 {
+		t.Errorf("LRUKeyDatabase: wanted only the key for kept.example.com, got %v", results)
+	}
+}
+
+func TestLRUKeyDatabaseConcurrent(t *testing.T) {
+	key := PublicKeyLookupResult{ValidUntilTS: PublicKeyNotValid, ExpiredTS: 500}
+	db := &LRUKeyDatabase{MaxEntries: 10}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				req := PublicKeyLookupRequest{ServerName(fmt.Sprintf("%d.example.com", j%20)), "ed25519:1"}
+				_ = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{req: key})
+				_, _ = db.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 1000})
+				if i == 0 && j%10 == 0 {
+					db.Purge(req.ServerName)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if db.Len() > 10 {
+		t.Errorf("LRUKeyDatabase: wanted at most 10 keys, got %d", db.Len())
+	}
+}
+
+func TestKeyRingWithLRUKeyDatabase(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	fetcher := &testRecordingKeyFetcher{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)), ExpiredTS: PublicKeyNotExpired},
+	}}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, KeyDatabase: &LRUKeyDatabase{}}
+
+	// The key is only fetched the first time, after which it is cached.
+	for i := 0; i < 2; i++ {
+		results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+			{ServerName: req.ServerName, Message: message, AtTS: 1000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Error != nil {
+			t.Fatalf("VerifyJSONs: unexpected error: %v", results[0].Error)
+		}
+	}
+	if len(fetcher.requests) != 1 {
+		t.Errorf("VerifyJSONs: wanted the key to be fetched once, got %d fetches", len(fetcher.requests))
+	}
+}
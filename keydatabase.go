@@ -0,0 +1,94 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"sync"
+)
+
+// An InMemoryKeyDatabase is a KeyDatabase that keeps the keys in memory, so
+// they are lost when the process exits. It is useful for tests, and as a
+// cache in front of the fetchers when there is no persistent storage. It is
+// safe for concurrent use.
+//
+// A persistent KeyDatabase should be designed for bulk operations, since
+// checking a response to /send_join can need keys for hundreds of servers
+// at once. In SQL, for example, the keys could be stored in a table like:
+//
+//	CREATE TABLE server_signing_keys (
+//	    server_name TEXT NOT NULL,
+//	    key_id TEXT NOT NULL,
+//	    public_key TEXT NOT NULL,
+//	    valid_until_ts BIGINT NOT NULL,
+//	    expired_ts BIGINT NOT NULL,
+//	    PRIMARY KEY (server_name, key_id)
+//	);
+//
+// FetchKeys can then look up all of the requested keys with a single query,
+// such as one that joins against the arrays of server names and key IDs,
+// rather than one query per key. It should return the keys that it has
+// whatever their validity, since the KeyRing checks whether they are valid
+// at the timestamps it needs and fetches them again if they aren't.
+// StoreKeys can store all of the keys with a single multi-row upsert that
+// replaces the existing row for each server name and key ID, since the
+// fetchers return the most recent copy of each key.
+type InMemoryKeyDatabase struct {
+	mutex sync.Mutex
+	keys  map[PublicKeyLookupRequest]PublicKeyLookupResult
+}
+
+// NewInMemoryKeyDatabase returns an InMemoryKeyDatabase holding the keys,
+// which may be nil.
+func NewInMemoryKeyDatabase(keys map[PublicKeyLookupRequest]PublicKeyLookupResult) *InMemoryKeyDatabase {
+	db := &InMemoryKeyDatabase{keys: make(map[PublicKeyLookupRequest]PublicKeyLookupResult, len(keys))}
+	for req, key := range keys {
+		db.keys[req] = key
+	}
+	return db
+}
+
+// FetcherName implements KeyFetcher
+func (db *InMemoryKeyDatabase) FetcherName() string {
+	return "InMemoryKeyDatabase"
+}
+
+// FetchKeys implements KeyFetcher
+func (db *InMemoryKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		if key, ok := db.keys[req]; ok {
+			results[req] = key
+		}
+	}
+	return results, nil
+}
+
+// StoreKeys implements KeyDatabase
+func (db *InMemoryKeyDatabase) StoreKeys(
+	ctx context.Context, results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for req, key := range results {
+		db.keys[req] = key
+	}
+	return nil
+}
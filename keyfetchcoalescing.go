@@ -0,0 +1,138 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// A KeyFetchCoalescer shares fetches of the same keys between concurrent
+// callers, so that when many messages from the same server are verified at
+// once, such as when processing a large transaction with a cold cache, the
+// keys are only fetched once rather than once for each caller. A fetch is
+// shared by callers asking the same KeyFetcher for the same key with the
+// same minimum validity, and every caller gets the keys and the error of the
+// fetch. Only the caller that made the fetch records a failure in the
+// KeyFetchFailureCache, so a shared failure is only counted once. The fetch
+// is made with a context of its own rather than that of the caller that
+// made it, so a caller whose context is done stops waiting for the fetch
+// without failing the others. KeyFetchers that aren't comparable, and so
+// can't be told apart, don't share fetches. The zero value is ready to use,
+// and a KeyFetchCoalescer is safe to share between goroutines and KeyRings.
+type KeyFetchCoalescer struct {
+	mutex sync.Mutex
+	calls map[coalescedKeyFetchKey]*coalescedKeyFetch
+}
+
+// coalescedKeyFetchKey identifies the fetches that can be shared.
+type coalescedKeyFetchKey struct {
+	fetcher KeyFetcher
+	request PublicKeyLookupRequest
+	atTS    Timestamp
+}
+
+// coalescedKeyFetch is a fetch that is in flight or has completed.
+type coalescedKeyFetch struct {
+	// Closed when the fetch has completed.
+	done    chan struct{}
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err     error
+}
+
+// canCoalesce returns whether fetches from the fetcher can be shared, which
+// needs the fetcher to be usable as a map key.
+func canCoalesce(fetcher KeyFetcher) bool {
+	return reflect.TypeOf(fetcher).Comparable()
+}
+
+// fetchKeys fetches the keys using the fetch function, which asks the
+// fetcher for keys, sharing the fetches of keys that are already in flight.
+// Returns the keys fetched, the requests that this caller fetched itself
+// rather than sharing, and the first error from any of the fetches.
+func (c *KeyFetchCoalescer) fetchKeys(
+	ctx context.Context, fetcher KeyFetcher, requests map[PublicKeyLookupRequest]Timestamp,
+	fetch func(context.Context, map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error),
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, map[PublicKeyLookupRequest]Timestamp, error) {
+	own := &coalescedKeyFetch{done: make(chan struct{})}
+	fetched := map[PublicKeyLookupRequest]Timestamp{}
+	var waitFor []*coalescedKeyFetch
+	c.mutex.Lock()
+	if c.calls == nil {
+		c.calls = map[coalescedKeyFetchKey]*coalescedKeyFetch{}
+	}
+	for req, atTS := range requests {
+		key := coalescedKeyFetchKey{fetcher, req, atTS}
+		call, ok := c.calls[key]
+		if !ok {
+			c.calls[key] = own
+			fetched[req] = atTS
+			continue
+		}
+		found := false
+		for _, other := range waitFor {
+			if other == call {
+				found = true
+				break
+			}
+		}
+		if !found {
+			waitFor = append(waitFor, call)
+		}
+	}
+	c.mutex.Unlock()
+
+	if len(fetched) > 0 {
+		go c.run(fetcher, fetched, own, fetch)
+		waitFor = append(waitFor, own)
+	}
+
+	results := make(map[PublicKeyLookupRequest]PublicKeyLookupResult, len(requests))
+	var err error
+	for _, call := range waitFor {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, fetched, ctx.Err()
+		}
+		if err == nil {
+			err = call.err
+		}
+		for req, res := range call.results {
+			results[req] = res
+		}
+	}
+	return results, fetched, err
+}
+
+// run makes the fetch and then lets the callers waiting for it have the
+// result. The fetch is forgotten once it has completed, so later callers
+// fetch the keys again, or find them in the KeyDatabase.
+func (c *KeyFetchCoalescer) run(
+	fetcher KeyFetcher, requests map[PublicKeyLookupRequest]Timestamp, call *coalescedKeyFetch,
+	fetch func(context.Context, map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error),
+) {
+	defer func() {
+		c.mutex.Lock()
+		for req, atTS := range requests {
+			delete(c.calls, coalescedKeyFetchKey{fetcher, req, atTS})
+		}
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+	call.results, call.err = fetch(context.Background(), requests)
+}
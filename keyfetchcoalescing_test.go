@@ -0,0 +1,252 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBlockingKeyFetcher is a KeyFetcher that counts the fetches made and
+// blocks each one until it is released.
+type testBlockingKeyFetcher struct {
+	keys    map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err     error
+	release chan struct{}
+	fetches int32
+}
+
+func (f *testBlockingKeyFetcher) FetcherName() string {
+	return "testBlockingKeyFetcher"
+}
+
+func (f *testBlockingKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	atomic.AddInt32(&f.fetches, 1)
+	<-f.release
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		if key, ok := f.keys[req]; ok {
+			results[req] = key
+		}
+	}
+	return results, nil
+}
+
+// testWaitingContext is a context that counts the calls to Done, which the
+// KeyFetchCoalescer makes when a caller starts waiting for a fetch.
+type testWaitingContext struct {
+	context.Context
+	waiting *int32
+}
+
+func (c testWaitingContext) Done() <-chan struct{} {
+	atomic.AddInt32(c.waiting, 1)
+	return c.Context.Done()
+}
+
+// testWaitFor waits for the condition to become true, failing the test if
+// it takes too long.
+func testWaitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testConcurrentVerifyJSONs verifies the message in many goroutines at once,
+// releasing the fetcher once all of them are waiting for a fetch, and
+// returns the result of each.
+func testConcurrentVerifyJSONs(
+	t *testing.T, k KeyRing, fetcher *testBlockingKeyFetcher, serverName ServerName, message []byte,
+) ([]error, []error) {
+	const calls = 100
+	results := make([]error, calls)
+	errs := make([]error, calls)
+	var waiting int32
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := testWaitingContext{context.Background(), &waiting}
+			res, err := k.VerifyJSONs(ctx, []VerifyJSONRequest{
+				{ServerName: serverName, Message: message, AtTS: 1000},
+			})
+			errs[i] = err
+			if err == nil {
+				results[i] = res[0].Error
+			}
+		}(i)
+	}
+
+	testWaitFor(t, "the callers to wait for the fetch", func() bool {
+		return atomic.LoadInt32(&waiting) == calls
+	})
+	close(fetcher.release)
+	wg.Wait()
+	return results, errs
+}
+
+func TestKeyRingCoalescesFetches(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	fetcher := &testBlockingKeyFetcher{
+		keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			req: {VerifyKey: key, ValidUntilTS: 2000, ExpiredTS: PublicKeyNotExpired},
+		},
+		release: make(chan struct{}),
+	}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, Coalescer: &KeyFetchCoalescer{}}
+
+	results, errs := testConcurrentVerifyJSONs(t, k, fetcher, req.ServerName, message)
+	for i := range results {
+		if errs[i] != nil || results[i] != nil {
+			t.Fatalf("Call %d: VerifyJSONs: unexpected error: %v, %v", i, errs[i], results[i])
+		}
+	}
+	if fetches := atomic.LoadInt32(&fetcher.fetches); fetches != 1 {
+		t.Errorf("VerifyJSONs: wanted 1 fetch, got %d", fetches)
+	}
+	if len(k.Coalescer.calls) != 0 {
+		t.Errorf("VerifyJSONs: wanted the fetch to be forgotten once it completed, got %d", len(k.Coalescer.calls))
+	}
+}
+
+func TestKeyRingCoalescesFailedFetches(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, _ := testSignedMessage(t, req.ServerName, req.KeyID)
+	fetcher := &testBlockingKeyFetcher{err: fmt.Errorf("failed"), release: make(chan struct{})}
+	cache := &KeyFetchFailureCache{}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, FailureCache: cache, Coalescer: &KeyFetchCoalescer{}}
+
+	// Every call gets the error of the shared fetch, and the failure is only
+	// recorded once.
+	_, errs := testConcurrentVerifyJSONs(t, k, fetcher, req.ServerName, message)
+	for i, err := range errs {
+		if err != fetcher.err {
+			t.Fatalf("Call %d: VerifyJSONs: wanted %v, got %v", i, fetcher.err, err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&fetcher.fetches); fetches != 1 {
+		t.Errorf("VerifyJSONs: wanted 1 fetch, got %d", fetches)
+	}
+	if failures := cache.entries[req].failures; failures != 1 {
+		t.Errorf("VerifyJSONs: wanted the failure to be recorded once, got %d", failures)
+	}
+}
+
+func TestKeyRingCoalescedFetchOutlivesCaller(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	fetcher := &testBlockingKeyFetcher{
+		keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			req: {VerifyKey: key, ValidUntilTS: 2000, ExpiredTS: PublicKeyNotExpired},
+		},
+		release: make(chan struct{}),
+	}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, Coalescer: &KeyFetchCoalescer{}}
+	requests := []VerifyJSONRequest{{ServerName: req.ServerName, Message: message, AtTS: 1000}}
+
+	// The caller that made the fetch gives up on it once another caller is
+	// waiting for it too.
+	ctx, cancel := context.WithCancel(context.Background())
+	var cancelledErr error
+	cancelled := make(chan struct{})
+	go func() {
+		defer close(cancelled)
+		_, cancelledErr = k.VerifyJSONs(ctx, requests)
+	}()
+	testWaitFor(t, "the fetch", func() bool {
+		return atomic.LoadInt32(&fetcher.fetches) == 1
+	})
+	var waiting int32
+	var results []VerifyJSONResult
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		results, err = k.VerifyJSONs(testWaitingContext{context.Background(), &waiting}, requests)
+	}()
+	testWaitFor(t, "the second caller to wait for the fetch", func() bool {
+		return atomic.LoadInt32(&waiting) == 1
+	})
+	cancel()
+	<-cancelled
+	if cancelledErr != context.Canceled {
+		t.Errorf("VerifyJSONs: wanted %v for the cancelled call, got %v", context.Canceled, cancelledErr)
+	}
+
+	// The fetch carries on for the other caller.
+	close(fetcher.release)
+	<-done
+	if err != nil || results[0].Error != nil {
+		t.Fatalf("VerifyJSONs: unexpected error: %v, %v", err, results[0].Error)
+	}
+	if fetches := atomic.LoadInt32(&fetcher.fetches); fetches != 1 {
+		t.Errorf("VerifyJSONs: wanted 1 fetch, got %d", fetches)
+	}
+}
+
+func TestKeyRingCoalescesFetchesByFetcher(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	coalescer := &KeyFetchCoalescer{}
+	release := make(chan struct{})
+
+	// Fetchers with the same name aren't the same fetcher, so the fetches
+	// from each are made separately.
+	fetchers := make([]*testBlockingKeyFetcher, 2)
+	errs := make([]error, len(fetchers))
+	var wg sync.WaitGroup
+	for i := range fetchers {
+		fetchers[i] = &testBlockingKeyFetcher{
+			keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+				req: {VerifyKey: key, ValidUntilTS: 2000, ExpiredTS: PublicKeyNotExpired},
+			},
+			release: release,
+		}
+		k := KeyRing{KeyFetchers: []KeyFetcher{fetchers[i]}, Coalescer: coalescer}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+				{ServerName: req.ServerName, Message: message, AtTS: 1000},
+			})
+		}(i)
+	}
+	testWaitFor(t, "a fetch from each fetcher", func() bool {
+		return atomic.LoadInt32(&fetchers[0].fetches) == 1 && atomic.LoadInt32(&fetchers[1].fetches) == 1
+	})
+	close(release)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Call %d: VerifyJSONs: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A KeyFetchFailedError is the error for a message when the keys it is
+// signed with weren't fetched because fetching them failed recently.
+type KeyFetchFailedError struct {
+	// The server the key is for.
+	ServerName ServerName
+	// The ID of the key.
+	KeyID KeyID
+	// When the key will be fetched again.
+	RetryAfter time.Time
+}
+
+func (e KeyFetchFailedError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: not fetching key with ID %q for %q since fetching it failed recently, retrying after %s",
+		e.KeyID, e.ServerName, e.RetryAfter.Format(time.RFC3339),
+	)
+}
+
+const (
+	defaultKeyFetchFailureMinBackoff = time.Minute
+	defaultKeyFetchFailureMaxBackoff = time.Hour
+	defaultKeyFetchFailureMaxEntries = 10000
+)
+
+// A KeyFetchFailureCache remembers the keys that a KeyRing failed to fetch,
+// so that the KeyRing doesn't try to fetch them again for a while. This
+// stops a server that is down, or that never existed, from slowing down
+// every verification that needs its keys. The time until a key is fetched
+// again starts at MinBackoff and doubles with each failure up to
+// MaxBackoff, and a successful fetch of the key forgets the failures. The
+// zero value is ready to use, and it is safe for concurrent use.
+type KeyFetchFailureCache struct {
+	// The time to wait after the first failure. Defaults to a minute.
+	MinBackoff time.Duration
+	// The longest time to wait after a failure. Defaults to an hour.
+	MaxBackoff time.Duration
+	// The most keys to remember failures for. When there are more then the
+	// keys that can be fetched again soonest are forgotten first, so that a
+	// lot of made up server names can't use up memory. Defaults to 10000.
+	MaxEntries int
+	// The clock to tell the time with. Defaults to WallClock.
+	Clock Clock
+
+	mutex   sync.Mutex
+	entries map[PublicKeyLookupRequest]keyFetchFailure
+}
+
+// keyFetchFailure is how many times in a row fetching a key failed, and
+// when it can be fetched again.
+type keyFetchFailure struct {
+	failures   int
+	retryAfter time.Time
+}
+
+func (c *KeyFetchFailureCache) minBackoff() time.Duration {
+	if c.MinBackoff <= 0 {
+		return defaultKeyFetchFailureMinBackoff
+	}
+	return c.MinBackoff
+}
+
+func (c *KeyFetchFailureCache) maxBackoff() time.Duration {
+	if c.MaxBackoff <= 0 {
+		return defaultKeyFetchFailureMaxBackoff
+	}
+	return c.MaxBackoff
+}
+
+func (c *KeyFetchFailureCache) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return defaultKeyFetchFailureMaxEntries
+	}
+	return c.MaxEntries
+}
+
+func (c *KeyFetchFailureCache) now() time.Time {
+	if c.Clock == nil {
+		return WallClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Len returns the number of keys that failures are remembered for.
+func (c *KeyFetchFailureCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// checkFailed returns a KeyFetchFailedError if fetching the key failed
+// recently enough that it shouldn't be fetched yet, or nil.
+func (c *KeyFetchFailureCache) checkFailed(req PublicKeyLookupRequest) error {
+	c.mutex.Lock()
+	entry, ok := c.entries[req]
+	c.mutex.Unlock()
+	if !ok || !c.now().Before(entry.retryAfter) {
+		return nil
+	}
+	return KeyFetchFailedError{req.ServerName, req.KeyID, entry.retryAfter}
+}
+
+// fetchFailed records that fetching the keys failed.
+func (c *KeyFetchFailureCache) fetchFailed(reqs []PublicKeyLookupRequest) {
+	if len(reqs) == 0 {
+		return
+	}
+	now := c.now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = map[PublicKeyLookupRequest]keyFetchFailure{}
+	}
+	for _, req := range reqs {
+		entry, ok := c.entries[req]
+		if !ok {
+			c.makeRoom(now)
+		}
+		entry.failures++
+		backoff := c.minBackoff()
+		for i := 1; i < entry.failures && backoff < c.maxBackoff(); i++ {
+			backoff *= 2
+		}
+		if backoff > c.maxBackoff() {
+			backoff = c.maxBackoff()
+		}
+		entry.retryAfter = now.Add(backoff)
+		c.entries[req] = entry
+	}
+}
+
+// fetchSucceeded forgets the failures for the keys.
+func (c *KeyFetchFailureCache) fetchSucceeded(reqs []PublicKeyLookupRequest) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, req := range reqs {
+		delete(c.entries, req)
+	}
+}
+
+// makeRoom forgets failures until there is room for another key. The keys
+// that can be fetched again soonest are forgotten first, starting with the
+// ones that can be fetched again already. The mutex must be held.
+func (c *KeyFetchFailureCache) makeRoom(now time.Time) {
+	if len(c.entries) < c.maxEntries() {
+		return
+	}
+	for req, entry := range c.entries {
+		if !now.Before(entry.retryAfter) {
+			delete(c.entries, req)
+		}
+	}
+	for len(c.entries) >= c.maxEntries() {
+		var soonest PublicKeyLookupRequest
+		var soonestRetry time.Time
+		first := true
+		for req, entry := range c.entries {
+			if first || entry.retryAfter.Before(soonestRetry) {
+				soonest, soonestRetry, first = req, entry.retryAfter, false
+			}
+		}
+		delete(c.entries, soonest)
+	}
+}
@@ -0,0 +1,132 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyRingFailureCache(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	now := time.Unix(1500000000, 0)
+	cache := &KeyFetchFailureCache{
+		MinBackoff: time.Minute,
+		MaxBackoff: 3 * time.Minute,
+		Clock:      ClockFunc(func() time.Time { return now }),
+	}
+	fetcher := &testRecordingKeyFetcher{}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, FailureCache: cache}
+	verify := func() error {
+		results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+			{ServerName: req.ServerName, Message: message, AtTS: 1000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results[0].Error
+	}
+
+	// The backoff doubles with each failure, up to the maximum, and the key
+	// isn't fetched during the backoff.
+	for i, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if err := verify(); err == nil {
+			t.Fatalf("Failure %d: VerifyJSONs: wanted an error", i)
+		}
+		if len(fetcher.requests) != i+1 {
+			t.Fatalf("Failure %d: VerifyJSONs: wanted %d fetches, got %d", i, i+1, len(fetcher.requests))
+		}
+		err := verify()
+		want := KeyFetchFailedError{req.ServerName, req.KeyID, now.Add(backoff)}
+		if err != want {
+			t.Fatalf("Failure %d: VerifyJSONs: wanted %v, got %v", i, want, err)
+		}
+		if len(fetcher.requests) != i+1 {
+			t.Fatalf("Failure %d: VerifyJSONs: wanted the key not to be fetched during the backoff", i)
+		}
+		now = now.Add(backoff)
+	}
+
+	// A successful fetch forgets the failures.
+	fetcher.keys = map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: 5000, ExpiredTS: PublicKeyNotExpired},
+	}
+	if err := verify(); err != nil {
+		t.Fatalf("VerifyJSONs: wanted the message to verify, got %v", err)
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("VerifyJSONs: wanted the failures to be forgotten, got %d", cache.Len())
+	}
+}
+
+func TestKeyRingFailureCacheFetcherError(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, _ := testSignedMessage(t, req.ServerName, req.KeyID)
+	fetcher := &testRecordingKeyFetcher{err: fmt.Errorf("server down")}
+	cache := &KeyFetchFailureCache{}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, FailureCache: cache}
+	requests := []VerifyJSONRequest{{ServerName: req.ServerName, Message: message, AtTS: 1000}}
+
+	// A fetch that fails because the context is done isn't a failure of
+	// the key.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := k.VerifyJSONs(ctx, requests); err == nil {
+		t.Fatalf("VerifyJSONs: wanted an error")
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("VerifyJSONs: wanted no failures after cancelling, got %d", cache.Len())
+	}
+
+	if _, err := k.VerifyJSONs(context.Background(), requests); err == nil {
+		t.Fatalf("VerifyJSONs: wanted an error")
+	}
+	results, err := k.VerifyJSONs(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results[0].Error.(KeyFetchFailedError); !ok {
+		t.Fatalf("VerifyJSONs: wanted a KeyFetchFailedError, got %v", results[0].Error)
+	}
+	if len(fetcher.requests) != 2 {
+		t.Fatalf("VerifyJSONs: wanted 2 fetches, got %d", len(fetcher.requests))
+	}
+}
+
+func TestKeyFetchFailureCacheMaxEntries(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cache := &KeyFetchFailureCache{
+		MaxEntries: 2,
+		Clock:      ClockFunc(func() time.Time { return now }),
+	}
+	for i := 0; i < 5; i++ {
+		cache.fetchFailed([]PublicKeyLookupRequest{{ServerName(fmt.Sprintf("%d.example.com", i)), "ed25519:1"}})
+		now = now.Add(time.Second)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("fetchFailed: wanted 2 entries, got %d", cache.Len())
+	}
+	// The failures that can be fetched again soonest are forgotten first.
+	for i, want := range []bool{false, false, false, true, true} {
+		err := cache.checkFailed(PublicKeyLookupRequest{ServerName(fmt.Sprintf("%d.example.com", i)), "ed25519:1"})
+		if (err != nil) != want {
+			t.Errorf("checkFailed: server %d: got %v, wanted failure %v", i, err, want)
+		}
+	}
+}
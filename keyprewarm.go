@@ -0,0 +1,98 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// prewarmConcurrency is how many servers Prewarm fetches keys for at once.
+const prewarmConcurrency = 8
+
+// Prewarm fetches the current keys of each of the servers and stores them in
+// the KeyDatabase, so that the first messages from the servers don't have to
+// wait for their keys to be fetched. It is meant to be called at startup with
+// the servers that were seen recently. The keys of each server are fetched
+// like VerifyJSONs fetches them, asking each fetcher in turn until one of them
+// has keys for the server, and sharing fetches with the Coalescer if there is
+// one. The FailureCache isn't used, so that a server that failed recently is
+// tried again. The keys of up to 8 servers are fetched at once.
+//
+// Prewarming is best effort: every server is tried even if some of them fail,
+// and if any of them failed then a PartialKeyFetchError is returned with why
+// each of them failed. The keys of the other servers are still stored.
+func (k *KeyRing) Prewarm(ctx context.Context, servers []ServerName) error {
+	var (
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+		errs      = map[ServerName]error{}
+		semaphore = make(chan struct{}, prewarmConcurrency)
+		seen      = make(map[ServerName]bool, len(servers))
+	)
+	for _, serverName := range servers {
+		if seen[serverName] {
+			continue
+		}
+		seen[serverName] = true
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(serverName ServerName) {
+			defer wg.Done()
+			err := k.prewarmServer(ctx, serverName)
+			<-semaphore
+			if err != nil {
+				mutex.Lock()
+				errs[serverName] = err
+				mutex.Unlock()
+			}
+		}(serverName)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return PartialKeyFetchError{errs}
+	}
+	return nil
+}
+
+// prewarmServer fetches all of the current keys of the server from the first
+// fetcher that has any, and stores them in the KeyDatabase. Returns the error
+// from the last fetcher if none of them have any keys for the server.
+func (k *KeyRing) prewarmServer(ctx context.Context, serverName ServerName) error {
+	request := PublicKeyLookupRequest{ServerName: serverName}
+	requests := map[PublicKeyLookupRequest]Timestamp{request: AsTimestamp(time.Now())}
+	var err error = KeyNotFoundError{ServerName: serverName}
+	for _, fetcher := range k.KeyFetchers {
+		keysFetched, _, fetchErr := k.fetchKeys(ctx, fetcher, requests)
+		if partial, ok := fetchErr.(PartialKeyFetchError); ok {
+			fetchErr = partial.Errors[serverName]
+		}
+		if fetchErr != nil {
+			err = fetchErr
+			continue
+		}
+		if !hasRequestedKey(keysFetched, request) {
+			continue
+		}
+		if k.KeyDatabase != nil {
+			return k.KeyDatabase.StoreKeys(ctx, keysFetched)
+		}
+		return nil
+	}
+	return err
+}
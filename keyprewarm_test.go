@@ -0,0 +1,94 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestKeyRingPrewarm(t *testing.T) {
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []ServerName{"a.example.com", "b.example.com", "unknown.example.com", "a.example.com"}
+	var keys []json.RawMessage
+	for _, serverName := range servers[:2] {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, testPerspectiveKeys(t, serverName, publicKey, privateKey, "notary.example.com", notaryPrivateKey))
+	}
+	transport := &testCountingTransport{transport: testNotaryTransport{"notary.example.com": keys}}
+	db := NewInMemoryKeyDatabase(nil)
+	keyRing := KeyRing{
+		KeyFetchers: []KeyFetcher{&PerspectiveKeyFetcher{
+			PerspectiveServerName: "notary.example.com",
+			PerspectiveServerKeys: map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey},
+			Client:                *NewClientWithTransport(transport),
+		}},
+		KeyDatabase: db,
+		Coalescer:   &KeyFetchCoalescer{},
+	}
+
+	// The notary has no keys for the unknown server, which is reported, but
+	// the keys of the others are still stored.
+	err = keyRing.Prewarm(context.Background(), servers)
+	partial, ok := err.(PartialKeyFetchError)
+	if !ok || len(partial.Errors) != 1 {
+		t.Fatalf("Prewarm: wanted a PartialKeyFetchError for one server, got %v", err)
+	}
+	if _, ok = partial.Errors["unknown.example.com"].(KeyNotFoundError); !ok {
+		t.Errorf("Prewarm: wanted a KeyNotFoundError for the unknown server, got %v", partial.Errors)
+	}
+	for _, serverName := range servers[:2] {
+		req := PublicKeyLookupRequest{serverName, "ed25519:1"}
+		results, err := db.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 1000})
+		if err != nil {
+			t.Fatalf("FetchKeys: unexpected error: %v", err)
+		}
+		if _, ok := results[req]; !ok {
+			t.Errorf("Prewarm: wanted the key of %s to be stored", serverName)
+		}
+	}
+
+	// Each server is only queried once, asking for all of its keys.
+	if len(transport.bodies) != 3 {
+		t.Fatalf("Prewarm: wanted 3 queries to the notary, got %d", len(transport.bodies))
+	}
+	for _, body := range transport.bodies {
+		var query struct {
+			ServerKeys map[ServerName]map[KeyID]json.RawMessage `json:"server_keys"`
+		}
+		if err = json.Unmarshal(body, &query); err != nil {
+			t.Fatal(err)
+		}
+		for _, keyIDs := range query.ServerKeys {
+			if len(query.ServerKeys) != 1 || keyIDs == nil || len(keyIDs) != 0 {
+				t.Errorf("Prewarm: wanted a query for all of the keys of one server, got %s", body)
+			}
+		}
+	}
+
+	if err = keyRing.Prewarm(context.Background(), servers[:2]); err != nil {
+		t.Errorf("Prewarm: unexpected error: %v", err)
+	}
+}
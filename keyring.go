@@ -3,9 +3,13 @@ package gomatrixserverlib
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/util"
 	"golang.org/x/crypto/ed25519"
 )
@@ -14,10 +18,27 @@ import (
 type PublicKeyLookupRequest struct {
 	// The server to fetch a key for.
 	ServerName ServerName
-	// The ID of the key to fetch.
+	// The ID of the key to fetch. If empty then all of the current keys of
+	// the server are fetched, which is how KeyRing.Prewarm fetches keys
+	// without knowing their IDs. The results never have an empty key ID.
 	KeyID KeyID
 }
 
+// hasRequestedKey returns whether the keys have the key requested, or any
+// key of the server if the request has an empty key ID.
+func hasRequestedKey(keys map[PublicKeyLookupRequest]PublicKeyLookupResult, req PublicKeyLookupRequest) bool {
+	if req.KeyID != "" {
+		_, ok := keys[req]
+		return ok
+	}
+	for key := range keys {
+		if key.ServerName == req.ServerName {
+			return true
+		}
+	}
+	return false
+}
+
 // PublicKeyNotExpired is a magic value for PublicKeyLookupResult.ExpiredTS:
 // it indicates that this is an active key which has not yet expired
 const PublicKeyNotExpired = Timestamp(0)
@@ -39,10 +60,12 @@ type PublicKeyLookupResult struct {
 }
 
 // WasValidAt checks if this signing key is valid for an event signed at the
-// given timestamp.
+// given timestamp. A key that has expired is valid for events signed before
+// it expired, and a key that hasn't expired is valid for events signed up to
+// when the result is valid until.
 func (r PublicKeyLookupResult) WasValidAt(atTs Timestamp) bool {
-	if r.ExpiredTS != PublicKeyNotExpired && atTs >= r.ExpiredTS {
-		return false
+	if r.ExpiredTS != PublicKeyNotExpired {
+		return atTs < r.ExpiredTS
 	}
 	if r.ValidUntilTS == PublicKeyNotValid || atTs > r.ValidUntilTS {
 		return false
@@ -50,6 +73,18 @@ func (r PublicKeyLookupResult) WasValidAt(atTs Timestamp) bool {
 	return true
 }
 
+// hasExpiredBefore returns whether the key expired before the timestamp, in
+// which case fetching the key again won't make it valid at that timestamp.
+func (r PublicKeyLookupResult) hasExpiredBefore(atTs Timestamp) bool {
+	return r.ExpiredTS != PublicKeyNotExpired && atTs >= r.ExpiredTS
+}
+
+// maxKeyValidityPeriod is the longest that a key fetched from a server is
+// treated as valid for after it was fetched, however far in the future the
+// valid_until_ts of the key is. See
+// https://matrix.org/docs/spec/rooms/v5#signing-key-validity-period
+const maxKeyValidityPeriod = 7 * 24 * time.Hour
+
 // A KeyFetcher is a way of fetching public keys in bulk.
 type KeyFetcher interface {
 	// Lookup a batch of public keys.
@@ -67,7 +102,13 @@ type KeyFetcher interface {
 	FetcherName() string
 }
 
-// A KeyDatabase is a store for caching public keys.
+// A KeyDatabase is a store for caching public keys. The KeyRing looks up keys
+// in the database before asking the fetchers, and stores the keys that the
+// fetchers return in it. The KeyRing asks for all of the keys it needs at
+// once, so implementations should look them up in bulk. See
+// InMemoryKeyDatabase for an implementation, and for how a persistent
+// implementation could store the keys, and LRUKeyDatabase for a bounded
+// cache.
 type KeyDatabase interface {
 	KeyFetcher
 	// Add a block of public keys to the database.
@@ -80,10 +121,152 @@ type KeyDatabase interface {
 	StoreKeys(ctx context.Context, results map[PublicKeyLookupRequest]PublicKeyLookupResult) error
 }
 
+// A KeyValidityMode says whether a KeyRing checks that keys were valid when
+// the messages they verify were signed.
+type KeyValidityMode int
+
+const (
+	// KeyValidityStrict only accepts a signature if the key was valid at the
+	// timestamp of the request, which for events is their origin_server_ts,
+	// as the specification requires. Keys that aren't known to be valid then
+	// are fetched again in case the server has renewed them. This is the
+	// default.
+	KeyValidityStrict KeyValidityMode = iota
+	// KeyValidityLenient accepts a signature from any key known for the
+	// server, whether or not it was valid at the timestamp of the request.
+	// This accepts events from servers that sign with keys outside of their
+	// validity periods, at the cost of trusting keys that may have been
+	// retired because they were compromised.
+	KeyValidityLenient
+)
+
+func (m KeyValidityMode) String() string {
+	switch m {
+	case KeyValidityStrict:
+		return "strict"
+	case KeyValidityLenient:
+		return "lenient"
+	default:
+		return fmt.Sprintf("KeyValidityMode(%d)", int(m))
+	}
+}
+
 // A KeyRing stores keys for matrix servers and provides methods for verifying JSON messages.
+// Options are added to a KeyRing as fields, so KeyRings should be made with
+// NewKeyRing or with keyed fields rather than with a positional literal.
 type KeyRing struct {
 	KeyFetchers []KeyFetcher
+	// The database to cache keys in. If nil then keys are fetched from the
+	// fetchers every time.
 	KeyDatabase KeyDatabase
+	// Remembers the keys that the fetchers failed to fetch, so that they
+	// aren't fetched again until the backoff has passed. Messages that are
+	// only signed with such keys fail with a KeyFetchFailedError. If nil
+	// then keys are fetched every time they are needed.
+	FailureCache *KeyFetchFailureCache
+	// Whether to check that keys were valid at the timestamps of the
+	// requests. Defaults to KeyValidityStrict.
+	KeyValidity KeyValidityMode
+	// Metrics is told about lookups in the database and fetches from the
+	// fetchers. If nil then nothing is reported.
+	Metrics KeyRingMetrics
+	// Shares fetches of the same keys between concurrent calls, so that
+	// they are only fetched once. A shared fetch is only reported to the
+	// Metrics by the call that made it. If nil then each call fetches the
+	// keys that it needs itself.
+	Coalescer *KeyFetchCoalescer
+}
+
+// KeyRingMetrics is told about the key lookups and fetches of a KeyRing, so
+// that they can be reported to a metrics system. The cache methods are
+// called for lookups in the KeyDatabase, and the same KeyRingMetrics can be
+// given to a DirectKeyFetcher to report on its cache too.
+type KeyRingMetrics interface {
+	KeyCacheMetrics
+	// FetchStarted is called when the KeyRing asks a fetcher for keys for a
+	// server. The fetcher is named by its FetcherName.
+	FetchStarted(serverName ServerName, fetcher string)
+	// FetchCompleted is called when the fetcher has returned, with how long
+	// it took and whether it returned the keys that were asked for.
+	FetchCompleted(serverName ServerName, fetcher string, duration time.Duration, outcome KeyFetchOutcome)
+}
+
+// A KeyFetchOutcome is the result of asking a fetcher for the keys of a
+// server.
+type KeyFetchOutcome int
+
+const (
+	// KeyFetchSucceeded means the fetcher returned all of the keys asked for.
+	KeyFetchSucceeded KeyFetchOutcome = iota
+	// KeyFetchMissingKeys means the fetcher returned without some of the
+	// keys asked for.
+	KeyFetchMissingKeys
+	// KeyFetchFailed means the fetcher returned an error.
+	KeyFetchFailed
+)
+
+func (o KeyFetchOutcome) String() string {
+	switch o {
+	case KeyFetchSucceeded:
+		return "succeeded"
+	case KeyFetchMissingKeys:
+		return "missing_keys"
+	case KeyFetchFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("KeyFetchOutcome(%d)", int(o))
+	}
+}
+
+// noopKeyRingMetrics is the KeyRingMetrics used if the KeyRing doesn't have
+// any.
+type noopKeyRingMetrics struct{}
+
+func (noopKeyRingMetrics) CacheHit(ServerName)                                               {}
+func (noopKeyRingMetrics) CacheMiss(ServerName)                                              {}
+func (noopKeyRingMetrics) FetchStarted(ServerName, string)                                   {}
+func (noopKeyRingMetrics) FetchCompleted(ServerName, string, time.Duration, KeyFetchOutcome) {}
+
+func (k *KeyRing) metrics() KeyRingMetrics {
+	if k.Metrics == nil {
+		return noopKeyRingMetrics{}
+	}
+	return k.Metrics
+}
+
+// keyRequestsByServer groups the key requests by server.
+func keyRequestsByServer(requests map[PublicKeyLookupRequest]Timestamp) map[ServerName][]PublicKeyLookupRequest {
+	byServer := map[ServerName][]PublicKeyLookupRequest{}
+	for req := range requests {
+		byServer[req.ServerName] = append(byServer[req.ServerName], req)
+	}
+	return byServer
+}
+
+// reportKeyLookups reports, for each server, whether all of the keys that
+// were requested for it were found.
+func reportKeyLookups(
+	requests map[PublicKeyLookupRequest]Timestamp, keys map[PublicKeyLookupRequest]PublicKeyLookupResult,
+	report func(serverName ServerName, found bool),
+) {
+	for serverName, reqs := range keyRequestsByServer(requests) {
+		found := true
+		for _, req := range reqs {
+			if !hasRequestedKey(keys, req) {
+				found = false
+				break
+			}
+		}
+		report(serverName, found)
+	}
+}
+
+// NewKeyRing returns a KeyRing that fetches keys using the fetchers and
+// caches them in the database, with the other options left at their
+// defaults. It makes the same KeyRing as the positional literal
+// KeyRing{keyFetchers, keyDatabase} did before KeyRing had other options.
+func NewKeyRing(keyFetchers []KeyFetcher, keyDatabase KeyDatabase) KeyRing {
+	return KeyRing{KeyFetchers: keyFetchers, KeyDatabase: keyDatabase}
 }
 
 // A VerifyJSONRequest is a request to check for a signature on a JSON message.
@@ -93,6 +276,7 @@ type VerifyJSONRequest struct {
 	// The name of the matrix server to check for a signature for.
 	ServerName ServerName
 	// The millisecond posix timestamp the message needs to be valid at.
+	// VerifyEventSignatures uses the origin_server_ts of the event.
 	AtTS Timestamp
 	// The JSON bytes.
 	Message []byte
@@ -104,6 +288,44 @@ type VerifyJSONResult struct {
 	// This will be nil if the message passed the checks.
 	// This will have an error if the message did not pass the checks.
 	Error error
+	// The outcome for each of the signatures on the message from the server,
+	// sorted by key ID, so that a failure can be diagnosed. This is empty if
+	// the message couldn't be parsed or wasn't signed by the server. Checking
+	// stops at the first valid signature, so if the message passed then only
+	// that signature is known to be valid. JSONVerifiers other than KeyRing
+	// may leave this empty.
+	Signatures []SignatureResult
+}
+
+// A SignatureResult is the outcome of checking one of the signatures on a
+// JSON message.
+type SignatureResult struct {
+	// The server the signature is from.
+	ServerName ServerName
+	// The ID of the key the signature was made with.
+	KeyID KeyID
+	// Why the signature couldn't be verified, or nil if it is valid. The
+	// KeyRing uses an UnsupportedAlgorithmError, KeyNotFoundError,
+	// KeyFetchFailedError, KeyExpiredError or SignatureInvalidError.
+	Error error
+}
+
+func (r SignatureResult) String() string {
+	if r.Error == nil {
+		return fmt.Sprintf("%s %s: valid", r.ServerName, r.KeyID)
+	}
+	return fmt.Sprintf("%s %s: %s", r.ServerName, r.KeyID, r.Error)
+}
+
+// setSignatureError records the outcome of checking the signature made with
+// the key in the result.
+func (r *VerifyJSONResult) setSignatureError(keyID KeyID, err error) {
+	for i := range r.Signatures {
+		if r.Signatures[i].KeyID == keyID {
+			r.Signatures[i].Error = err
+			return
+		}
+	}
 }
 
 // A JSONVerifier is an object which can verify the signatures of JSON messages.
@@ -116,6 +338,110 @@ type JSONVerifier interface {
 	VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error)
 }
 
+// A KeyNotFoundError is the error for a message when none of the keys that
+// it is signed with could be found for the server, or for a signature when
+// its key couldn't be found.
+type KeyNotFoundError struct {
+	// The server the keys are for.
+	ServerName ServerName
+	// The ID of the key, if the error is for a signature.
+	KeyID KeyID
+}
+
+func (e KeyNotFoundError) Error() string {
+	if e.KeyID != "" {
+		return fmt.Sprintf("gomatrixserverlib: could not download key with ID %q for %q", e.KeyID, e.ServerName)
+	}
+	return fmt.Sprintf("gomatrixserverlib: could not download key for %q", e.ServerName)
+}
+
+// A KeyExpiredError is the error for a message when the key that it is
+// signed with wasn't valid at the time that the message needs it to be,
+// either because the key had expired by then or because the server hasn't
+// said that it is valid for that long.
+type KeyExpiredError struct {
+	// The server the key is for.
+	ServerName ServerName
+	// The ID of the key.
+	KeyID KeyID
+	// The time the key needed to be valid at.
+	AtTS Timestamp
+	// When the key expired, or PublicKeyNotExpired.
+	ExpiredTS Timestamp
+	// When the key is valid until, if it hasn't expired.
+	ValidUntilTS Timestamp
+	// The key validity mode of the KeyRing that rejected the key.
+	Mode KeyValidityMode
+}
+
+func (e KeyExpiredError) Error() string {
+	if e.ExpiredTS != PublicKeyNotExpired {
+		return fmt.Sprintf(
+			"gomatrixserverlib: key with ID %q for %q expired at %d, before %d (%s key validity)",
+			e.KeyID, e.ServerName, e.ExpiredTS, e.AtTS, e.Mode,
+		)
+	}
+	return fmt.Sprintf(
+		"gomatrixserverlib: key with ID %q for %q not valid at %d (%s key validity)",
+		e.KeyID, e.ServerName, e.AtTS, e.Mode,
+	)
+}
+
+// A SignatureInvalidError is the error for a message when its signature
+// couldn't be verified using the key it claims to be signed with.
+type SignatureInvalidError struct {
+	// The server the signature is from.
+	ServerName ServerName
+	// The ID of the key.
+	KeyID KeyID
+	// The error from VerifyJSON.
+	Err error
+}
+
+func (e SignatureInvalidError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: invalid signature from %q with key ID %q: %s", e.ServerName, e.KeyID, e.Err,
+	)
+}
+
+// A KeyFetchTimeoutError is the error for fetching keys from a server,
+// either the server the keys are for or a perspective server, that didn't
+// answer within the fetch timeout of the fetcher.
+type KeyFetchTimeoutError struct {
+	// The server that didn't answer in time.
+	ServerName ServerName
+	// How long the fetcher waited for the server.
+	Timeout time.Duration
+}
+
+func (e KeyFetchTimeoutError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: timed out fetching keys from %q after %s", e.ServerName, e.Timeout)
+}
+
+// A PartialKeyFetchError is returned by a KeyFetcher, along with the keys
+// that it did fetch, when fetching the keys of some of the servers failed.
+// The KeyRing uses the keys that were fetched, and the messages that needed
+// keys from the servers that failed fail with the error for the server
+// unless another fetcher finds the keys.
+type PartialKeyFetchError struct {
+	// Why fetching the keys of each server that failed failed.
+	Errors map[ServerName]error
+}
+
+func (e PartialKeyFetchError) Error() string {
+	serverNames := make([]string, 0, len(e.Errors))
+	for serverName := range e.Errors {
+		serverNames = append(serverNames, string(serverName))
+	}
+	sort.Strings(serverNames)
+	failures := make([]string, len(serverNames))
+	for i, serverName := range serverNames {
+		failures[i] = fmt.Sprintf("%s: %s", serverName, e.Errors[ServerName(serverName)])
+	}
+	return fmt.Sprintf("gomatrixserverlib: failed to fetch keys from %d server(s): %s",
+		len(failures), strings.Join(failures, "; "))
+}
+
 // VerifyJSONs implements JSONVerifier.
 func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) { // nolint: gocyclo
 	logger := util.GetLogger(ctx)
@@ -125,27 +451,36 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 	for i := range requests {
 		ids, err := ListKeyIDs(string(requests[i].ServerName), requests[i].Message)
 		if err != nil {
-			results[i].Error = fmt.Errorf("gomatrixserverlib: error extracting key IDs")
+			results[i].Error = fmt.Errorf("gomatrixserverlib: error extracting key IDs: %s", err)
 			continue
 		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		// Signatures made with algorithms that we don't support are ignored,
+		// as long as there is a signature that we can check.
 		for _, keyID := range ids {
-			if k.isAlgorithmSupported(keyID) {
+			var signatureErr error = KeyNotFoundError{requests[i].ServerName, keyID}
+			if isSignatureAlgorithmSupported(keyID) {
 				keyIDs[i] = append(keyIDs[i], keyID)
+			} else {
+				signatureErr = UnsupportedAlgorithmError{keyID}
 			}
+			results[i].Signatures = append(results[i].Signatures, SignatureResult{
+				requests[i].ServerName, keyID, signatureErr,
+			})
 		}
 		if len(keyIDs[i]) == 0 {
-			results[i].Error = fmt.Errorf(
-				"gomatrixserverlib: not signed by %q with a supported algorithm", requests[i].ServerName,
-			)
+			if len(ids) > 0 {
+				results[i].Error = UnsupportedAlgorithmError{ids[0]}
+			} else {
+				results[i].Error = fmt.Errorf("gomatrixserverlib: not signed by %q", requests[i].ServerName)
+			}
 			continue
 		}
 		// Set a place holder error in the result field.
 		// This will be unset if one of the signature checks passes.
 		// This will be overwritten if one of the signature checks fails.
 		// Therefore this will only remain in place if the keys couldn't be downloaded.
-		results[i].Error = fmt.Errorf(
-			"gomatrixserverlib: could not download key for %q", requests[i].ServerName,
-		)
+		results[i].Error = KeyNotFoundError{ServerName: requests[i].ServerName}
 	}
 
 	keyRequests := k.publicKeyRequests(requests, results, keyIDs)
@@ -154,50 +489,197 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		// This will happen if all the objects are missing supported signatures.
 		return results, nil
 	}
-	keysFromDatabase, err := k.KeyDatabase.FetchKeys(ctx, keyRequests)
-	if err != nil {
-		return nil, err
+	if k.KeyDatabase != nil {
+		keysFromDatabase, err := k.KeyDatabase.FetchKeys(ctx, keyRequests)
+		if err != nil {
+			return nil, err
+		}
+		metrics := k.metrics()
+		reportKeyLookups(keyRequests, keysFromDatabase, func(serverName ServerName, found bool) {
+			if found {
+				metrics.CacheHit(serverName)
+			} else {
+				metrics.CacheMiss(serverName)
+			}
+		})
+		k.checkUsingKeys(requests, results, keyIDs, keysFromDatabase)
+	}
+
+	if k.FailureCache != nil && len(k.KeyFetchers) > 0 {
+		k.skipFailedKeys(requests, results, keyIDs)
 	}
-	k.checkUsingKeys(requests, results, keyIDs, keysFromDatabase)
+	// The keys requested from the fetchers and the keys they returned, to
+	// update the failure cache with.
+	requested := map[PublicKeyLookupRequest]bool{}
+	fetched := map[PublicKeyLookupRequest]bool{}
 
 	for _, fetcher := range k.KeyFetchers {
-		// TODO: we should distinguish here between expired keys, and those we don't have.
-		// If the key has expired, it's no use re-requesting it.
+		// Keys that we have but that aren't valid at the timestamp are
+		// requested again, since the server may have renewed them, with the
+		// timestamp as the minimum_valid_until_ts. Keys that had already
+		// expired at the timestamp aren't requested since they won't have
+		// become valid since.
 		keyRequests := k.publicKeyRequests(requests, results, keyIDs)
 		if len(keyRequests) == 0 {
 			// There aren't any keys to fetch so we can stop here.
 			// This means that we've checked every JSON object we can check.
-			return results, nil
+			break
 		}
 		fetcherLogger := logger.WithField("fetcher", fetcher.FetcherName())
-
-		// TODO: Coalesce in-flight requests for the same keys.
-		// Otherwise we risk spamming the servers we query the keys from.
-
 		fetcherLogger.WithField("num_key_requests", len(keyRequests)).
 			Info("Requesting keys from fetcher")
 
-		keysFetched, err := fetcher.FetchKeys(ctx, keyRequests)
+		// Only the keys that this call fetched itself count towards the
+		// failure cache, so that a failed fetch shared by many calls is
+		// only recorded once.
+		keysFetched, ownRequests, err := k.fetchKeys(ctx, fetcher, keyRequests)
+		for req := range ownRequests {
+			requested[req] = true
+		}
+		// If only some of the servers failed then the keys that were
+		// fetched are still used.
+		partial, isPartial := err.(PartialKeyFetchError)
+		if isPartial {
+			err = nil
+		}
 		if err != nil {
+			// The error could be for any of the keys requested, so all of
+			// the ones we haven't got are treated as having failed, unless
+			// the error is because the context is done.
+			if ctx.Err() == nil {
+				k.updateFailureCache(requested, fetched)
+			}
 			return nil, err
 		}
+		for req := range keysFetched {
+			fetched[req] = true
+		}
 
 		fetcherLogger.WithField("num_keys_fetched", len(keysFetched)).
 			Info("Got keys from fetcher")
 
 		k.checkUsingKeys(requests, results, keyIDs, keysFetched)
+		if isPartial {
+			reportKeyFetchErrors(requests, results, keyIDs, keysFetched, partial)
+		}
 
 		// Add the keys to the database so that we won't need to fetch them again.
-		if err := k.KeyDatabase.StoreKeys(ctx, keysFetched); err != nil {
-			return nil, err
+		if k.KeyDatabase != nil {
+			if err := k.KeyDatabase.StoreKeys(ctx, keysFetched); err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	k.updateFailureCache(requested, fetched)
 	return results, nil
 }
 
-func (k *KeyRing) isAlgorithmSupported(keyID KeyID) bool {
-	return strings.HasPrefix(string(keyID), "ed25519:")
+// fetchKeys asks the fetcher for the keys, sharing the fetches of keys that
+// are already being fetched if there is a Coalescer. Returns the keys
+// fetched and the requests that were fetched by this call rather than
+// shared.
+func (k *KeyRing) fetchKeys(
+	ctx context.Context, fetcher KeyFetcher, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, map[PublicKeyLookupRequest]Timestamp, error) {
+	metrics, fetcherName := k.metrics(), fetcher.FetcherName()
+	fetch := func(
+		ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+	) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+		for serverName := range keyRequestsByServer(requests) {
+			metrics.FetchStarted(serverName, fetcherName)
+		}
+		start := time.Now()
+		keysFetched, err := fetcher.FetchKeys(ctx, requests)
+		duration := time.Since(start)
+		partial, isPartial := err.(PartialKeyFetchError)
+		reportKeyLookups(requests, keysFetched, func(serverName ServerName, found bool) {
+			outcome := KeyFetchSucceeded
+			if (isPartial && partial.Errors[serverName] != nil) || (!isPartial && err != nil) {
+				outcome = KeyFetchFailed
+			} else if !found {
+				outcome = KeyFetchMissingKeys
+			}
+			metrics.FetchCompleted(serverName, fetcherName, duration, outcome)
+		})
+		return keysFetched, err
+	}
+	if k.Coalescer == nil || !canCoalesce(fetcher) {
+		keysFetched, err := fetch(ctx, requests)
+		return keysFetched, requests, err
+	}
+	return k.Coalescer.fetchKeys(ctx, fetcher, requests, fetch)
+}
+
+// reportKeyFetchErrors records why the keys of the servers that a fetcher
+// failed to fetch keys from weren't fetched, for the messages that still
+// need them. The error replaces the KeyNotFoundError of the message, and of
+// each signature whose key wasn't fetched.
+func reportKeyFetchErrors(
+	requests []VerifyJSONRequest, results []VerifyJSONResult, keyIDs [][]KeyID,
+	keysFetched map[PublicKeyLookupRequest]PublicKeyLookupResult, partial PartialKeyFetchError,
+) {
+	for i := range requests {
+		fetchErr := partial.Errors[requests[i].ServerName]
+		if results[i].Error == nil || fetchErr == nil {
+			continue
+		}
+		for _, keyID := range keyIDs[i] {
+			if _, ok := keysFetched[PublicKeyLookupRequest{requests[i].ServerName, keyID}]; !ok {
+				results[i].setSignatureError(keyID, fetchErr)
+			}
+		}
+		if _, ok := results[i].Error.(KeyNotFoundError); ok {
+			results[i].Error = fetchErr
+		}
+	}
+}
+
+// skipFailedKeys stops the keys that failed to be fetched recently from
+// being fetched or used. Messages that are left without any keys to check
+// fail with a KeyFetchFailedError.
+func (k *KeyRing) skipFailedKeys(requests []VerifyJSONRequest, results []VerifyJSONResult, keyIDs [][]KeyID) {
+	for i := range requests {
+		if results[i].Error == nil || len(keyIDs[i]) == 0 {
+			continue
+		}
+		var failedErr error
+		remaining := keyIDs[i][:0:0]
+		for _, keyID := range keyIDs[i] {
+			if err := k.FailureCache.checkFailed(PublicKeyLookupRequest{requests[i].ServerName, keyID}); err != nil {
+				results[i].setSignatureError(keyID, err)
+				if failedErr == nil {
+					failedErr = err
+				}
+				continue
+			}
+			remaining = append(remaining, keyID)
+		}
+		keyIDs[i] = remaining
+		if len(remaining) == 0 {
+			results[i].Error = failedErr
+		}
+	}
+}
+
+// updateFailureCache records the keys that were requested from the fetchers
+// but that weren't fetched as failed, and forgets the failures of the keys
+// that were fetched.
+func (k *KeyRing) updateFailureCache(requested, fetched map[PublicKeyLookupRequest]bool) {
+	if k.FailureCache == nil {
+		return
+	}
+	var failed, succeeded []PublicKeyLookupRequest
+	for req := range requested {
+		if !fetched[req] {
+			failed = append(failed, req)
+		}
+	}
+	for req := range fetched {
+		succeeded = append(succeeded, req)
+	}
+	k.FailureCache.fetchSucceeded(succeeded)
+	k.FailureCache.fetchFailed(failed)
 }
 
 func (k *KeyRing) publicKeyRequests(
@@ -236,116 +718,447 @@ func (k *KeyRing) checkUsingKeys(
 			// So we can skip to the next message.
 			continue
 		}
-		for _, keyID := range keyIDs[i] {
+		for j := 0; j < len(keyIDs[i]); j++ {
+			keyID := keyIDs[i][j]
 			serverKey, ok := keys[PublicKeyLookupRequest{requests[i].ServerName, keyID}]
 			if !ok {
 				// No key for this key ID so we continue onto the next key ID.
 				continue
 			}
-			if !serverKey.WasValidAt(requests[i].AtTS) {
+			strict := k.KeyValidity != KeyValidityLenient
+			if strict && serverKey.hasExpiredBefore(requests[i].AtTS) {
+				// The key had expired by the timestamp we needed it to be
+				// valid at, so stop looking for it and skip onto the next key.
+				results[i].Error = KeyExpiredError{
+					requests[i].ServerName, keyID, requests[i].AtTS, serverKey.ExpiredTS, serverKey.ValidUntilTS, k.KeyValidity,
+				}
+				results[i].setSignatureError(keyID, results[i].Error)
+				keyIDs[i] = append(keyIDs[i][:j:j], keyIDs[i][j+1:]...)
+				j--
+				continue
+			}
+			if strict && !serverKey.WasValidAt(requests[i].AtTS) {
 				// The key wasn't valid at the timestamp we needed it to be valid at.
 				// So skip onto the next key.
-				results[i].Error = fmt.Errorf(
-					"gomatrixserverlib: key with ID %q for %q not valid at %d",
-					keyID, requests[i].ServerName, requests[i].AtTS,
-				)
+				results[i].Error = KeyExpiredError{
+					requests[i].ServerName, keyID, requests[i].AtTS, serverKey.ExpiredTS, serverKey.ValidUntilTS, k.KeyValidity,
+				}
+				results[i].setSignatureError(keyID, results[i].Error)
 				continue
 			}
 			if err := VerifyJSON(
 				string(requests[i].ServerName), keyID, ed25519.PublicKey(serverKey.Key), requests[i].Message,
 			); err != nil {
 				// The signature wasn't valid, record the error and try the next key ID.
-				results[i].Error = err
+				results[i].Error = SignatureInvalidError{requests[i].ServerName, keyID, err}
+				results[i].setSignatureError(keyID, results[i].Error)
 				continue
 			}
 			// The signature is valid, set the result to nil.
 			results[i].Error = nil
+			results[i].setSignatureError(keyID, nil)
 			break
 		}
 	}
 }
 
-// A PerspectiveKeyFetcher fetches server keys from a single perspective server.
+// A PerspectiveServer is a perspective server, also known as a notary
+// server, that a PerspectiveKeyFetcher fetches keys from.
+type PerspectiveServer struct {
+	// The name of the perspective server.
+	ServerName ServerName
+	// The ed25519 public keys the perspective server must sign responses
+	// with, which must have been fetched from it separately.
+	Keys map[KeyID]ed25519.PublicKey
+}
+
+// A PerspectiveKeyFetcher fetches server keys from perspective servers.
+// Each key object in a response must be signed both by the perspective
+// server, using one of its known keys, and by the server the keys are for.
+// Key objects that fail either check are discarded, and the other key
+// objects in the response are still used. All of the keys asked for in a
+// call to FetchKeys are queried for at once, whichever servers they are
+// for, and with a BatchWindow the keys asked for by concurrent calls are
+// too. Keys that the perspective servers don't return are left out of the
+// results, so that the KeyRing can fetch them with its next fetcher.
+//
+// Each key is asked for with the timestamp it is needed at as its
+// minimum_valid_until_ts, so that a perspective server with an older copy of
+// the key fetches it again from the server it is for. A perspective server
+// that couldn't do that may still return the older copy, so keys that
+// aren't valid at the timestamp asked for are treated as missing too, unless
+// the KeyValidity is KeyValidityLenient.
 type PerspectiveKeyFetcher struct {
 	// The name of the perspective server to fetch keys from.
 	PerspectiveServerName ServerName
 	// The ed25519 public keys the perspective server must sign responses with.
 	PerspectiveServerKeys map[KeyID]ed25519.PublicKey
+	// Further perspective servers to fetch keys from, in order, after the
+	// one above if it is set. Each server is only asked for the keys that
+	// the servers before it didn't return.
+	Perspectives []PerspectiveServer
 	// The federation client to use to fetch keys with.
 	Client Client
+	// How long to wait for other calls to FetchKeys before querying the
+	// perspective servers, so that the keys they ask for are fetched with
+	// one query to each perspective server. If zero then each call queries
+	// the perspective servers straight away.
+	BatchWindow time.Duration
+	// How long to wait for each perspective server to answer before moving
+	// on to the next one. Defaults to 5 seconds if zero.
+	FetchTimeout time.Duration
+	// Whether keys that aren't valid at the timestamp asked for are left out
+	// of the results. Defaults to KeyValidityStrict, which leaves them out.
+	// A KeyRing in KeyValidityLenient mode can use them.
+	KeyValidity KeyValidityMode
+
+	// The calls waiting to be fetched together. This is a pointer so that
+	// the PerspectiveKeyFetcher can still be copied.
+	batcher *perspectiveKeyBatcher
+}
+
+// perspectiveKeyBatcherMutex guards the creation of the batchers of
+// PerspectiveKeyFetchers.
+var perspectiveKeyBatcherMutex sync.Mutex
+
+// perspectiveKeyBatcher holds the batch of a PerspectiveKeyFetcher that
+// calls to FetchKeys add their keys to.
+type perspectiveKeyBatcher struct {
+	mutex sync.Mutex
+	batch *perspectiveKeyBatch
+}
+
+// perspectiveKeyBatch is the keys asked for by the calls to FetchKeys that
+// are waiting to be fetched together.
+type perspectiveKeyBatch struct {
+	requests map[PublicKeyLookupRequest]Timestamp
+	// Closed when the keys have been fetched.
+	done    chan struct{}
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err     error
+}
+
+// perspectives returns the perspective servers to fetch keys from in order.
+func (p PerspectiveKeyFetcher) perspectives() []PerspectiveServer {
+	if p.PerspectiveServerName == "" {
+		return p.Perspectives
+	}
+	return append([]PerspectiveServer{{p.PerspectiveServerName, p.PerspectiveServerKeys}}, p.Perspectives...)
+}
+
+func (p *PerspectiveKeyFetcher) fetchTimeout() time.Duration {
+	if p.FetchTimeout == 0 {
+		return defaultKeyFetchTimeout
+	}
+	return p.FetchTimeout
+}
+
+// keyBatcher returns the batcher of the PerspectiveKeyFetcher, creating it
+// if this is the first call to use it.
+func (p *PerspectiveKeyFetcher) keyBatcher() *perspectiveKeyBatcher {
+	perspectiveKeyBatcherMutex.Lock()
+	defer perspectiveKeyBatcherMutex.Unlock()
+	if p.batcher == nil {
+		p.batcher = &perspectiveKeyBatcher{}
+	}
+	return p.batcher
 }
 
 // FetcherName implements KeyFetcher
 func (p PerspectiveKeyFetcher) FetcherName() string {
-	return fmt.Sprintf("perspective server %s", p.PerspectiveServerName)
+	var names []string
+	for _, perspective := range p.perspectives() {
+		names = append(names, string(perspective.ServerName))
+	}
+	if len(names) == 1 {
+		return fmt.Sprintf("perspective server %s", names[0])
+	}
+	return fmt.Sprintf("perspective servers %s", strings.Join(names, ", "))
 }
 
-// FetchKeys implements KeyFetcher
+// FetchKeys implements KeyFetcher. Returns an error if none of the
+// perspective servers could be reached and no keys were fetched.
+//
+// With a BatchWindow, the first call starts a batch that fetches the keys
+// asked for by every call made during the window. The batch is fetched with
+// a context of its own rather than that of any of the calls, so a call that
+// gives up waiting doesn't fail the others, and each perspective server is
+// given the FetchTimeout to answer. Each call gets the keys that it asked
+// for, or the error of the fetch, unless its context is done first.
 func (p *PerspectiveKeyFetcher) FetchKeys(
 	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
 ) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
-	serverKeys, err := p.Client.LookupServerKeys(ctx, p.PerspectiveServerName, requests)
-	if err != nil {
-		return nil, err
+	if p.BatchWindow <= 0 {
+		results, err := p.fetchKeys(ctx, requests)
+		if err != nil {
+			return nil, err
+		}
+		return p.withoutStaleKeys(requests, results), nil
+	}
+
+	batcher := p.keyBatcher()
+	batcher.mutex.Lock()
+	batch := batcher.batch
+	if batch == nil {
+		batch = &perspectiveKeyBatch{
+			requests: map[PublicKeyLookupRequest]Timestamp{},
+			done:     make(chan struct{}),
+		}
+		batcher.batch = batch
+		go p.fetchBatch(batcher, batch)
+	}
+	for req, ts := range requests {
+		// Ask for the key to be valid until the latest time any of the
+		// calls need it to be.
+		if maxTS, ok := batch.requests[req]; !ok || ts > maxTS {
+			batch.requests[req] = ts
+		}
+	}
+	batcher.mutex.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if batch.err != nil {
+		return nil, batch.err
+	}
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		if req.KeyID == "" {
+			for key, result := range batch.results {
+				if key.ServerName == req.ServerName {
+					results[key] = result
+				}
+			}
+		} else if result, ok := batch.results[req]; ok {
+			results[req] = result
+		}
+	}
+	return p.withoutStaleKeys(requests, results), nil
+}
+
+// fetchBatch waits for the batch window and then fetches the keys of the
+// batch, closing its done channel once they have been fetched.
+func (p *PerspectiveKeyFetcher) fetchBatch(batcher *perspectiveKeyBatcher, batch *perspectiveKeyBatch) {
+	time.Sleep(p.BatchWindow)
+	batcher.mutex.Lock()
+	batcher.batch = nil
+	batcher.mutex.Unlock()
+	batch.results, batch.err = p.fetchKeys(context.Background(), batch.requests)
+	close(batch.done)
+}
+
+// withoutStaleKeys removes the keys that aren't valid at the timestamps they
+// were asked for at from the results, unless the KeyValidity is lenient.
+func (p *PerspectiveKeyFetcher) withoutStaleKeys(
+	requests map[PublicKeyLookupRequest]Timestamp, results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) map[PublicKeyLookupRequest]PublicKeyLookupResult {
+	if p.KeyValidity == KeyValidityLenient {
+		return results
+	}
+	for req, ts := range requests {
+		if result, ok := results[req]; ok && !result.WasValidAt(ts) {
+			delete(results, req)
+		}
 	}
+	return results
+}
 
+// fetchKeys fetches the keys from the perspective servers in order, asking
+// each one for the keys that the ones before it didn't return.
+func (p *PerspectiveKeyFetcher) fetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	logger := util.GetLogger(ctx)
 	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	var lastErr error
+	for _, perspective := range p.perspectives() {
+		remaining := map[PublicKeyLookupRequest]Timestamp{}
+		for req, ts := range requests {
+			if req.KeyID == "" {
+				if !hasRequestedKey(results, req) {
+					remaining[req] = ts
+				}
+			} else if result, ok := results[req]; !ok || !result.WasValidAt(ts) {
+				remaining[req] = ts
+			}
+		}
+		if len(remaining) == 0 {
+			break
+		}
 
-	for _, keys := range serverKeys {
-		var valid bool
-		keyIDs, err := ListKeyIDs(string(p.PerspectiveServerName), keys.Raw)
+		serverKeys, err := p.lookupServerKeys(ctx, perspective.ServerName, remaining)
 		if err != nil {
-			// The response from the perspective server was corrupted.
-			return nil, err
+			logger.WithError(err).Warnf("Failed to fetch keys from perspective server %s", perspective.ServerName)
+			lastErr = err
+			continue
 		}
-		for _, keyID := range keyIDs {
-			perspectiveKey, ok := p.PerspectiveServerKeys[keyID]
-			if !ok {
-				// We don't have a key for that keyID, skip to the next keyID.
+		fetchedAt := AsTimestamp(time.Now())
+		for _, keys := range serverKeys {
+			if err := checkNotarySignature(keys, perspective.ServerName, perspective.Keys); err != nil {
+				logger.WithError(err).Warnf("Discarding keys from perspective server %s", perspective.ServerName)
 				continue
 			}
-			if err := VerifyJSON(string(p.PerspectiveServerName), keyID, perspectiveKey, keys.Raw); err != nil {
-				// An invalid signature is very bad since it means we have a
-				// problem talking to the perspective server.
-				return nil, err
+			// Check that the keys are valid for the server they claim to be.
+			if checks, _ := CheckKeys(keys.ServerName, time.Unix(0, 0), keys); !checks.AllChecksOK {
+				logger.Warnf(
+					"Discarding keys for %s from perspective server %s that failed checks",
+					keys.ServerName, perspective.ServerName,
+				)
+				continue
+			}
+			fetched := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+			mapServerKeysToPublicKeyLookupResult(keys, fetched, fetchedAt)
+			for req, result := range fetched {
+				// If the same key is in more than one response then use the
+				// one that is valid for longest.
+				if existing, ok := results[req]; !ok || isValidForLonger(result, existing) {
+					results[req] = result
+				}
 			}
-			valid = true
-			break
-		}
-		if !valid {
-			// This means we don't have a known signature from the perspective server.
-			return nil, fmt.Errorf("gomatrixserverlib: not signed with a known key for the perspective server")
 		}
+	}
+	if len(results) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return results, nil
+}
 
-		// Check that the keys are valid for the server they claim to be
-		checks, _ := CheckKeys(keys.ServerName, time.Unix(0, 0), keys)
-		if !checks.AllChecksOK {
-			// This is bad because it means that the perspective server was trying to feed us an invalid response.
-			return nil, fmt.Errorf("gomatrixserverlib: key response from perspective server failed checks")
-		}
+// lookupServerKeys queries the perspective server for the keys, giving up
+// with a KeyFetchTimeoutError if it doesn't answer within the fetch timeout.
+func (p *PerspectiveKeyFetcher) lookupServerKeys(
+	ctx context.Context, serverName ServerName, requests map[PublicKeyLookupRequest]Timestamp,
+) ([]ServerKeys, error) {
+	timeout := p.fetchTimeout()
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	serverKeys, err := p.Client.LookupServerKeys(fetchCtx, serverName, requests)
+	if err != nil && fetchCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, KeyFetchTimeoutError{serverName, timeout}
+	}
+	return serverKeys, err
+}
 
-		// TODO (matrix-org/dendrite#345): What happens if the same key ID
-		// appears in multiple responses?
-		// We should probably take the response with the highest valid_until_ts.
-		mapServerKeysToPublicKeyLookupResult(keys, results)
+// isValidForLonger returns whether the key in a is valid for longer than the
+// key in b. A key that hasn't expired is valid for longer than one that has.
+func isValidForLonger(a, b PublicKeyLookupResult) bool {
+	if (a.ExpiredTS == PublicKeyNotExpired) != (b.ExpiredTS == PublicKeyNotExpired) {
+		return a.ExpiredTS == PublicKeyNotExpired
 	}
+	if a.ExpiredTS != PublicKeyNotExpired {
+		return a.ExpiredTS > b.ExpiredTS
+	}
+	return a.ValidUntilTS > b.ValidUntilTS
+}
 
-	return results, nil
+// KeyCacheMetrics is told about the lookups in a key cache, so that they can
+// be reported to a metrics system.
+type KeyCacheMetrics interface {
+	// CacheHit is called when the keys for a server were in the cache.
+	CacheHit(serverName ServerName)
+	// CacheMiss is called when the keys for a server had to be fetched.
+	CacheMiss(serverName ServerName)
 }
 
+// The defaults for the retries of a DirectKeyFetcher.
+const (
+	defaultDirectKeyFetchAttempts = 3
+	defaultDirectKeyFetchBackoff  = 500 * time.Millisecond
+)
+
+// defaultKeyFetchTimeout is how long fetchers wait for a server by default.
+const defaultKeyFetchTimeout = 5 * time.Second
+
 // A DirectKeyFetcher fetches keys directly from a server.
 // This may be suitable for local deployments that are firewalled from the public internet where DNS can be trusted.
+//
+// All of a server's keys are fetched in one request and cached together
+// until the valid_until_ts of the response, but for no longer than the
+// keys are treated as valid for after they were fetched. Concurrent fetches
+// for the same server share a single request, and requests that fail with
+// a network error or a server error are retried with exponential backoff.
+// The keys of different servers are fetched in parallel, and each server
+// has to answer within the fetch timeout, including any retries. If some of
+// the servers fail then the keys of the others are returned along with a
+// PartialKeyFetchError.
+// A DirectKeyFetcher must not be copied after it is first used.
 type DirectKeyFetcher struct {
 	// The federation client to use to fetch keys with.
 	Client Client
+	// The number of times to try fetching the keys of a server before
+	// giving up. Defaults to 3 if zero.
+	MaxAttempts int
+	// How long to wait before the first retry, doubling for each retry after
+	// that. Defaults to 500 milliseconds if zero.
+	RetryBackoff time.Duration
+	// How long to wait for the keys of each server, including any retries,
+	// before giving up with a KeyFetchTimeoutError. Defaults to 5 seconds if
+	// zero.
+	FetchTimeout time.Duration
+	// Metrics, if not nil, is told about cache hits and misses.
+	Metrics KeyCacheMetrics
+	// Clock tells the time for the cache. Defaults to WallClock if nil.
+	Clock Clock
+
+	mutex    sync.Mutex
+	cache    map[ServerName]directKeyCacheEntry
+	inFlight map[ServerName]*directKeyFetch
+}
+
+// A directKeyCacheEntry is the cached keys of a server.
+type directKeyCacheEntry struct {
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult
+	expires time.Time
+}
+
+// A directKeyFetch is a fetch of the keys of a server that is in flight.
+// The results and error are set before done is closed.
+type directKeyFetch struct {
+	done    chan struct{}
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err     error
 }
 
 // FetcherName implements KeyFetcher
-func (d DirectKeyFetcher) FetcherName() string {
+func (d *DirectKeyFetcher) FetcherName() string {
 	return "DirectKeyFetcher"
 }
 
-// FetchKeys implements KeyFetcher
+func (d *DirectKeyFetcher) maxAttempts() int {
+	if d.MaxAttempts == 0 {
+		return defaultDirectKeyFetchAttempts
+	}
+	return d.MaxAttempts
+}
+
+func (d *DirectKeyFetcher) retryBackoff() time.Duration {
+	if d.RetryBackoff == 0 {
+		return defaultDirectKeyFetchBackoff
+	}
+	return d.RetryBackoff
+}
+
+func (d *DirectKeyFetcher) fetchTimeout() time.Duration {
+	if d.FetchTimeout == 0 {
+		return defaultKeyFetchTimeout
+	}
+	return d.FetchTimeout
+}
+
+func (d *DirectKeyFetcher) now() time.Time {
+	if d.Clock == nil {
+		return WallClock.Now()
+	}
+	return d.Clock.Now()
+}
+
+// FetchKeys implements KeyFetcher. If fetching the keys of some of the
+// servers fails then the keys of the other servers are returned with a
+// PartialKeyFetchError. If all of them fail then the error for one of them
+// is returned.
 func (d *DirectKeyFetcher) FetchKeys(
 	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
 ) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
@@ -359,23 +1172,190 @@ func (d *DirectKeyFetcher) FetchKeys(
 		server[req] = ts
 	}
 
-	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
-	for server := range byServer {
-		// TODO: make these requests in parallel
-		serverResults, err := d.fetchKeysForServer(ctx, server)
-		if err != nil {
-			// TODO: Should we actually be erroring here? or should we just drop those keys from the result map?
-			return nil, err
+	var (
+		mutex   sync.Mutex
+		wg      sync.WaitGroup
+		results = map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+		errs    = map[ServerName]error{}
+	)
+	for server, serverRequests := range byServer {
+		wg.Add(1)
+		go func(server ServerName, serverRequests map[PublicKeyLookupRequest]Timestamp) {
+			defer wg.Done()
+			serverResults := d.cachedKeys(server, serverRequests)
+			var err error
+			if serverResults == nil {
+				serverResults, err = d.fetchKeysForServer(ctx, server)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errs[server] = err
+				return
+			}
+			for req, keys := range serverResults {
+				results[req] = keys
+			}
+		}(server, serverRequests)
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return results, nil
+	}
+	if len(errs) == len(byServer) {
+		// None of the servers could be fetched from, so return the error
+		// for the first of them.
+		var first ServerName
+		for server := range errs {
+			if first == "" || server < first {
+				first = server
+			}
+		}
+		return nil, errs[first]
+	}
+	return results, PartialKeyFetchError{errs}
+}
+
+// cachedKeys returns the cached keys of the server if they haven't expired
+// and have every key requested valid at the timestamp requested, or nil.
+func (d *DirectKeyFetcher) cachedKeys(
+	serverName ServerName, requests map[PublicKeyLookupRequest]Timestamp,
+) map[PublicKeyLookupRequest]PublicKeyLookupResult {
+	d.mutex.Lock()
+	entry, ok := d.cache[serverName]
+	d.mutex.Unlock()
+	if ok && d.now().Before(entry.expires) {
+		for req, ts := range requests {
+			if req.KeyID == "" {
+				continue
+			}
+			if result, ok := entry.results[req]; !ok || !result.WasValidAt(ts) {
+				entry.results = nil
+				break
+			}
 		}
-		for req, keys := range serverResults {
-			results[req] = keys
+	} else {
+		entry.results = nil
+	}
+	if d.Metrics != nil {
+		if entry.results != nil {
+			d.Metrics.CacheHit(serverName)
+		} else {
+			d.Metrics.CacheMiss(serverName)
 		}
 	}
-	return results, nil
+	return entry.results
 }
 
+// fetchKeysForServer fetches the keys of the server, or waits for the fetch
+// that is already in flight for the server, and caches them. The results
+// are shared, so must not be modified.
 func (d *DirectKeyFetcher) fetchKeysForServer(
 	ctx context.Context, serverName ServerName,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	d.mutex.Lock()
+	if fetch, ok := d.inFlight[serverName]; ok {
+		d.mutex.Unlock()
+		select {
+		case <-fetch.done:
+			return fetch.results, fetch.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	fetch := &directKeyFetch{done: make(chan struct{})}
+	if d.inFlight == nil {
+		d.inFlight = map[ServerName]*directKeyFetch{}
+	}
+	d.inFlight[serverName] = fetch
+	d.mutex.Unlock()
+
+	timeout := d.fetchTimeout()
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	fetch.results, fetch.err = d.fetchKeysForServerWithRetries(fetchCtx, serverName)
+	if fetch.err != nil && fetchCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		fetch.err = KeyFetchTimeoutError{serverName, timeout}
+	}
+	cancel()
+
+	d.mutex.Lock()
+	delete(d.inFlight, serverName)
+	if fetch.err == nil {
+		if d.cache == nil {
+			d.cache = map[ServerName]directKeyCacheEntry{}
+		}
+		d.cache[serverName] = directKeyCacheEntry{fetch.results, directKeyCacheExpiry(fetch.results)}
+	}
+	d.mutex.Unlock()
+	close(fetch.done)
+	return fetch.results, fetch.err
+}
+
+// directKeyCacheExpiry returns when the keys of a server fetched together
+// expire from the cache, which is when the current keys stop being valid.
+// Their validity is already capped to maxKeyValidityPeriod after they were
+// fetched.
+func directKeyCacheExpiry(results map[PublicKeyLookupRequest]PublicKeyLookupResult) time.Time {
+	var validUntilTS Timestamp
+	for _, result := range results {
+		if result.ExpiredTS == PublicKeyNotExpired && result.ValidUntilTS > validUntilTS {
+			validUntilTS = result.ValidUntilTS
+		}
+	}
+	return validUntilTS.Time()
+}
+
+// fetchKeysForServerWithRetries fetches the keys of the server, retrying
+// with exponential backoff if the fetch fails in a way that may be
+// temporary.
+func (d *DirectKeyFetcher) fetchKeysForServerWithRetries(
+	ctx context.Context, serverName ServerName,
+) (results map[PublicKeyLookupRequest]PublicKeyLookupResult, err error) {
+	backoff := d.retryBackoff()
+	for attempt := 1; ; attempt++ {
+		results, err = d.fetchKeysFromServer(ctx, serverName)
+		if err == nil || attempt >= d.maxAttempts() || !isTemporaryKeyFetchError(err) {
+			return results, err
+		}
+		util.GetLogger(ctx).WithError(err).Warnf(
+			"Failed to fetch keys from %s, retrying in %s", serverName, backoff,
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// isTemporaryKeyFetchError returns whether fetching keys failed in a way
+// that may succeed if tried again: a network error, or an HTTP error that
+// is a server error or rate limiting rather than a client error.
+func isTemporaryKeyFetchError(err error) bool {
+	switch e := err.(type) {
+	case gomatrix.HTTPError:
+		return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+	case keyCheckError:
+		return false
+	default:
+		return true
+	}
+}
+
+// A keyCheckError is returned when the keys fetched from a server fail the
+// checks, which won't be fixed by fetching them again.
+type keyCheckError struct {
+	serverName ServerName
+}
+
+func (e keyCheckError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: key response direct from %q failed checks", e.serverName)
+}
+
+func (d *DirectKeyFetcher) fetchKeysFromServer(
+	ctx context.Context, serverName ServerName,
 ) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
 	keys, err := d.Client.GetServerKeys(ctx, serverName)
 	if err != nil {
@@ -384,40 +1364,51 @@ func (d *DirectKeyFetcher) fetchKeysForServer(
 	// Check that the keys are valid for the server.
 	checks, _ := CheckKeys(serverName, time.Unix(0, 0), keys)
 	if !checks.AllChecksOK {
-		return nil, fmt.Errorf("gomatrixserverlib: key response direct from %q failed checks", serverName)
+		return nil, keyCheckError{serverName}
 	}
 
 	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
 
 	// TODO (matrix-org/dendrite#345): What happens if the same key ID
 	// appears in multiple responses? We should probably reject the response.
-	mapServerKeysToPublicKeyLookupResult(keys, results)
+	mapServerKeysToPublicKeyLookupResult(keys, results, AsTimestamp(d.now()))
 
 	return results, nil
 }
 
 // mapServerKeysToPublicKeyLookupResult takes the (verified) result from a
 // /key/v2/query call and inserts it into a PublicKeyLookupRequest->PublicKeyLookupResult
-// map.
-func mapServerKeysToPublicKeyLookupResult(serverKeys ServerKeys, results map[PublicKeyLookupRequest]PublicKeyLookupResult) {
-	for keyID, key := range serverKeys.VerifyKeys {
+// map. The keys were fetched at fetchedAt, and aren't treated as valid for
+// longer than maxKeyValidityPeriod after that. The old keys the server has
+// rotated out are included with their expiry, so that they can still verify
+// the messages that were signed before they expired.
+func mapServerKeysToPublicKeyLookupResult(
+	serverKeys ServerKeys, results map[PublicKeyLookupRequest]PublicKeyLookupResult, fetchedAt Timestamp,
+) {
+	validUntilTS := serverKeys.ValidUntilTS
+	if maxValidUntilTS := fetchedAt + Timestamp(maxKeyValidityPeriod/time.Millisecond); validUntilTS > maxValidUntilTS {
+		validUntilTS = maxValidUntilTS
+	}
+	// Old keys are added first so that a key that is in both lists is
+	// treated as current, the same as ServerKeys.PublicKey does.
+	for keyID, key := range serverKeys.OldVerifyKeys {
 		results[PublicKeyLookupRequest{
 			ServerName: serverKeys.ServerName,
 			KeyID:      keyID,
 		}] = PublicKeyLookupResult{
-			VerifyKey:    key,
-			ValidUntilTS: serverKeys.ValidUntilTS,
-			ExpiredTS:    PublicKeyNotExpired,
+			VerifyKey:    key.VerifyKey,
+			ValidUntilTS: PublicKeyNotValid,
+			ExpiredTS:    key.ExpiredTS,
 		}
 	}
-	for keyID, key := range serverKeys.OldVerifyKeys {
+	for keyID, key := range serverKeys.VerifyKeys {
 		results[PublicKeyLookupRequest{
 			ServerName: serverKeys.ServerName,
 			KeyID:      keyID,
 		}] = PublicKeyLookupResult{
-			VerifyKey:    key.VerifyKey,
-			ValidUntilTS: PublicKeyNotValid,
-			ExpiredTS:    key.ExpiredTS,
+			VerifyKey:    key,
+			ValidUntilTS: validUntilTS,
+			ExpiredTS:    PublicKeyNotExpired,
 		}
 	}
 }
@@ -1,8 +1,20 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 var privateKeySeed1 = `QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz/G5HE`
@@ -86,7 +98,7 @@ func (db *testKeyDatabase) StoreKeys(
 
 func TestVerifyJSONsSuccess(t *testing.T) {
 	// Check that trying to verify the server key JSON works.
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := NewKeyRing(nil, &testKeyDatabase{})
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName: "localhost:8800",
 		Message:    []byte(testKeys),
@@ -102,7 +114,7 @@ func TestVerifyJSONsSuccess(t *testing.T) {
 
 func TestVerifyJSONsUnknownServerFails(t *testing.T) {
 	// Check that trying to verify JSON for an unknown server fails.
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := NewKeyRing(nil, &testKeyDatabase{})
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName: "unknown:8800",
 		Message:    []byte(testKeys),
@@ -119,7 +131,7 @@ func TestVerifyJSONsUnknownServerFails(t *testing.T) {
 func TestVerifyJSONsDistantFutureFails(t *testing.T) {
 	// Check that trying to verify JSON from the distant future fails.
 	distantFuture := Timestamp(2000000000000)
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := NewKeyRing(nil, &testKeyDatabase{})
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName: "unknown:8800",
 		Message:    []byte(testKeys),
@@ -135,7 +147,7 @@ func TestVerifyJSONsDistantFutureFails(t *testing.T) {
 
 func TestVerifyJSONsFetcherError(t *testing.T) {
 	// Check that if the database errors then the attempt to verify JSON fails.
-	k := KeyRing{nil, &erroringKeyDatabase{}}
+	k := NewKeyRing(nil, &erroringKeyDatabase{})
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName: "localhost:8800",
 		Message:    []byte(testKeys),
@@ -171,3 +183,1018 @@ func (e *erroringKeyDatabase) StoreKeys(
 ) error {
 	return &testErrorStore
 }
+
+// testRecordingKeyFetcher is a KeyFetcher that returns keys from a map and
+// records the requests made to it.
+type testRecordingKeyFetcher struct {
+	keys     map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err      error
+	requests []map[PublicKeyLookupRequest]Timestamp
+}
+
+func (f *testRecordingKeyFetcher) FetcherName() string {
+	return "testRecordingKeyFetcher"
+}
+
+func (f *testRecordingKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	f.requests = append(f.requests, requests)
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		if key, ok := f.keys[req]; ok {
+			results[req] = key
+		}
+	}
+	return results, nil
+}
+
+// testSignedMessage returns a message signed by the server with a new key,
+// and the public key.
+func testSignedMessage(t *testing.T, serverName ServerName, keyID KeyID) ([]byte, VerifyKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := SignJSON(string(serverName), keyID, privateKey, []byte(`{"content":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message, VerifyKey{Key: Base64String(publicKey)}
+}
+
+func TestVerifyJSONsKeyExpiredBetweenEvents(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:old"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	db := NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: PublicKeyNotValid, ExpiredTS: 2000},
+	})
+	fetcher := &testRecordingKeyFetcher{}
+	k := NewKeyRing([]KeyFetcher{fetcher}, db)
+
+	// The key expired between the two messages, so only the first verifies,
+	// and the key isn't fetched again for the second since it won't have
+	// become valid since.
+	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+		{ServerName: req.ServerName, Message: message, AtTS: 1000},
+		{ServerName: req.ServerName, Message: message, AtTS: 3000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Errorf("VerifyJSONs: wanted the message before the key expired to verify, got %v", results[0].Error)
+	}
+	if results[1].Error == nil || !strings.Contains(results[1].Error.Error(), "expired") {
+		t.Errorf("VerifyJSONs: wanted an expired key error for the message after the key expired, got %v", results[1].Error)
+	}
+	if len(fetcher.requests) != 0 {
+		t.Errorf("VerifyJSONs: wanted the expired key not to be fetched, got %v", fetcher.requests)
+	}
+}
+
+func TestVerifyJSONsKeyValidityMode(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	db := NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: PublicKeyNotValid, ExpiredTS: 2000},
+	})
+	requests := []VerifyJSONRequest{{ServerName: req.ServerName, Message: message, AtTS: 3000}}
+
+	// By default the key must have been valid at the timestamp.
+	k := KeyRing{KeyDatabase: db}
+	results, err := k.VerifyJSONs(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := results[0].Error.(KeyExpiredError)
+	if !ok || e.Mode != KeyValidityStrict || !strings.Contains(e.Error(), "strict key validity") {
+		t.Errorf("VerifyJSONs: wanted a KeyExpiredError from strict mode, got %v", results[0].Error)
+	}
+
+	// In lenient mode any known key is accepted.
+	k.KeyValidity = KeyValidityLenient
+	results, err = k.VerifyJSONs(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Errorf("VerifyJSONs: wanted the message to verify in lenient mode, got %v", results[0].Error)
+	}
+}
+
+type testKeyRingMetrics struct {
+	testKeyCacheMetrics
+	started   []string
+	completed []string
+}
+
+func (m *testKeyRingMetrics) FetchStarted(serverName ServerName, fetcher string) {
+	m.started = append(m.started, string(serverName)+" "+fetcher)
+}
+
+func (m *testKeyRingMetrics) FetchCompleted(
+	serverName ServerName, fetcher string, duration time.Duration, outcome KeyFetchOutcome,
+) {
+	m.completed = append(m.completed, string(serverName)+" "+fetcher+" "+outcome.String())
+}
+
+func TestVerifyJSONsSignatureBreakdown(t *testing.T) {
+	serverName := ServerName("example.com")
+	message, key := testSignedMessage(t, serverName, "ed25519:1")
+	var fields map[string]interface{}
+	if err := json.Unmarshal(message, &fields); err != nil {
+		t.Fatal(err)
+	}
+	signatures := fields["signatures"].(map[string]interface{})[string(serverName)].(map[string]interface{})
+	signatures["ed25519:bad"] = "not base64!"
+	signatures["ed25519:missing"] = signatures["ed25519:1"]
+	signatures["unknown:x"] = signatures["ed25519:1"]
+	message, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wrongKey := testSignedMessage(t, serverName, "ed25519:1")
+
+	verify := func(key VerifyKey) VerifyJSONResult {
+		k := KeyRing{KeyDatabase: NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			{serverName, "ed25519:1"}:   {VerifyKey: key, ValidUntilTS: 2000, ExpiredTS: PublicKeyNotExpired},
+			{serverName, "ed25519:bad"}: {VerifyKey: key, ValidUntilTS: 2000, ExpiredTS: PublicKeyNotExpired},
+		})}
+		results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+			{ServerName: serverName, Message: message, AtTS: 1000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results[0]
+	}
+
+	// Every signature fails for a different reason.
+	result := verify(wrongKey)
+	if result.Error == nil {
+		t.Fatalf("VerifyJSONs: wanted an error with the wrong key")
+	}
+	var gotKeyIDs []KeyID
+	for _, signature := range result.Signatures {
+		gotKeyIDs = append(gotKeyIDs, signature.KeyID)
+		if signature.ServerName != serverName {
+			t.Errorf("VerifyJSONs: got server name %q for %q, want %q", signature.ServerName, signature.KeyID, serverName)
+		}
+	}
+	wantKeyIDs := []KeyID{"ed25519:1", "ed25519:bad", "ed25519:missing", "unknown:x"}
+	if !reflect.DeepEqual(gotKeyIDs, wantKeyIDs) {
+		t.Fatalf("VerifyJSONs: got signatures %v, want %v", result.Signatures, wantKeyIDs)
+	}
+	if e, ok := result.Signatures[0].Error.(SignatureInvalidError); !ok || strings.Contains(e.Err.Error(), "base64") {
+		t.Errorf("VerifyJSONs: wanted a signature mismatch for ed25519:1, got %v", result.Signatures[0].Error)
+	}
+	if e, ok := result.Signatures[1].Error.(SignatureInvalidError); !ok || !strings.Contains(e.Err.Error(), "base64") {
+		t.Errorf("VerifyJSONs: wanted a base64 error for ed25519:bad, got %v", result.Signatures[1].Error)
+	}
+	if e, ok := result.Signatures[2].Error.(KeyNotFoundError); !ok || e.KeyID != "ed25519:missing" {
+		t.Errorf("VerifyJSONs: wanted a KeyNotFoundError for ed25519:missing, got %v", result.Signatures[2].Error)
+	}
+	if _, ok := result.Signatures[3].Error.(UnsupportedAlgorithmError); !ok {
+		t.Errorf("VerifyJSONs: wanted an UnsupportedAlgorithmError for unknown:x, got %v", result.Signatures[3].Error)
+	}
+
+	// The signature that isn't valid base64 doesn't stop the others from
+	// being checked.
+	result = verify(key)
+	if result.Error != nil || result.Signatures[0].Error != nil {
+		t.Errorf("VerifyJSONs: wanted ed25519:1 to be valid, got %v: %v", result.Error, result.Signatures)
+	}
+}
+
+func TestVerifyJSONsMetrics(t *testing.T) {
+	cached := PublicKeyLookupRequest{"cached.example.com", "ed25519:1"}
+	fetched := PublicKeyLookupRequest{"fetched.example.com", "ed25519:1"}
+	missing := PublicKeyLookupRequest{"missing.example.com", "ed25519:1"}
+	cachedMessage, cachedKey := testSignedMessage(t, cached.ServerName, cached.KeyID)
+	fetchedMessage, fetchedKey := testSignedMessage(t, fetched.ServerName, fetched.KeyID)
+	missingMessage, _ := testSignedMessage(t, missing.ServerName, missing.KeyID)
+	metrics := &testKeyRingMetrics{}
+	k := KeyRing{
+		KeyFetchers: []KeyFetcher{&testRecordingKeyFetcher{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			fetched: {VerifyKey: fetchedKey, ValidUntilTS: PublicKeyNotValid, ExpiredTS: PublicKeyNotExpired},
+		}}},
+		KeyDatabase: NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			cached: {VerifyKey: cachedKey, ValidUntilTS: 5000, ExpiredTS: PublicKeyNotExpired},
+		}),
+		Metrics: metrics,
+	}
+	_, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+		{ServerName: cached.ServerName, Message: cachedMessage, AtTS: 1000},
+		{ServerName: fetched.ServerName, Message: fetchedMessage, AtTS: 1000},
+		{ServerName: missing.ServerName, Message: missingMessage, AtTS: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.hits != 1 || metrics.misses != 2 {
+		t.Errorf("VerifyJSONs: wanted 1 cache hit and 2 misses, got %d and %d", metrics.hits, metrics.misses)
+	}
+	sort.Strings(metrics.started)
+	sort.Strings(metrics.completed)
+	wantStarted := []string{
+		"fetched.example.com testRecordingKeyFetcher",
+		"missing.example.com testRecordingKeyFetcher",
+	}
+	wantCompleted := []string{
+		"fetched.example.com testRecordingKeyFetcher succeeded",
+		"missing.example.com testRecordingKeyFetcher missing_keys",
+	}
+	if !reflect.DeepEqual(metrics.started, wantStarted) {
+		t.Errorf("VerifyJSONs: got fetches started %v, want %v", metrics.started, wantStarted)
+	}
+	if !reflect.DeepEqual(metrics.completed, wantCompleted) {
+		t.Errorf("VerifyJSONs: got fetches completed %v, want %v", metrics.completed, wantCompleted)
+	}
+}
+
+func TestVerifyJSONsRefetchesKeyPastValidity(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	db := NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: 2000, ExpiredTS: PublicKeyNotExpired},
+	})
+	fetcher := &testRecordingKeyFetcher{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: 5000, ExpiredTS: PublicKeyNotExpired},
+	}}
+	k := NewKeyRing([]KeyFetcher{fetcher}, db)
+
+	// The cached key is only valid until before the message, so it is
+	// fetched again with the timestamp of the message as the minimum valid
+	// until timestamp, and the renewed key is stored.
+	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+		{ServerName: req.ServerName, Message: message, AtTS: 1000},
+		{ServerName: req.ServerName, Message: message, AtTS: 3000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Error != nil {
+			t.Errorf("VerifyJSONs: wanted message %d to verify, got %v", i, result.Error)
+		}
+	}
+	if len(fetcher.requests) != 1 || len(fetcher.requests[0]) != 1 || fetcher.requests[0][req] != 3000 {
+		t.Errorf("VerifyJSONs: wanted the key to be fetched valid until 3000, got %v", fetcher.requests)
+	}
+	if db.keys[req].ValidUntilTS != 5000 {
+		t.Errorf("VerifyJSONs: wanted the renewed key to be stored, got %v", db.keys[req])
+	}
+}
+
+func TestVerifyJSONsWithoutKeyDatabase(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	message, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	fetcher := &testRecordingKeyFetcher{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		req: {VerifyKey: key, ValidUntilTS: 5000, ExpiredTS: PublicKeyNotExpired},
+	}}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}}
+
+	// Without a database the key is fetched for every call.
+	for i := 0; i < 2; i++ {
+		results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+			{ServerName: req.ServerName, Message: message, AtTS: 1000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Error != nil {
+			t.Errorf("VerifyJSONs: wanted the message to verify, got %v", results[0].Error)
+		}
+	}
+	if len(fetcher.requests) != 2 {
+		t.Errorf("VerifyJSONs: wanted the key to be fetched twice, got %v", fetcher.requests)
+	}
+}
+
+func TestInMemoryKeyDatabase(t *testing.T) {
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	_, key := testSignedMessage(t, req.ServerName, req.KeyID)
+	other := PublicKeyLookupRequest{"example.com", "ed25519:2"}
+	db := NewInMemoryKeyDatabase(nil)
+	ctx := context.Background()
+
+	for _, validUntil := range []Timestamp{2000, 1000} {
+		if err := db.StoreKeys(ctx, map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			req: {VerifyKey: key, ValidUntilTS: validUntil, ExpiredTS: PublicKeyNotExpired},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := db.FetchKeys(ctx, map[PublicKeyLookupRequest]Timestamp{req: 0, other: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key stored last is returned, and unknown keys are left out.
+	if len(results) != 1 || results[req].ValidUntilTS != 1000 {
+		t.Errorf("FetchKeys: wanted only the last stored key, got %v", results)
+	}
+}
+
+func TestMapServerKeysCapsValidity(t *testing.T) {
+	fetchedAt := AsTimestamp(time.Unix(1500000000, 0))
+	week := Timestamp(7 * 24 * time.Hour / time.Millisecond)
+	for _, test := range []struct {
+		validUntilTS Timestamp
+		want         Timestamp
+	}{
+		{fetchedAt + 1000, fetchedAt + 1000},
+		{fetchedAt + week, fetchedAt + week},
+		{fetchedAt + 30*week, fetchedAt + week},
+	} {
+		var keys ServerKeys
+		keys.ServerName = "example.com"
+		keys.ValidUntilTS = test.validUntilTS
+		keys.VerifyKeys = map[KeyID]VerifyKey{"ed25519:1": {}}
+		results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+		mapServerKeysToPublicKeyLookupResult(keys, results, fetchedAt)
+		if got := results[PublicKeyLookupRequest{"example.com", "ed25519:1"}].ValidUntilTS; got != test.want {
+			t.Errorf("mapServerKeysToPublicKeyLookupResult: valid_until_ts %d: got %d, want %d", test.validUntilTS, got, test.want)
+		}
+	}
+}
+
+// testNotaryTransport answers key queries for each perspective server with
+// the key objects given for it, and fails requests to other servers.
+type testNotaryTransport map[ServerName][]json.RawMessage
+
+func (t testNotaryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverKeys, ok := t[ServerName(req.URL.Host)]
+	if !ok || req.URL.Path != "/_matrix/key/v2/query" {
+		return nil, fmt.Errorf("unexpected request to %s", req.URL)
+	}
+	body, err := json.Marshal(map[string]interface{}{"server_keys": serverKeys})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// testPerspectiveKeys returns a key object for the server advertising the
+// public key and signed by the private key, which is then signed by the
+// notary.
+func testPerspectiveKeys(
+	t *testing.T, serverName ServerName, publicKey ed25519.PublicKey, privateKey ed25519.PrivateKey,
+	notary ServerName, notaryPrivateKey ed25519.PrivateKey,
+) json.RawMessage {
+	unsigned, err := json.Marshal(map[string]interface{}{
+		"server_name":    serverName,
+		"valid_until_ts": 2000,
+		"verify_keys": map[string]interface{}{
+			"ed25519:1": map[string]interface{}{"key": Base64String(publicKey)},
+		},
+		"old_verify_keys": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignJSON(string(serverName), "ed25519:1", privateKey, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosigned, err := SignJSON(string(notary), "ed25519:notary", notaryPrivateKey, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cosigned
+}
+
+func TestPerspectiveKeyFetcher(t *testing.T) {
+	newKey := func() (ed25519.PublicKey, ed25519.PrivateKey) {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return publicKey, privateKey
+	}
+	notaryPublicKey, notaryPrivateKey := newKey()
+	otherNotaryPublicKey, otherNotaryPrivateKey := newKey()
+	unknownPublicKey, unknownPrivateKey := newKey()
+	goodPublicKey, goodPrivateKey := newKey()
+	victimPublicKey, victimPrivateKey := newKey()
+
+	// The notary returns a key for victim.example.com that has been
+	// replaced after victim.example.com signed it, so its self-signature
+	// doesn't match. It also returns a key for good.example.com signed
+	// with a key of its own that we don't know.
+	tampered := testPerspectiveKeys(t, "victim.example.com", victimPublicKey, victimPrivateKey, "notary.example.com", notaryPrivateKey)
+	tampered = json.RawMessage(strings.Replace(
+		string(tampered), string(Base64String(victimPublicKey).Encode()), string(Base64String(unknownPublicKey).Encode()), 1,
+	))
+	tampered, err := SignJSON("notary.example.com", "ed25519:notary", notaryPrivateKey, tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := PerspectiveKeyFetcher{
+		Perspectives: []PerspectiveServer{
+			{"down.example.com", map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey}},
+			{"notary.example.com", map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey}},
+			{"other.example.com", map[KeyID]ed25519.PublicKey{"ed25519:notary": otherNotaryPublicKey}},
+		},
+		Client: *NewClientWithTransport(testNotaryTransport{
+			"notary.example.com": {
+				tampered,
+				testPerspectiveKeys(t, "good.example.com", goodPublicKey, goodPrivateKey, "notary.example.com", unknownPrivateKey),
+			},
+			"other.example.com": {
+				testPerspectiveKeys(t, "good.example.com", goodPublicKey, goodPrivateKey, "other.example.com", otherNotaryPrivateKey),
+			},
+		}),
+	}
+
+	victimReq := PublicKeyLookupRequest{"victim.example.com", "ed25519:1"}
+	goodReq := PublicKeyLookupRequest{"good.example.com", "ed25519:1"}
+	results, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{
+		victimReq: 1000, goodReq: 1000,
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys: unexpected error: %v", err)
+	}
+	// The tampered key is rejected, but the key for good.example.com is
+	// still fetched from the other notary, since only the key objects that
+	// fail the checks are discarded.
+	if _, ok := results[victimReq]; ok {
+		t.Errorf("FetchKeys: wanted the tampered key to be rejected, got %v", results[victimReq])
+	}
+	if !bytes.Equal(results[goodReq].Key, goodPublicKey) {
+		t.Errorf("FetchKeys: wanted the key for good.example.com, got %v", results)
+	}
+
+	// If none of the perspective servers can be reached then that is an
+	// error.
+	fetcher.Perspectives = fetcher.Perspectives[:1]
+	if _, err = fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{goodReq: 1000}); err == nil {
+		t.Errorf("FetchKeys: wanted an error when no perspective server can be reached")
+	}
+}
+
+// testCountingTransport counts the requests made through the transport and
+// records the bodies of the requests.
+type testCountingTransport struct {
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	bodies    [][]byte
+}
+
+func (t *testCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	t.bodies = append(t.bodies, body)
+	t.mutex.Unlock()
+	return t.transport.RoundTrip(req)
+}
+
+func TestPerspectiveKeyFetcherMinimumValidUntilTS(t *testing.T) {
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The notary only has a copy of the key that is valid until 2000.
+	keys := testPerspectiveKeys(t, "a.example.com", publicKey, privateKey, "notary.example.com", notaryPrivateKey)
+	message, err := SignJSON("a.example.com", "ed25519:1", privateKey, []byte(`{"foo":"bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(mode KeyValidityMode, atTS Timestamp) (VerifyJSONResult, []byte) {
+		transport := &testCountingTransport{transport: testNotaryTransport{"notary.example.com": {keys}}}
+		keyRing := KeyRing{
+			KeyFetchers: []KeyFetcher{&PerspectiveKeyFetcher{
+				PerspectiveServerName: "notary.example.com",
+				PerspectiveServerKeys: map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey},
+				Client:                *NewClientWithTransport(transport),
+				KeyValidity:           mode,
+			}},
+			KeyValidity: mode,
+		}
+		results, err := keyRing.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+			{ServerName: "a.example.com", AtTS: atTS, Message: message},
+		})
+		if err != nil {
+			t.Fatalf("VerifyJSONs: unexpected error: %v", err)
+		}
+		if len(transport.bodies) != 1 {
+			t.Fatalf("VerifyJSONs: wanted 1 query to the notary, got %d", len(transport.bodies))
+		}
+		return results[0], transport.bodies[0]
+	}
+
+	// The timestamp of the message is asked for as the minimum validity.
+	result, body := verify(KeyValidityStrict, 1000)
+	if result.Error != nil {
+		t.Errorf("VerifyJSONs: unexpected error for a key valid at the time: %v", result.Error)
+	}
+	want := `{"server_keys":{"a.example.com":{"ed25519:1":{"minimum_valid_until_ts":1000}}}}`
+	if string(body) != want {
+		t.Errorf("VerifyJSONs: got query %s, want %s", body, want)
+	}
+
+	// A key that isn't valid until the time asked for is treated as missing.
+	result, _ = verify(KeyValidityStrict, 3000)
+	if _, ok := result.Error.(KeyNotFoundError); !ok {
+		t.Errorf("VerifyJSONs: wanted a KeyNotFoundError for a key that is too old, got %v", result.Error)
+	}
+	result, _ = verify(KeyValidityLenient, 3000)
+	if result.Error != nil {
+		t.Errorf("VerifyJSONs: unexpected error in lenient mode: %v", result.Error)
+	}
+}
+
+func TestPerspectiveKeyFetcherBatchWindow(t *testing.T) {
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []ServerName{"a.example.com", "b.example.com", "unknown.example.com"}
+	var keys []json.RawMessage
+	for _, serverName := range servers[:2] {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, testPerspectiveKeys(t, serverName, publicKey, privateKey, "notary.example.com", notaryPrivateKey))
+	}
+	transport := &testCountingTransport{transport: testNotaryTransport{"notary.example.com": keys}}
+	fetcher := &PerspectiveKeyFetcher{
+		PerspectiveServerName: "notary.example.com",
+		PerspectiveServerKeys: map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey},
+		Client:                *NewClientWithTransport(transport),
+		BatchWindow:           200 * time.Millisecond,
+	}
+
+	// Concurrent calls for the keys of different servers share one query.
+	results := make([]map[PublicKeyLookupRequest]PublicKeyLookupResult, len(servers))
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, serverName := range servers {
+		wg.Add(1)
+		go func(i int, req PublicKeyLookupRequest) {
+			defer wg.Done()
+			results[i], errs[i] = fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 1000})
+		}(i, PublicKeyLookupRequest{serverName, "ed25519:1"})
+	}
+	wg.Wait()
+	if len(transport.bodies) != 1 {
+		t.Fatalf("FetchKeys: wanted 1 query to the notary, got %d", len(transport.bodies))
+	}
+	var query struct {
+		ServerKeys map[ServerName]map[KeyID]json.RawMessage `json:"server_keys"`
+	}
+	if err = json.Unmarshal(transport.bodies[0], &query); err != nil {
+		t.Fatal(err)
+	}
+	if len(query.ServerKeys) != len(servers) {
+		t.Errorf("FetchKeys: wanted the query to ask for the keys of %d servers, got %s", len(servers), transport.bodies[0])
+	}
+
+	// Each call gets the keys it asked for, and the key that the notary
+	// didn't return is left for another fetcher.
+	for i, serverName := range servers {
+		if errs[i] != nil {
+			t.Fatalf("FetchKeys: unexpected error for %s: %v", serverName, errs[i])
+		}
+		_, ok := results[i][PublicKeyLookupRequest{serverName, "ed25519:1"}]
+		wantKeys := 1
+		if serverName == "unknown.example.com" {
+			wantKeys = 0
+		}
+		if len(results[i]) != wantKeys || ok != (wantKeys == 1) {
+			t.Errorf("FetchKeys: got %v for %s, wanted %d keys", results[i], serverName, wantKeys)
+		}
+	}
+}
+
+func TestPerspectiveKeyFetcherBatchWindowCancel(t *testing.T) {
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testPerspectiveKeys(t, "a.example.com", publicKey, privateKey, "notary.example.com", notaryPrivateKey)
+	fetcher := &PerspectiveKeyFetcher{
+		PerspectiveServerName: "notary.example.com",
+		PerspectiveServerKeys: map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey},
+		Client:                *NewClientWithTransport(testNotaryTransport{"notary.example.com": {keys}}),
+		BatchWindow:           200 * time.Millisecond,
+	}
+
+	// A call that gives up waiting for the batch doesn't fail the other
+	// calls in it, whichever call started the batch.
+	req := PublicKeyLookupRequest{"a.example.com", "ed25519:1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	var cancelledErr, err2 error
+	var results map[PublicKeyLookupRequest]PublicKeyLookupResult
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, cancelledErr = fetcher.FetchKeys(ctx, map[PublicKeyLookupRequest]Timestamp{req: 1000})
+	}()
+	go func() {
+		defer wg.Done()
+		results, err2 = fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 1000})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	if cancelledErr != context.Canceled {
+		t.Errorf("FetchKeys: wanted %v for the cancelled call, got %v", context.Canceled, cancelledErr)
+	}
+	if err2 != nil {
+		t.Fatalf("FetchKeys: unexpected error: %v", err2)
+	}
+	if _, ok := results[req]; !ok {
+		t.Errorf("FetchKeys: wanted the key of a.example.com, got %v", results)
+	}
+
+	// Copies of the fetcher are still usable.
+	fetcherCopy := *fetcher
+	if name := fetcherCopy.FetcherName(); name != "perspective server notary.example.com" {
+		t.Errorf("FetcherName: got %q", name)
+	}
+}
+
+// testKeyServerTransport answers requests for the keys of a server with the
+// given key object, after failing the first failures requests with the
+// status code, and counts the requests. If release isn't nil then requests
+// wait for it to be closed.
+type testKeyServerTransport struct {
+	keys     []byte
+	failures int
+	status   int
+	release  chan struct{}
+	mutex    sync.Mutex
+	requests int
+}
+
+func (t *testKeyServerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.release != nil {
+		<-t.release
+	}
+	t.mutex.Lock()
+	t.requests++
+	status, body := http.StatusOK, t.keys
+	if t.requests <= t.failures {
+		status, body = t.status, []byte(`{}`)
+	}
+	t.mutex.Unlock()
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+type testKeyCacheMetrics struct {
+	mutex        sync.Mutex
+	hits, misses int
+}
+
+func (m *testKeyCacheMetrics) CacheHit(serverName ServerName) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hits++
+}
+
+func (m *testKeyCacheMetrics) CacheMiss(serverName ServerName) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.misses++
+}
+
+// testSelfSignedKeys returns a key object for example.com that is valid
+// until the timestamp.
+func testSelfSignedKeys(t *testing.T, validUntilTS Timestamp) []byte {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := json.Marshal(map[string]interface{}{
+		"server_name":    "example.com",
+		"valid_until_ts": validUntilTS,
+		"verify_keys": map[string]interface{}{
+			"ed25519:1": map[string]interface{}{"key": Base64String(publicKey)},
+		},
+		"old_verify_keys": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignJSON("example.com", "ed25519:1", privateKey, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// testSlowKeyServerTransport answers requests for the keys of each server
+// with the key object given for it, after waiting for the delay given for
+// it or until the request is cancelled.
+type testSlowKeyServerTransport struct {
+	keys  map[ServerName][]byte
+	delay map[ServerName]time.Duration
+}
+
+func (t testSlowKeyServerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverName := ServerName(req.URL.Host)
+	select {
+	case <-time.After(t.delay[serverName]):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	keys, ok := t.keys[serverName]
+	if !ok {
+		return nil, fmt.Errorf("unexpected request to %s", req.URL)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(keys)),
+		Request:    req,
+	}, nil
+}
+
+func TestVerifyJSONsFetchTimeout(t *testing.T) {
+	now := time.Now()
+	transport := testSlowKeyServerTransport{
+		keys:  map[ServerName][]byte{},
+		delay: map[ServerName]time.Duration{"slow.example.com": time.Minute},
+	}
+	var requests []VerifyJSONRequest
+	for _, serverName := range []ServerName{"fast.example.com", "slow.example.com"} {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := LocalServerKeys(serverName, "ed25519:1", publicKey, now.Add(time.Hour), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, err = SignServerKeys(keys, "ed25519:1", privateKey); err != nil {
+			t.Fatal(err)
+		}
+		transport.keys[serverName] = keys.Raw
+		message, err := SignJSON(string(serverName), "ed25519:1", privateKey, []byte(`{"content":"hello"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, VerifyJSONRequest{ServerName: serverName, Message: message, AtTS: AsTimestamp(now)})
+	}
+	fetcher := &DirectKeyFetcher{
+		Client:       *NewClientWithTransport(transport),
+		MaxAttempts:  1,
+		FetchTimeout: 50 * time.Millisecond,
+	}
+	cache := &KeyFetchFailureCache{}
+	k := KeyRing{KeyFetchers: []KeyFetcher{fetcher}, FailureCache: cache}
+
+	// The message from the fast server is verified without waiting for the
+	// slow server, and the message from the slow server fails with a
+	// timeout that is recorded in the failure cache.
+	start := time.Now()
+	results, err := k.VerifyJSONs(context.Background(), requests)
+	if err != nil {
+		t.Fatalf("VerifyJSONs: unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("VerifyJSONs: took %s, wanted it to give up on the slow server", elapsed)
+	}
+	if results[0].Error != nil {
+		t.Errorf("VerifyJSONs: unexpected error for the fast server: %v", results[0].Error)
+	}
+	want := KeyFetchTimeoutError{"slow.example.com", 50 * time.Millisecond}
+	if results[1].Error != want {
+		t.Errorf("VerifyJSONs: got %v for the slow server, want %v", results[1].Error, want)
+	}
+	if len(results[1].Signatures) != 1 || results[1].Signatures[0].Error != want {
+		t.Errorf("VerifyJSONs: got signatures %v for the slow server, want %v", results[1].Signatures, want)
+	}
+	if err := cache.checkFailed(PublicKeyLookupRequest{"slow.example.com", "ed25519:1"}); err == nil {
+		t.Errorf("VerifyJSONs: wanted the timeout to be recorded in the failure cache")
+	}
+
+	// If every server times out then that is the error.
+	_, err = fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{
+		{"slow.example.com", "ed25519:2"}: AsTimestamp(now),
+	})
+	if err != want {
+		t.Errorf("FetchKeys: got error %v, want %v", err, want)
+	}
+
+	// Perspective servers that don't answer in time are given up on too.
+	perspectiveFetcher := &PerspectiveKeyFetcher{
+		PerspectiveServerName: "slow.example.com",
+		Client:                *NewClientWithTransport(transport),
+		FetchTimeout:          50 * time.Millisecond,
+	}
+	_, err = perspectiveFetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{
+		{"fast.example.com", "ed25519:1"}: AsTimestamp(now),
+	})
+	if err != want {
+		t.Errorf("PerspectiveKeyFetcher.FetchKeys: got error %v, want %v", err, want)
+	}
+}
+
+func TestKeyRingOldVerifyKeys(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	rotatedAt := AsTimestamp(now.Add(-10 * 24 * time.Hour))
+	oldPublic, oldPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPublic, newPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := json.Marshal(map[string]interface{}{
+		"server_name":    "example.com",
+		"valid_until_ts": AsTimestamp(now.Add(24 * time.Hour)),
+		"verify_keys": map[string]interface{}{
+			"ed25519:new": map[string]interface{}{"key": Base64String(newPublic)},
+		},
+		"old_verify_keys": map[string]interface{}{
+			"ed25519:old": map[string]interface{}{"key": Base64String(oldPublic), "expired_ts": rotatedAt},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := SignJSON("example.com", "ed25519:new", newPrivate, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(keyID KeyID, privateKey ed25519.PrivateKey) []byte {
+		message, err := SignJSON("example.com", keyID, privateKey, []byte(`{"content":"hello"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	signedOld, signedNew := sign("ed25519:old", oldPrivate), sign("ed25519:new", newPrivate)
+
+	db := NewInMemoryKeyDatabase(nil)
+	k := KeyRing{
+		KeyFetchers: []KeyFetcher{&DirectKeyFetcher{
+			Client: *NewClientWithTransport(&testKeyServerTransport{keys: keys}),
+			Clock:  ClockFunc(func() time.Time { return now }),
+		}},
+		KeyDatabase: db,
+	}
+	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+		{ServerName: "example.com", Message: signedOld, AtTS: rotatedAt - 1000},
+		{ServerName: "example.com", Message: signedOld, AtTS: rotatedAt + 1000},
+		{ServerName: "example.com", Message: signedNew, AtTS: rotatedAt + 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The old key verifies messages from before the rotation but not after.
+	if results[0].Error != nil {
+		t.Errorf("VerifyJSONs: wanted the old key to verify a message from before it expired, got %v", results[0].Error)
+	}
+	if _, ok := results[1].Error.(KeyExpiredError); !ok {
+		t.Errorf("VerifyJSONs: wanted a KeyExpiredError for the old key after it expired, got %v", results[1].Error)
+	}
+	if results[2].Error != nil {
+		t.Errorf("VerifyJSONs: wanted the new key to verify, got %v", results[2].Error)
+	}
+
+	// The old key is stored with its expiry, so it isn't fetched again.
+	stored, err := db.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{{"example.com", "ed25519:old"}: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored[PublicKeyLookupRequest{"example.com", "ed25519:old"}]; got.ExpiredTS != rotatedAt {
+		t.Errorf("VerifyJSONs: wanted the old key to be stored expiring at %d, got %+v", rotatedAt, got)
+	}
+	k.KeyFetchers = nil
+	results, err = k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+		{ServerName: "example.com", Message: signedOld, AtTS: rotatedAt - 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Errorf("VerifyJSONs: wanted the stored old key to verify, got %v", results[0].Error)
+	}
+}
+
+func TestDirectKeyFetcherCachesKeys(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	transport := &testKeyServerTransport{keys: testSelfSignedKeys(t, AsTimestamp(now.Add(30*24*time.Hour)))}
+	metrics := &testKeyCacheMetrics{}
+	fetcher := &DirectKeyFetcher{
+		Client:  *NewClientWithTransport(transport),
+		Metrics: metrics,
+		Clock:   ClockFunc(func() time.Time { return now }),
+	}
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	fetch := func(ts Timestamp) {
+		results, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: ts})
+		if err != nil {
+			t.Fatalf("FetchKeys: unexpected error: %v", err)
+		}
+		if _, ok := results[req]; !ok {
+			t.Fatalf("FetchKeys: wanted a key for %v, got %v", req, results)
+		}
+	}
+
+	fetch(AsTimestamp(now))
+	fetch(AsTimestamp(now.Add(time.Hour)))
+	if transport.requests != 1 || metrics.hits != 1 || metrics.misses != 1 {
+		t.Errorf("FetchKeys: wanted 1 request, 1 hit and 1 miss, got %d, %d and %d",
+			transport.requests, metrics.hits, metrics.misses)
+	}
+
+	// The keys are valid for 30 days, but are only cached for 7.
+	now = now.Add(8 * 24 * time.Hour)
+	fetch(AsTimestamp(now))
+	if transport.requests != 2 {
+		t.Errorf("FetchKeys: wanted the keys to be fetched again after 7 days, got %d requests", transport.requests)
+	}
+}
+
+func TestDirectKeyFetcherCoalescesFetches(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	transport := &testKeyServerTransport{
+		keys:    testSelfSignedKeys(t, AsTimestamp(now.Add(24*time.Hour))),
+		release: make(chan struct{}),
+	}
+	fetcher := &DirectKeyFetcher{
+		Client: *NewClientWithTransport(transport),
+		Clock:  ClockFunc(func() time.Time { return now }),
+	}
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: AsTimestamp(now)})
+			errs <- err
+		}()
+	}
+	close(transport.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("FetchKeys: unexpected error: %v", err)
+		}
+	}
+	if transport.requests != 1 {
+		t.Errorf("FetchKeys: wanted the concurrent fetches to share 1 request, got %d", transport.requests)
+	}
+}
+
+func TestDirectKeyFetcherRetries(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	keys := testSelfSignedKeys(t, AsTimestamp(now.Add(24*time.Hour)))
+	req := PublicKeyLookupRequest{"example.com", "ed25519:1"}
+	for _, test := range []struct {
+		failures, status int
+		wantRequests     int
+		wantErr          bool
+	}{
+		{2, http.StatusServiceUnavailable, 3, false},
+		{3, http.StatusBadGateway, 3, true},
+		{1, http.StatusNotFound, 1, true},
+	} {
+		transport := &testKeyServerTransport{keys: keys, failures: test.failures, status: test.status}
+		fetcher := &DirectKeyFetcher{
+			Client:       *NewClientWithTransport(transport),
+			RetryBackoff: time.Millisecond,
+			Clock:        ClockFunc(func() time.Time { return now }),
+		}
+		_, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: AsTimestamp(now)})
+		if (err != nil) != test.wantErr {
+			t.Errorf("FetchKeys: %d failures with %d: got error %v, wanted error %v", test.failures, test.status, err, test.wantErr)
+		}
+		if transport.requests != test.wantRequests {
+			t.Errorf("FetchKeys: %d failures with %d: got %d requests, want %d", test.failures, test.status, transport.requests, test.wantRequests)
+		}
+	}
+}
@@ -17,8 +17,12 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 // ServerKeys are the ed25519 signing keys published by a matrix server.
@@ -78,16 +82,235 @@ func (keys ServerKeys) MarshalJSON() ([]byte, error) {
 }
 
 // PublicKey returns a public key with the given ID valid at the given TS or nil if no such key exists.
+// An old key is valid for messages signed before it expired, like PublicKeyLookupResult.WasValidAt.
 func (keys ServerKeys) PublicKey(keyID KeyID, atTS Timestamp) []byte {
 	if currentKey, ok := keys.VerifyKeys[keyID]; ok && (atTS <= keys.ValidUntilTS) {
 		return currentKey.Key
 	}
-	if oldKey, ok := keys.OldVerifyKeys[keyID]; ok && (atTS <= oldKey.ExpiredTS) {
+	if oldKey, ok := keys.OldVerifyKeys[keyID]; ok && (atTS < oldKey.ExpiredTS) {
 		return oldKey.Key
 	}
 	return nil
 }
 
+// Check that the keys are valid at the given time, which is a Timestamp in
+// milliseconds like the ValidUntilTS it is compared with: that the response
+// hasn't expired, that the server has at least one ed25519 key, and that every
+// ed25519 key it advertises is a valid key that has signed the response.
+// This should be checked before any of the keys are used to verify
+// signatures, since a response signed by the keys it advertises proves that
+// the server holds the private keys.
+// Returns an error describing the first check that failed.
+func (keys ServerKeys) Check(now Timestamp) error {
+	checks, _ := CheckKeys(keys.ServerName, now.Time(), keys)
+	if checks.AllChecksOK {
+		return nil
+	}
+	if !checks.FutureValidUntilTS {
+		return fmt.Errorf(
+			"gomatrixserverlib: keys for %q expired at %d, before %d",
+			keys.ServerName, keys.ValidUntilTS, now,
+		)
+	}
+	if !checks.HasEd25519Key {
+		return fmt.Errorf("gomatrixserverlib: keys for %q have no ed25519 keys", keys.ServerName)
+	}
+	keyIDs := make([]string, 0, len(checks.Ed25519Checks))
+	for keyID := range checks.Ed25519Checks {
+		keyIDs = append(keyIDs, string(keyID))
+	}
+	sort.Strings(keyIDs)
+	for _, keyID := range keyIDs {
+		entry := checks.Ed25519Checks[KeyID(keyID)]
+		if !entry.ValidEd25519 {
+			return fmt.Errorf("gomatrixserverlib: key %q for %q is not a valid ed25519 key", keyID, keys.ServerName)
+		}
+		if !entry.MatchingSignature {
+			return fmt.Errorf("gomatrixserverlib: keys for %q are not signed by key %q", keys.ServerName, keyID)
+		}
+	}
+	return fmt.Errorf("gomatrixserverlib: keys for %q are not valid", keys.ServerName)
+}
+
+// defaultLocalKeyValidityPeriod is how long the keys built by
+// LocalServerKeys are valid for if no time is given.
+const defaultLocalKeyValidityPeriod = 24 * time.Hour
+
+// LocalServerKeys builds the keys that a server publishes at
+// /_matrix/key/v2/server, with the public key of the ed25519 key that it
+// signs with now and the old keys that it used to sign with, which must have
+// their ExpiredTS set. The keys are valid until validUntil, which defaults
+// to a day from now if it is zero. Other servers won't treat the keys as
+// valid for more than a week after fetching them, so validUntil is capped
+// to a week from now. The keys must be signed with SignServerKeys before
+// they are served.
+// Returns an error if a key ID isn't a valid ed25519 key ID, or if a key
+// isn't a valid ed25519 public key.
+func LocalServerKeys(
+	serverName ServerName, keyID KeyID, publicKey ed25519.PublicKey, validUntil time.Time,
+	oldKeys map[KeyID]OldVerifyKey,
+) (ServerKeys, error) {
+	if err := checkLocalKey(keyID, publicKey); err != nil {
+		return ServerKeys{}, err
+	}
+	now := WallClock.Now()
+	if validUntil.IsZero() {
+		validUntil = now.Add(defaultLocalKeyValidityPeriod)
+	}
+	if maxValidUntil := now.Add(maxKeyValidityPeriod); validUntil.After(maxValidUntil) {
+		validUntil = maxValidUntil
+	}
+	fields := ServerKeyFields{
+		ServerName:      serverName,
+		TLSFingerprints: []TLSFingerprint{},
+		VerifyKeys:      map[KeyID]VerifyKey{keyID: {Key: Base64String(publicKey)}},
+		ValidUntilTS:    AsTimestamp(validUntil),
+		OldVerifyKeys:   map[KeyID]OldVerifyKey{},
+	}
+	for oldKeyID, oldKey := range oldKeys {
+		if oldKeyID == keyID {
+			return ServerKeys{}, fmt.Errorf("gomatrixserverlib: key %q is both a current and an old key", keyID)
+		}
+		if err := checkLocalKey(oldKeyID, ed25519.PublicKey(oldKey.Key)); err != nil {
+			return ServerKeys{}, err
+		}
+		if oldKey.ExpiredTS == PublicKeyNotExpired {
+			return ServerKeys{}, fmt.Errorf("gomatrixserverlib: old key %q has no expired_ts", oldKeyID)
+		}
+		fields.OldVerifyKeys[oldKeyID] = oldKey
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	return ServerKeys{Raw: raw, ServerKeyFields: fields}, nil
+}
+
+// checkLocalKey checks that the key ID is an ed25519 key ID and that the
+// key is an ed25519 public key.
+func checkLocalKey(keyID KeyID, publicKey ed25519.PublicKey) error {
+	algorithm, _, err := ParseKeyID(string(keyID))
+	if err != nil {
+		return err
+	}
+	if algorithm != "ed25519" {
+		return fmt.Errorf("gomatrixserverlib: key %q is not an ed25519 key", keyID)
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("gomatrixserverlib: key %q is not a valid ed25519 public key", keyID)
+	}
+	return nil
+}
+
+// SignServerKeys signs the keys of our server, as built by LocalServerKeys,
+// with our ed25519 private key, returning a copy of the keys that is ready
+// to be marshalled and served. The keys should be signed with each of the
+// keys in VerifyKeys, since other servers check that every current key has
+// signed them.
+func SignServerKeys(keys ServerKeys, keyID KeyID, privateKey ed25519.PrivateKey) (ServerKeys, error) {
+	return signServerKeys(keys, keys.ServerName, keyID, privateKey)
+}
+
+// NotarySignServerKeys adds the signature of our notary server to the keys
+// of another server, for responses to /_matrix/key/v2/query. The keys are
+// signed as they are, keeping the signatures of the other server, so the
+// keys must have been decoded from the JSON that the other server served.
+// Returns a copy of the keys that is ready to be marshalled and served.
+func NotarySignServerKeys(
+	keys ServerKeys, notary ServerName, keyID KeyID, privateKey ed25519.PrivateKey,
+) (ServerKeys, error) {
+	if len(keys.Raw) == 0 {
+		return ServerKeys{}, fmt.Errorf("gomatrixserverlib: keys for %q have no JSON to sign", keys.ServerName)
+	}
+	return signServerKeys(keys, notary, keyID, privateKey)
+}
+
+// signServerKeys signs the JSON of the keys as the signing name, adding to
+// the existing signatures.
+func signServerKeys(
+	keys ServerKeys, signingName ServerName, keyID KeyID, privateKey ed25519.PrivateKey,
+) (ServerKeys, error) {
+	raw := keys.Raw
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(keys.ServerKeyFields); err != nil {
+			return ServerKeys{}, err
+		}
+	}
+	signed, err := SignJSON(string(signingName), keyID, privateKey, raw)
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	var result ServerKeys
+	if err = json.Unmarshal(signed, &result); err != nil {
+		return ServerKeys{}, err
+	}
+	return result, nil
+}
+
+// RespKeyQuery is the content of a response to POST /_matrix/key/v2/query,
+// which a notary server answers with the keys it has for other servers.
+// See https://matrix.org/docs/spec/server_server/r0.1.3.html#post-matrix-key-v2-query
+type RespKeyQuery struct {
+	// The keys for each of the servers, as returned by each server and
+	// countersigned by the notary server.
+	ServerKeys []ServerKeys `json:"server_keys"`
+}
+
+// Check checks that each of the key objects in a response from the notary
+// server passes ServerKeys.Check at the given time, so was signed by its own
+// server, and was also signed by the notary server using one of the
+// notaryKeys. The response doesn't carry the notary's own keys, so the
+// notary's signatures can only be verified with keys that were fetched from
+// the notary server separately, and trusting keys that the notary vouches
+// for itself would let it sign with any key. Signatures by notary keys that
+// aren't in notaryKeys are ignored, but every known notary key that signed
+// a key object must have signed it correctly.
+// Returns an error describing the first check that failed.
+func (r RespKeyQuery) Check(now Timestamp, notary ServerName, notaryKeys map[KeyID]ed25519.PublicKey) error {
+	for _, keys := range r.ServerKeys {
+		if err := keys.Check(now); err != nil {
+			return err
+		}
+		if err := checkNotarySignature(keys, notary, notaryKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNotarySignature checks that the keys were signed by the notary server
+// using one of the notaryKeys, and that every known notary key that signed
+// them signed them correctly.
+func checkNotarySignature(keys ServerKeys, notary ServerName, notaryKeys map[KeyID]ed25519.PublicKey) error {
+	keyIDs, err := ListKeyIDs(string(notary), keys.Raw)
+	if err != nil {
+		return err
+	}
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] < keyIDs[j] })
+	signed := false
+	for _, keyID := range keyIDs {
+		notaryKey, ok := notaryKeys[keyID]
+		if !ok {
+			continue
+		}
+		if err = VerifyJSON(string(notary), keyID, notaryKey, keys.Raw); err != nil {
+			return fmt.Errorf(
+				"gomatrixserverlib: keys for %q are not signed by notary key %q of %q: %s",
+				keys.ServerName, keyID, notary, err.Error(),
+			)
+		}
+		signed = true
+	}
+	if !signed {
+		return fmt.Errorf(
+			"gomatrixserverlib: keys for %q are not signed by a known key of notary %q",
+			keys.ServerName, notary,
+		)
+	}
+	return nil
+}
+
 // Ed25519Checks are the checks that are applied to Ed25519 keys in ServerKey responses.
 type Ed25519Checks struct {
 	ValidEd25519      bool // The verify key is valid Ed25519 keys.
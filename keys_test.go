@@ -0,0 +1,335 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func testServerKeys(t *testing.T, keysJSON string) ServerKeys {
+	var keys ServerKeys
+	if err := json.Unmarshal([]byte(keysJSON), &keys); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// testSignedServerKeys returns keys for "example.com" advertising the public
+// key, with the response signed by the private key.
+func testSignedServerKeys(t *testing.T, publicKey ed25519.PublicKey, privateKey ed25519.PrivateKey) ServerKeys {
+	unsigned, err := json.Marshal(map[string]interface{}{
+		"server_name":    "example.com",
+		"valid_until_ts": 2000,
+		"verify_keys": map[string]interface{}{
+			"ed25519:1": map[string]interface{}{"key": Base64String(publicKey)},
+		},
+		"old_verify_keys": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignJSON("example.com", "ed25519:1", privateKey, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testServerKeys(t, string(signed))
+}
+
+func TestServerKeysCheck(t *testing.T) {
+	keys := testServerKeys(t, testKeys)
+	if err := keys.Check(1493142432963); err != nil {
+		t.Fatalf("ServerKeys.Check: unexpected error for valid keys: %s", err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testSignedServerKeys(t, publicKey, privateKey).Check(1000); err != nil {
+		t.Fatalf("ServerKeys.Check: unexpected error for valid keys: %s", err)
+	}
+}
+
+func TestServerKeysCheckExpired(t *testing.T) {
+	keys := testServerKeys(t, testKeys)
+	for _, now := range []Timestamp{1493142432964, 1493142432965} {
+		err := keys.Check(now)
+		if err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Errorf("ServerKeys.Check(%d): want an expired error, got %v", now, err)
+		}
+	}
+}
+
+func TestServerKeysCheckWronglySigned(t *testing.T) {
+	// The response has been changed since it was signed.
+	keys := testServerKeys(t, strings.Replace(
+		testKeys, "I2ohBnqpb5m3HldWFwyA10WdjqDksukiKVUdZ690WzM", "AAAhBnqpb5m3HldWFwyA10WdjqDksukiKVUdZ690WzM", 1,
+	))
+	err := keys.Check(1000)
+	if err == nil || !strings.Contains(err.Error(), `not signed by key "ed25519:a_Obwu"`) {
+		t.Errorf("ServerKeys.Check: want a signature error for a changed response, got %v", err)
+	}
+
+	// The response is signed by a different key to the one it advertises.
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testSignedServerKeys(t, publicKey, otherPrivateKey).Check(1000)
+	if err == nil || !strings.Contains(err.Error(), `not signed by key "ed25519:1"`) {
+		t.Errorf("ServerKeys.Check: want a signature error for keys signed by another key, got %v", err)
+	}
+
+	// The advertised key isn't a valid ed25519 key.
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testSignedServerKeys(t, publicKey[:16], privateKey).Check(1000)
+	if err == nil || !strings.Contains(err.Error(), "not a valid ed25519 key") {
+		t.Errorf("ServerKeys.Check: want an invalid key error, got %v", err)
+	}
+}
+
+// testNotaryKeyQuery returns a notary response for "notary.example.com"
+// containing keys for "example.com", countersigned by the notary's key.
+func testNotaryKeyQuery(t *testing.T, notaryKeyID KeyID, notaryPrivateKey ed25519.PrivateKey) RespKeyQuery {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testSignedServerKeys(t, publicKey, privateKey)
+	cosigned, err := SignJSON("notary.example.com", notaryKeyID, notaryPrivateKey, keys.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response RespKeyQuery
+	if err = json.Unmarshal([]byte(`{"server_keys":[`+string(cosigned)+`]}`), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestServerKeysPublicKeyOldKeys(t *testing.T) {
+	keys := testServerKeys(t, `{
+		"server_name": "example.com",
+		"valid_until_ts": 2000,
+		"verify_keys": {"ed25519:new": {"key": "bmV3"}, "ed25519:both": {"key": "Ym90aA"}},
+		"old_verify_keys": {
+			"ed25519:old": {"key": "b2xk", "expired_ts": 1000},
+			"ed25519:both": {"key": "b2xk", "expired_ts": 1000}
+		}
+	}`)
+	for _, test := range []struct {
+		keyID KeyID
+		atTS  Timestamp
+		want  string
+	}{
+		{"ed25519:old", 999, "old"},
+		{"ed25519:old", 1000, ""},
+		{"ed25519:new", 1000, "new"},
+		{"ed25519:new", 2001, ""},
+		{"ed25519:both", 1500, "both"},
+	} {
+		if got := string(keys.PublicKey(test.keyID, test.atTS)); got != test.want {
+			t.Errorf("PublicKey(%q, %d): got %q, want %q", test.keyID, test.atTS, got, test.want)
+		}
+	}
+}
+
+func TestRespKeyQueryCheck(t *testing.T) {
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notaryKeys := map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey}
+
+	response := testNotaryKeyQuery(t, "ed25519:notary", notaryPrivateKey)
+	if err = response.Check(1000, "notary.example.com", notaryKeys); err != nil {
+		t.Fatalf("RespKeyQuery.Check: unexpected error for cosigned keys: %s", err)
+	}
+
+	// The keys must still be valid for the server that they are for.
+	err = response.Check(2000, "notary.example.com", notaryKeys)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("RespKeyQuery.Check: want an expired error, got %v", err)
+	}
+
+	// The keys must be signed by the notary that was asked.
+	err = response.Check(1000, "other.example.com", notaryKeys)
+	if err == nil || !strings.Contains(err.Error(), `not signed by a known key of notary "other.example.com"`) {
+		t.Errorf("RespKeyQuery.Check: want an error for keys not signed by the notary, got %v", err)
+	}
+}
+
+func TestRespKeyQueryCheckWronglyCosigned(t *testing.T) {
+	notaryPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notaryKeys := map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey}
+
+	// Signatures by notary keys we don't know about aren't enough.
+	response := testNotaryKeyQuery(t, "ed25519:unknown", otherPrivateKey)
+	err = response.Check(1000, "notary.example.com", notaryKeys)
+	if err == nil || !strings.Contains(err.Error(), "not signed by a known key of notary") {
+		t.Errorf("RespKeyQuery.Check: want an error for keys signed by an unknown notary key, got %v", err)
+	}
+
+	// The response is signed by a different key to the notary key we know.
+	response = testNotaryKeyQuery(t, "ed25519:notary", otherPrivateKey)
+	err = response.Check(1000, "notary.example.com", notaryKeys)
+	if err == nil || !strings.Contains(err.Error(), `not signed by notary key "ed25519:notary"`) {
+		t.Errorf("RespKeyQuery.Check: want a signature error for keys signed by another key, got %v", err)
+	}
+}
+
+func TestLocalServerKeysRoundTrip(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPublicKey, oldPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rotatedAt := AsTimestamp(now.Add(-time.Hour))
+	keys, err := LocalServerKeys("example.com", "ed25519:new", publicKey, now.Add(time.Hour), map[KeyID]OldVerifyKey{
+		"ed25519:old": {VerifyKey{Base64String(oldPublicKey)}, rotatedAt},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = SignServerKeys(keys, "ed25519:new", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys pass the checks that other servers make.
+	var fetched ServerKeys
+	if err = json.Unmarshal(served, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if err = fetched.Check(AsTimestamp(now)); err != nil {
+		t.Fatalf("ServerKeys.Check: unexpected error for our own keys: %s", err)
+	}
+
+	// A KeyRing fetching the keys can verify messages signed with either key.
+	sign := func(keyID KeyID, privateKey ed25519.PrivateKey) []byte {
+		message, err := SignJSON("example.com", keyID, privateKey, []byte(`{"content":"hello"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	k := KeyRing{KeyFetchers: []KeyFetcher{&DirectKeyFetcher{
+		Client: *NewClientWithTransport(&testKeyServerTransport{keys: served}),
+	}}}
+	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{
+		{ServerName: "example.com", Message: sign("ed25519:new", privateKey), AtTS: AsTimestamp(now)},
+		{ServerName: "example.com", Message: sign("ed25519:old", oldPrivateKey), AtTS: rotatedAt - 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Error != nil {
+			t.Errorf("VerifyJSONs: unexpected error for message %d: %v", i, result.Error)
+		}
+	}
+
+	// A notary can countersign the keys without breaking our signature.
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notarised, err := NotarySignServerKeys(fetched, "notary.example.com", "ed25519:notary", notaryPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notaryKeys := map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey}
+	response := RespKeyQuery{ServerKeys: []ServerKeys{notarised}}
+	if err = response.Check(AsTimestamp(now), "notary.example.com", notaryKeys); err != nil {
+		t.Errorf("RespKeyQuery.Check: unexpected error for notarised keys: %s", err)
+	}
+}
+
+func TestLocalServerKeysValidity(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, test := range []struct {
+		validUntil time.Time
+		want       time.Duration
+	}{
+		{time.Time{}, defaultLocalKeyValidityPeriod},
+		{now.Add(time.Hour), time.Hour},
+		{now.Add(30 * 24 * time.Hour), maxKeyValidityPeriod},
+	} {
+		keys, err := LocalServerKeys("example.com", "ed25519:1", publicKey, test.validUntil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := keys.ValidUntilTS.Time().Sub(now)
+		if got < test.want-time.Minute || got > test.want+time.Minute {
+			t.Errorf("LocalServerKeys(%v): got keys valid for %s, want %s", test.validUntil, got, test.want)
+		}
+	}
+}
+
+func TestLocalServerKeysInvalid(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validUntil := time.Now().Add(time.Hour)
+	for _, test := range []struct {
+		keyID     KeyID
+		publicKey ed25519.PublicKey
+		oldKeys   map[KeyID]OldVerifyKey
+	}{
+		{"ed25519", publicKey, nil},
+		{"curve25519:1", publicKey, nil},
+		{"ed25519:1", publicKey[:16], nil},
+		{"ed25519:1", publicKey, map[KeyID]OldVerifyKey{"ed25519:old": {VerifyKey{Base64String(publicKey)}, 0}}},
+		{"ed25519:1", publicKey, map[KeyID]OldVerifyKey{"ed25519:1": {VerifyKey{Base64String(publicKey)}, 1000}}},
+	} {
+		if _, err := LocalServerKeys("example.com", test.keyID, test.publicKey, validUntil, test.oldKeys); err == nil {
+			t.Errorf("LocalServerKeys(%q, %v): wanted an error", test.keyID, test.oldKeys)
+		}
+	}
+}
@@ -51,8 +51,9 @@ func (r *RawJSON) UnmarshalJSON(data []byte) error {
 }
 
 // redactEvent strips the user controlled fields from an event, but leaves the
-// fields necessary for authenticating the event.
-func redactEvent(eventJSON []byte) ([]byte, error) {
+// fields necessary for authenticating the event. The fields that are kept
+// depend on the redaction algorithm of the room version.
+func redactEvent(eventJSON []byte, algorithm RedactionAlgorithm) ([]byte, error) { // nolint: gocyclo
 
 	// createContent keeps the fields needed in a m.room.create event.
 	// Create events need to keep the creator.
@@ -63,8 +64,10 @@ func redactEvent(eventJSON []byte) ([]byte, error) {
 
 	// joinRulesContent keeps the fields needed in a m.room.join_rules event.
 	// Join rules events need to keep the join_rule key.
+	// Since redaction algorithm v3 they also keep the allow conditions.
 	type joinRulesContent struct {
 		JoinRule RawJSON `json:"join_rule,omitempty"`
+		Allow    RawJSON `json:"allow,omitempty"`
 	}
 
 	// powerLevelContent keeps the fields needed in a m.room.power_levels event.
@@ -78,13 +81,18 @@ func redactEvent(eventJSON []byte) ([]byte, error) {
 		Ban           RawJSON `json:"ban,omitempty"`
 		Kick          RawJSON `json:"kick,omitempty"`
 		Redact        RawJSON `json:"redact,omitempty"`
+		Invite        RawJSON `json:"invite,omitempty"`
 	}
 
 	// memberContent keeps the fields needed in a m.room.member event.
 	// Member events keep the membership.
 	// (In an ideal world they would keep the third_party_invite see matrix-org/synapse#1831)
+	// Since redaction algorithm v4 they keep the user who authorised a
+	// restricted join, and since v5 the signed part of a third party invite.
 	type memberContent struct {
-		Membership RawJSON `json:"membership,omitempty"`
+		Membership                   RawJSON `json:"membership,omitempty"`
+		JoinAuthorisedViaUsersServer RawJSON `json:"join_authorised_via_users_server,omitempty"`
+		ThirdPartyInvite             RawJSON `json:"third_party_invite,omitempty"`
 	}
 
 	// aliasesContent keeps the fields needed in a m.room.aliases event.
@@ -99,6 +107,12 @@ func redactEvent(eventJSON []byte) ([]byte, error) {
 		HistoryVisibility RawJSON `json:"history_visibility,omitempty"`
 	}
 
+	// redactionContent keeps the fields needed in a m.room.redaction event.
+	// Since redaction algorithm v5 redaction events keep the redacts key.
+	type redactionContent struct {
+		Redacts RawJSON `json:"redacts,omitempty"`
+	}
+
 	// allContent keeps the union of all the content fields needed across all the event types.
 	// All the content JSON keys we are keeping are distinct across the different event types.
 	type allContent struct {
@@ -108,30 +122,32 @@ func redactEvent(eventJSON []byte) ([]byte, error) {
 		memberContent
 		aliasesContent
 		historyVisibilityContent
+		redactionContent
 	}
 
 	// eventFields keeps the top level keys needed by all event types.
 	// (In an ideal world they would include the "redacts" key for m.room.redaction events, see matrix-org/synapse#1831)
 	// See https://github.com/matrix-org/synapse/blob/v0.18.7/synapse/events/utils.py#L42-L56 for the list of fields
 	type eventFields struct {
-		EventID        RawJSON    `json:"event_id,omitempty"`
-		Sender         RawJSON    `json:"sender,omitempty"`
-		RoomID         RawJSON    `json:"room_id,omitempty"`
-		Hashes         RawJSON    `json:"hashes,omitempty"`
-		Signatures     RawJSON    `json:"signatures,omitempty"`
-		Content        allContent `json:"content"`
-		Type           string     `json:"type"`
-		StateKey       RawJSON    `json:"state_key,omitempty"`
-		Depth          RawJSON    `json:"depth,omitempty"`
-		PrevEvents     RawJSON    `json:"prev_events,omitempty"`
-		PrevState      RawJSON    `json:"prev_state,omitempty"`
-		AuthEvents     RawJSON    `json:"auth_events,omitempty"`
-		Origin         RawJSON    `json:"origin,omitempty"`
-		OriginServerTS RawJSON    `json:"origin_server_ts,omitempty"`
-		Membership     RawJSON    `json:"membership,omitempty"`
+		EventID        RawJSON     `json:"event_id,omitempty"`
+		Sender         RawJSON     `json:"sender,omitempty"`
+		RoomID         RawJSON     `json:"room_id,omitempty"`
+		Hashes         RawJSON     `json:"hashes,omitempty"`
+		Signatures     RawJSON     `json:"signatures,omitempty"`
+		Content        interface{} `json:"content"`
+		Type           string      `json:"type"`
+		StateKey       RawJSON     `json:"state_key,omitempty"`
+		Depth          RawJSON     `json:"depth,omitempty"`
+		PrevEvents     RawJSON     `json:"prev_events,omitempty"`
+		PrevState      RawJSON     `json:"prev_state,omitempty"`
+		AuthEvents     RawJSON     `json:"auth_events,omitempty"`
+		Origin         RawJSON     `json:"origin,omitempty"`
+		OriginServerTS RawJSON     `json:"origin_server_ts,omitempty"`
+		Membership     RawJSON     `json:"membership,omitempty"`
 	}
 
-	var event eventFields
+	var content allContent
+	event := eventFields{Content: &content}
 	// Unmarshalling into a struct will discard any extra fields from the event.
 	if err := json.Unmarshal(eventJSON, &event); err != nil {
 		return nil, err
@@ -141,21 +157,65 @@ func redactEvent(eventJSON []byte) ([]byte, error) {
 	// By default we copy nothing leaving the content object empty.
 	switch event.Type {
 	case MRoomCreate:
-		newContent.createContent = event.Content.createContent
+		newContent.createContent = content.createContent
 	case MRoomMember:
-		newContent.memberContent = event.Content.memberContent
+		newContent.Membership = content.Membership
+		if algorithm >= RedactionAlgorithmV4 {
+			newContent.JoinAuthorisedViaUsersServer = content.JoinAuthorisedViaUsersServer
+		}
+		if algorithm >= RedactionAlgorithmV5 {
+			var thirdPartyInvite struct {
+				Signed RawJSON `json:"signed,omitempty"`
+			}
+			// Third party invites that aren't objects are dropped.
+			if json.Unmarshal(content.ThirdPartyInvite, &thirdPartyInvite) == nil && thirdPartyInvite.Signed != nil {
+				var err error
+				if newContent.ThirdPartyInvite, err = json.Marshal(thirdPartyInvite); err != nil {
+					return nil, err
+				}
+			}
+		}
 	case MRoomJoinRules:
-		newContent.joinRulesContent = event.Content.joinRulesContent
+		newContent.JoinRule = content.JoinRule
+		if algorithm >= RedactionAlgorithmV3 {
+			newContent.Allow = content.Allow
+		}
 	case MRoomPowerLevels:
-		newContent.powerLevelContent = event.Content.powerLevelContent
+		newContent.powerLevelContent = content.powerLevelContent
+		if algorithm < RedactionAlgorithmV5 {
+			newContent.Invite = nil
+		}
 	case MRoomHistoryVisibility:
-		newContent.historyVisibilityContent = event.Content.historyVisibilityContent
+		newContent.historyVisibilityContent = content.historyVisibilityContent
 	case MRoomAliases:
-		newContent.aliasesContent = event.Content.aliasesContent
+		if algorithm < RedactionAlgorithmV2 {
+			newContent.aliasesContent = content.aliasesContent
+		}
+	case MRoomRedaction:
+		if algorithm >= RedactionAlgorithmV5 {
+			newContent.redactionContent = content.redactionContent
+		}
 	}
 	// Replace the content with our new filtered content.
 	// This will zero out any keys that weren't copied in the switch statement above.
 	event.Content = newContent
+	if algorithm >= RedactionAlgorithmV5 {
+		if event.Type == MRoomCreate {
+			// Create events keep all of their content.
+			var rawContent struct {
+				Content RawJSON `json:"content"`
+			}
+			if err := json.Unmarshal(eventJSON, &rawContent); err != nil {
+				return nil, err
+			}
+			if rawContent.Content != nil {
+				event.Content = rawContent.Content
+			}
+		}
+		event.Origin = nil
+		event.Membership = nil
+		event.PrevState = nil
+	}
 	// Return the redacted event encoded as JSON.
 	return json.Marshal(&event)
 }
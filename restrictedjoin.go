@@ -0,0 +1,123 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SelectJoinAuthoriser picks one of our users to name in the
+// "join_authorised_via_users_server" of a join to a restricted room, when
+// another server asks us to make_join for a user that can't join through
+// the other servers in the room. The state is the current state of the
+// room being joined, and allowRooms is the current state of the rooms
+// named by its allow conditions that we know about, by room ID.
+//
+// We can only authorise the join if we can tell whether the user is allowed
+// to join, so at least one of our users must be joined to one of the rooms
+// named by the "m.room_membership" allow conditions. The authoriser must then
+// be one of our users who is joined to the room being joined and has the
+// power to invite users to it, as the authorisation rules require. If more
+// than one of our users can authorise the join then the one with the highest
+// power level is picked, and then the one with the lowest user ID, so that
+// the same user is picked each time.
+//
+// Returns an error if the room doesn't have a restricted join rule, or if
+// none of our users can authorise the join.
+func SelectJoinAuthoriser(state RespState, allowRooms map[string]RespState, ourUsers []string) (string, error) {
+	joinRule, err := state.JoinRule()
+	if err != nil {
+		return "", err
+	}
+	if joinRule.JoinRule != Restricted && joinRule.JoinRule != KnockRestricted {
+		return "", fmt.Errorf("gomatrixserverlib: room has join rule %q, not a restricted join rule", joinRule.JoinRule)
+	}
+
+	inAllowedRoom := false
+	for _, condition := range joinRule.Allow {
+		if condition.Type != MRoomMembership {
+			continue
+		}
+		allowRoom, ok := allowRooms[condition.RoomID]
+		if !ok {
+			continue
+		}
+		joined := joinedMembers(allowRoom)
+		for _, userID := range ourUsers {
+			if joined[userID] {
+				inAllowedRoom = true
+			}
+		}
+	}
+	if !inAllowedRoom {
+		return "", fmt.Errorf("gomatrixserverlib: none of our users are joined to any of the rooms allowed by the join rule")
+	}
+
+	createEvent := findCreateEvent(state.StateEvents, nil)
+	if createEvent == nil {
+		return "", fmt.Errorf("gomatrixserverlib: no m.room.create event in the state of the room")
+	}
+	authEvents := NewAuthEventsWithCapacity(len(state.StateEvents))
+	for i := range state.StateEvents {
+		if state.StateEvents[i].StateKey() != nil {
+			authEvents.AddEvent(&state.StateEvents[i]) // nolint: errcheck
+		}
+	}
+	create, err := NewCreateContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return "", err
+	}
+	powerLevels, err := NewPowerLevelContentFromAuthEvents(&authEvents, create.Creator)
+	if err != nil {
+		return "", err
+	}
+
+	joined := joinedMembers(state)
+	var candidates []string
+	for _, userID := range ourUsers {
+		if joined[userID] && powerLevels.UserLevel(userID) >= powerLevels.Invite {
+			candidates = append(candidates, userID)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("gomatrixserverlib: none of our users are joined to the room with the power to invite")
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		levelI, levelJ := powerLevels.UserLevel(candidates[i]), powerLevels.UserLevel(candidates[j])
+		if levelI != levelJ {
+			return levelI > levelJ
+		}
+		return candidates[i] < candidates[j]
+	})
+	return candidates[0], nil
+}
+
+// joinedMembers returns the users that are joined to the room according to
+// the m.room.member events in the state. Events with invalid content are
+// ignored.
+func joinedMembers(state RespState) map[string]bool {
+	joined := map[string]bool{}
+	for _, event := range state.StateEvents {
+		if event.Type() != MRoomMember || event.StateKey() == nil {
+			continue
+		}
+		if content, err := NewMemberContentFromEvent(event); err == nil && content.Membership == Join {
+			joined[*event.StateKey()] = true
+		}
+	}
+	return joined
+}
@@ -0,0 +1,115 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"testing"
+)
+
+// testRoomState returns the state of a room made up of the events, given as
+// "type", "state_key" and "content", with the sender @creator:a.
+func testRoomState(t *testing.T, roomID string, events ...[3]string) RespState {
+	var state RespState
+	for i, e := range events {
+		state.StateEvents = append(state.StateEvents, testEventf(t, `{
+			"type": %q,
+			"state_key": %q,
+			"event_id": "$%d:a",
+			"room_id": %q,
+			"sender": "@creator:a",
+			"content": %s
+		}`, e[0], e[1], i, roomID, e[2]))
+	}
+	return state
+}
+
+func TestSelectJoinAuthoriser(t *testing.T) {
+	create := [3]string{MRoomCreate, "", `{"creator": "@creator:a"}`}
+	restricted := [3]string{MRoomJoinRules, "", `{
+		"join_rule": "restricted",
+		"allow": [{"type": "m.room_membership", "room_id": "!space:a"}]
+	}`}
+	powerLevels := [3]string{MRoomPowerLevels, "", `{"invite": 50, "users": {"@mod:b": 50, "@admin:b": 100, "@other:b": 100}}`}
+	joined := func(userID string) [3]string {
+		return [3]string{MRoomMember, userID, `{"membership": "join"}`}
+	}
+	left := func(userID string) [3]string {
+		return [3]string{MRoomMember, userID, `{"membership": "leave"}`}
+	}
+	space := map[string]RespState{"!space:a": testRoomState(t, "!space:a", create, joined("@user:b"))}
+
+	tests := []struct {
+		name       string
+		state      RespState
+		allowRooms map[string]RespState
+		ourUsers   []string
+		want       string
+	}{
+		{
+			"the user with the highest power level is picked",
+			testRoomState(t, "!room:a", create, restricted, powerLevels,
+				joined("@mod:b"), joined("@admin:b"), joined("@other:b"), joined("@user:b")),
+			space, []string{"@user:b", "@mod:b", "@other:b", "@admin:b"}, "@admin:b",
+		},
+		{
+			"users must be joined to the room",
+			testRoomState(t, "!room:a", create, restricted, powerLevels,
+				joined("@mod:b"), left("@admin:b"), joined("@user:b")),
+			space, []string{"@user:b", "@mod:b", "@admin:b"}, "@mod:b",
+		},
+		{
+			"without power levels only the creator can invite",
+			testRoomState(t, "!room:a", create, restricted, joined("@creator:a"), joined("@mod:b")),
+			map[string]RespState{"!space:a": testRoomState(t, "!space:a", create, joined("@creator:a"))},
+			[]string{"@creator:a", "@mod:b"}, "@creator:a",
+		},
+		{
+			"no user has the power to invite",
+			testRoomState(t, "!room:a", create, restricted, powerLevels, joined("@user:b")),
+			space, []string{"@user:b"}, "",
+		},
+		{
+			"none of our users are in an allowed room",
+			testRoomState(t, "!room:a", create, restricted, powerLevels, joined("@admin:b")),
+			space, []string{"@admin:b"}, "",
+		},
+		{
+			"we don't know the state of the allowed room",
+			testRoomState(t, "!room:a", create, restricted, powerLevels, joined("@admin:b"), joined("@user:b")),
+			nil, []string{"@admin:b", "@user:b"}, "",
+		},
+		{
+			"the room isn't restricted",
+			testRoomState(t, "!room:a", create, [3]string{MRoomJoinRules, "", `{"join_rule": "invite"}`},
+				powerLevels, joined("@admin:b"), joined("@user:b")),
+			space, []string{"@admin:b", "@user:b"}, "",
+		},
+	}
+	for _, test := range tests {
+		got, err := SelectJoinAuthoriser(test.state, test.allowRooms, test.ourUsers)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: SelectJoinAuthoriser: wanted an error, got %q", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: SelectJoinAuthoriser: unexpected error: %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: SelectJoinAuthoriser: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
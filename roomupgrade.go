@@ -0,0 +1,81 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CheckRoomUpgrade checks that a room upgrade is consistent across the old
+// and new rooms: the m.room.tombstone event in the old room must point at the
+// new room, the m.room.create event in the new room must name the tombstone
+// event and the old room as its predecessor, and both must have been sent by
+// the same user.
+// The tombstone event must already have been accepted into the old room, so
+// that the auth rules have checked that its sender had the power level needed
+// to send it. Servers should check the upgrade before applying its effects,
+// such as moving aliases to the new room.
+// https://matrix.org/docs/spec/client_server/r0.5.0#room-upgrades
+func CheckRoomUpgrade(oldRoomTombstone Event, newRoomCreate Event) error {
+	if oldRoomTombstone.Type() != MRoomTombstone || !oldRoomTombstone.StateKeyEquals("") {
+		return fmt.Errorf(
+			"gomatrixserverlib: event %q is not a m.room.tombstone state event",
+			oldRoomTombstone.EventID(),
+		)
+	}
+	if newRoomCreate.Type() != MRoomCreate || !newRoomCreate.StateKeyEquals("") {
+		return fmt.Errorf(
+			"gomatrixserverlib: event %q is not a m.room.create state event",
+			newRoomCreate.EventID(),
+		)
+	}
+
+	var tombstone TombstoneContent
+	if err := json.Unmarshal(oldRoomTombstone.Content(), &tombstone); err != nil {
+		return fmt.Errorf("gomatrixserverlib: unparsable tombstone event content: %s", err)
+	}
+	var create CreateContent
+	if err := json.Unmarshal(newRoomCreate.Content(), &create); err != nil {
+		return fmt.Errorf("gomatrixserverlib: unparsable create event content: %s", err)
+	}
+
+	if tombstone.ReplacementRoom != newRoomCreate.RoomID() {
+		return fmt.Errorf(
+			"gomatrixserverlib: tombstone replacement room %q doesn't match the new room %q",
+			tombstone.ReplacementRoom, newRoomCreate.RoomID(),
+		)
+	}
+	if create.Predecessor.RoomID != oldRoomTombstone.RoomID() {
+		return fmt.Errorf(
+			"gomatrixserverlib: create event predecessor room %q doesn't match the old room %q",
+			create.Predecessor.RoomID, oldRoomTombstone.RoomID(),
+		)
+	}
+	if create.Predecessor.EventID != oldRoomTombstone.EventID() {
+		return fmt.Errorf(
+			"gomatrixserverlib: create event predecessor event %q doesn't match the tombstone event %q",
+			create.Predecessor.EventID, oldRoomTombstone.EventID(),
+		)
+	}
+	if newRoomCreate.Sender() != oldRoomTombstone.Sender() {
+		return fmt.Errorf(
+			"gomatrixserverlib: create event sender %q doesn't match the tombstone sender %q",
+			newRoomCreate.Sender(), oldRoomTombstone.Sender(),
+		)
+	}
+	return nil
+}
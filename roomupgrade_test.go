@@ -0,0 +1,80 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"testing"
+)
+
+func testRoomUpgradeEvent(t *testing.T, eventType, eventID, roomID, sender, content string) Event {
+	return testEventf(t, `{
+		"type": %q,
+		"state_key": "",
+		"event_id": %q,
+		"room_id": %q,
+		"sender": %q,
+		"content": %s
+	}`, eventType, eventID, roomID, sender, content)
+}
+
+func TestCheckRoomUpgrade(t *testing.T) {
+	tombstone := testRoomUpgradeEvent(
+		t, MRoomTombstone, "$tombstone:a", "!old:a", "@admin:a",
+		`{"body": "This room has been replaced", "replacement_room": "!new:a"}`,
+	)
+	create := testRoomUpgradeEvent(
+		t, MRoomCreate, "$create:a", "!new:a", "@admin:a",
+		`{"creator": "@admin:a", "room_version": "5", "predecessor": {"room_id": "!old:a", "event_id": "$tombstone:a"}}`,
+	)
+	if err := CheckRoomUpgrade(tombstone, create); err != nil {
+		t.Fatalf("CheckRoomUpgrade: unexpected error: %s", err)
+	}
+
+	bad := []struct {
+		name              string
+		tombstone, create Event
+	}{
+		{"wrong replacement room", testRoomUpgradeEvent(
+			t, MRoomTombstone, "$tombstone:a", "!old:a", "@admin:a",
+			`{"body": "This room has been replaced", "replacement_room": "!other:a"}`,
+		), create},
+		{"wrong predecessor room", tombstone, testRoomUpgradeEvent(
+			t, MRoomCreate, "$create:a", "!new:a", "@admin:a",
+			`{"creator": "@admin:a", "predecessor": {"room_id": "!other:a", "event_id": "$tombstone:a"}}`,
+		)},
+		{"wrong predecessor event", tombstone, testRoomUpgradeEvent(
+			t, MRoomCreate, "$create:a", "!new:a", "@admin:a",
+			`{"creator": "@admin:a", "predecessor": {"room_id": "!old:a", "event_id": "$other:a"}}`,
+		)},
+		{"no predecessor", tombstone, testRoomUpgradeEvent(
+			t, MRoomCreate, "$create:a", "!new:a", "@admin:a", `{"creator": "@admin:a"}`,
+		)},
+		{"different senders", tombstone, testRoomUpgradeEvent(
+			t, MRoomCreate, "$create:a", "!new:a", "@mallory:b",
+			`{"creator": "@mallory:b", "predecessor": {"room_id": "!old:a", "event_id": "$tombstone:a"}}`,
+		)},
+		{"not a tombstone", testRoomUpgradeEvent(
+			t, "m.room.topic", "$tombstone:a", "!old:a", "@admin:a",
+			`{"replacement_room": "!new:a"}`,
+		), create},
+		{"swapped events", create, tombstone},
+	}
+	for _, tt := range bad {
+		if err := CheckRoomUpgrade(tt.tombstone, tt.create); err == nil {
+			t.Errorf("CheckRoomUpgrade: %s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// A SignatureAlgorithm signs and verifies the signatures made with the keys
+// of a signing algorithm, such as "ed25519". The algorithm of a signature is
+// given by the part of the key ID before the colon.
+type SignatureAlgorithm interface {
+	// Sign returns the signature of the message made with the private key.
+	Sign(privateKey, message []byte) ([]byte, error)
+	// Verify checks that the signature of the message was made with the
+	// private key for the public key. Returns an error if it wasn't.
+	Verify(publicKey, message, signature []byte) error
+}
+
+// An UnsupportedAlgorithmError is returned when signing or verifying with a
+// key whose algorithm hasn't been registered with RegisterSignatureAlgorithm.
+type UnsupportedAlgorithmError struct {
+	// The ID of the key.
+	KeyID KeyID
+}
+
+func (e UnsupportedAlgorithmError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: unsupported signing algorithm for key %q", e.KeyID)
+}
+
+var (
+	signatureAlgorithmsMutex sync.RWMutex
+	signatureAlgorithms      = map[string]SignatureAlgorithm{
+		"ed25519": ed25519Algorithm{},
+	}
+)
+
+// RegisterSignatureAlgorithm registers the implementation of a signing
+// algorithm, which SignJSON, VerifyJSON, event signing and the KeyRing then
+// use for keys with IDs starting with the name of the algorithm. Registering
+// a nil algorithm removes it. Only "ed25519" is registered by default, since
+// it is the only algorithm that Matrix servers use, so this is for testing
+// and for experimenting with new algorithms.
+func RegisterSignatureAlgorithm(name string, algorithm SignatureAlgorithm) {
+	signatureAlgorithmsMutex.Lock()
+	defer signatureAlgorithmsMutex.Unlock()
+	if algorithm == nil {
+		delete(signatureAlgorithms, name)
+		return
+	}
+	signatureAlgorithms[name] = algorithm
+}
+
+// signatureAlgorithmFor returns the signing algorithm of the key. Returns
+// an error if the key ID is invalid, or an UnsupportedAlgorithmError if the
+// algorithm isn't registered.
+func signatureAlgorithmFor(keyID KeyID) (SignatureAlgorithm, error) {
+	name, _, err := ParseKeyID(string(keyID))
+	if err != nil {
+		return nil, err
+	}
+	signatureAlgorithmsMutex.RLock()
+	algorithm, ok := signatureAlgorithms[name]
+	signatureAlgorithmsMutex.RUnlock()
+	if !ok {
+		return nil, UnsupportedAlgorithmError{keyID}
+	}
+	return algorithm, nil
+}
+
+// isSignatureAlgorithmSupported returns whether the algorithm of the key is
+// registered.
+func isSignatureAlgorithmSupported(keyID KeyID) bool {
+	_, err := signatureAlgorithmFor(keyID)
+	return err == nil
+}
+
+// ed25519Algorithm is the "ed25519" signing algorithm.
+type ed25519Algorithm struct{}
+
+func (ed25519Algorithm) Sign(privateKey, message []byte) ([]byte, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("gomatrixserverlib: bad ed25519 private key length %d", len(privateKey))
+	}
+	return ed25519.Sign(ed25519.PrivateKey(privateKey), message), nil
+}
+
+func (ed25519Algorithm) Verify(publicKey, message, signature []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("bad ed25519 public key length %d", len(publicKey))
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("bad ed25519 signature length %d", len(signature))
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), message, signature) {
+		return fmt.Errorf("ed25519 signature doesn't match")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testSignatureAlgorithm is a toy signing algorithm where the private key is
+// the same as the public key, and the signature is the SHA-256 hash of the
+// key and the message.
+type testSignatureAlgorithm struct{}
+
+func (testSignatureAlgorithm) Sign(privateKey, message []byte) ([]byte, error) {
+	hash := sha256.Sum256(append(append([]byte(nil), privateKey...), message...))
+	return hash[:], nil
+}
+
+func (a testSignatureAlgorithm) Verify(publicKey, message, signature []byte) error {
+	want, _ := a.Sign(publicKey, message)
+	if !bytes.Equal(signature, want) {
+		return fmt.Errorf("test signature doesn't match")
+	}
+	return nil
+}
+
+func TestRegisterSignatureAlgorithm(t *testing.T) {
+	RegisterSignatureAlgorithm("test", testSignatureAlgorithm{})
+	defer RegisterSignatureAlgorithm("test", nil)
+
+	key := []byte("secret")
+	signed, err := SignJSON("example.com", "test:1", key, []byte(`{"content":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyJSON("example.com", "test:1", key, signed); err != nil {
+		t.Errorf("VerifyJSON: unexpected error for a registered algorithm: %v", err)
+	}
+	if err = VerifyJSON("example.com", "test:1", []byte("other"), signed); err == nil {
+		t.Errorf("VerifyJSON: wanted an error for the wrong key")
+	}
+
+	// Once the algorithm is removed the signature can't be checked, which
+	// is a different error to a bad signature.
+	RegisterSignatureAlgorithm("test", nil)
+	if _, ok := VerifyJSON("example.com", "test:1", key, signed).(UnsupportedAlgorithmError); !ok {
+		t.Errorf("VerifyJSON: wanted an UnsupportedAlgorithmError for an unregistered algorithm")
+	}
+	if _, err = SignJSON("example.com", "test:1", key, []byte(`{}`)); err == nil {
+		t.Errorf("SignJSON: wanted an error for an unregistered algorithm")
+	}
+}
+
+func TestVerifyEventSignaturesIgnoresUnsupportedAlgorithms(t *testing.T) {
+	const serverName, keyID = ServerName("example.com"), KeyID("ed25519:1")
+	privateKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	keyRing := KeyRing{KeyDatabase: NewInMemoryKeyDatabase(map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{serverName, keyID}: {
+			VerifyKey:    VerifyKey{Key: Base64String(privateKey.Public().(ed25519.PublicKey))},
+			ValidUntilTS: AsTimestamp(time.Unix(2000000000, 0)),
+		},
+	})}
+	stateKey := ""
+	builder := EventBuilder{
+		Sender:   "@alice:example.com",
+		RoomID:   "!room:example.com",
+		Type:     MRoomCreate,
+		StateKey: &stateKey,
+		Content:  RawJSON(`{"creator":"@alice:example.com"}`),
+	}
+	signedEvent, err := builder.Build("$create:example.com", time.Unix(1500000000, 0), serverName, keyID, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add signatures from the server with an algorithm that the KeyRing
+	// won't know about.
+	RegisterSignatureAlgorithm("test", testSignatureAlgorithm{})
+	signedEvent = signedEvent.Sign(string(serverName), "test:1", []byte("secret"))
+	otherBuilder := builder
+	otherBuilder.Content = RawJSON(`{"creator":"@bob:example.com"}`)
+	unsupportedEvent, err := otherBuilder.Build("$other:example.com", time.Unix(1500000000, 0), serverName, "test:1", []byte("secret"))
+	RegisterSignatureAlgorithm("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err := VerifyEventSignatures(context.Background(), []Event{signedEvent, unsupportedEvent}, keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil {
+		t.Errorf("VerifyEventSignatures: wanted signatures with unsupported algorithms to be ignored, got %v", errs[0])
+	}
+	if _, ok := errs[1].(UnsupportedAlgorithmError); !ok {
+		t.Errorf("VerifyEventSignatures: wanted an UnsupportedAlgorithmError without a supported signature, got %v", errs[1])
+	}
+}
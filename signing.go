@@ -18,19 +18,79 @@ package gomatrixserverlib
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/ed25519"
 )
 
 // A KeyID is the ID of a ed25519 key used to sign JSON.
-// The key IDs have a format of "ed25519:[0-9A-Za-z]+"
+// The key IDs have a format of "ed25519:[0-9A-Za-z_]+", which can be checked
+// using ParseKeyID.
 // If we switch to using a different signing algorithm then we will change the
 // prefix used.
 type KeyID string
 
+// ParseKeyID splits a key ID of the form "<algorithm>:<version>" into the
+// algorithm and the version of the key. Returns an error if the key ID
+// doesn't have that form, or if either part is empty or contains characters
+// other than "[0-9A-Za-z_]".
+// https://matrix.org/docs/spec/appendices.html#signing-key
+func ParseKeyID(keyID string) (algorithm, version string, err error) {
+	parts := strings.SplitN(keyID, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("gomatrixserverlib: key ID %q has no algorithm", keyID)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", "", fmt.Errorf("gomatrixserverlib: key ID %q has an empty algorithm or version", keyID)
+		}
+		for _, c := range part {
+			if !isKeyIDChar(c) {
+				return "", "", fmt.Errorf("gomatrixserverlib: key ID %q contains invalid character %q", keyID, c)
+			}
+		}
+	}
+	return parts[0], parts[1], nil
+}
+
+// isKeyIDChar returns whether the character is allowed in the parts of a
+// key ID.
+func isKeyIDChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+}
+
 // SignJSON signs a JSON object returning a copy signed with the given key.
+// The key is used with the signing algorithm named by the key ID, which is
+// normally ed25519. Returns an UnsupportedAlgorithmError if the algorithm
+// isn't registered.
 // https://matrix.org/docs/spec/server_server/unstable.html#signing-json
 func SignJSON(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, message []byte) ([]byte, error) {
+	return SignJSONWithKeys(signingName, []SigningKey{{keyID, privateKey}}, message)
+}
+
+// A SigningKey is a private key along with its key ID.
+type SigningKey struct {
+	KeyID      KeyID
+	PrivateKey ed25519.PrivateKey
+}
+
+// SignJSONWithKeys signs a JSON object with each of the keys, returning a
+// copy with all of the signatures. This is for signing with both the old
+// and the new key while rotating keys. The signatures are added to any
+// signatures that the object already has, including other signatures by
+// the signing name, replacing only existing signatures with the same key
+// IDs. Like SignJSON, the "signatures" and "unsigned" keys of the object
+// aren't covered by the signatures.
+func SignJSONWithKeys(signingName string, keys []SigningKey, message []byte) ([]byte, error) {
+	algorithms := make([]SignatureAlgorithm, len(keys))
+	for i, key := range keys {
+		algorithm, err := signatureAlgorithmFor(key.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		algorithms[i] = algorithm
+	}
+
 	// Unpack the top-level key of the JSON object without unpacking the contents of the keys.
 	// This allows us to add and remove the top-level keys from the JSON object.
 	// It also ensures that the JSON is actually a valid JSON object.
@@ -51,8 +111,9 @@ func SignJSON(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, me
 		if err := json.Unmarshal(*rawSignatures, &signatures); err != nil {
 			return nil, err
 		}
-		delete(object, "signatures")
-	} else {
+	}
+	delete(object, "signatures")
+	if signatures == nil {
 		signatures = map[string]map[KeyID]Base64String{}
 	}
 
@@ -67,15 +128,17 @@ func SignJSON(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, me
 		return nil, err
 	}
 
-	// Sign the canonical JSON with the ed25519 key.
-	signature := Base64String(ed25519.Sign(privateKey, canonical))
-
-	// Add the signature to the "signature" key.
-	signaturesForEntity := signatures[signingName]
-	if signaturesForEntity != nil {
-		signaturesForEntity[keyID] = signature
-	} else {
-		signatures[signingName] = map[KeyID]Base64String{keyID: signature}
+	// Sign the canonical JSON with each key, and add the signatures to the
+	// "signatures" key.
+	for i, key := range keys {
+		rawSignature, err := algorithms[i].Sign(key.PrivateKey, canonical)
+		if err != nil {
+			return nil, err
+		}
+		if signatures[signingName] == nil {
+			signatures[signingName] = map[KeyID]Base64String{}
+		}
+		signatures[signingName][key.KeyID] = Base64String(rawSignature)
 	}
 	var rawSignatures json.RawMessage
 	rawSignatures, err = json.Marshal(signatures)
@@ -102,18 +165,29 @@ func ListKeyIDs(signingName string, message []byte) ([]KeyID, error) {
 	}
 	var result []KeyID
 	for keyID := range object.Signatures[signingName] {
+		if _, _, err := ParseKeyID(string(keyID)); err != nil {
+			return nil, err
+		}
 		result = append(result, keyID)
 	}
 	return result, nil
 }
 
 // VerifyJSON checks that the entity has signed the message using a particular key.
+// The key is used with the signing algorithm named by the key ID, which is
+// normally ed25519. Returns an UnsupportedAlgorithmError if the algorithm
+// isn't registered, rather than treating the signature as bad.
 func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, message []byte) error {
+	algorithm, err := signatureAlgorithmFor(keyID)
+	if err != nil {
+		return err
+	}
+
 	// Unpack the top-level key of the JSON object without unpacking the contents of the keys.
 	// This allows us to add and remove the top-level keys from the JSON object.
 	// It also ensures that the JSON is actually a valid JSON object.
 	var object map[string]*json.RawMessage
-	var signatures map[string]map[KeyID]Base64String
+	var signatures map[string]map[KeyID]string
 	if err := json.Unmarshal(message, &object); err != nil {
 		return err
 	}
@@ -125,14 +199,21 @@ func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, me
 	if err := json.Unmarshal(*object["signatures"], &signatures); err != nil {
 		return err
 	}
-	signature, ok := signatures[signingName][keyID]
+	for signatureKeyID := range signatures[signingName] {
+		if _, _, err := ParseKeyID(string(signatureKeyID)); err != nil {
+			return err
+		}
+	}
+	encodedSignature, ok := signatures[signingName][keyID]
 	if !ok {
 		return fmt.Errorf("No signature from %q with ID %q", signingName, keyID)
 	}
-	if len(signature) != ed25519.SignatureSize {
-		return fmt.Errorf("Bad signature length from %q with ID %q", signingName, keyID)
+	// Only the signature being checked is decoded, so that a signature that
+	// isn't valid base64 doesn't stop the other signatures being checked.
+	var signature Base64String
+	if err := signature.Decode(encodedSignature); err != nil {
+		return fmt.Errorf("Signature from %q with ID %q isn't valid base64: %s", signingName, keyID, err)
 	}
-
 	// The "unsigned" key and "signatures" keys aren't covered by the signature so remove them.
 	delete(object, "unsigned")
 	delete(object, "signatures")
@@ -144,12 +225,12 @@ func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, me
 	}
 	canonical, err := CanonicalJSON(unsorted)
 	if err != nil {
-		return err
+		return fmt.Errorf("Message can't be made canonical: %s", err)
 	}
 
-	// Verify the ed25519 signature.
-	if !ed25519.Verify(publicKey, canonical, signature) {
-		return fmt.Errorf("Bad signature from %q with ID %q", signingName, keyID)
+	// Verify the signature.
+	if err := algorithm.Verify(publicKey, canonical, signature); err != nil {
+		return fmt.Errorf("Bad signature from %q with ID %q: %s", signingName, keyID, err)
 	}
 
 	return nil
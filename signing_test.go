@@ -89,11 +89,25 @@ func TestVerifyJSON(t *testing.T) {
 		}}
 	}`)
 	testVerifyNotOK("the signature is too short for ed25519", `{"signatures": {"domain": {"ed25519:1":"not/a/valid/signature"}}}`)
-	testVerifyNotOK("the signature has base64 padding that it shouldn't have", `{
+	testVerifyNotOK("the signature has the wrong amount of base64 padding", `{
+		"signatures": { "domain": {
+			"ed25519:1": "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ="
+		}}
+	}`)
+
+	// Older servers have sent signatures with base64 padding, and with the
+	// URL-safe alphabet, which are accepted although the spec doesn't allow
+	// them.
+	testVerifyOK(`{
 		"signatures": { "domain": {
 			"ed25519:1": "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ=="
 		}}
 	}`)
+	testVerifyOK(`{
+		"signatures": { "domain": {
+			"ed25519:1": "K8280_U9SSy9IVtjBuVeLr-HpOB4BQFWbg-UZaADMtTdGYI7Geitb76LTrr5QV_7Xg4ahLwYGYZzuHGZKM5ZAQ=="
+		}}
+	}`)
 }
 
 func TestSignJSON(t *testing.T) {
@@ -119,6 +133,60 @@ func TestSignJSON(t *testing.T) {
 	}
 }
 
+func TestSignJSONWithKeys(t *testing.T) {
+	newKey := func() (ed25519.PublicKey, ed25519.PrivateKey) {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return publicKey, privateKey
+	}
+	otherPublic, otherPrivate := newKey()
+	previousPublic, previousPrivate := newKey()
+	oldPublic, oldPrivate := newKey()
+	newPublic, newPrivate := newKey()
+
+	// The object is already signed by another server, and by us with a key
+	// that we aren't signing with now.
+	signed, err := SignJSON("other.example.com", "ed25519:other", otherPrivate, []byte(`{"content":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = SignJSON("example.com", "ed25519:previous", previousPrivate, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = SignJSONWithKeys("example.com", []SigningKey{
+		{"ed25519:old", oldPrivate},
+		{"ed25519:new", newPrivate},
+	}, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		signingName string
+		keyID       KeyID
+		publicKey   ed25519.PublicKey
+	}{
+		{"other.example.com", "ed25519:other", otherPublic},
+		{"example.com", "ed25519:previous", previousPublic},
+		{"example.com", "ed25519:old", oldPublic},
+		{"example.com", "ed25519:new", newPublic},
+	} {
+		if err = VerifyJSON(check.signingName, check.keyID, check.publicKey, signed); err != nil {
+			t.Errorf("VerifyJSON(%q, %q): unexpected error: %v", check.signingName, check.keyID, err)
+		}
+	}
+
+	if _, err = SignJSONWithKeys("example.com", []SigningKey{
+		{"ed25519:new", newPrivate},
+		{"unknown:1", newPrivate},
+	}, signed); err == nil {
+		t.Errorf("SignJSONWithKeys: wanted an error for a key with an unknown algorithm")
+	}
+}
+
 func IsJSONEqual(a, b []byte) bool {
 	canonicalA, err := CanonicalJSON(a)
 	if err != nil {
@@ -221,3 +289,71 @@ func TestSignJSONWithUnsigned(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestParseKeyID(t *testing.T) {
+	for keyID, want := range map[string][2]string{
+		"ed25519:1":         {"ed25519", "1"},
+		"ed25519:a_Obwu":    {"ed25519", "a_Obwu"},
+		"ed25519:my_key_id": {"ed25519", "my_key_id"},
+		"curve25519:ABC123": {"curve25519", "ABC123"},
+	} {
+		algorithm, version, err := ParseKeyID(keyID)
+		if err != nil {
+			t.Errorf("ParseKeyID(%q): unexpected error: %v", keyID, err)
+			continue
+		}
+		if algorithm != want[0] || version != want[1] {
+			t.Errorf("ParseKeyID(%q): got (%q, %q), want (%q, %q)", keyID, algorithm, version, want[0], want[1])
+		}
+	}
+}
+
+func TestParseKeyIDMalformed(t *testing.T) {
+	for _, keyID := range []string{
+		"",
+		"ed25519",
+		"ed25519:",
+		":1",
+		":",
+		"ed25519:a:b",
+		"ed25519:a-b",
+		"ed25519:a b",
+		"ed25519:ключ",
+		"ed 25519:1",
+	} {
+		if _, _, err := ParseKeyID(keyID); err == nil {
+			t.Errorf("ParseKeyID(%q): wanted an error", keyID)
+		}
+	}
+}
+
+func TestSignaturesWithMalformedKeyIDs(t *testing.T) {
+	random := bytes.NewBuffer([]byte("Some 32 randomly generated bytes"))
+	publicKey, privateKey, err := ed25519.GenerateKey(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SignJSON("example.com", "ed25519:a-b", privateKey, []byte(`{}`)); err == nil {
+		t.Errorf("SignJSON: wanted an error signing with a malformed key ID")
+	}
+
+	// A message signed with a valid key ID that also has a signature with a
+	// malformed key ID from the same entity.
+	signed, err := SignJSON("example.com", "ed25519:1", privateKey, []byte(`{
+		"signatures": {"example.com": {"ed25519:a-b": "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ListKeyIDs("example.com", signed); err == nil {
+		t.Errorf("ListKeyIDs: wanted an error for a malformed key ID")
+	}
+	if err = VerifyJSON("example.com", "ed25519:1", publicKey, signed); err == nil {
+		t.Errorf("VerifyJSON: wanted an error for a malformed key ID")
+	}
+
+	// Malformed key IDs from other entities don't matter.
+	if _, err = ListKeyIDs("other.example.com", signed); err != nil {
+		t.Errorf("ListKeyIDs: unexpected error for another entity: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// signingKeyVersionChars are the characters used for the random part of the
+// versions of generated keys.
+const signingKeyVersionChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// GenerateSigningKey generates a new ed25519 signing key with a random key
+// version. Like Synapse, the version is "a_" followed by four random letters,
+// which is a valid key version for ParseKeyID.
+func GenerateSigningKey() (KeyID, ed25519.PrivateKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	random := make([]byte, 4)
+	if _, err = rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	version := []byte("a_")
+	for _, b := range random {
+		version = append(version, signingKeyVersionChars[int(b)%len(signingKeyVersionChars)])
+	}
+	return KeyID("ed25519:" + string(version)), privateKey, nil
+}
+
+// EncodeSigningKey encodes a signing key in the "ed25519 <version> <seed>"
+// format that Synapse uses for its signing key files, where the seed of the
+// private key is encoded as unpadded base64. The result doesn't end with a
+// newline. Returns an error if the key ID isn't a valid ed25519 key ID or
+// the private key is the wrong size.
+func EncodeSigningKey(keyID KeyID, privateKey ed25519.PrivateKey) (string, error) {
+	algorithm, version, err := ParseKeyID(string(keyID))
+	if err != nil {
+		return "", err
+	}
+	if algorithm != "ed25519" {
+		return "", fmt.Errorf("gomatrixserverlib: key ID %q is not an ed25519 key", keyID)
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("gomatrixserverlib: private key for %q has length %d, want %d", keyID, len(privateKey), ed25519.PrivateKeySize)
+	}
+	return "ed25519 " + version + " " + Base64String(privateKey.Seed()).Encode(), nil
+}
+
+// DecodeSigningKey decodes a signing key encoded by EncodeSigningKey, or read
+// from a Synapse signing key file holding a single key. Whitespace around the
+// key is ignored, and the seed may be padded or unpadded, standard or URL-safe
+// base64. Returns an error if the text doesn't hold exactly one ed25519 key.
+func DecodeSigningKey(text string) (KeyID, ed25519.PrivateKey, error) {
+	text = strings.TrimSpace(text)
+	if strings.ContainsAny(text, "\r\n") {
+		return "", nil, fmt.Errorf("gomatrixserverlib: signing key has more than one line")
+	}
+	parts := strings.Fields(text)
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("gomatrixserverlib: signing key has %d fields, want 3", len(parts))
+	}
+	keyID := KeyID(parts[0] + ":" + parts[1])
+	if _, _, err := ParseKeyID(string(keyID)); err != nil {
+		return "", nil, err
+	}
+	if parts[0] != "ed25519" {
+		return "", nil, fmt.Errorf("gomatrixserverlib: key ID %q is not an ed25519 key", keyID)
+	}
+	var seed Base64String
+	if err := seed.Decode(parts[2]); err != nil {
+		return "", nil, fmt.Errorf("gomatrixserverlib: signing key %q has an invalid seed: %s", keyID, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return "", nil, fmt.Errorf("gomatrixserverlib: seed for %q has length %d, want %d", keyID, len(seed), ed25519.SeedSize)
+	}
+	return keyID, ed25519.NewKeyFromSeed(seed), nil
+}
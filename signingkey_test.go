@@ -0,0 +1,104 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestGenerateSigningKeyRoundTrip(t *testing.T) {
+	keyID, privateKey, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("GenerateSigningKey: unexpected error: %v", err)
+	}
+	algorithm, version, err := ParseKeyID(string(keyID))
+	if err != nil {
+		t.Fatalf("ParseKeyID(%q): unexpected error: %v", keyID, err)
+	}
+	if algorithm != "ed25519" || !strings.HasPrefix(version, "a_") {
+		t.Errorf("GenerateSigningKey: got key ID %q, want \"ed25519:a_...\"", keyID)
+	}
+
+	encoded, err := EncodeSigningKey(keyID, privateKey)
+	if err != nil {
+		t.Fatalf("EncodeSigningKey: unexpected error: %v", err)
+	}
+	gotKeyID, gotPrivateKey, err := DecodeSigningKey(encoded)
+	if err != nil {
+		t.Fatalf("DecodeSigningKey(%q): unexpected error: %v", encoded, err)
+	}
+	if gotKeyID != keyID || !bytes.Equal(gotPrivateKey, privateKey) {
+		t.Errorf("DecodeSigningKey(%q): got key %q, want %q", encoded, gotKeyID, keyID)
+	}
+}
+
+func TestDecodeSigningKeySynapseFile(t *testing.T) {
+	// A signing key file in the format written by Synapse, using the seed from
+	// the signing examples in the spec appendices.
+	text, err := ioutil.ReadFile("testdata/synapse.signing.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, privateKey, err := DecodeSigningKey(string(text))
+	if err != nil {
+		t.Fatalf("DecodeSigningKey: unexpected error: %v", err)
+	}
+	if keyID != "ed25519:a_AbCd" {
+		t.Errorf("DecodeSigningKey: got key ID %q, want %q", keyID, "ed25519:a_AbCd")
+	}
+	publicKey := Base64String(privateKey.Public().(ed25519.PublicKey)).Encode()
+	if want := "XGX0JRS2Af3be3knz2fBiRbApjm2Dh61gXDJA8kcJNI"; publicKey != want {
+		t.Errorf("DecodeSigningKey: got public key %q, want %q", publicKey, want)
+	}
+
+	// Encoding the key gives back the contents of the file.
+	encoded, err := EncodeSigningKey(keyID, privateKey)
+	if err != nil {
+		t.Fatalf("EncodeSigningKey: unexpected error: %v", err)
+	}
+	if want := strings.TrimSpace(string(text)); encoded != want {
+		t.Errorf("EncodeSigningKey: got %q, want %q", encoded, want)
+	}
+}
+
+func TestDecodeSigningKeyInvalid(t *testing.T) {
+	seed := "YJDBA9Xnr2sVqXD9Vj7XVUnmFZcZrlw8Md7kMW+3XA1"
+	if _, _, err := DecodeSigningKey("ed25519 1 " + seed + "="); err != nil {
+		t.Errorf("DecodeSigningKey: unexpected error for a padded seed: %v", err)
+	}
+	for _, text := range []string{
+		"",
+		"ed25519 1",
+		"ed25519 1 " + seed + " extra",
+		"ed25519 1 " + seed + "\ned25519 2 " + seed,
+		"curve25519 1 " + seed,
+		"ed25519 a-b " + seed,
+		"ed25519 1 not*base64",
+		"ed25519 1 YJDBA9Xnr2sVqXD9",
+	} {
+		if _, _, err := DecodeSigningKey(text); err == nil {
+			t.Errorf("DecodeSigningKey(%q): wanted an error", text)
+		}
+	}
+	if _, err := EncodeSigningKey("ed25519:1", ed25519.PrivateKey("short")); err == nil {
+		t.Errorf("EncodeSigningKey: wanted an error for a short private key")
+	}
+}
@@ -0,0 +1,310 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// A StateResolutionProvider loads the events needed to resolve the state of
+// a room, typically from a database.
+type StateResolutionProvider interface {
+	// StateAfterEvent returns the state of the room after the event with the
+	// given ID.
+	StateAfterEvent(ctx context.Context, eventID string) ([]Event, error)
+	// EventsByID loads events by ID. It may return fewer events than were
+	// asked for if some of the events are not known, like an
+	// AuthChainProvider.
+	EventsByID(ctx context.Context, eventIDs []string) ([]Event, error)
+}
+
+// ResolveStateAfterEvent works out the state of a room after the new events,
+// starting from prevResolvedState, the already resolved state of the room
+// after the events with IDs latestEventIDs. The new events must be in an
+// order where every event comes after any of its prev events that are also
+// new events.
+//
+// The state before each new event is worked out as follows:
+//
+//   - If the prev events of the event are exactly the latest events, which
+//     are the given latest events for the first new event and the previous
+//     new event after that, then the state before the event is the state
+//     after the latest events and nothing needs to be resolved. This is
+//     always true for a linear run of events on top of the resolved state,
+//     and is the same as the full algorithm since resolving the state after
+//     the same events again gives the same state. The provider isn't used.
+//   - Otherwise the state after each of the prev events is loaded, from the
+//     new events that have been seen already or from the provider, and if
+//     every state set has the same event for every state key tuple then
+//     that is the state before the event. This is the same as the full
+//     algorithm, since state sets that are identical have no conflicted
+//     events and no auth difference, so the resolved state is the
+//     unconflicted state.
+//   - Otherwise the state sets are resolved using the full state resolution
+//     algorithm of the room version, loading the auth events needed from
+//     the provider.
+//
+// The state after a new state event is then the state before the event with
+// the event applied. Returns the state after the last new event, sorted by
+// event type and then state key. Returns an error if the room version isn't
+// supported, or if the provider fails to load the events needed.
+func ResolveStateAfterEvent(
+	ctx context.Context, roomVersion RoomVersion,
+	prevResolvedState []Event, latestEventIDs []string, newEvents []Event,
+	provider StateResolutionProvider,
+) ([]Event, error) {
+	algorithm, err := roomVersion.StateResAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[StateKeyTuple]*Event, len(prevResolvedState)+len(newEvents))
+	for i := range prevResolvedState {
+		if prevResolvedState[i].StateKey() != nil {
+			state[stateKeyTupleOf(&prevResolvedState[i])] = &prevResolvedState[i]
+		}
+	}
+
+	// The state after any new events that are prev events of a later new
+	// event other than the next one, which can't be loaded from the provider.
+	newEventIndexes := make(map[string]int, len(newEvents))
+	for i := range newEvents {
+		newEventIndexes[newEvents[i].EventID()] = i
+	}
+	stateAfter := map[string][]Event{}
+	for i := range newEvents {
+		for _, prevEventID := range newEvents[i].PrevEventIDs() {
+			if j, ok := newEventIndexes[prevEventID]; ok && j < i-1 {
+				stateAfter[prevEventID] = nil
+			}
+		}
+	}
+
+	latest := latestEventIDs
+	for i := range newEvents {
+		event := &newEvents[i]
+		prevEventIDs := event.PrevEventIDs()
+		if !sameEventIDs(prevEventIDs, latest) {
+			stateSets, err := loadStateSets(ctx, prevEventIDs, latest, state, stateAfter, provider)
+			if err != nil {
+				return nil, err
+			}
+			resolved, err := resolveStateSets(ctx, algorithm, stateSets, provider)
+			if err != nil {
+				return nil, err
+			}
+			state = make(map[StateKeyTuple]*Event, len(resolved)+len(newEvents)-i)
+			for j := range resolved {
+				state[stateKeyTupleOf(&resolved[j])] = &resolved[j]
+			}
+		}
+		if event.StateKey() != nil {
+			state[stateKeyTupleOf(event)] = event
+		}
+		latest = []string{event.EventID()}
+		if _, ok := stateAfter[event.EventID()]; ok {
+			stateAfter[event.EventID()] = stateEventsOf(state)
+		}
+	}
+	return stateEventsOf(state), nil
+}
+
+// loadStateSets loads the state after each of the prev events of an event.
+// The state after the latest events is the current state, and the state
+// after new events that were seen already is in stateAfter.
+func loadStateSets(
+	ctx context.Context, prevEventIDs, latest []string,
+	state map[StateKeyTuple]*Event, stateAfter map[string][]Event,
+	provider StateResolutionProvider,
+) ([][]Event, error) {
+	var stateSets [][]Event
+	seen := make(map[string]bool, len(prevEventIDs))
+	for _, prevEventID := range prevEventIDs {
+		if seen[prevEventID] {
+			continue
+		}
+		seen[prevEventID] = true
+		if len(latest) == 1 && latest[0] == prevEventID {
+			stateSets = append(stateSets, stateEventsOf(state))
+			continue
+		}
+		if stateSet, ok := stateAfter[prevEventID]; ok && stateSet != nil {
+			stateSets = append(stateSets, stateSet)
+			continue
+		}
+		stateSet, err := provider.StateAfterEvent(ctx, prevEventID)
+		if err != nil {
+			return nil, err
+		}
+		stateSets = append(stateSets, stateSet)
+	}
+	return stateSets, nil
+}
+
+// resolveStateSets resolves the state sets using the state resolution
+// algorithm, or returns the unconflicted state without running the algorithm
+// if there are no conflicts.
+func resolveStateSets(
+	ctx context.Context, algorithm StateResAlgorithm, stateSets [][]Event, provider StateResolutionProvider,
+) ([]Event, error) {
+	if len(stateSets) == 0 {
+		return nil, nil
+	}
+
+	conflicted, unconflicted := separateStateConflicts(algorithm, stateSets)
+	if len(conflicted) == 0 {
+		return unconflicted, nil
+	}
+
+	switch algorithm {
+	case StateResV1:
+		var authEventIDs []string
+		for i := range conflicted {
+			authEventIDs = append(authEventIDs, conflicted[i].AuthEventIDs()...)
+		}
+		authEvents, err := provider.EventsByID(ctx, authEventIDs)
+		if err != nil {
+			return nil, err
+		}
+		return append(unconflicted, ResolveStateConflicts(conflicted, authEvents)...), nil
+	case StateResV2:
+		authDifference, err := AuthDifference(ctx, stateSets, provider.EventsByID)
+		if err != nil {
+			return nil, err
+		}
+		authEvents, err := AuthChain(ctx, append(append([]Event(nil), conflicted...), authDifference...), provider.EventsByID)
+		if err != nil {
+			return nil, err
+		}
+		return ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference), nil
+	default:
+		return nil, fmt.Errorf("gomatrixserverlib: unknown state resolution algorithm %d", algorithm)
+	}
+}
+
+// SeparateStateConflicts splits the events in the state sets into the
+// conflicted events, which need to be resolved with the state resolution
+// algorithm of the room version, and the unconflicted events, which are in
+// the resolved state as they are. A state key tuple is unconflicted if every
+// state set that has an event for it has the same event. In room versions
+// using version 2 of the algorithm every state set must also have an event
+// for the tuple, so a state set that doesn't have one makes it conflicted,
+// whereas version 1 only looks at the state sets that do have one. Events
+// without a state key are ignored, and each event is only returned once.
+// The events are returned sorted by event type, then state key, then event
+// ID. If the conflicted events are empty then the unconflicted events are
+// the resolved state, and there is no need to run the algorithm. Returns an
+// error if the room version isn't supported.
+func SeparateStateConflicts(roomVersion RoomVersion, stateSets [][]Event) (conflicted, unconflicted []Event, err error) {
+	algorithm, err := roomVersion.StateResAlgorithm()
+	if err != nil {
+		return nil, nil, err
+	}
+	conflicted, unconflicted = separateStateConflicts(algorithm, stateSets)
+	sortStateConflicts(conflicted)
+	sortStateConflicts(unconflicted)
+	return conflicted, unconflicted, nil
+}
+
+// separateStateConflicts is SeparateStateConflicts for a state resolution
+// algorithm, without sorting the events.
+func separateStateConflicts(algorithm StateResAlgorithm, stateSets [][]Event) (conflicted, unconflicted []Event) {
+	eventsByTuple := map[StateKeyTuple][]*Event{}
+	counts := map[StateKeyTuple]int{}
+	for _, stateSet := range stateSets {
+		for i := range stateSet {
+			event := &stateSet[i]
+			if event.StateKey() == nil {
+				continue
+			}
+			tuple := stateKeyTupleOf(event)
+			counts[tuple]++
+			found := false
+			for _, other := range eventsByTuple[tuple] {
+				if other.EventID() == event.EventID() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				eventsByTuple[tuple] = append(eventsByTuple[tuple], event)
+			}
+		}
+	}
+	for tuple, events := range eventsByTuple {
+		if len(events) == 1 && (algorithm == StateResV1 || counts[tuple] == len(stateSets)) {
+			unconflicted = append(unconflicted, *events[0])
+			continue
+		}
+		for _, event := range events {
+			conflicted = append(conflicted, *event)
+		}
+	}
+	return conflicted, unconflicted
+}
+
+// sortStateConflicts sorts the events by event type, then state key, then
+// event ID.
+func sortStateConflicts(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type() != events[j].Type() {
+			return events[i].Type() < events[j].Type()
+		}
+		if *events[i].StateKey() != *events[j].StateKey() {
+			return *events[i].StateKey() < *events[j].StateKey()
+		}
+		return events[i].EventID() < events[j].EventID()
+	})
+}
+
+// sameEventIDs returns whether the lists contain the same event IDs,
+// ignoring their order and any duplicates.
+func sameEventIDs(a, b []string) bool {
+	inA := make(map[string]bool, len(a))
+	for _, eventID := range a {
+		inA[eventID] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, eventID := range b {
+		if !inA[eventID] {
+			return false
+		}
+		inB[eventID] = true
+	}
+	return len(inA) == len(inB)
+}
+
+func stateKeyTupleOf(event *Event) StateKeyTuple {
+	return StateKeyTuple{event.Type(), *event.StateKey()}
+}
+
+// stateEventsOf returns the events in the state sorted by event type and
+// then state key.
+func stateEventsOf(state map[StateKeyTuple]*Event) []Event {
+	events := make([]Event, 0, len(state))
+	for _, event := range state {
+		events = append(events, *event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type() != events[j].Type() {
+			return events[i].Type() < events[j].Type()
+		}
+		return *events[i].StateKey() < *events[j].StateKey()
+	})
+	return events
+}
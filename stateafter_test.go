@@ -0,0 +1,237 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStateResolutionProvider is a StateResolutionProvider backed by a test
+// room that counts the calls made to it.
+type testStateResolutionProvider struct {
+	room            *stateResTestRoom
+	stateAfterCalls int
+	eventsByIDCalls int
+}
+
+func (p *testStateResolutionProvider) StateAfterEvent(ctx context.Context, eventID string) ([]Event, error) {
+	p.stateAfterCalls++
+	var result []Event
+	for node, event := range p.room.events {
+		if event.EventID() != eventID {
+			continue
+		}
+		for _, stateEventID := range p.room.stateAfter[node] {
+			result = append(result, p.room.eventByID(stateEventID))
+		}
+	}
+	return result, nil
+}
+
+func (p *testStateResolutionProvider) EventsByID(ctx context.Context, eventIDs []string) ([]Event, error) {
+	p.eventsByIDCalls++
+	var result []Event
+	for _, eventID := range eventIDs {
+		result = append(result, p.room.eventByID(eventID))
+	}
+	return result, nil
+}
+
+// stateAfterTestInputs returns the state after the node and the events with
+// the nodes given.
+func stateAfterTestInputs(room *stateResTestRoom, node string, newNodes ...string) ([]Event, []string, []Event) {
+	var prevResolvedState []Event
+	for _, eventID := range room.stateAfter[node] {
+		prevResolvedState = append(prevResolvedState, room.eventByID(eventID))
+	}
+	newEvents := make([]Event, len(newNodes))
+	for i, newNode := range newNodes {
+		newEvents[i] = room.events[newNode]
+	}
+	return prevResolvedState, []string{room.events[node].EventID()}, newEvents
+}
+
+func checkStateAfterEvent(t *testing.T, room *stateResTestRoom, node string, got []Event) {
+	gotState := map[StateKeyTuple]string{}
+	for i := range got {
+		gotState[stateKeyTupleOf(&got[i])] = got[i].EventID()
+	}
+	if !reflect.DeepEqual(gotState, room.stateAfter[node]) {
+		t.Fatalf("ResolveStateAfterEvent: got state %v, want %v", gotState, room.stateAfter[node])
+	}
+}
+
+func TestResolveStateAfterEventLinear(t *testing.T) {
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{"topic":"one"}`},
+		{"PA", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"M1", stateResBob, "m.room.message", nil, `{}`},
+		{"T2", stateResBob, "m.room.topic", stateResStateKey(""), `{"topic":"two"}`},
+	}, [][]string{
+		{"END", "T2", "M1", "PA", "T1", "START"},
+	}, ResolveStateConflictsV2)
+
+	// A linear run of events on top of the resolved state takes the fast
+	// path, so the provider isn't used at all.
+	provider := &testStateResolutionProvider{room: room}
+	prevResolvedState, latest, newEvents := stateAfterTestInputs(room, "START", "T1", "PA", "M1", "T2", "END")
+	got, err := ResolveStateAfterEvent(context.Background(), RoomVersionV2, prevResolvedState, latest, newEvents, provider)
+	if err != nil {
+		t.Fatalf("ResolveStateAfterEvent: unexpected error: %v", err)
+	}
+	checkStateAfterEvent(t, room, "END", got)
+	if provider.stateAfterCalls != 0 || provider.eventsByIDCalls != 0 {
+		t.Errorf("ResolveStateAfterEvent: wanted no calls to the provider, got %d and %d",
+			provider.stateAfterCalls, provider.eventsByIDCalls)
+	}
+}
+
+func TestResolveStateAfterEventIdenticalStateSets(t *testing.T) {
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"M1", stateResAlice, "m.room.message", nil, `{}`},
+		{"M2", stateResBob, "m.room.message", nil, `{}`},
+	}, [][]string{
+		{"END", "M1", "START"},
+		{"END", "M2", "START"},
+	}, ResolveStateConflictsV2)
+
+	// The END event merges branches with the same state, so the state after
+	// the other branch is loaded but there is nothing to resolve.
+	provider := &testStateResolutionProvider{room: room}
+	prevResolvedState, latest, newEvents := stateAfterTestInputs(room, "M1", "END")
+	got, err := ResolveStateAfterEvent(context.Background(), RoomVersionV2, prevResolvedState, latest, newEvents, provider)
+	if err != nil {
+		t.Fatalf("ResolveStateAfterEvent: unexpected error: %v", err)
+	}
+	checkStateAfterEvent(t, room, "END", got)
+	if provider.stateAfterCalls != 1 || provider.eventsByIDCalls != 0 {
+		t.Errorf("ResolveStateAfterEvent: wanted only the state of the other branch to be loaded, got %d and %d calls",
+			provider.stateAfterCalls, provider.eventsByIDCalls)
+	}
+}
+
+func TestResolveStateAfterEventMatchesFullResolution(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		testEvents, edges := randomStateResTestEvents(rng)
+		room := newStateResTestRoom(t, testEvents, edges, ResolveStateConflictsV2)
+
+		// Resolve the state after the END event given the state after one of
+		// the branches that it merges.
+		provider := &testStateResolutionProvider{room: room}
+		prevResolvedState, latest, newEvents := stateAfterTestInputs(room, edges[0][1], "END")
+		got, err := ResolveStateAfterEvent(context.Background(), RoomVersionV2, prevResolvedState, latest, newEvents, provider)
+		if err != nil {
+			t.Fatalf("Case %d: ResolveStateAfterEvent: unexpected error: %v", i, err)
+		}
+		checkStateAfterEvent(t, room, "END", got)
+
+		// Resolve the state after all of the branches and the END event at
+		// once, which needs the state after earlier new events.
+		nodes := make([]string, 0, len(testEvents))
+		for _, testEvent := range testEvents {
+			nodes = append(nodes, testEvent.node)
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			return room.events[nodes[i]].Depth() < room.events[nodes[j]].Depth()
+		})
+		prevResolvedState, latest, newEvents = stateAfterTestInputs(room, "START", append(nodes, "END")...)
+		got, err = ResolveStateAfterEvent(context.Background(), RoomVersionV2, prevResolvedState, latest, newEvents, provider)
+		if err != nil {
+			t.Fatalf("Case %d: ResolveStateAfterEvent: unexpected error: %v", i, err)
+		}
+		checkStateAfterEvent(t, room, "END", got)
+	}
+}
+
+func TestSeparateStateConflicts(t *testing.T) {
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{"topic":"one"}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{"topic":"two"}`},
+	}, [][]string{
+		{"END", "T1", "START"},
+		{"END", "T2", "START"},
+	}, ResolveStateConflictsV2)
+	stateSet := func(nodes ...string) []Event {
+		var events []Event
+		for _, node := range nodes {
+			events = append(events, room.events[node])
+		}
+		return events
+	}
+	eventIDs := func(events []Event) []string {
+		var ids []string
+		for i := range events {
+			ids = append(ids, events[i].EventID())
+		}
+		return ids
+	}
+	ids := func(nodes ...string) []string {
+		var ids []string
+		for _, node := range nodes {
+			ids = append(ids, stateResEventID(node))
+		}
+		return ids
+	}
+
+	tests := []struct {
+		roomVersion      RoomVersion
+		stateSets        [][]Event
+		wantConflicted   []string
+		wantUnconflicted []string
+	}{
+		// A topic that only one of the state sets has is unconflicted in
+		// version 1 but conflicted in version 2.
+		{RoomVersionV1, [][]Event{stateSet("CREATE", "T1", "START"), stateSet("CREATE")},
+			nil, ids("CREATE", "T1")},
+		{RoomVersionV2, [][]Event{stateSet("CREATE", "T1", "START"), stateSet("CREATE")},
+			ids("T1"), ids("CREATE")},
+		// Different topics are conflicted in both.
+		{RoomVersionV1, [][]Event{stateSet("CREATE", "T1"), stateSet("CREATE", "T2")},
+			ids("T1", "T2"), ids("CREATE")},
+		{RoomVersionV2, [][]Event{stateSet("T1", "CREATE"), stateSet("CREATE", "T2"), stateSet("T1", "CREATE")},
+			ids("T1", "T2"), ids("CREATE")},
+	}
+	for i, test := range tests {
+		conflicted, unconflicted, err := SeparateStateConflicts(test.roomVersion, test.stateSets)
+		if err != nil {
+			t.Fatalf("Case %d: SeparateStateConflicts: unexpected error: %v", i, err)
+		}
+		// The topics sort by event ID, and the create event sorts first.
+		if got := eventIDs(conflicted); !reflect.DeepEqual(got, test.wantConflicted) {
+			t.Errorf("Case %d: SeparateStateConflicts: got conflicted %v, want %v", i, got, test.wantConflicted)
+		}
+		if got := eventIDs(unconflicted); !reflect.DeepEqual(got, test.wantUnconflicted) {
+			t.Errorf("Case %d: SeparateStateConflicts: got unconflicted %v, want %v", i, got, test.wantUnconflicted)
+		}
+	}
+
+	if _, _, err := SeparateStateConflicts("unknown", nil); err == nil {
+		t.Errorf("SeparateStateConflicts: wanted an error for an unknown room version")
+	}
+}
+
+func TestResolveStateAfterEventUnsupportedRoomVersion(t *testing.T) {
+	_, err := ResolveStateAfterEvent(context.Background(), "unknown", nil, nil, nil, nil)
+	if _, ok := err.(UnsupportedRoomVersionError); !ok {
+		t.Fatalf("ResolveStateAfterEvent: wanted an UnsupportedRoomVersionError, got %v", err)
+	}
+}
@@ -24,15 +24,24 @@ import (
 
 // ResolveStateConflicts takes a list of state events with conflicting state keys
 // and works out which event should be used for each state event.
+//
+// The result is sorted by event type and then state key, and doesn't depend
+// on the order of the given events, so every server resolving the same
+// events picks the same state. If there are several auth events with the
+// same type and state key then the one that sorts last by depth and SHA1 of
+// event ID, like the conflicted events, is used.
 func ResolveStateConflicts(conflicted []Event, authEvents []Event) []Event {
 	var r stateResolver
 	r.resolvedThirdPartyInvites = map[string]*Event{}
 	r.resolvedMembers = map[string]*Event{}
+	r.contentCache = contentCache{}
 	// Group the conflicted events by type and state key.
 	r.addConflicted(conflicted)
-	// Add the unconflicted auth events needed for auth checks.
-	for i := range authEvents {
-		r.addAuthEvent(&authEvents[i])
+	// Add the unconflicted auth events needed for auth checks, in sorted
+	// order so that which is used doesn't depend on the order they were
+	// given in.
+	for _, authEvent := range r.sortBlock(authEvents) {
+		r.addAuthEvent(authEvent.event)
 	}
 	// Resolve the conflicted auth events.
 	r.resolveAndAddAuthBlocks([][]Event{r.creates})
@@ -46,6 +55,12 @@ func ResolveStateConflicts(conflicted []Event, authEvents []Event) []Event {
 			r.result = append(r.result, *event)
 		}
 	}
+	sort.Slice(r.result, func(i, j int) bool {
+		if r.result[i].Type() != r.result[j].Type() {
+			return r.result[i].Type() < r.result[j].Type()
+		}
+		return *r.result[i].StateKey() < *r.result[j].StateKey()
+	})
 	return r.result
 }
 
@@ -77,6 +92,15 @@ type stateResolver struct {
 	// The list of resolved events.
 	// This will contain one entry for each conflicted event type and state key.
 	result []Event
+	// The parsed content of the events used for auth checks. The auth events
+	// are checked against many times, so their content is only parsed once.
+	contentCache contentCache
+	// A buffer reused for sorting each block of conflicted events.
+	sortBuffer []conflictedEvent
+}
+
+func (r *stateResolver) parsedContent() contentCache {
+	return r.contentCache
 }
 
 func (r *stateResolver) Create() (*Event, error) {
@@ -222,7 +246,7 @@ func (r *stateResolver) resolveAndAddAuthBlocks(blocks [][]Event) {
 // resolveAuthBlock resolves a block of auth events with the same state key to a single event.
 func (r *stateResolver) resolveAuthBlock(events []Event) *Event {
 	// Sort the events by depth and sha1 of event ID
-	block := sortConflictedEventsByDepthAndSHA1(events)
+	block := r.sortBlock(events)
 
 	// Pick the "oldest" event, that is the one with the lowest depth, as the first candidate.
 	// If none of the newer events pass auth checks against this event then we pick the "oldest" event.
@@ -255,7 +279,7 @@ func (r *stateResolver) resolveAuthBlock(events []Event) *Event {
 // resolveNormalBlock resolves a block of normal state events with the same state key to a single event.
 func (r *stateResolver) resolveNormalBlock(events []Event) *Event {
 	// Sort the events by depth and sha1 of event ID
-	block := sortConflictedEventsByDepthAndSHA1(events)
+	block := r.sortBlock(events)
 	// Start at the "newest" event, that is the one with the highest depth, and go
 	// backward through the list until we find one that passes authentication checks.
 	// (SPEC: This prefers newer events so that we don't flip a valid state back to a previous version)
@@ -271,16 +295,29 @@ func (r *stateResolver) resolveNormalBlock(events []Event) *Event {
 	return block[0].event
 }
 
+// sortBlock sorts a block of conflicting events like
+// sortConflictedEventsByDepthAndSHA1, reusing the resolver's buffer. The
+// returned slice is only valid until the next block is sorted.
+func (r *stateResolver) sortBlock(events []Event) []conflictedEvent {
+	r.sortBuffer = sortConflictedEventsInto(r.sortBuffer[:0], events)
+	return r.sortBuffer
+}
+
 // sortConflictedEventsByDepthAndSHA1 sorts by ascending depth and descending sha1 of event ID.
 func sortConflictedEventsByDepthAndSHA1(events []Event) []conflictedEvent {
-	block := make([]conflictedEvent, len(events))
+	return sortConflictedEventsInto(make([]conflictedEvent, 0, len(events)), events)
+}
+
+// sortConflictedEventsInto appends the events to the block and sorts the
+// block by ascending depth and descending sha1 of event ID.
+func sortConflictedEventsInto(block []conflictedEvent, events []Event) []conflictedEvent {
 	for i := range events {
 		event := &events[i]
-		block[i] = conflictedEvent{
+		block = append(block, conflictedEvent{
 			depth:       event.Depth(),
 			eventIDSHA1: sha1.Sum([]byte(event.EventID())),
 			event:       event,
-		}
+		})
 	}
 	sort.Sort(conflictedEventSorter(block))
 	return block
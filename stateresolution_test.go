@@ -1,6 +1,11 @@
 package gomatrixserverlib
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -34,3 +39,154 @@ func TestConflictEventSorter(t *testing.T) {
 		}
 	}
 }
+
+// A stateResCorpusCase is a conflict from the state resolution corpus along
+// with the events that were picked by ResolveStateConflicts.
+type stateResCorpusCase struct {
+	Conflicted []json.RawMessage `json:"conflicted"`
+	AuthEvents []json.RawMessage `json:"auth_events"`
+	Resolved   []string          `json:"resolved"`
+}
+
+// The corpus holds conflicts between the state of branches of randomly
+// generated rooms, along with the events ResolveStateConflicts picked for
+// them, sorted by type and state key. They were recorded before the resolver
+// was changed to parse the content of each event once, and check that changes
+// to the resolver don't change its results.
+func TestResolveStateConflictsCorpus(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/stateresolution_v1_corpus.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []stateResCorpusCase
+	if err = json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range cases {
+		conflicted := testStateResCorpusEvents(t, c.Conflicted)
+		authEvents := testStateResCorpusEvents(t, c.AuthEvents)
+		var got []string
+		for _, event := range ResolveStateConflicts(conflicted, authEvents) {
+			got = append(got, event.EventID())
+		}
+		if !reflect.DeepEqual(got, c.Resolved) {
+			t.Errorf("Case %d: got %v, want %v", i, got, c.Resolved)
+		}
+	}
+}
+
+func TestResolveStateConflictsDoesntDependOnInputOrder(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/stateresolution_v1_corpus.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []stateResCorpusCase
+	if err = json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i, c := range cases {
+		conflicted := testStateResCorpusEvents(t, c.Conflicted)
+		authEvents := testStateResCorpusEvents(t, c.AuthEvents)
+		want := stateResEventIDs(ResolveStateConflicts(conflicted, authEvents))
+		for j := 0; j < 20; j++ {
+			rng.Shuffle(len(conflicted), func(i, j int) { conflicted[i], conflicted[j] = conflicted[j], conflicted[i] })
+			rng.Shuffle(len(authEvents), func(i, j int) { authEvents[i], authEvents[j] = authEvents[j], authEvents[i] })
+			if got := stateResEventIDs(ResolveStateConflicts(conflicted, authEvents)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Case %d: got %v after shuffling the input, want %v", i, got, want)
+			}
+		}
+	}
+}
+
+func TestResolveStateConflictsTiesDontDependOnInputOrder(t *testing.T) {
+	// Two topics with the same depth and timestamp, and two power levels
+	// auth events with the same depth, only one of which lets @u:a change
+	// the topic.
+	events := testStateResCorpusEvents(t, []json.RawMessage{
+		[]byte(`{"type":"m.room.create","state_key":"","event_id":"$create:a","room_id":"!r:a","sender":"@u:a","depth":1,"content":{"creator":"@u:a"}}`),
+		[]byte(`{"type":"m.room.member","state_key":"@u:a","event_id":"$member:a","room_id":"!r:a","sender":"@u:a","depth":2,"content":{"membership":"join"}}`),
+		[]byte(`{"type":"m.room.power_levels","state_key":"","event_id":"$pl1:a","room_id":"!r:a","sender":"@u:a","depth":3,"content":{"users":{"@u:a":50},"events":{"m.room.topic":100}}}`),
+		[]byte(`{"type":"m.room.power_levels","state_key":"","event_id":"$pl2:a","room_id":"!r:a","sender":"@u:a","depth":3,"content":{"users":{"@u:a":50},"events":{"m.room.topic":0}}}`),
+		[]byte(`{"type":"m.room.topic","state_key":"","event_id":"$topic1:a","room_id":"!r:a","sender":"@u:a","depth":4,"origin_server_ts":10,"content":{"topic":"one"}}`),
+		[]byte(`{"type":"m.room.topic","state_key":"","event_id":"$topic2:a","room_id":"!r:a","sender":"@u:a","depth":4,"origin_server_ts":10,"content":{"topic":"two"}}`),
+	})
+	authEvents := append([]Event(nil), events[:4]...)
+	conflicted := append([]Event(nil), events[4:]...)
+	want := stateResEventIDs(ResolveStateConflicts(conflicted, authEvents))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		rng.Shuffle(len(conflicted), func(i, j int) { conflicted[i], conflicted[j] = conflicted[j], conflicted[i] })
+		rng.Shuffle(len(authEvents), func(i, j int) { authEvents[i], authEvents[j] = authEvents[j], authEvents[i] })
+		if got := stateResEventIDs(ResolveStateConflicts(conflicted, authEvents)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Got %v after shuffling the input, want %v", got, want)
+		}
+	}
+}
+
+func testStateResCorpusEvents(t *testing.T, eventJSONs []json.RawMessage) []Event {
+	events := make([]Event, len(eventJSONs))
+	for i, eventJSON := range eventJSONs {
+		var err error
+		if events[i], err = NewEventFromTrustedJSON(eventJSON, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return events
+}
+
+// benchmarkStateResConflict returns a conflict between two state sets of a
+// room with 5000 users, where each user has joined in one state set and has
+// been kicked or banned in the other, along with the unconflicted auth events.
+func benchmarkStateResConflict(b *testing.B) (conflicted, authEvents []Event) {
+	users := map[string]int{"@u0:a": 100}
+	for i := 1; i < 5000; i += 50 {
+		users[fmt.Sprintf("@u%d:a", i)] = 50
+	}
+	powerLevels, err := json.Marshal(map[string]interface{}{"users": users})
+	if err != nil {
+		b.Fatal(err)
+	}
+	authJSON := []string{
+		`{"type":"m.room.create","state_key":"","event_id":"$create:a","room_id":"!r:a","sender":"@u0:a",` +
+			`"depth":1,"content":{"creator":"@u0:a"}}`,
+		`{"type":"m.room.member","state_key":"@u0:a","event_id":"$join0:a","room_id":"!r:a","sender":"@u0:a",` +
+			`"depth":2,"content":{"membership":"join"}}`,
+		`{"type":"m.room.power_levels","state_key":"","event_id":"$power_levels:a","room_id":"!r:a",` +
+			`"sender":"@u0:a","depth":3,"content":` + string(powerLevels) + `}`,
+		`{"type":"m.room.join_rules","state_key":"","event_id":"$join_rules:a","room_id":"!r:a",` +
+			`"sender":"@u0:a","depth":4,"content":{"join_rule":"public"}}`,
+	}
+	for _, eventJSON := range authJSON {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		authEvents = append(authEvents, event)
+	}
+	for i := 1; i <= 5000; i++ {
+		membership := []string{"leave", "ban"}[i%2]
+		for _, eventJSON := range []string{
+			fmt.Sprintf(`{"type":"m.room.member","state_key":"@u%d:a","event_id":"$join%d:a","room_id":"!r:a",`+
+				`"sender":"@u%d:a","depth":5,"content":{"membership":"join"}}`, i, i, i),
+			fmt.Sprintf(`{"type":"m.room.member","state_key":"@u%d:a","event_id":"$%s%d:a","room_id":"!r:a",`+
+				`"sender":"@u0:a","depth":6,"content":{"membership":"%s"}}`, i, membership, i, membership),
+		} {
+			event, err := NewEventFromTrustedJSON([]byte(eventJSON), false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conflicted = append(conflicted, event)
+		}
+	}
+	return
+}
+
+func BenchmarkResolveStateConflicts(b *testing.B) {
+	conflicted, authEvents := benchmarkStateResConflict(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ResolveStateConflicts(conflicted, authEvents)
+	}
+}
@@ -0,0 +1,1212 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ResolveStateConflictsV2 resolves the state of a room using version 2 of the
+// state resolution algorithm, which is used by room versions 2 and later.
+// Returns the resolved state of the room, including the unconflicted events.
+//
+// The conflicted events are the state events that differ between the state
+// sets being resolved, and the unconflicted events are the state events that
+// are the same in every state set. The auth difference is the set of events
+// in the auth chain of some but not all of the state sets, which can be
+// computed using AuthDifference. The auth events are used to look up the
+// auth events of the conflicted events and of the auth difference, so should
+// contain their auth chains. Auth events that can't be found are ignored,
+// as with the MissingAuthEventsIgnore policy. This differs from
+// ResolveStateConflictsV2WithOptions, which fails by default.
+//
+// Events that fail the auth checks during resolution are left out of the
+// resolved state, but are still used to order the other events.
+//
+// The result is sorted by event type and then state key, and doesn't depend
+// on the order of the given events, so every server resolving the same
+// events picks the same state. Every ordering step ends with a tie-break on
+// event ID, and the events are never ordered by iterating over a map.
+// https://matrix.org/docs/spec/rooms/v2#state-resolution
+func ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference []Event) []Event {
+	resolved, _, _ := resolveStateConflictsV2(
+		context.Background(), conflicted, unconflicted, authEvents, authDifference,
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsIgnore},
+	)
+	return resolved
+}
+
+// resolveStateConflictsV2 resolves the state of a room like
+// ResolveStateConflictsV2WithOptions, but is given the full events rather
+// than their metadata, so never needs to load any.
+func resolveStateConflictsV2(
+	ctx context.Context, conflicted, unconflicted, authEvents, authDifference []Event, opts StateResV2Options,
+) ([]Event, []RejectedEvent, error) {
+	r := newStateResolverV2(ctx, nil, opts)
+	metadata := func(events []Event) []EventMetadata {
+		result := make([]EventMetadata, len(events))
+		for i := range events {
+			result[i] = events[i].Metadata()
+			r.loaded[events[i].EventID()] = &events[i]
+		}
+		return result
+	}
+	// The resolver has all the events already so it doesn't need to load any,
+	// and can only fail because of missing auth events.
+	resolved, err := r.resolve(
+		metadata(conflicted), metadata(unconflicted), metadata(authEvents), metadata(authDifference),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := make([]Event, len(resolved))
+	for i := range resolved {
+		result[i] = *r.loaded[resolved[i].EventID]
+	}
+	return result, r.rejectedEvents, nil
+}
+
+// EventMetadata is the information about an event that version 2 of the state
+// resolution algorithm needs to order the event, which doesn't include the
+// content of the event.
+type EventMetadata struct {
+	EventID        string
+	RoomID         string
+	Type           string
+	StateKey       *string
+	Sender         string
+	OriginServerTS Timestamp
+	AuthEventIDs   []string
+}
+
+// Metadata returns the metadata of the event used for state resolution.
+func (e Event) Metadata() EventMetadata {
+	return EventMetadata{
+		EventID:        e.EventID(),
+		RoomID:         e.RoomID(),
+		Type:           e.Type(),
+		StateKey:       e.StateKey(),
+		Sender:         e.Sender(),
+		OriginServerTS: e.OriginServerTS(),
+		AuthEventIDs:   e.AuthEventIDs(),
+	}
+}
+
+// An EventLoader loads the full events with the given IDs, typically from a
+// database. Unlike an AuthChainProvider it must return every event that it
+// is asked for, in any order.
+type EventLoader func(ctx context.Context, eventIDs []string) ([]Event, error)
+
+// ResolveStateConflictsV2WithOptions resolves the state of a room like
+// ResolveStateConflictsV2, doing the work as the options say. It is given
+// the metadata of the events rather than the full events, and returns the
+// metadata of the resolved state, along with the events that failed the
+// auth checks during resolution, so that they can be marked as rejected.
+// The rejected events are in the order that they were checked, which only
+// depends on the events given and not on the order they were given in.
+//
+// Unlike ResolveStateConflictsV2, it fails if the checked events have auth
+// events that weren't given, unless the MissingAuthEvents option says
+// otherwise. Setting it to MissingAuthEventsIgnore gives the same result as
+// ResolveStateConflictsV2.
+//
+// The loader is only used to load the events whose content is inspected by
+// the algorithm: the m.room.create, m.room.power_levels, m.room.join_rules,
+// m.room.third_party_invite and m.room.member events that are checked
+// against the auth rules or are used as auth events during the checks.
+// Other events, such as topics, are never loaded, and neither are the
+// unconflicted events and auth events that no checked event needs. Events
+// are loaded in batches and each event is loaded at most once. The loader
+// and the auth event fetcher are only called from the calling goroutine,
+// but the workers may read the events that they returned at the same time
+// as the auth checks.
+//
+// Returns an error if the loader fails, or doesn't return an event that
+// it is asked for, or if the resolution fails because of missing auth
+// events.
+func ResolveStateConflictsV2WithOptions(
+	ctx context.Context, conflicted, unconflicted, authEvents, authDifference []EventMetadata,
+	loader EventLoader, opts StateResV2Options,
+) ([]EventMetadata, []RejectedEvent, error) {
+	r := newStateResolverV2(ctx, loader, opts)
+	resolved, err := r.resolve(conflicted, unconflicted, authEvents, authDifference)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resolved, r.rejectedEvents, nil
+}
+
+// A stateResolverV2 tracks the internal state of version 2 of the state
+// resolution algorithm. The algorithm works on the metadata of the events,
+// and the full events are only loaded when their content is needed.
+type stateResolverV2 struct {
+	ctx context.Context
+	// The metadata of all the events that were given to the resolver by event
+	// ID.
+	eventsByID map[string]*EventMetadata
+	// The full events that have been loaded so far by event ID.
+	loaded map[string]*Event
+	// Loads the full events that haven't been loaded yet. This is nil if the
+	// resolver was given all of the full events.
+	loader EventLoader
+	// The state that has been resolved so far.
+	partialState map[StateKeyTuple]*EventMetadata
+	// The IDs of events that failed the auth checks during resolution.
+	rejected map[string]bool
+	// The events that failed the auth checks in the order they were checked,
+	// along with the reasons.
+	rejectedEvents []RejectedEvent
+	// The power level of the sender of each event, given by the auth events
+	// of the event.
+	senderPowerLevel map[string]int64
+	// The parsed content of the events used for auth checks.
+	contentCache contentCache
+	// If not nil then records how the state was resolved.
+	trace *ResolutionTrace
+	// Control how the auth checks are done.
+	opts StateResV2Options
+	// The ID of the first missing auth event of each event in the full
+	// conflicted set that has one, for MissingAuthEventsReject and
+	// MissingAuthEventsFetch.
+	missingAuthEvents map[string]string
+	// The m.room.member events replaced in the partially resolved state since
+	// the last time memberships were evicted, for StreamMemberships.
+	replacedMemberships []*EventMetadata
+}
+
+func newStateResolverV2(ctx context.Context, loader EventLoader, opts StateResV2Options) *stateResolverV2 {
+	return &stateResolverV2{
+		ctx:               ctx,
+		eventsByID:        map[string]*EventMetadata{},
+		loaded:            map[string]*Event{},
+		loader:            loader,
+		partialState:      map[StateKeyTuple]*EventMetadata{},
+		rejected:          map[string]bool{},
+		senderPowerLevel:  map[string]int64{},
+		contentCache:      contentCache{},
+		trace:             opts.Trace,
+		opts:              opts,
+		missingAuthEvents: map[string]string{},
+	}
+}
+
+// resolve runs the algorithm and returns the resolved state sorted by event
+// type and then state key.
+func (r *stateResolverV2) resolve(conflicted, unconflicted, authEvents, authDifference []EventMetadata) ([]EventMetadata, error) {
+	for _, events := range [][]EventMetadata{authEvents, authDifference, unconflicted, conflicted} {
+		for i := range events {
+			r.eventsByID[events[i].EventID] = &events[i]
+		}
+	}
+
+	// The full conflicted set is the union of the conflicted events and the
+	// auth difference.
+	fullConflictedSet := map[string]bool{}
+	for _, events := range [][]EventMetadata{conflicted, authDifference} {
+		for i := range events {
+			if events[i].StateKey != nil {
+				fullConflictedSet[events[i].EventID] = true
+			}
+		}
+	}
+
+	if err := r.handleMissingAuthEvents(fullConflictedSet); err != nil {
+		return nil, err
+	}
+
+	// Start from the unconflicted state.
+	r.applyState(unconflicted)
+
+	// Order the power events in the full conflicted set, along with the events
+	// in their auth chains that are in the full conflicted set, so that every
+	// event comes after its auth events, and apply them to the state if they
+	// pass the auth checks.
+	// Whether a m.room.member event is a power event depends on its content,
+	// so the ones that could be are loaded first.
+	var maybePowerEventIDs []string
+	for eventID := range fullConflictedSet {
+		if event := r.eventsByID[eventID]; event.Type == MRoomMember && *event.StateKey != event.Sender {
+			maybePowerEventIDs = append(maybePowerEventIDs, eventID)
+		}
+	}
+	if err := r.load(maybePowerEventIDs); err != nil {
+		return nil, err
+	}
+	var powerEventIDs []string
+	for eventID := range fullConflictedSet {
+		if r.isPowerEvent(r.eventsByID[eventID]) {
+			powerEventIDs = append(powerEventIDs, eventID)
+		}
+	}
+	// The m.room.member events that aren't power events, such as invites,
+	// are loaded again when they are checked.
+	var maybePowerEvents []*EventMetadata
+	for _, eventID := range maybePowerEventIDs {
+		if event := r.eventsByID[eventID]; !r.isPowerEvent(event) {
+			maybePowerEvents = append(maybePowerEvents, event)
+		}
+	}
+	r.evictMemberships(maybePowerEvents)
+	graph := r.authGraph(powerEventIDs, fullConflictedSet)
+	powerEvents, err := r.reverseTopologicalPowerOrder(graph)
+	if err != nil {
+		return nil, err
+	}
+	if r.trace != nil {
+		r.trace.PowerEventOrder = eventIDsOf(powerEvents)
+	}
+	if err = r.authAndApplyEvents(powerEvents); err != nil {
+		return nil, err
+	}
+
+	// Order the other events in the full conflicted set by their position
+	// relative to the resolved power levels and apply them to the state if
+	// they pass the auth checks.
+	var otherEvents []*EventMetadata
+	for eventID := range fullConflictedSet {
+		if _, ok := graph[eventID]; !ok {
+			otherEvents = append(otherEvents, r.eventsByID[eventID])
+		}
+	}
+	if err = r.authAndApplyEvents(r.mainlineOrder(otherEvents)); err != nil {
+		return nil, err
+	}
+
+	// Apply the unconflicted state again, in case it was replaced by any of
+	// the conflicted events.
+	r.applyState(unconflicted)
+
+	result := make([]EventMetadata, 0, len(r.partialState))
+	for _, event := range r.partialState {
+		result = append(result, *event)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return *result[i].StateKey < *result[j].StateKey
+	})
+	return result, nil
+}
+
+// handleMissingAuthEvents applies the missing auth event policy to the auth
+// events of the events in the full conflicted set that weren't given to the
+// resolver. The events are visited in order of event ID, so that the same
+// auth events are fetched whatever order the events were given in.
+func (r *stateResolverV2) handleMissingAuthEvents(fullConflictedSet map[string]bool) error {
+	policy := r.opts.MissingAuthEvents
+	if policy == MissingAuthEventsIgnore {
+		return nil
+	}
+	if policy == MissingAuthEventsFetch && r.opts.FetchAuthEvent == nil {
+		return fmt.Errorf("gomatrixserverlib: no FetchAuthEvent to fetch missing auth events with")
+	}
+	eventIDs := make([]string, 0, len(fullConflictedSet))
+	for eventID := range fullConflictedSet {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Strings(eventIDs)
+	fetcher := missingAuthEventFetcher{
+		r:        r,
+		notFound: map[string]bool{},
+		fetching: map[string]bool{},
+	}
+	for _, eventID := range eventIDs {
+		for _, authEventID := range r.eventsByID[eventID].AuthEventIDs {
+			if r.eventsByID[authEventID] != nil {
+				continue
+			}
+			switch policy {
+			case MissingAuthEventsFail:
+				return MissingAuthEventError{eventID, authEventID}
+			case MissingAuthEventsFetch:
+				found, err := fetcher.fetch(authEventID, 1)
+				if err != nil {
+					return err
+				}
+				if found {
+					continue
+				}
+			}
+			if _, ok := r.missingAuthEvents[eventID]; !ok {
+				r.missingAuthEvents[eventID] = authEventID
+			}
+		}
+	}
+	return nil
+}
+
+// A missingAuthEventFetcher fetches missing auth events for a resolver.
+type missingAuthEventFetcher struct {
+	r *stateResolverV2
+	// The number of auth events fetched so far.
+	fetches int
+	// The IDs of the auth events that couldn't be found.
+	notFound map[string]bool
+	// The IDs of the auth events whose auth events are being fetched, which
+	// would be a cycle if they were auth events of the events being fetched.
+	fetching map[string]bool
+}
+
+// fetch fetches the auth event at the given depth from the checked events,
+// and then its missing auth events. Returns whether the event was found, or
+// an error if fetching it failed or went beyond the limits.
+func (f *missingAuthEventFetcher) fetch(eventID string, depth int) (bool, error) {
+	if f.r.eventsByID[eventID] != nil {
+		return true, nil
+	}
+	if f.notFound[eventID] {
+		return false, nil
+	}
+	if maxDepth := f.r.opts.maxAuthEventFetchDepth(); depth > maxDepth {
+		return false, fmt.Errorf(
+			"gomatrixserverlib: missing auth event %q is more than %d auth events away from the checked events",
+			eventID, maxDepth,
+		)
+	}
+	if maxFetches := f.r.opts.maxAuthEventFetches(); f.fetches >= maxFetches {
+		return false, fmt.Errorf("gomatrixserverlib: more than %d missing auth events to fetch", maxFetches)
+	}
+	f.fetches++
+	event, err := f.r.opts.FetchAuthEvent(f.r.ctx, eventID)
+	if err != nil {
+		return false, err
+	}
+	if event == nil {
+		f.notFound[eventID] = true
+		return false, nil
+	}
+	if event.EventID() != eventID {
+		return false, fmt.Errorf(
+			"gomatrixserverlib: fetched event %q when fetching auth event %q", event.EventID(), eventID,
+		)
+	}
+	metadata := event.Metadata()
+	f.r.eventsByID[eventID] = &metadata
+	f.r.loaded[eventID] = event
+
+	f.fetching[eventID] = true
+	defer delete(f.fetching, eventID)
+	for _, authEventID := range metadata.AuthEventIDs {
+		if f.fetching[authEventID] {
+			return false, fmt.Errorf("gomatrixserverlib: fetched auth events of %q form a cycle", authEventID)
+		}
+		if _, err = f.fetch(authEventID, depth+1); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// cachedAuthEvents are auth events that use the content cache of a resolver.
+type cachedAuthEvents struct {
+	*AuthEvents
+	cache contentCache
+}
+
+func (a cachedAuthEvents) parsedContent() contentCache {
+	return a.cache
+}
+
+// authContentNeeded returns whether the auth checks of events of the type, or
+// of the events that they are auth events of, inspect their content.
+func authContentNeeded(eventType string) bool {
+	switch eventType {
+	case MRoomCreate, MRoomPowerLevels, MRoomJoinRules, MRoomThirdPartyInvite, MRoomMember:
+		return true
+	}
+	return false
+}
+
+// load loads the events with the given IDs whose content is needed, if they
+// haven't been loaded already. Events that weren't given to the resolver are
+// ignored.
+func (r *stateResolverV2) load(eventIDs []string) error {
+	var needed []string
+	requested := map[string]bool{}
+	for _, eventID := range eventIDs {
+		event := r.eventsByID[eventID]
+		if event == nil || r.loaded[eventID] != nil || requested[eventID] || !authContentNeeded(event.Type) {
+			continue
+		}
+		requested[eventID] = true
+		needed = append(needed, eventID)
+	}
+	if len(needed) == 0 || r.loader == nil {
+		return nil
+	}
+	events, err := r.loader(r.ctx, needed)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		if r.eventsByID[events[i].EventID()] != nil {
+			r.loaded[events[i].EventID()] = &events[i]
+		}
+	}
+	for _, eventID := range needed {
+		if r.loaded[eventID] == nil {
+			return fmt.Errorf("gomatrixserverlib: event loader didn't return event %q", eventID)
+		}
+	}
+	return nil
+}
+
+// fullEvent returns the full event for the metadata. Events whose content
+// isn't needed may not have been loaded, in which case an event with empty
+// content is built from the metadata.
+func (r *stateResolverV2) fullEvent(event *EventMetadata) (*Event, error) {
+	if loaded := r.loaded[event.EventID]; loaded != nil {
+		return loaded, nil
+	}
+	fields := map[string]interface{}{
+		"event_id":         event.EventID,
+		"room_id":          event.RoomID,
+		"type":             event.Type,
+		"sender":           event.Sender,
+		"origin_server_ts": event.OriginServerTS,
+		"content":          struct{}{},
+		"prev_events":      []string{},
+		"auth_events":      event.AuthEventIDs,
+	}
+	if event.StateKey != nil {
+		fields["state_key"] = *event.StateKey
+	}
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	result, err := NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// applyState adds the events to the partially resolved state, replacing any
+// events with the same type and state key. Replaced memberships are
+// forgotten if the StreamMemberships option is set.
+func (r *stateResolverV2) applyState(events []EventMetadata) {
+	var replaced []*EventMetadata
+	for i := range events {
+		event := r.eventsByID[events[i].EventID]
+		tuple := StateKeyTuple{event.Type, *event.StateKey}
+		if previous := r.partialState[tuple]; previous != nil && previous != event {
+			replaced = append(replaced, previous)
+		}
+		r.partialState[tuple] = event
+	}
+	r.evictMemberships(replaced)
+}
+
+// isPowerEvent returns whether the event is a power event: an event that
+// changes who can do what in the room. These are the m.room.create,
+// m.room.power_levels and m.room.join_rules events and the m.room.member
+// events that kick or ban a user. The m.room.member events that aren't sent
+// by their target must have been loaded.
+func (r *stateResolverV2) isPowerEvent(event *EventMetadata) bool {
+	switch event.Type {
+	case MRoomCreate, MRoomPowerLevels, MRoomJoinRules:
+		return *event.StateKey == ""
+	case MRoomMember:
+		if *event.StateKey == event.Sender {
+			return false
+		}
+		loaded := r.loaded[event.EventID]
+		if loaded == nil {
+			return false
+		}
+		content, err := NewMemberContentFromEvent(*loaded)
+		if err != nil {
+			return false
+		}
+		return content.Membership == Leave || content.Membership == Ban
+	}
+	return false
+}
+
+// authGraph returns the graph of the events and the events in their auth
+// chains that are in the full conflicted set. The graph maps the ID of each
+// event to the IDs of its auth events that are in the graph. The auth chains
+// are only followed through events in the full conflicted set.
+func (r *stateResolverV2) authGraph(eventIDs []string, fullConflictedSet map[string]bool) map[string][]string {
+	graph := map[string][]string{}
+	queue := append([]string(nil), eventIDs...)
+	for len(queue) > 0 {
+		eventID := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, ok := graph[eventID]; ok {
+			continue
+		}
+		graph[eventID] = nil
+		for _, authEventID := range r.eventsByID[eventID].AuthEventIDs {
+			if !fullConflictedSet[authEventID] {
+				continue
+			}
+			graph[eventID] = append(graph[eventID], authEventID)
+			if _, ok := graph[authEventID]; !ok {
+				queue = append(queue, authEventID)
+			}
+		}
+	}
+	return graph
+}
+
+// reverseTopologicalPowerOrder orders the events in the graph so that every
+// event comes after its auth events. Events that could come next are
+// ordered by descending power level of their sender, then by ascending
+// origin_server_ts, then by ascending event ID.
+func (r *stateResolverV2) reverseTopologicalPowerOrder(graph map[string][]string) ([]*EventMetadata, error) {
+	// The power levels of the senders come from the m.room.create and
+	// m.room.power_levels auth events of the events.
+	var levelEventIDs []string
+	for eventID := range graph {
+		for _, authEventID := range r.eventsByID[eventID].AuthEventIDs {
+			if authEvent := r.eventsByID[authEventID]; authEvent != nil && isLevelEvent(authEvent) {
+				levelEventIDs = append(levelEventIDs, authEventID)
+			}
+		}
+	}
+	if err := r.load(levelEventIDs); err != nil {
+		return nil, err
+	}
+
+	// Count the auth events of each event that haven't been output yet, and
+	// record which events each event is an auth event of.
+	remaining := make(map[string]int, len(graph))
+	authEventOf := make(map[string][]string, len(graph))
+	ready := &powerOrderHeap{resolver: r}
+	for eventID, authEventIDs := range graph {
+		remaining[eventID] = len(authEventIDs)
+		for _, authEventID := range authEventIDs {
+			authEventOf[authEventID] = append(authEventOf[authEventID], eventID)
+		}
+		if len(authEventIDs) == 0 {
+			ready.events = append(ready.events, r.eventsByID[eventID])
+		}
+	}
+	heap.Init(ready)
+
+	result := make([]*EventMetadata, 0, len(graph))
+	for ready.Len() > 0 {
+		event := heap.Pop(ready).(*EventMetadata)
+		result = append(result, event)
+		for _, eventID := range authEventOf[event.EventID] {
+			remaining[eventID]--
+			if remaining[eventID] == 0 {
+				heap.Push(ready, r.eventsByID[eventID])
+			}
+		}
+	}
+	return result, nil
+}
+
+// isLevelEvent returns whether the event is used to work out the power
+// levels of users: the m.room.create and m.room.power_levels events.
+func isLevelEvent(event *EventMetadata) bool {
+	return (event.Type == MRoomCreate || event.Type == MRoomPowerLevels) && event.StateKey != nil && *event.StateKey == ""
+}
+
+// powerLevelOf returns the power level of the sender of the event given by
+// the auth events of the event. If the auth events don't include a
+// m.room.power_levels event then the creator of the room has level 100 and
+// other users have level 0. The auth events must have been loaded.
+func (r *stateResolverV2) powerLevelOf(event *EventMetadata) int64 {
+	if level, ok := r.senderPowerLevel[event.EventID]; ok {
+		return level
+	}
+	authEvents := NewAuthEventsWithCapacity(2)
+	for _, authEventID := range event.AuthEventIDs {
+		if authEvent := r.loaded[authEventID]; authEvent != nil && isLevelEvent(r.eventsByID[authEventID]) {
+			_ = authEvents.AddEvent(authEvent)
+		}
+	}
+	provider := cachedAuthEvents{&authEvents, r.contentCache}
+	var level int64
+	create, err := NewCreateContentFromAuthEvents(provider)
+	if err == nil {
+		var powerLevels PowerLevelContent
+		if powerLevels, err = NewPowerLevelContentFromAuthEvents(provider, create.Creator); err == nil {
+			level = powerLevels.UserLevel(event.Sender)
+		}
+	}
+	r.senderPowerLevel[event.EventID] = level
+	return level
+}
+
+// A powerOrderHeap is a heap of events ordered by descending power level of
+// their sender, then by ascending origin_server_ts, then by ascending event ID.
+type powerOrderHeap struct {
+	resolver *stateResolverV2
+	events   []*EventMetadata
+}
+
+func (h *powerOrderHeap) Len() int {
+	return len(h.events)
+}
+
+func (h *powerOrderHeap) Less(i, j int) bool {
+	a, b := h.events[i], h.events[j]
+	levelA, levelB := h.resolver.powerLevelOf(a), h.resolver.powerLevelOf(b)
+	if levelA != levelB {
+		return levelA > levelB
+	}
+	if a.OriginServerTS != b.OriginServerTS {
+		return a.OriginServerTS < b.OriginServerTS
+	}
+	return a.EventID < b.EventID
+}
+
+func (h *powerOrderHeap) Swap(i, j int) {
+	h.events[i], h.events[j] = h.events[j], h.events[i]
+}
+
+func (h *powerOrderHeap) Push(x interface{}) {
+	h.events = append(h.events, x.(*EventMetadata))
+}
+
+func (h *powerOrderHeap) Pop() interface{} {
+	event := h.events[len(h.events)-1]
+	h.events = h.events[:len(h.events)-1]
+	return event
+}
+
+// mainlineOrder orders the events by the position of their closest mainline
+// event, then by ascending origin_server_ts, then by ascending event ID.
+// The mainline is the resolved m.room.power_levels event followed by the
+// m.room.power_levels events in its auth chain. The closest mainline event of
+// an event is the first mainline event reached by following the
+// m.room.power_levels auth events from the event. Mainline events closer to
+// the start of the room come first, and events without a closest mainline
+// event come before all the others.
+func (r *stateResolverV2) mainlineOrder(events []*EventMetadata) []*EventMetadata {
+	// Number the mainline so that the oldest m.room.power_levels event has
+	// position 1.
+	// The walks along the m.room.power_levels auth events are limited to the
+	// number of events so that they end even if the auth events have a cycle.
+	var mainline []string
+	event := r.partialState[StateKeyTuple{MRoomPowerLevels, ""}]
+	for ; event != nil && len(mainline) < len(r.eventsByID); event = r.powerLevelsAuthEvent(event) {
+		mainline = append(mainline, event.EventID)
+	}
+	mainlinePosition := make(map[string]int, len(mainline))
+	for i, eventID := range mainline {
+		mainlinePosition[eventID] = len(mainline) - i
+	}
+
+	positions := make(map[string]int, len(events))
+	for _, event := range events {
+		position := 0
+		e := event
+		for steps := 0; e != nil && steps < len(r.eventsByID); steps++ {
+			if p, ok := mainlinePosition[e.EventID]; ok {
+				position = p
+				break
+			}
+			e = r.powerLevelsAuthEvent(e)
+		}
+		positions[event.EventID] = position
+	}
+
+	result := append([]*EventMetadata(nil), events...)
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if positions[a.EventID] != positions[b.EventID] {
+			return positions[a.EventID] < positions[b.EventID]
+		}
+		if a.OriginServerTS != b.OriginServerTS {
+			return a.OriginServerTS < b.OriginServerTS
+		}
+		return a.EventID < b.EventID
+	})
+
+	if r.trace != nil {
+		r.trace.Mainline = make([]string, len(mainline))
+		for i, eventID := range mainline {
+			r.trace.Mainline[len(mainline)-1-i] = eventID
+		}
+		r.trace.MainlinePositions = positions
+		r.trace.MainlineOrder = eventIDsOf(result)
+	}
+	return result
+}
+
+// powerLevelsAuthEvent returns the m.room.power_levels auth event of the
+// event, or nil if the event doesn't have one or it wasn't given to the
+// resolver.
+func (r *stateResolverV2) powerLevelsAuthEvent(event *EventMetadata) *EventMetadata {
+	for _, authEventID := range event.AuthEventIDs {
+		authEvent := r.eventsByID[authEventID]
+		if authEvent != nil && authEvent.Type == MRoomPowerLevels && authEvent.StateKey != nil && *authEvent.StateKey == "" {
+			return authEvent
+		}
+	}
+	return nil
+}
+
+// defaultAuthCheckLookahead is the number of events that are prepared ahead
+// of the auth checks if the options don't set a lookahead.
+const defaultAuthCheckLookahead = 100
+
+// defaultMaxAuthEventFetchDepth and defaultMaxAuthEventFetches are the limits
+// on fetching missing auth events if the options don't set them.
+const (
+	defaultMaxAuthEventFetchDepth = 10
+	defaultMaxAuthEventFetches    = 100
+)
+
+// A MissingAuthEventPolicy says what version 2 of the state resolution
+// algorithm does when an event in the full conflicted set, which is checked
+// against the auth rules, has auth events that weren't given to it. This
+// happens when resolving state over partial data, such as after joining a
+// room without all of its state.
+type MissingAuthEventPolicy int
+
+const (
+	// MissingAuthEventsFail fails the resolution with a
+	// MissingAuthEventError.
+	MissingAuthEventsFail MissingAuthEventPolicy = iota
+	// MissingAuthEventsReject rejects the events with missing auth events,
+	// so that they are left out of the resolved state. The reason they were
+	// rejected is a MissingAuthEventError.
+	MissingAuthEventsReject
+	// MissingAuthEventsFetch fetches the missing auth events using the
+	// FetchAuthEvent option, along with any missing auth events of the events
+	// that are fetched, within the limits set by the options. Events with
+	// auth events that can't be found are rejected like
+	// MissingAuthEventsReject. Missing auth events of the fetched events
+	// that can't be found are ignored, since the fetched events are only
+	// used to order the other events.
+	MissingAuthEventsFetch
+	// MissingAuthEventsIgnore checks the events as if the missing auth events
+	// weren't auth events of them. This is what ResolveStateConflictsV2
+	// does.
+	MissingAuthEventsIgnore
+)
+
+// An AuthEventFetcher fetches a missing auth event by ID, typically from
+// another server. Returns nil if the event can't be found.
+type AuthEventFetcher func(ctx context.Context, eventID string) (*Event, error)
+
+// StateResV2Options control how version 2 of the state resolution algorithm
+// does its work. The zero value prepares and checks the events one at a time
+// on the calling goroutine, and fails if any auth events are missing.
+type StateResV2Options struct {
+	// The number of goroutines that prepare the events for the auth checks,
+	// by building the events and parsing the content of their auth events,
+	// while the checks themselves are applied in order on the calling
+	// goroutine. If zero or one then the events are prepared on the calling
+	// goroutine before they are checked.
+	Workers int
+	// The number of events that are prepared ahead of the auth checks, which
+	// is also the number of events that are loaded at a time. If zero then
+	// 100 is used.
+	Lookahead int
+	// What to do about missing auth events of the events that are checked.
+	// The workers and the lookahead never change the result, but the policy
+	// does.
+	MissingAuthEvents MissingAuthEventPolicy
+	// Fetches the missing auth events for MissingAuthEventsFetch.
+	FetchAuthEvent AuthEventFetcher
+	// The maximum number of auth events between a checked event and an auth
+	// event that is fetched, counting the auth events of the checked event as
+	// one. Fetching an auth event further away fails the resolution. If zero
+	// then 10 is used.
+	MaxAuthEventFetchDepth int
+	// The maximum number of auth events that are fetched. Fetching more fails
+	// the resolution. If zero then 100 is used.
+	MaxAuthEventFetches int
+	// If true then the m.room.member events in the full conflicted set are
+	// streamed through the auth checks: their full events are loaded a batch
+	// at a time, and are forgotten along with their parsed content once they
+	// have been checked, unless they are in the partially resolved state.
+	// Membership events are also forgotten once they are replaced in the
+	// partially resolved state.
+	// Resolving a conflict between very many memberships then only needs the
+	// full events of the current batch and of the partially resolved state,
+	// rather than every full event, along with the metadata of the events.
+	//
+	// The result is the same as without the option. The order of the checks
+	// doesn't change, and the check of an event only reads its own full
+	// event, its auth events and the events in the partially resolved state
+	// that it needs, none of which can have been forgotten without being
+	// loaded again. The parsed content of an event only depends on the
+	// event, so parsing it again gives the same content. A forgotten event
+	// is loaded again if a later check needs it as an auth event, so the
+	// loader may be asked for an event more than once and must return the
+	// same event each time. Full events given to the resolver rather than
+	// loaded are kept, since they can't be loaded again.
+	StreamMemberships bool
+	// If not nil then how the state was resolved is recorded in the trace.
+	Trace *ResolutionTrace
+}
+
+// lookahead returns the number of events that are prepared ahead of the
+// auth checks.
+func (o StateResV2Options) lookahead() int {
+	if o.Lookahead <= 0 {
+		return defaultAuthCheckLookahead
+	}
+	return o.Lookahead
+}
+
+// maxAuthEventFetchDepth returns the maximum depth of a fetched auth event.
+func (o StateResV2Options) maxAuthEventFetchDepth() int {
+	if o.MaxAuthEventFetchDepth <= 0 {
+		return defaultMaxAuthEventFetchDepth
+	}
+	return o.MaxAuthEventFetchDepth
+}
+
+// maxAuthEventFetches returns the maximum number of auth events fetched.
+func (o StateResV2Options) maxAuthEventFetches() int {
+	if o.MaxAuthEventFetches <= 0 {
+		return defaultMaxAuthEventFetches
+	}
+	return o.MaxAuthEventFetches
+}
+
+// A preparedAuthCheck is the work for the auth check of an event that doesn't
+// depend on the partially resolved state, so can be done ahead of the check.
+type preparedAuthCheck struct {
+	// The full event.
+	event *Event
+	// The auth events of the event, or nil for the auth events that weren't
+	// loaded.
+	authEvents []*Event
+	// The state that the auth checks of the event need.
+	stateNeeded []StateKeyTuple
+	// The error building the full event, if any.
+	err error
+}
+
+// A parsedAuthContent is the content of an auth event parsed ahead of the
+// auth checks, which is only valid if ok is true.
+type parsedAuthContent struct {
+	event   *Event
+	content interface{}
+	ok      bool
+}
+
+// An authCheckBatch is a batch of events whose auth checks are prepared
+// together.
+type authCheckBatch struct {
+	events   []*EventMetadata
+	prepared []preparedAuthCheck
+	parsed   []parsedAuthContent
+	// Done when all of the events have been prepared.
+	done sync.WaitGroup
+}
+
+// authAndApplyEvents checks each event in turn against its auth events and
+// the partially resolved state, and adds the events that pass to the
+// partially resolved state. Events that fail are marked as rejected.
+//
+// The checks have to be applied in order, since each check depends on the
+// events that passed before it, but the rest of the work can be done ahead.
+// The events are split into batches of the lookahead size, and the workers
+// prepare the next batch while the current batch is being checked.
+func (r *stateResolverV2) authAndApplyEvents(events []*EventMetadata) error {
+	lookahead := r.opts.lookahead()
+	batchAt := func(start int) []*EventMetadata {
+		if start+lookahead < len(events) {
+			return events[start : start+lookahead]
+		}
+		return events[start:]
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	next, err := r.prepareBatch(batchAt(0))
+	if err != nil {
+		return err
+	}
+	// Don't return while the workers are still reading the loaded events.
+	defer func() {
+		if next != nil {
+			next.done.Wait()
+		}
+	}()
+	var checked []*EventMetadata
+	for start := 0; start < len(events); start += lookahead {
+		batch := next
+		next = nil
+		batch.done.Wait()
+		// The workers have finished with the loaded events, so the events
+		// checked in the last batch and the events they replaced in the
+		// partially resolved state can be forgotten.
+		r.evictMemberships(checked)
+		r.evictMemberships(r.replacedMemberships)
+		r.replacedMemberships = nil
+		if err = r.loadStateNeeded(batch); err != nil {
+			return err
+		}
+		for _, parsed := range batch.parsed {
+			_, ok := r.contentCache[parsed.event]
+			if parsed.ok && !ok && r.loaded[parsed.event.EventID()] == parsed.event {
+				r.contentCache.add(parsed.event, parsed.content)
+			}
+		}
+		if start+lookahead < len(events) {
+			if next, err = r.prepareBatch(batchAt(start + lookahead)); err != nil {
+				return err
+			}
+		}
+		for i, event := range batch.events {
+			if err = r.authAndApplyEvent(event, &batch.prepared[i]); err != nil {
+				return err
+			}
+		}
+		checked = batch.events
+	}
+	r.evictMemberships(checked)
+	r.evictMemberships(r.replacedMemberships)
+	r.replacedMemberships = nil
+	return nil
+}
+
+// evictMemberships forgets the full events of the m.room.member events, and
+// their parsed content, if the StreamMemberships option is set and the
+// events aren't in the partially resolved state. The events are loaded again
+// if they are needed later. Full events that were given to the resolver
+// rather than loaded are kept, and only their parsed content is forgotten.
+func (r *stateResolverV2) evictMemberships(events []*EventMetadata) {
+	if !r.opts.StreamMemberships {
+		return
+	}
+	for _, event := range events {
+		if event.Type != MRoomMember || event.StateKey == nil {
+			continue
+		}
+		if current := r.partialState[StateKeyTuple{event.Type, *event.StateKey}]; current != nil && current.EventID == event.EventID {
+			continue
+		}
+		loaded := r.loaded[event.EventID]
+		if loaded == nil {
+			continue
+		}
+		delete(r.contentCache, loaded)
+		if r.loader != nil {
+			delete(r.loaded, event.EventID)
+		}
+	}
+}
+
+// prepareBatch loads the events in the batch and their auth events, and then
+// prepares the auth checks of the events. If there are workers then the
+// auth checks are prepared in the background and the batch is done when they
+// have finished, otherwise the batch is done when prepareBatch returns.
+// The loaded events mustn't change until the batch is done.
+func (r *stateResolverV2) prepareBatch(events []*EventMetadata) (*authCheckBatch, error) {
+	eventIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		eventIDs = append(eventIDs, event.EventID)
+		eventIDs = append(eventIDs, event.AuthEventIDs...)
+	}
+	if err := r.load(eventIDs); err != nil {
+		return nil, err
+	}
+
+	batch := &authCheckBatch{
+		events:   events,
+		prepared: make([]preparedAuthCheck, len(events)),
+	}
+	// Parse the content of the auth events that haven't been parsed already,
+	// each one once.
+	toParse := map[*Event]bool{}
+	for _, event := range events {
+		for _, authEventID := range event.AuthEventIDs {
+			authEvent := r.loaded[authEventID]
+			if authEvent == nil || toParse[authEvent] {
+				continue
+			}
+			if _, ok := r.contentCache[authEvent]; !ok {
+				toParse[authEvent] = true
+				batch.parsed = append(batch.parsed, parsedAuthContent{event: authEvent})
+			}
+		}
+	}
+
+	workers := r.opts.Workers
+	if workers <= 1 {
+		r.prepareAuthChecks(batch, 0, 1)
+		return batch, nil
+	}
+	batch.done.Add(workers)
+	for worker := 0; worker < workers; worker++ {
+		go func(worker int) {
+			defer batch.done.Done()
+			r.prepareAuthChecks(batch, worker, workers)
+		}(worker)
+	}
+	return batch, nil
+}
+
+// prepareAuthChecks prepares every stride'th auth check in the batch and
+// parses the content of every stride'th auth event, starting from offset.
+// It only reads the loaded events, so can be run alongside the auth checks.
+func (r *stateResolverV2) prepareAuthChecks(batch *authCheckBatch, offset, stride int) {
+	for i := offset; i < len(batch.events); i += stride {
+		event := batch.events[i]
+		prepared := &batch.prepared[i]
+		if prepared.event, prepared.err = r.fullEvent(event); prepared.err != nil {
+			continue
+		}
+		prepared.authEvents = make([]*Event, len(event.AuthEventIDs))
+		for j, authEventID := range event.AuthEventIDs {
+			prepared.authEvents[j] = r.loaded[authEventID]
+		}
+		prepared.stateNeeded = StateNeededForAuth([]Event{*prepared.event}).Tuples()
+	}
+	for i := offset; i < len(batch.parsed); i += stride {
+		parsed := &batch.parsed[i]
+		parsed.content, parsed.ok = parseAuthContent(parsed.event)
+	}
+}
+
+// loadStateNeeded loads the events in the partially resolved state that the
+// auth checks of the batch need. Any events in the partially resolved state
+// that replace those before the batch is checked come from the batch, so
+// are loaded already.
+func (r *stateResolverV2) loadStateNeeded(batch *authCheckBatch) error {
+	var eventIDs []string
+	for i := range batch.prepared {
+		for _, tuple := range batch.prepared[i].stateNeeded {
+			if stateEvent := r.partialState[tuple]; stateEvent != nil {
+				eventIDs = append(eventIDs, stateEvent.EventID)
+			}
+		}
+	}
+	return r.load(eventIDs)
+}
+
+// authAndApplyEvent checks the event against its auth events and the
+// partially resolved state, and adds it to the partially resolved state if
+// it passes. The events needed for the check must have been loaded.
+func (r *stateResolverV2) authAndApplyEvent(event *EventMetadata, prepared *preparedAuthCheck) error {
+	if prepared.err != nil {
+		return prepared.err
+	}
+	if authEventID, ok := r.missingAuthEvents[event.EventID]; ok {
+		r.reject(event.EventID, MissingAuthEventError{event.EventID, authEventID})
+		return nil
+	}
+	// The auth events of the event are replaced by the events in the
+	// partially resolved state with the same type and state key. Only the
+	// events whose content is needed are used by the checks.
+	authEvents := NewAuthEventsWithCapacity(len(event.AuthEventIDs))
+	for i, authEventID := range event.AuthEventIDs {
+		authEvent := prepared.authEvents[i]
+		if authEvent != nil && !r.rejected[authEventID] {
+			_ = authEvents.AddEvent(authEvent)
+		}
+	}
+	for _, tuple := range prepared.stateNeeded {
+		if stateEvent := r.partialState[tuple]; stateEvent != nil && r.loaded[stateEvent.EventID] != nil {
+			_ = authEvents.AddEvent(r.loaded[stateEvent.EventID])
+		}
+	}
+	if err := Allowed(*prepared.event, cachedAuthEvents{&authEvents, r.contentCache}); err != nil {
+		r.reject(event.EventID, err)
+		return nil
+	}
+	tuple := StateKeyTuple{event.Type, *event.StateKey}
+	if replaced := r.partialState[tuple]; replaced != nil && r.opts.StreamMemberships && event.Type == MRoomMember {
+		r.replacedMemberships = append(r.replacedMemberships, replaced)
+	}
+	r.partialState[tuple] = event
+	return nil
+}
+
+// reject marks the event as rejected for the reason given.
+func (r *stateResolverV2) reject(eventID string, reason error) {
+	r.rejected[eventID] = true
+	rejected := RejectedEvent{eventID, reason.Error()}
+	r.rejectedEvents = append(r.rejectedEvents, rejected)
+	if r.trace != nil {
+		r.trace.Rejected = append(r.trace.Rejected, rejected)
+	}
+}
+
+// eventIDsOf returns the IDs of the events.
+func eventIDsOf(events []*EventMetadata) []string {
+	eventIDs := make([]string, len(events))
+	for i, event := range events {
+		eventIDs[i] = event.EventID
+	}
+	return eventIDs
+}
+
+// A ResolutionTrace records how version 2 of the state resolution algorithm
+// resolved the state of a room, to help work out why the state was resolved
+// the way it was. It can be encoded as JSON.
+type ResolutionTrace struct {
+	// The IDs of the power events in the full conflicted set, and the events
+	// in their auth chains, in the order that they were checked.
+	PowerEventOrder []string `json:"power_event_order"`
+	// The IDs of the events in the mainline, from the oldest
+	// m.room.power_levels event to the resolved m.room.power_levels event.
+	// The event at index i has mainline position i+1.
+	Mainline []string `json:"mainline"`
+	// The mainline position of each of the other events in the full
+	// conflicted set, by event ID. Events with position 0 don't have a
+	// mainline event in their auth chain.
+	MainlinePositions map[string]int `json:"mainline_positions"`
+	// The IDs of the other events in the full conflicted set, in the order
+	// that they were checked.
+	MainlineOrder []string `json:"mainline_order"`
+	// The events that failed the auth checks, in the order that they were
+	// checked.
+	Rejected []RejectedEvent `json:"rejected"`
+}
+
+// A RejectedEvent is an event that failed the auth checks during state
+// resolution.
+type RejectedEvent struct {
+	// The ID of the event.
+	EventID string `json:"event_id"`
+	// Why the event failed the auth checks.
+	Reason string `json:"reason"`
+}
+
+// String returns a description of the trace suitable for including in a bug
+// report.
+func (t *ResolutionTrace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Power events in the order checked:\n")
+	for i, eventID := range t.PowerEventOrder {
+		fmt.Fprintf(&b, "  %d. %s\n", i+1, eventID)
+	}
+	fmt.Fprintf(&b, "Mainline:\n")
+	for i, eventID := range t.Mainline {
+		fmt.Fprintf(&b, "  %d. %s\n", i+1, eventID)
+	}
+	fmt.Fprintf(&b, "Other events in the order checked:\n")
+	for i, eventID := range t.MainlineOrder {
+		fmt.Fprintf(&b, "  %d. %s (mainline position %d)\n", i+1, eventID, t.MainlinePositions[eventID])
+	}
+	fmt.Fprintf(&b, "Rejected events:\n")
+	for _, rejected := range t.Rejected {
+		fmt.Fprintf(&b, "  %s: %s\n", rejected.EventID, rejected.Reason)
+	}
+	return b.String()
+}
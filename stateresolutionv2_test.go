@@ -0,0 +1,1384 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	stateResAlice   = "@alice:example.com"
+	stateResBob     = "@bob:example.com"
+	stateResCharlie = "@charlie:example.com"
+	stateResElla    = "@ella:example.com"
+	stateResZara    = "@zara:example.com"
+)
+
+// A stateResTestEvent describes an event in a state resolution test. The
+// events and the tests using them follow the tests for the implementation of
+// the algorithm in Synapse.
+// https://github.com/matrix-org/synapse/blob/v1.0.0/tests/state/test_v2.py
+type stateResTestEvent struct {
+	node     string
+	sender   string
+	typ      string
+	stateKey *string
+	content  string
+}
+
+func stateResStateKey(stateKey string) *string {
+	return &stateKey
+}
+
+func stateResEventID(node string) string {
+	return "$" + node + ":example.com"
+}
+
+// stateResInitialEvents are the events at the start of each test room, in
+// the order that they were sent.
+var stateResInitialEvents = []stateResTestEvent{
+	{"CREATE", stateResAlice, MRoomCreate, stateResStateKey(""), `{"creator":"` + stateResAlice + `","room_version":"2"}`},
+	{"IMA", stateResAlice, MRoomMember, stateResStateKey(stateResAlice), `{"membership":"join"}`},
+	{"IPOWER", stateResAlice, MRoomPowerLevels, stateResStateKey(""), `{"users":{"` + stateResAlice + `":100}}`},
+	{"IJR", stateResAlice, MRoomJoinRules, stateResStateKey(""), `{"join_rule":"public"}`},
+	{"IMB", stateResBob, MRoomMember, stateResStateKey(stateResBob), `{"membership":"join"}`},
+	{"IMC", stateResCharlie, MRoomMember, stateResStateKey(stateResCharlie), `{"membership":"join"}`},
+	{"IMZ", stateResZara, MRoomMember, stateResStateKey(stateResZara), `{"membership":"join"}`},
+	{"START", stateResZara, "m.room.message", nil, `{}`},
+	{"END", stateResZara, "m.room.message", nil, `{}`},
+}
+
+// A stateResTestRoom is a room built from a DAG of test events, along with
+// the state after each event.
+type stateResTestRoom struct {
+	// The events by node name.
+	events map[string]Event
+	// The state after each event by node name.
+	stateAfter map[string]map[StateKeyTuple]string
+}
+
+// newStateResTestRoom builds a room from the initial events followed by the
+// test events. The edges are chains of node names, where each node has the
+// node after it in the chain as a prev event. The state before events with
+// more than one prev event is resolved using the resolve function.
+func newStateResTestRoom(
+	t *testing.T, testEvents []stateResTestEvent, edges [][]string,
+	resolve func(conflicted, unconflicted, authEvents, authDifference []Event) []Event,
+) *stateResTestRoom {
+	room := &stateResTestRoom{
+		events:     map[string]Event{},
+		stateAfter: map[string]map[StateKeyTuple]string{},
+	}
+	definitions := append(append([]stateResTestEvent(nil), stateResInitialEvents...), testEvents...)
+	prevs := map[string][]string{}
+	for i := 1; i < len(stateResInitialEvents)-1; i++ {
+		prevs[stateResInitialEvents[i].node] = []string{stateResInitialEvents[i-1].node}
+	}
+	for _, chain := range edges {
+		for i := 0; i+1 < len(chain); i++ {
+			prevs[chain[i]] = append(prevs[chain[i]], chain[i+1])
+		}
+	}
+
+	// Add the events in the order they were defined once their prev events
+	// have been added, giving them timestamps in the order that they are
+	// added.
+	for len(room.events) < len(definitions) {
+		added := false
+		for ts, definition := range definitions {
+			if _, ok := room.events[definition.node]; ok {
+				continue
+			}
+			ready := true
+			for _, prev := range prevs[definition.node] {
+				if _, ok := room.events[prev]; !ok {
+					ready = false
+				}
+			}
+			if ready {
+				room.addEvent(t, definition, prevs[definition.node], int64(ts), resolve)
+				added = true
+			}
+		}
+		if !added {
+			t.Fatalf("The test events have a cycle or missing prev events")
+		}
+	}
+	return room
+}
+
+// addEvent builds the event with auth events taken from the state before
+// the event and adds it to the room.
+func (room *stateResTestRoom) addEvent(
+	t *testing.T, definition stateResTestEvent, prevs []string, ts int64,
+	resolve func(conflicted, unconflicted, authEvents, authDifference []Event) []Event,
+) {
+	var stateBefore map[StateKeyTuple]string
+	switch len(prevs) {
+	case 0:
+		stateBefore = map[StateKeyTuple]string{}
+	case 1:
+		stateBefore = room.stateAfter[prevs[0]]
+	default:
+		stateSets := make([]map[StateKeyTuple]string, len(prevs))
+		for i, prev := range prevs {
+			stateSets[i] = room.stateAfter[prev]
+		}
+		stateBefore = room.resolve(t, stateSets, resolve)
+	}
+
+	var depth int64
+	for _, prev := range prevs {
+		if prevDepth := room.events[prev].Depth(); prevDepth >= depth {
+			depth = prevDepth + 1
+		}
+	}
+
+	fields := map[string]interface{}{
+		"event_id":         stateResEventID(definition.node),
+		"room_id":          "!room:example.com",
+		"sender":           definition.sender,
+		"type":             definition.typ,
+		"content":          json.RawMessage(definition.content),
+		"origin_server_ts": ts,
+		"depth":            depth,
+		"prev_events":      []interface{}{},
+		"auth_events":      []interface{}{},
+	}
+	if definition.stateKey != nil {
+		fields["state_key"] = *definition.stateKey
+	}
+	for _, prev := range prevs {
+		fields["prev_events"] = append(fields["prev_events"].([]interface{}), []interface{}{stateResEventID(prev), struct{}{}})
+	}
+	event := room.newEvent(t, fields)
+	for _, tuple := range StateNeededForAuth([]Event{event}).Tuples() {
+		if eventID, ok := stateBefore[tuple]; ok {
+			fields["auth_events"] = append(fields["auth_events"].([]interface{}), []interface{}{eventID, struct{}{}})
+		}
+	}
+	event = room.newEvent(t, fields)
+	room.events[definition.node] = event
+
+	stateAfter := make(map[StateKeyTuple]string, len(stateBefore)+1)
+	for tuple, eventID := range stateBefore {
+		stateAfter[tuple] = eventID
+	}
+	if event.StateKey() != nil {
+		stateAfter[StateKeyTuple{event.Type(), *event.StateKey()}] = event.EventID()
+	}
+	room.stateAfter[definition.node] = stateAfter
+}
+
+func (room *stateResTestRoom) newEvent(t *testing.T, fields map[string]interface{}) Event {
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// allEvents returns every event in the room, ordered by event ID.
+func (room *stateResTestRoom) allEvents() []Event {
+	events := make([]Event, 0, len(room.events))
+	for _, event := range room.events {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].EventID() < events[j].EventID() })
+	return events
+}
+
+func (room *stateResTestRoom) eventByID(eventID string) Event {
+	for _, event := range room.events {
+		if event.EventID() == eventID {
+			return event
+		}
+	}
+	panic("unknown event " + eventID)
+}
+
+// resolveInputs separates the state sets into conflicted and unconflicted
+// events and computes their auth difference.
+func (room *stateResTestRoom) resolveInputs(
+	t *testing.T, stateSets []map[StateKeyTuple]string,
+) (conflicted, unconflicted, authEvents, authDifference []Event) {
+	eventIDs := map[StateKeyTuple]map[string]int{}
+	for _, stateSet := range stateSets {
+		for tuple, eventID := range stateSet {
+			if eventIDs[tuple] == nil {
+				eventIDs[tuple] = map[string]int{}
+			}
+			eventIDs[tuple][eventID]++
+		}
+	}
+	for _, ids := range eventIDs {
+		for eventID, count := range ids {
+			if len(ids) == 1 && count == len(stateSets) {
+				unconflicted = append(unconflicted, room.eventByID(eventID))
+			} else {
+				conflicted = append(conflicted, room.eventByID(eventID))
+			}
+		}
+	}
+
+	stateSetEvents := make([][]Event, len(stateSets))
+	for i, stateSet := range stateSets {
+		for _, eventID := range stateSet {
+			stateSetEvents[i] = append(stateSetEvents[i], room.eventByID(eventID))
+		}
+	}
+	authEvents = room.allEvents()
+	provider := func(ctx context.Context, eventIDs []string) ([]Event, error) {
+		var result []Event
+		for _, eventID := range eventIDs {
+			result = append(result, room.eventByID(eventID))
+		}
+		return result, nil
+	}
+	authDifference, err := AuthDifference(context.Background(), stateSetEvents, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (room *stateResTestRoom) resolve(
+	t *testing.T, stateSets []map[StateKeyTuple]string,
+	resolve func(conflicted, unconflicted, authEvents, authDifference []Event) []Event,
+) map[StateKeyTuple]string {
+	conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, stateSets)
+	result := map[StateKeyTuple]string{}
+	for _, event := range resolve(conflicted, unconflicted, authEvents, authDifference) {
+		result[StateKeyTuple{event.Type(), *event.StateKey()}] = event.EventID()
+	}
+	return result
+}
+
+func testStateResolutionV2(t *testing.T, testEvents []stateResTestEvent, edges [][]string, expected []string) {
+	room := newStateResTestRoom(t, testEvents, edges, ResolveStateConflictsV2)
+	state := room.stateAfter["END"]
+	for _, node := range expected {
+		event := room.events[node]
+		tuple := StateKeyTuple{event.Type(), *event.StateKey()}
+		if state[tuple] != event.EventID() {
+			t.Errorf("Expected %v to be %q, got %q", tuple, event.EventID(), state[tuple])
+		}
+	}
+}
+
+func TestStateResolutionV2BanVsPowerLevels(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"PA", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"MA", stateResAlice, MRoomMember, stateResStateKey(stateResAlice), `{"membership":"join"}`},
+		{"MB", stateResAlice, MRoomMember, stateResStateKey(stateResBob), `{"membership":"ban"}`},
+		{"PB", stateResBob, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+	}, [][]string{
+		{"END", "MB", "MA", "PA", "START"},
+		{"END", "PB", "PA"},
+	}, []string{"PA", "MA", "MB"})
+}
+
+func TestStateResolutionV2JoinRuleEvasion(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"JR", stateResAlice, MRoomJoinRules, stateResStateKey(""), `{"join_rule":"private"}`},
+		{"ME", stateResElla, MRoomMember, stateResStateKey(stateResElla), `{"membership":"join"}`},
+	}, [][]string{
+		{"END", "JR", "START"},
+		{"END", "ME", "START"},
+	}, []string{"JR"})
+}
+
+func TestStateResolutionV2OffTopicPowerLevels(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"PA", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"PB", stateResBob, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50,"` + stateResCharlie + `":50}}`},
+		{"PC", stateResCharlie, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50,"` + stateResCharlie + `":0}}`},
+	}, [][]string{
+		{"END", "PC", "PB", "PA", "START"},
+		{"END", "PA"},
+	}, []string{"PC"})
+}
+
+func TestStateResolutionV2TopicBasic(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":0}}`},
+		{"PB", stateResBob, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "T3", "PB", "PA1"},
+	}, []string{"PA2", "T2"})
+}
+
+func TestStateResolutionV2TopicReset(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T2", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"MB", stateResAlice, MRoomMember, stateResStateKey(stateResBob), `{"membership":"ban"}`},
+	}, [][]string{
+		{"END", "MB", "T2", "PA", "T1", "START"},
+		{"END", "T1"},
+	}, []string{"T1", "MB", "PA"})
+}
+
+func TestStateResolutionV2Topic(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":0}}`},
+		{"PB", stateResBob, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"MZ1", stateResZara, "m.room.message", nil, `{}`},
+		{"T4", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "T4", "MZ1", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "MZ1", "T3", "PB", "PA1"},
+	}, []string{"T4", "PA2"})
+}
+
+func TestStateResolutionV2MainlineSort(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50},"events":{"` + MRoomPowerLevels + `":100}}`},
+		{"PB", stateResBob, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"T4", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "T3", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "T4", "PB", "PA1"},
+	}, []string{"T3", "PA2"})
+}
+
+func TestStateResolutionV2RejectedEventsLeftOut(t *testing.T) {
+	// Ella's join is rejected because of the new join rules, so she must not
+	// be in the resolved state even though her join is in a state set.
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"JR", stateResAlice, MRoomJoinRules, stateResStateKey(""), `{"join_rule":"private"}`},
+		{"ME", stateResElla, MRoomMember, stateResStateKey(stateResElla), `{"membership":"join"}`},
+	}, [][]string{
+		{"END", "JR", "START"},
+		{"END", "ME", "START"},
+	}, ResolveStateConflictsV2)
+	if eventID, ok := room.stateAfter["END"][StateKeyTuple{MRoomMember, stateResElla}]; ok {
+		t.Errorf("Expected the rejected membership of %s to be left out, got %q", stateResElla, eventID)
+	}
+}
+
+func TestStateResolutionV2WithRejections(t *testing.T) {
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"JR", stateResAlice, MRoomJoinRules, stateResStateKey(""), `{"join_rule":"private"}`},
+		{"ME", stateResElla, MRoomMember, stateResStateKey(stateResElla), `{"membership":"join"}`},
+	}, [][]string{
+		{"END", "JR", "START"},
+		{"END", "ME", "START"},
+	}, ResolveStateConflictsV2)
+	conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, []map[StateKeyTuple]string{
+		room.stateAfter["JR"], room.stateAfter["ME"],
+	})
+
+	resolved, rejected := resolveStateResV2WithRejections(conflicted, unconflicted, authEvents, authDifference)
+	want := ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference)
+	if !reflect.DeepEqual(stateResEventIDs(resolved), stateResEventIDs(want)) {
+		t.Errorf("Got resolved state %v, want %v", stateResEventIDs(resolved), stateResEventIDs(want))
+	}
+	wantRejected := []RejectedEvent{{
+		EventID: "$ME:example.com",
+		Reason:  `eventauth: "@ella:example.com" is not allowed to change their membership from "leave" to "join"`,
+	}}
+	if !reflect.DeepEqual(rejected, wantRejected) {
+		t.Errorf("Got rejected events %v, want %v", rejected, wantRejected)
+	}
+}
+
+func TestStateResolutionV2DoesntDependOnInputOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for i := 0; i < 100; i++ {
+		testEvents, edges := randomStateResTestEvents(rng)
+		room := newStateResTestRoom(t, testEvents, edges, ResolveStateConflictsV2)
+		var stateSets []map[StateKeyTuple]string
+		for _, chain := range edges {
+			stateSets = append(stateSets, room.stateAfter[chain[1]])
+		}
+		conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, stateSets)
+		resolved, wantRejected := resolveStateResV2WithRejections(conflicted, unconflicted, authEvents, authDifference)
+		wantResolved := stateResEventIDs(resolved)
+		for j := 0; j < 20; j++ {
+			for _, events := range [][]Event{conflicted, unconflicted, authEvents, authDifference} {
+				rng.Shuffle(len(events), func(i, j int) { events[i], events[j] = events[j], events[i] })
+			}
+			resolved, rejected := resolveStateResV2WithRejections(conflicted, unconflicted, authEvents, authDifference)
+			if got := stateResEventIDs(resolved); !reflect.DeepEqual(got, wantResolved) {
+				t.Fatalf("Case %d with edges %v: got %v after shuffling the input, want %v",
+					i, edges, got, wantResolved)
+			}
+			if !reflect.DeepEqual(rejected, wantRejected) {
+				t.Fatalf("Case %d with edges %v: got rejected events %v after shuffling the input, want %v",
+					i, edges, rejected, wantRejected)
+			}
+		}
+	}
+}
+
+// naiveResolveStateConflictsV2 is a simple, slow implementation of version 2
+// of the state resolution algorithm, following the steps in the
+// specification as directly as possible, which is used to check
+// ResolveStateConflictsV2 on small inputs.
+func naiveResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference []Event) []Event { // nolint: gocyclo
+	byID := map[string]Event{}
+	for _, events := range [][]Event{authEvents, authDifference, unconflicted, conflicted} {
+		for _, event := range events {
+			byID[event.EventID()] = event
+		}
+	}
+	inFullConflictedSet := map[string]bool{}
+	for _, events := range [][]Event{conflicted, authDifference} {
+		for _, event := range events {
+			inFullConflictedSet[event.EventID()] = true
+		}
+	}
+	state := map[StateKeyTuple]string{}
+	for _, event := range unconflicted {
+		state[StateKeyTuple{event.Type(), *event.StateKey()}] = event.EventID()
+	}
+	rejected := map[string]bool{}
+
+	authCheck := func(eventIDs []string) {
+		for _, eventID := range eventIDs {
+			event := byID[eventID]
+			authEvents := NewAuthEvents(nil)
+			for _, authEventID := range event.AuthEventIDs() {
+				if authEvent, ok := byID[authEventID]; ok && !rejected[authEventID] {
+					authEvent := authEvent
+					_ = authEvents.AddEvent(&authEvent)
+				}
+			}
+			for _, tuple := range StateNeededForAuth([]Event{event}).Tuples() {
+				if stateEventID, ok := state[tuple]; ok {
+					stateEvent := byID[stateEventID]
+					_ = authEvents.AddEvent(&stateEvent)
+				}
+			}
+			if Allowed(event, &authEvents) != nil {
+				rejected[eventID] = true
+			} else {
+				state[StateKeyTuple{event.Type(), *event.StateKey()}] = eventID
+			}
+		}
+	}
+
+	// Find the power events and the events in their auth chains that are in
+	// the full conflicted set.
+	var conflictedPowerEvents func(eventID string, seen map[string]bool)
+	conflictedPowerEvents = func(eventID string, seen map[string]bool) {
+		if seen[eventID] {
+			return
+		}
+		seen[eventID] = true
+		for _, authEventID := range byID[eventID].AuthEventIDs() {
+			if inFullConflictedSet[authEventID] {
+				conflictedPowerEvents(authEventID, seen)
+			}
+		}
+	}
+	powerEvents := map[string]bool{}
+	for eventID := range inFullConflictedSet {
+		event := byID[eventID]
+		isPower := false
+		switch event.Type() {
+		case MRoomCreate, MRoomPowerLevels, MRoomJoinRules:
+			isPower = *event.StateKey() == ""
+		case MRoomMember:
+			var content struct {
+				Membership string `json:"membership"`
+			}
+			_ = json.Unmarshal(event.Content(), &content)
+			isPower = *event.StateKey() != event.Sender() &&
+				(content.Membership == "leave" || content.Membership == "ban")
+		}
+		if isPower {
+			conflictedPowerEvents(eventID, powerEvents)
+		}
+	}
+
+	// Sort the power events by picking the smallest event whose auth events
+	// have all been picked, each time.
+	senderLevel := func(event Event) int64 {
+		var creator string
+		for _, authEventID := range event.AuthEventIDs() {
+			authEvent := byID[authEventID]
+			if authEvent.Type() == MRoomPowerLevels && *authEvent.StateKey() == "" {
+				var content PowerLevelContent
+				content, _ = NewPowerLevelContentFromEvent(authEvent)
+				return content.UserLevel(event.Sender())
+			}
+			if authEvent.Type() == MRoomCreate && *authEvent.StateKey() == "" {
+				var content struct {
+					Creator string `json:"creator"`
+				}
+				_ = json.Unmarshal(authEvent.Content(), &content)
+				creator = content.Creator
+			}
+		}
+		if creator != "" && creator == event.Sender() {
+			return 100
+		}
+		return 0
+	}
+	var sortedPowerEvents []string
+	picked := map[string]bool{}
+	for len(sortedPowerEvents) < len(powerEvents) {
+		best := ""
+		for eventID := range powerEvents {
+			if picked[eventID] {
+				continue
+			}
+			ready := true
+			for _, authEventID := range byID[eventID].AuthEventIDs() {
+				if powerEvents[authEventID] && !picked[authEventID] {
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+			if best == "" {
+				best = eventID
+				continue
+			}
+			a, b := byID[eventID], byID[best]
+			if senderLevel(a) != senderLevel(b) {
+				if senderLevel(a) > senderLevel(b) {
+					best = eventID
+				}
+			} else if a.OriginServerTS() != b.OriginServerTS() {
+				if a.OriginServerTS() < b.OriginServerTS() {
+					best = eventID
+				}
+			} else if eventID < best {
+				best = eventID
+			}
+		}
+		picked[best] = true
+		sortedPowerEvents = append(sortedPowerEvents, best)
+	}
+	authCheck(sortedPowerEvents)
+
+	// Sort the other events by mainline position.
+	powerLevelsAuthEvent := func(eventID string) string {
+		for _, authEventID := range byID[eventID].AuthEventIDs() {
+			if byID[authEventID].Type() == MRoomPowerLevels {
+				return authEventID
+			}
+		}
+		return ""
+	}
+	var mainline []string
+	for eventID := state[StateKeyTuple{MRoomPowerLevels, ""}]; eventID != ""; eventID = powerLevelsAuthEvent(eventID) {
+		mainline = append([]string{eventID}, mainline...)
+	}
+	var position func(eventID string) int
+	position = func(eventID string) int {
+		for i, mainlineEventID := range mainline {
+			if mainlineEventID == eventID {
+				return i + 1
+			}
+		}
+		if next := powerLevelsAuthEvent(eventID); next != "" {
+			return position(next)
+		}
+		return 0
+	}
+	var otherEvents []string
+	for eventID := range inFullConflictedSet {
+		if !powerEvents[eventID] {
+			otherEvents = append(otherEvents, eventID)
+		}
+	}
+	sort.Slice(otherEvents, func(i, j int) bool {
+		a, b := byID[otherEvents[i]], byID[otherEvents[j]]
+		if position(a.EventID()) != position(b.EventID()) {
+			return position(a.EventID()) < position(b.EventID())
+		}
+		if a.OriginServerTS() != b.OriginServerTS() {
+			return a.OriginServerTS() < b.OriginServerTS()
+		}
+		return a.EventID() < b.EventID()
+	})
+	authCheck(otherEvents)
+
+	for _, event := range unconflicted {
+		state[StateKeyTuple{event.Type(), *event.StateKey()}] = event.EventID()
+	}
+	var result []Event
+	for _, eventID := range state {
+		result = append(result, byID[eventID])
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type() != result[j].Type() {
+			return result[i].Type() < result[j].Type()
+		}
+		return *result[i].StateKey() < *result[j].StateKey()
+	})
+	return result
+}
+
+// randomStateResTestEvents returns random events for a room with several
+// branches starting from the START event, where the END event merges the
+// branches.
+func randomStateResTestEvents(rng *rand.Rand) ([]stateResTestEvent, [][]string) {
+	users := []string{stateResAlice, stateResBob, stateResCharlie, stateResZara}
+	levels := []int{0, 25, 50, 75, 100}
+	var events []stateResTestEvent
+	var edges [][]string
+	branches := 2 + rng.Intn(2)
+	for b := 0; b < branches; b++ {
+		chain := []string{"START"}
+		for i := 0; i < 1+rng.Intn(4); i++ {
+			node := fmt.Sprintf("B%dE%d", b, i)
+			sender := users[rng.Intn(len(users))]
+			target := users[rng.Intn(len(users))]
+			var event stateResTestEvent
+			switch rng.Intn(5) {
+			case 0:
+				userLevels := map[string]int{}
+				for _, user := range users {
+					userLevels[user] = levels[rng.Intn(len(levels))]
+				}
+				content, _ := json.Marshal(map[string]interface{}{"users": userLevels})
+				event = stateResTestEvent{node, sender, MRoomPowerLevels, stateResStateKey(""), string(content)}
+			case 1:
+				membership := []string{"ban", "leave", "join", "invite"}[rng.Intn(4)]
+				event = stateResTestEvent{node, sender, MRoomMember, stateResStateKey(target), `{"membership":"` + membership + `"}`}
+			case 2:
+				joinRule := []string{"public", "invite", "private"}[rng.Intn(3)]
+				event = stateResTestEvent{node, sender, MRoomJoinRules, stateResStateKey(""), `{"join_rule":"` + joinRule + `"}`}
+			default:
+				event = stateResTestEvent{node, sender, "m.room.topic", stateResStateKey(""), `{"topic":"` + node + `"}`}
+			}
+			events = append(events, event)
+			chain = append([]string{node}, chain...)
+		}
+		edges = append(edges, append([]string{"END"}, chain...))
+	}
+	return events, edges
+}
+
+func TestStateResolutionV2MatchesNaiveImplementation(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		testEvents, edges := randomStateResTestEvents(rng)
+		room := newStateResTestRoom(t, testEvents, edges, ResolveStateConflictsV2)
+
+		var stateSets []map[StateKeyTuple]string
+		for _, chain := range edges {
+			stateSets = append(stateSets, room.stateAfter[chain[1]])
+		}
+		conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, stateSets)
+		want := naiveResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference)
+		got := ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference)
+		if !reflect.DeepEqual(stateResEventIDs(got), stateResEventIDs(want)) {
+			t.Fatalf("Case %d with edges %v: got %v, want %v",
+				i, edges, stateResEventIDs(got), stateResEventIDs(want))
+		}
+
+		// The result mustn't depend on the order of the inputs.
+		for _, events := range [][]Event{conflicted, unconflicted, authEvents, authDifference} {
+			rng.Shuffle(len(events), func(i, j int) { events[i], events[j] = events[j], events[i] })
+		}
+		shuffled := ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference)
+		if !reflect.DeepEqual(stateResEventIDs(shuffled), stateResEventIDs(got)) {
+			t.Fatalf("Case %d with edges %v: got %v after shuffling the input, want %v",
+				i, edges, stateResEventIDs(shuffled), stateResEventIDs(got))
+		}
+	}
+}
+
+func stateResEventIDs(events []Event) []string {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	return eventIDs
+}
+
+func TestStateResolutionV2Trace(t *testing.T) {
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50},"events":{"` + MRoomPowerLevels + `":100}}`},
+		{"PB", stateResBob, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"T4", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "T3", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "T4", "PB", "PA1"},
+	}, ResolveStateConflictsV2)
+	conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(
+		t, []map[StateKeyTuple]string{room.stateAfter["T3"], room.stateAfter["T4"]},
+	)
+
+	var trace ResolutionTrace
+	got, _, err := resolveStateResV2Events(
+		conflicted, unconflicted, authEvents, authDifference,
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsIgnore, Trace: &trace},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference)
+	if !reflect.DeepEqual(stateResEventIDs(got), stateResEventIDs(want)) {
+		t.Errorf("Tracing changed the resolved state: got %v, want %v", stateResEventIDs(got), stateResEventIDs(want))
+	}
+
+	// Alice's power levels are checked first since she has the higher power
+	// level, and then forbid Bob from changing the power levels. Bob's topic
+	// comes later in the mainline, so replaces Alice's.
+	wantTrace := ResolutionTrace{
+		PowerEventOrder: []string{"$PA2:example.com", "$PB:example.com"},
+		Mainline:        []string{"$IPOWER:example.com", "$PA1:example.com", "$PA2:example.com"},
+		MainlinePositions: map[string]int{
+			"$T3:example.com": 3,
+			"$T4:example.com": 2,
+		},
+		MainlineOrder: []string{"$T4:example.com", "$T3:example.com"},
+		Rejected: []RejectedEvent{{
+			EventID: "$PB:example.com",
+			Reason:  `eventauth: sender "@bob:example.com" is not allowed to send event. 50 < 100`,
+		}},
+	}
+	if !reflect.DeepEqual(trace, wantTrace) {
+		t.Errorf("Got trace:\n%s\nwant:\n%s", trace.String(), wantTrace.String())
+	}
+
+	traceJSON, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ResolutionTrace
+	if err = json.Unmarshal(traceJSON, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, wantTrace) {
+		t.Errorf("Got trace %s after encoding as JSON, want:\n%s", traceJSON, wantTrace.String())
+	}
+}
+
+func stateResMetadata(events []Event) []EventMetadata {
+	metadata := make([]EventMetadata, len(events))
+	for i := range events {
+		metadata[i] = events[i].Metadata()
+	}
+	return metadata
+}
+
+// resolveStateResV2Events resolves the state of a room from the full events
+// using ResolveStateConflictsV2WithOptions, loading the full events from the
+// given events, and returns the full events of the resolved state.
+func resolveStateResV2Events(
+	conflicted, unconflicted, authEvents, authDifference []Event, opts StateResV2Options,
+) ([]Event, []RejectedEvent, error) {
+	eventsByID := map[string]Event{}
+	for _, events := range [][]Event{conflicted, unconflicted, authEvents, authDifference} {
+		for _, event := range events {
+			eventsByID[event.EventID()] = event
+		}
+	}
+	loader := func(ctx context.Context, eventIDs []string) ([]Event, error) {
+		events := make([]Event, 0, len(eventIDs))
+		for _, eventID := range eventIDs {
+			if event, ok := eventsByID[eventID]; ok {
+				events = append(events, event)
+			}
+		}
+		return events, nil
+	}
+	resolved, rejected, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), stateResMetadata(conflicted), stateResMetadata(unconflicted),
+		stateResMetadata(authEvents), stateResMetadata(authDifference), loader, opts,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := make([]Event, len(resolved))
+	for i := range resolved {
+		result[i] = eventsByID[resolved[i].EventID]
+	}
+	return result, rejected, nil
+}
+
+// resolveStateResV2WithRejections resolves the state of a room like
+// ResolveStateConflictsV2, and also returns the rejected events.
+func resolveStateResV2WithRejections(conflicted, unconflicted, authEvents, authDifference []Event) ([]Event, []RejectedEvent) {
+	resolved, rejected, _ := resolveStateResV2Events(
+		conflicted, unconflicted, authEvents, authDifference,
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsIgnore},
+	)
+	return resolved, rejected
+}
+
+func TestStateResolutionV2MetadataMatchesEvents(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 100; i++ {
+		testEvents, edges := randomStateResTestEvents(rng)
+		room := newStateResTestRoom(t, testEvents, edges, ResolveStateConflictsV2)
+
+		var stateSets []map[StateKeyTuple]string
+		for _, chain := range edges {
+			stateSets = append(stateSets, room.stateAfter[chain[1]])
+		}
+		conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, stateSets)
+		want := ResolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference)
+
+		loaded := map[string]bool{}
+		loader := func(ctx context.Context, eventIDs []string) ([]Event, error) {
+			var result []Event
+			for _, eventID := range eventIDs {
+				if loaded[eventID] {
+					t.Fatalf("Case %d: event %q was loaded more than once", i, eventID)
+				}
+				loaded[eventID] = true
+				event := room.eventByID(eventID)
+				if !authContentNeeded(event.Type()) {
+					t.Fatalf("Case %d: loaded %s event %q whose content isn't needed", i, event.Type(), eventID)
+				}
+				result = append(result, event)
+			}
+			return result, nil
+		}
+		got, _, err := ResolveStateConflictsV2WithOptions(
+			context.Background(), stateResMetadata(conflicted), stateResMetadata(unconflicted),
+			stateResMetadata(authEvents), stateResMetadata(authDifference), loader,
+			StateResV2Options{MissingAuthEvents: MissingAuthEventsIgnore},
+		)
+		if err != nil {
+			t.Fatalf("Case %d: ResolveStateConflictsV2WithOptions: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, stateResMetadata(want)) {
+			t.Fatalf("Case %d with edges %v: got %v, want %v", i, edges, got, stateResEventIDs(want))
+		}
+	}
+}
+
+func TestStateResolutionV2MetadataLoaderErrors(t *testing.T) {
+	room := newStateResTestRoom(t, []stateResTestEvent{
+		{"MB", stateResAlice, MRoomMember, stateResStateKey(stateResBob), `{"membership":"ban"}`},
+		{"T1", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "MB", "START"},
+		{"END", "T1", "START"},
+	}, ResolveStateConflictsV2)
+	conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, []map[StateKeyTuple]string{
+		room.stateAfter["MB"], room.stateAfter["T1"],
+	})
+
+	for name, loader := range map[string]EventLoader{
+		"failing": func(ctx context.Context, eventIDs []string) ([]Event, error) {
+			return nil, fmt.Errorf("database unavailable")
+		},
+		"missing events": func(ctx context.Context, eventIDs []string) ([]Event, error) {
+			return nil, nil
+		},
+	} {
+		_, _, err := ResolveStateConflictsV2WithOptions(
+			context.Background(), stateResMetadata(conflicted), stateResMetadata(unconflicted),
+			stateResMetadata(authEvents), stateResMetadata(authDifference), loader,
+			StateResV2Options{MissingAuthEvents: MissingAuthEventsIgnore},
+		)
+		if err == nil {
+			t.Errorf("%s loader: wanted an error", name)
+		}
+	}
+}
+
+// stateResV2TestOptions are the options that the differential tests compare
+// with the default options, with lookaheads that split the events into
+// batches in different places.
+var stateResV2TestOptions = []StateResV2Options{
+	{Workers: 1, Lookahead: 1},
+	{Workers: 4, Lookahead: 1},
+	{Workers: 4, Lookahead: 2},
+	{Workers: 3, Lookahead: 5},
+	{Workers: 8},
+	{Lookahead: 1, StreamMemberships: true},
+	{Workers: 4, Lookahead: 3, StreamMemberships: true},
+}
+
+func TestStateResolutionV2WithOptionsMatchesSerial(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for i := 0; i < 100; i++ {
+		testEvents, edges := randomStateResTestEvents(rng)
+		room := newStateResTestRoom(t, testEvents, edges, ResolveStateConflictsV2)
+		var stateSets []map[StateKeyTuple]string
+		for _, chain := range edges {
+			stateSets = append(stateSets, room.stateAfter[chain[1]])
+		}
+		conflicted, unconflicted, authEvents, authDifference := room.resolveInputs(t, stateSets)
+		wantResolved, wantRejected := resolveStateResV2WithRejections(conflicted, unconflicted, authEvents, authDifference)
+		for _, opts := range stateResV2TestOptions {
+			resolved, rejected, err := resolveStateResV2Events(
+				conflicted, unconflicted, authEvents, authDifference, opts,
+			)
+			if err != nil {
+				t.Fatalf("Case %d with options %+v: ResolveStateConflictsV2WithOptions: unexpected error: %v", i, opts, err)
+			}
+			if !reflect.DeepEqual(stateResEventIDs(resolved), stateResEventIDs(wantResolved)) {
+				t.Fatalf("Case %d with options %+v: got %v, want %v",
+					i, opts, stateResEventIDs(resolved), stateResEventIDs(wantResolved))
+			}
+			if !reflect.DeepEqual(rejected, wantRejected) {
+				t.Fatalf("Case %d with options %+v: got rejected events %v, want %v", i, opts, rejected, wantRejected)
+			}
+
+			loader := func(ctx context.Context, eventIDs []string) ([]Event, error) {
+				var result []Event
+				for _, eventID := range eventIDs {
+					result = append(result, room.eventByID(eventID))
+				}
+				return result, nil
+			}
+			got, _, err := ResolveStateConflictsV2WithOptions(
+				context.Background(), stateResMetadata(conflicted), stateResMetadata(unconflicted),
+				stateResMetadata(authEvents), stateResMetadata(authDifference), loader, opts,
+			)
+			if err != nil {
+				t.Fatalf("Case %d with options %+v: ResolveStateConflictsV2WithOptions: unexpected error: %v",
+					i, opts, err)
+			}
+			if !reflect.DeepEqual(got, stateResMetadata(wantResolved)) {
+				t.Fatalf("Case %d with options %+v: got %v from the metadata, want %v",
+					i, opts, got, stateResEventIDs(wantResolved))
+			}
+		}
+	}
+}
+
+// largeStateResV2Conflict returns the inputs for resolving a large conflict
+// between two forks of a room with many members. On each fork every member
+// changes their display name and sets the topic, and on one of the forks the
+// room admin bans some of the members and changes the power levels.
+func largeStateResV2Conflict(tb testing.TB, members int) (conflicted, unconflicted, authEvents, authDifference []Event) {
+	ts := 0
+	newEvent := func(id, sender, eventType string, stateKey *string, content string, authEventIDs ...string) Event {
+		ts++
+		authRefs := make([]interface{}, len(authEventIDs))
+		for i, authEventID := range authEventIDs {
+			authRefs[i] = []interface{}{authEventID, struct{}{}}
+		}
+		fields := map[string]interface{}{
+			"event_id":         id,
+			"room_id":          "!room:example.com",
+			"sender":           sender,
+			"type":             eventType,
+			"content":          json.RawMessage(content),
+			"origin_server_ts": ts,
+			"depth":            ts,
+			"prev_events":      []interface{}{},
+			"auth_events":      authRefs,
+		}
+		if stateKey != nil {
+			fields["state_key"] = *stateKey
+		}
+		eventJSON, err := json.Marshal(fields)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		event, err := NewEventFromTrustedJSON(eventJSON, false)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		authEvents = append(authEvents, event)
+		return event
+	}
+
+	create := newEvent("$create:a", stateResAlice, MRoomCreate, stateResStateKey(""),
+		`{"creator":"`+stateResAlice+`","room_version":"2"}`)
+	aliceJoin := newEvent("$alice:a", stateResAlice, MRoomMember, stateResStateKey(stateResAlice),
+		`{"membership":"join"}`, "$create:a")
+	powerLevels := newEvent("$power:a", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+		`{"users":{"`+stateResAlice+`":100}}`, "$create:a", "$alice:a")
+	joinRules := newEvent("$joinrules:a", stateResAlice, MRoomJoinRules, stateResStateKey(""),
+		`{"join_rule":"public"}`, "$create:a", "$alice:a", "$power:a")
+	unconflicted = []Event{create, aliceJoin, powerLevels, joinRules}
+
+	authDifference = append(authDifference,
+		newEvent("$power-fork:a", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"`+stateResAlice+`":100},"events":{"m.room.topic":10}}`, "$create:a", "$alice:a", "$power:a"),
+	)
+	conflicted = append(conflicted, authDifference[0])
+	for i := 0; i < members; i++ {
+		user := fmt.Sprintf("@user%d:example.com", i)
+		join := newEvent(fmt.Sprintf("$join%d:a", i), user, MRoomMember, stateResStateKey(user),
+			`{"membership":"join"}`, "$create:a", "$power:a", "$joinrules:a")
+		unconflicted = append(unconflicted, join)
+		for fork := 0; fork < 2; fork++ {
+			powerEventID := "$power:a"
+			if fork == 1 {
+				powerEventID = "$power-fork:a"
+			}
+			var member Event
+			if fork == 1 && i%10 == 0 {
+				member = newEvent(fmt.Sprintf("$ban%d:a", i), stateResAlice, MRoomMember, stateResStateKey(user),
+					`{"membership":"ban"}`, "$create:a", powerEventID, "$alice:a", join.EventID())
+			} else {
+				member = newEvent(fmt.Sprintf("$name%d-%d:a", i, fork), user, MRoomMember, stateResStateKey(user),
+					fmt.Sprintf(`{"membership":"join","displayname":"User %d on fork %d"}`, i, fork),
+					"$create:a", powerEventID, "$joinrules:a", join.EventID())
+			}
+			topic := newEvent(fmt.Sprintf("$topic%d-%d:a", i, fork), user, "m.room.topic", stateResStateKey(""),
+				fmt.Sprintf(`{"topic":"Set by user %d on fork %d"}`, i, fork),
+				"$create:a", powerEventID, join.EventID())
+			conflicted = append(conflicted, member, topic)
+		}
+	}
+	return
+}
+
+func TestStateResolutionV2LargeConflictWithOptions(t *testing.T) {
+	conflicted, unconflicted, authEvents, authDifference := largeStateResV2Conflict(t, 300)
+	wantResolved, wantRejected := resolveStateResV2WithRejections(conflicted, unconflicted, authEvents, authDifference)
+	if len(wantRejected) == 0 {
+		t.Fatalf("Expected some of the events to be rejected")
+	}
+	for _, opts := range append(stateResV2TestOptions, StateResV2Options{Workers: 4, Lookahead: 7}) {
+		resolved, rejected, err := resolveStateResV2Events(
+			conflicted, unconflicted, authEvents, authDifference, opts,
+		)
+		if err != nil {
+			t.Fatalf("With options %+v: ResolveStateConflictsV2WithOptions: unexpected error: %v", opts, err)
+		}
+		if !reflect.DeepEqual(stateResEventIDs(resolved), stateResEventIDs(wantResolved)) {
+			t.Fatalf("With options %+v: got %v, want %v", opts, stateResEventIDs(resolved), stateResEventIDs(wantResolved))
+		}
+		if !reflect.DeepEqual(rejected, wantRejected) {
+			t.Fatalf("With options %+v: got rejected events %v, want %v", opts, rejected, wantRejected)
+		}
+	}
+}
+
+func BenchmarkResolveStateConflictsV2WithOptions(b *testing.B) {
+	conflicted, unconflicted, authEvents, authDifference := largeStateResV2Conflict(b, 2000)
+	eventsByID := make(map[string]Event, len(authEvents))
+	for _, event := range authEvents {
+		eventsByID[event.EventID()] = event
+	}
+	loader := func(ctx context.Context, eventIDs []string) ([]Event, error) {
+		result := make([]Event, len(eventIDs))
+		for i, eventID := range eventIDs {
+			result[i] = eventsByID[eventID]
+		}
+		return result, nil
+	}
+	conflictedMetadata, unconflictedMetadata := stateResMetadata(conflicted), stateResMetadata(unconflicted)
+	authEventsMetadata, authDifferenceMetadata := stateResMetadata(authEvents), stateResMetadata(authDifference)
+	for _, opts := range []StateResV2Options{{}, {Workers: 2}, {Workers: 4}, {Workers: 8}} {
+		b.Run(fmt.Sprintf("Workers%d", opts.Workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := ResolveStateConflictsV2WithOptions(
+					context.Background(), conflictedMetadata, unconflictedMetadata,
+					authEventsMetadata, authDifferenceMetadata, loader, opts,
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// missingAuthEventTestInputs returns the inputs for resolving a room where
+// the power levels event PA1, which is an auth event of the conflicted power
+// levels event PA2, wasn't given. Also returns the inputs with PA1 given.
+func missingAuthEventTestInputs(t *testing.T) (room *stateResTestRoom, full, partial [4][]Event) {
+	room = newStateResTestRoom(t, []stateResTestEvent{
+		{"PA1", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50}}`},
+		{"PA2", stateResAlice, MRoomPowerLevels, stateResStateKey(""),
+			`{"users":{"` + stateResAlice + `":100,"` + stateResBob + `":50},"events":{"m.room.topic":100}}`},
+		{"T", stateResAlice, "m.room.topic", stateResStateKey(""), `{"topic":"alice"}`},
+	}, [][]string{
+		{"END", "PA2", "PA1", "START"},
+		{"END", "T", "START"},
+	}, ResolveStateConflictsV2)
+	full[0], full[1], full[2], full[3] = room.resolveInputs(
+		t, []map[StateKeyTuple]string{room.stateAfter["PA2"], room.stateAfter["T"]},
+	)
+	for i, events := range full {
+		for _, event := range events {
+			if event.EventID() != stateResEventID("PA1") {
+				partial[i] = append(partial[i], event)
+			}
+		}
+	}
+	return
+}
+
+func TestStateResolutionV2MissingAuthEventsFail(t *testing.T) {
+	_, _, partial := missingAuthEventTestInputs(t)
+	_, _, err := resolveStateResV2Events(
+		partial[0], partial[1], partial[2], partial[3], StateResV2Options{},
+	)
+	want := MissingAuthEventError{stateResEventID("PA2"), stateResEventID("PA1")}
+	if err != want {
+		t.Fatalf("ResolveStateConflictsV2WithOptions: got error %v, want %v", err, want)
+	}
+}
+
+func TestStateResolutionV2MissingAuthEventsReject(t *testing.T) {
+	room, _, partial := missingAuthEventTestInputs(t)
+	resolved, rejected, err := resolveStateResV2Events(
+		partial[0], partial[1], partial[2], partial[3],
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsReject},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions: unexpected error: %v", err)
+	}
+	wantRejected := []RejectedEvent{{
+		EventID: stateResEventID("PA2"),
+		Reason:  MissingAuthEventError{stateResEventID("PA2"), stateResEventID("PA1")}.Error(),
+	}}
+	if !reflect.DeepEqual(rejected, wantRejected) {
+		t.Errorf("Got rejected events %v, want %v", rejected, wantRejected)
+	}
+	// Without PA2 the initial power levels are kept.
+	for _, event := range resolved {
+		if event.Type() == MRoomPowerLevels && event.EventID() != room.events["IPOWER"].EventID() {
+			t.Errorf("Got power levels %q, want the initial power levels", event.EventID())
+		}
+		if event.Type() == "m.room.topic" && event.EventID() != room.events["T"].EventID() {
+			t.Errorf("Got topic %q, want the topic from the other fork", event.EventID())
+		}
+	}
+}
+
+func TestStateResolutionV2MissingAuthEventsFetch(t *testing.T) {
+	room, full, partial := missingAuthEventTestInputs(t)
+	wantResolved, wantRejected := resolveStateResV2WithRejections(full[0], full[1], full[2], full[3])
+
+	var fetched []string
+	fetch := func(ctx context.Context, eventID string) (*Event, error) {
+		fetched = append(fetched, eventID)
+		event := room.eventByID(eventID)
+		return &event, nil
+	}
+	resolved, rejected, err := resolveStateResV2Events(
+		partial[0], partial[1], partial[2], partial[3],
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsFetch, FetchAuthEvent: fetch},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions: unexpected error: %v", err)
+	}
+	if want := []string{stateResEventID("PA1")}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("Fetched %v, want %v", fetched, want)
+	}
+	if !reflect.DeepEqual(stateResEventIDs(resolved), stateResEventIDs(wantResolved)) {
+		t.Errorf("Got %v, want %v", stateResEventIDs(resolved), stateResEventIDs(wantResolved))
+	}
+	if !reflect.DeepEqual(rejected, wantRejected) {
+		t.Errorf("Got rejected events %v, want %v", rejected, wantRejected)
+	}
+
+	// Events whose auth events can't be found are rejected.
+	notFound := func(ctx context.Context, eventID string) (*Event, error) {
+		return nil, nil
+	}
+	_, rejected, err = resolveStateResV2Events(
+		partial[0], partial[1], partial[2], partial[3],
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsFetch, FetchAuthEvent: notFound},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions: unexpected error: %v", err)
+	}
+	if len(rejected) != 1 || rejected[0].EventID != stateResEventID("PA2") {
+		t.Errorf("Got rejected events %v, want PA2 to be rejected", rejected)
+	}
+}
+
+func TestStateResolutionV2MissingAuthEventsFetchLimits(t *testing.T) {
+	room, _, partial := missingAuthEventTestInputs(t)
+
+	// A malicious server returns an endless chain of auth events, or auth
+	// events that form a cycle.
+	fakeEvent := func(eventID string, authEventID string) *Event {
+		event := room.newEvent(t, map[string]interface{}{
+			"event_id":         eventID,
+			"room_id":          "!room:example.com",
+			"sender":           stateResAlice,
+			"type":             MRoomPowerLevels,
+			"state_key":        "",
+			"content":          map[string]interface{}{},
+			"origin_server_ts": 0,
+			"depth":            0,
+			"prev_events":      []interface{}{},
+			"auth_events":      []interface{}{[]interface{}{authEventID, struct{}{}}},
+		})
+		return &event
+	}
+	endless := func(ctx context.Context, eventID string) (*Event, error) {
+		return fakeEvent(eventID, eventID+"x"), nil
+	}
+	cycle := func(ctx context.Context, eventID string) (*Event, error) {
+		if eventID == stateResEventID("PA1") {
+			return fakeEvent(eventID, "$fake:example.com"), nil
+		}
+		return fakeEvent(eventID, stateResEventID("PA1")), nil
+	}
+	for name, tc := range map[string]struct {
+		fetch AuthEventFetcher
+		opts  StateResV2Options
+		want  string
+	}{
+		"depth":   {endless, StateResV2Options{MaxAuthEventFetchDepth: 5}, "more than 5 auth events away"},
+		"fetches": {endless, StateResV2Options{MaxAuthEventFetchDepth: 1000, MaxAuthEventFetches: 20}, "more than 20"},
+		"cycle":   {cycle, StateResV2Options{}, "form a cycle"},
+	} {
+		var fetches int
+		opts := tc.opts
+		opts.MissingAuthEvents = MissingAuthEventsFetch
+		opts.FetchAuthEvent = func(ctx context.Context, eventID string) (*Event, error) {
+			fetches++
+			return tc.fetch(ctx, eventID)
+		}
+		_, _, err := resolveStateResV2Events(
+			partial[0], partial[1], partial[2], partial[3], opts,
+		)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want an error containing %q", name, err, tc.want)
+		}
+		if fetches > 20 {
+			t.Errorf("%s: fetched %d events", name, fetches)
+		}
+	}
+}
+
+func TestStateResolutionV2MissingAuthEventsIgnore(t *testing.T) {
+	// The policy gives the same result as ResolveStateConflictsV2, which
+	// ignores missing auth events.
+	_, _, partial := missingAuthEventTestInputs(t)
+	want := ResolveStateConflictsV2(partial[0], partial[1], partial[2], partial[3])
+	resolved, _, err := resolveStateResV2Events(
+		partial[0], partial[1], partial[2], partial[3],
+		StateResV2Options{MissingAuthEvents: MissingAuthEventsIgnore},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(stateResEventIDs(resolved), stateResEventIDs(want)) {
+		t.Errorf("Got %v, want %v", stateResEventIDs(resolved), stateResEventIDs(want))
+	}
+}
+
+func TestStateResolutionV2StreamMembershipsForgetsEvents(t *testing.T) {
+	conflicted, unconflicted, authEvents, authDifference := largeStateResV2Conflict(t, 300)
+	eventsByID := make(map[string]Event, len(authEvents))
+	for _, event := range authEvents {
+		eventsByID[event.EventID()] = event
+	}
+	loads := 0
+	loader := func(ctx context.Context, eventIDs []string) ([]Event, error) {
+		loads += len(eventIDs)
+		result := make([]Event, len(eventIDs))
+		for i, eventID := range eventIDs {
+			result[i] = eventsByID[eventID]
+		}
+		return result, nil
+	}
+	resolve := func(opts StateResV2Options) (*stateResolverV2, []EventMetadata) {
+		loads = 0
+		r := newStateResolverV2(context.Background(), loader, opts)
+		resolved, err := r.resolve(
+			stateResMetadata(conflicted), stateResMetadata(unconflicted),
+			stateResMetadata(authEvents), stateResMetadata(authDifference),
+		)
+		if err != nil {
+			t.Fatalf("Resolving with options %+v: unexpected error: %v", opts, err)
+		}
+		return r, resolved
+	}
+	held := func(r *stateResolverV2) (memberships int) {
+		for _, event := range r.loaded {
+			if event.Type() == MRoomMember {
+				memberships++
+			}
+		}
+		return
+	}
+
+	r, want := resolve(StateResV2Options{})
+	allMemberships, allLoads := held(r), loads
+	r, got := resolve(StateResV2Options{StreamMemberships: true})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got a different resolved state when streaming memberships")
+	}
+
+	// Only the memberships in the resolved state are still held, and the
+	// content of the forgotten memberships is forgotten too.
+	inState := map[string]bool{}
+	for _, event := range got {
+		inState[event.EventID] = true
+	}
+	for eventID, event := range r.loaded {
+		if event.Type() == MRoomMember && !inState[eventID] {
+			t.Errorf("Membership %q isn't in the resolved state but is still held", eventID)
+		}
+	}
+	for event := range r.contentCache {
+		if event.Type() == MRoomMember && r.loaded[event.EventID()] != event {
+			t.Errorf("The content of forgotten membership %q is still held", event.EventID())
+		}
+	}
+	if memberships := held(r); memberships >= allMemberships {
+		t.Errorf("Held %d memberships when streaming, want fewer than %d", memberships, allMemberships)
+	}
+	t.Logf("Held %d of %d memberships, with %d loads instead of %d", held(r), allMemberships, loads, allLoads)
+}
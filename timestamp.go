@@ -16,3 +16,26 @@ func AsTimestamp(t time.Time) Timestamp {
 func (t Timestamp) Time() time.Time {
 	return time.Unix(int64(t)/1000, (int64(t)%1000)*1000000).UTC()
 }
+
+// A Clock tells the current time. The helpers that build events take a Clock
+// to set the "origin_server_ts" of the events, so that tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc is an adapter to allow the use of ordinary functions as a Clock.
+type ClockFunc func() time.Time
+
+// Now implements Clock
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// WallClock is a Clock that tells the current time from the system clock.
+// The helpers that build events use it if they aren't given a Clock.
+var WallClock Clock = ClockFunc(time.Now)
+
+// FixedClock returns a Clock that always tells the given time.
+func FixedClock(t time.Time) Clock {
+	return ClockFunc(func() time.Time { return t })
+}
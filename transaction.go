@@ -1,5 +1,7 @@
 package gomatrixserverlib
 
+import "fmt"
+
 // A Transaction is used to push data from one matrix server to another matrix
 // server.
 type Transaction struct {
@@ -32,3 +34,67 @@ type Transaction struct {
 // The ID must be safe to insert into a URL path segment. The ID should have a
 // format matching '^[0-9A-Za-z\-_]*$'
 type TransactionID string
+
+// A PDUOriginError is returned by ValidatePDUOrigin when a server isn't
+// allowed to send an event in a transaction.
+type PDUOriginError struct {
+	// The ID of the event.
+	EventID string
+	// The server that sent the transaction.
+	Origin ServerName
+	// Why the server isn't allowed to send the event.
+	Reason string
+}
+
+func (e PDUOriginError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: server %q may not send event %q: %s", e.Origin, e.EventID, e.Reason,
+	)
+}
+
+// ValidatePDUOrigin checks that the server that sent a transaction is allowed
+// to send the event in it. A server may send the events of its own users. It
+// may also relay the membership events of users on other servers that it has
+// been involved in creating: the join, leave and knock events that users ask
+// a server in the room to send for them with /send_join, /send_leave and
+// /send_knock, and invites of its own users that it has signed. Any other
+// event must come from the server of its sender. This only checks which
+// server sent the event: its signatures still need to be verified. Returns a
+// PDUOriginError if the server isn't allowed to send the event.
+func ValidatePDUOrigin(pdu Event, txnOrigin ServerName) error {
+	senderDomain, err := domainFromID(pdu.Sender())
+	if err != nil {
+		return err
+	}
+	if ServerName(senderDomain) == txnOrigin {
+		return nil
+	}
+	if pdu.Type() != MRoomMember || pdu.StateKey() == nil {
+		return PDUOriginError{pdu.EventID(), txnOrigin, "event was sent by a user on another server"}
+	}
+	membership, err := pdu.Membership()
+	if err != nil {
+		return err
+	}
+	switch membership {
+	case Join, Leave, Knock:
+		if *pdu.StateKey() != pdu.Sender() {
+			return PDUOriginError{pdu.EventID(), txnOrigin, "membership was set by a user on another server"}
+		}
+		return nil
+	case Invite:
+		targetDomain, err := domainFromID(*pdu.StateKey())
+		if err != nil {
+			return err
+		}
+		if ServerName(targetDomain) != txnOrigin {
+			return PDUOriginError{pdu.EventID(), txnOrigin, "invite is for a user on another server"}
+		}
+		if len(pdu.KeyIDs(string(txnOrigin))) == 0 {
+			return PDUOriginError{pdu.EventID(), txnOrigin, "invite isn't signed by the invited user's server"}
+		}
+		return nil
+	default:
+		return PDUOriginError{pdu.EventID(), txnOrigin, "membership was set by a user on another server"}
+	}
+}
@@ -0,0 +1,56 @@
+package gomatrixserverlib
+
+import (
+	"testing"
+)
+
+func TestValidatePDUOrigin(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		event      string
+		signatures string
+		origin     ServerName
+		wantErr    bool
+	}{
+		{"own message", `"type": "m.room.message", "sender": "@u:a", "content": {}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "a", false},
+		{"relayed message", `"type": "m.room.message", "sender": "@u:a", "content": {}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", true},
+		{"relayed state", `"type": "m.room.topic", "state_key": "", "sender": "@u:a", "content": {"topic": "t"}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", true},
+		{"relayed join", `"type": "m.room.member", "state_key": "@u:a", "sender": "@u:a", "content": {"membership": "join"}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", false},
+		{"relayed leave", `"type": "m.room.member", "state_key": "@u:a", "sender": "@u:a", "content": {"membership": "leave"}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", false},
+		{"relayed kick", `"type": "m.room.member", "state_key": "@v:c", "sender": "@u:a", "content": {"membership": "leave"}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", true},
+		{"relayed ban", `"type": "m.room.member", "state_key": "@u:a", "sender": "@u:a", "content": {"membership": "ban"}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", true},
+		{"relayed invite", `"type": "m.room.member", "state_key": "@v:b", "sender": "@u:a", "content": {"membership": "invite"}`,
+			`{"a": {"ed25519:1": "c2ln"}, "b": {"ed25519:1": "c2ln"}}`, "b", false},
+		{"relayed invite not signed by the invited server", `"type": "m.room.member", "state_key": "@v:b", "sender": "@u:a", "content": {"membership": "invite"}`,
+			`{"a": {"ed25519:1": "c2ln"}}`, "b", true},
+		{"invite relayed by another server", `"type": "m.room.member", "state_key": "@v:b", "sender": "@u:a", "content": {"membership": "invite"}`,
+			`{"a": {"ed25519:1": "c2ln"}, "b": {"ed25519:1": "c2ln"}, "c": {"ed25519:1": "c2ln"}}`, "c", true},
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(`{
+			"event_id": "$event:a",
+			"room_id": "!r:a",
+			"signatures": `+test.signatures+`,
+			`+test.event+`
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ValidatePDUOrigin(event, test.origin)
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("%s: ValidatePDUOrigin: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if e, ok := err.(PDUOriginError); !ok || e.EventID != "$event:a" || e.Origin != test.origin {
+			t.Errorf("%s: ValidatePDUOrigin: wanted a PDUOriginError, got %v", test.name, err)
+		}
+	}
+}
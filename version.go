@@ -15,6 +15,8 @@
 
 package gomatrixserverlib
 
+import "strings"
+
 // A Version is a struct that matches the version response from a Matrix homeserver. See
 // https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-version
 type Version struct {
@@ -27,3 +29,79 @@ type Version struct {
 		Version string `json:"version"`
 	} `json:"server"`
 }
+
+// RespFederationVersion is the response to a request for the version of a
+// Matrix homeserver, which is the same as a Version. See
+// https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-version
+type RespFederationVersion = Version
+
+// AtLeast returns whether the server is the named implementation at the
+// given version or later, comparing the versions with CompareVersions.
+// The names are compared ignoring case, since implementations aren't
+// consistent about how they capitalise their names.
+func (v Version) AtLeast(name, version string) bool {
+	if !strings.EqualFold(v.Server.Name, name) {
+		return false
+	}
+	return CompareVersions(v.Server.Version, version) >= 0
+}
+
+// CompareVersions compares two version strings loosely, returning -1 if a is
+// older than b, 1 if a is newer than b and 0 otherwise. Only the leading
+// dot-separated numbers of each version are compared, after an optional "v",
+// so "v1.2" is the same as "1.2.0" and anything after the numbers, like
+// "-rc1" or " (abcdef)", is ignored. Missing numbers count as zero, so a
+// version that doesn't start with a number is the same as "0".
+func CompareVersions(a, b string) int {
+	partsA, partsB := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		partA, partB := "0", "0"
+		if i < len(partsA) {
+			partA = partsA[i]
+		}
+		if i < len(partsB) {
+			partB = partsB[i]
+		}
+		// The parts have no leading zeros, so a longer part is a bigger
+		// number and parts of the same length compare as strings. This
+		// avoids overflowing on versions with very long numbers.
+		if len(partA) != len(partB) {
+			if len(partA) < len(partB) {
+				return -1
+			}
+			return 1
+		}
+		if partA != partB {
+			if partA < partB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionNumbers returns the leading dot-separated numbers of a version, with
+// any leading zeros removed.
+func versionNumbers(version string) []string {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	var parts []string
+	for {
+		end := 0
+		for end < len(version) && version[end] >= '0' && version[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			return parts
+		}
+		part := strings.TrimLeft(version[:end], "0")
+		if part == "" {
+			part = "0"
+		}
+		parts = append(parts, part)
+		if end == len(version) || version[end] != '.' {
+			return parts
+		}
+		version = version[end+1:]
+	}
+}
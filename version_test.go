@@ -0,0 +1,64 @@
+/* Copyright 2019 New Vector Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRespFederationVersionDecode(t *testing.T) {
+	input := `{"server":{"name":"Synapse","version":"1.2.1 (b=master,abcdef)"}}`
+	var res RespFederationVersion
+	if err := json.Unmarshal([]byte(input), &res); err != nil {
+		t.Fatalf("json.Unmarshal: unexpected error: %v", err)
+	}
+	if res.Server.Name != "Synapse" || res.Server.Version != "1.2.1 (b=master,abcdef)" {
+		t.Fatalf("json.Unmarshal: got %+v", res)
+	}
+	if !res.AtLeast("synapse", "1.2") {
+		t.Errorf("AtLeast: wanted %q to be at least synapse 1.2", res.Server.Version)
+	}
+	if res.AtLeast("synapse", "1.10") {
+		t.Errorf("AtLeast: wanted %q not to be at least synapse 1.10", res.Server.Version)
+	}
+	if res.AtLeast("dendrite", "0.1") {
+		t.Errorf("AtLeast: wanted a different implementation not to match")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2", "1.2.0", 0},
+		{"1.2.0-rc1", "1.2.0", 0},
+		{"1.9", "1.10", -1},
+		{"1.10", "1.9", 1},
+		{"01.2", "1.2", 0},
+		{"2", "1.99.99", 1},
+		{"", "0.0.1", -1},
+		{"unknown", "0", 0},
+		{"123456789012345678901234567890", "123456789012345678901234567891", -1},
+	}
+	for _, test := range tests {
+		if got := CompareVersions(test.a, test.b); got != test.want {
+			t.Errorf("CompareVersions(%q, %q): got %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}